@@ -19,6 +19,7 @@ package common
 import (
 	"fmt"
 	"reflect"
+	"sort"
 
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
@@ -234,26 +235,51 @@ func ManageChildren(
 	parent *unstructured.Unstructured,
 	observedChildren, desiredChildren AnyUnstructRegistry,
 ) error {
+	return ManageChildrenWithIdentity(
+		dynClient, updateStrategy, parent, observedChildren, desiredChildren, nil,
+	)
+}
+
+// ManageChildrenWithIdentity ensures the relevant children objects of
+// the given parent are in sync similar to ManageChildren. Observed &
+// desired children of the same kind are paired via the given identity
+// function e.g. ChildIdentityByLabel. Hence, a child whose name is
+// changed by the controller is updated in place under its observed
+// name instead of being deleted & created. Children are paired by
+// their names relative to the parent if identity is nil. Children are
+// not managed if these can't be paired.
+func ManageChildrenWithIdentity(
+	dynClient *dynamicclientset.Clientset,
+	updateStrategy ChildUpdateStrategyGetter,
+	parent *unstructured.Unstructured,
+	observedChildren, desiredChildren AnyUnstructRegistry,
+	identity ChildIdentityFn,
+) error {
+	paired, err := pairChildrenByKind(parent, observedChildren, desiredChildren, identity)
+	if err != nil {
+		return err
+	}
+
 	// If some operations fail, keep trying others so, for example,
 	// we don't block recovery (create new Pod) on a failed delete.
 	var errs []error
 
 	// Delete observed, owned objects that are not desired.
-	for key, objects := range observedChildren {
+	for key := range observedChildren {
 		apiVersion, kind := ParseKeyToAPIVersionKind(key)
 		client, err := dynClient.GetClientByKind(apiVersion, kind)
 		if err != nil {
 			errs = append(errs, err)
 			continue
 		}
-		if err := deleteChildren(client, parent, objects, desiredChildren[key]); err != nil {
+		if err := deleteChildren(client, parent, paired[key].Delete); err != nil {
 			errs = append(errs, err)
 			continue
 		}
 	}
 
 	// Create or update desired objects.
-	for key, objects := range desiredChildren {
+	for key := range desiredChildren {
 		apiVersion, kind := ParseKeyToAPIVersionKind(key)
 		client, err := dynClient.GetClientByKind(apiVersion, kind)
 		if err != nil {
@@ -264,8 +290,7 @@ func ManageChildren(
 			client,
 			updateStrategy,
 			parent,
-			observedChildren[key],
-			objects,
+			paired[key],
 		); err != nil {
 			errs = append(errs, err)
 			continue
@@ -275,34 +300,87 @@ func ManageChildren(
 	return utilerrors.NewAggregate(errs)
 }
 
+// childIdentityByName returns a ChildIdentityFn that identifies the
+// children of the given parent by their names relative to the parent.
+// This is the same as the key of the child in its registry & is the
+// identity of the children when none is set.
+func childIdentityByName(parent *unstructured.Unstructured) ChildIdentityFn {
+	return func(obj *unstructured.Unstructured) string {
+		return relativeName(parent, obj)
+	}
+}
+
+// pairChildrenByKind pairs the given observed & desired children of
+// each kind via the given identity function. An error is returned if
+// the children of any kind could not be paired.
+func pairChildrenByKind(
+	parent *unstructured.Unstructured,
+	observedChildren, desiredChildren AnyUnstructRegistry,
+	identity ChildIdentityFn,
+) (map[string]*PairedChildren, error) {
+	if identity == nil {
+		identity = childIdentityByName(parent)
+	}
+	paired := make(map[string]*PairedChildren, len(desiredChildren))
+	for _, registry := range []AnyUnstructRegistry{observedChildren, desiredChildren} {
+		for key := range registry {
+			if _, done := paired[key]; done {
+				continue
+			}
+			pairs, err := PairChildren(
+				childrenByName(observedChildren[key]),
+				childrenByName(desiredChildren[key]),
+				identity,
+			)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Can't manage children of %s", key)
+			}
+			paired[key] = pairs
+		}
+	}
+	return paired, nil
+}
+
+// childrenByName returns the given children sorted by their names
+func childrenByName(children map[string]*unstructured.Unstructured) []*unstructured.Unstructured {
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	objs := make([]*unstructured.Unstructured, 0, len(children))
+	for _, name := range names {
+		objs = append(objs, children[name])
+	}
+	return objs
+}
+
 // TODO (@amitkumardas) deprecate this in favour of
 // ControllerManager's Delete method
 func deleteChildren(
 	client *dynamicclientset.ResourceClient,
 	parent *unstructured.Unstructured,
-	observed, desired map[string]*unstructured.Unstructured,
+	observed []*unstructured.Unstructured,
 ) error {
 	var errs []error
-	for name, obj := range observed {
+	for _, obj := range observed {
 		if obj.GetDeletionTimestamp() != nil {
 			// Skip objects that are already pending deletion.
 			continue
 		}
-		if desired == nil || desired[name] == nil {
-			// This observed object wasn't listed as desired.
-			glog.Infof("%v: deleting %v", describeObject(parent), describeObject(obj))
-			uid := obj.GetUID()
-			// Explicitly request deletion propagation, which is what users expect,
-			// since some objects default to orphaning for backwards compatibility.
-			propagation := metav1.DeletePropagationBackground
-			err := client.Namespace(obj.GetNamespace()).Delete(obj.GetName(), &metav1.DeleteOptions{
-				Preconditions:     &metav1.Preconditions{UID: &uid},
-				PropagationPolicy: &propagation,
-			})
-			if err != nil {
-				errs = append(errs, fmt.Errorf("can't delete %v: %v", describeObject(obj), err))
-				continue
-			}
+		// This observed object wasn't listed as desired.
+		glog.Infof("%v: deleting %v", describeObject(parent), describeObject(obj))
+		uid := obj.GetUID()
+		// Explicitly request deletion propagation, which is what users expect,
+		// since some objects default to orphaning for backwards compatibility.
+		propagation := metav1.DeletePropagationBackground
+		err := client.Namespace(obj.GetNamespace()).Delete(obj.GetName(), &metav1.DeleteOptions{
+			Preconditions:     &metav1.Preconditions{UID: &uid},
+			PropagationPolicy: &propagation,
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("can't delete %v: %v", describeObject(obj), err))
+			continue
 		}
 	}
 	return utilerrors.NewAggregate(errs)
@@ -314,116 +392,125 @@ func updateChildren(
 	client *dynamicclientset.ResourceClient,
 	updateStrategy ChildUpdateStrategyGetter,
 	parent *unstructured.Unstructured,
-	observed, desired map[string]*unstructured.Unstructured,
+	paired *PairedChildren,
 ) error {
 	var errs []error
-	for name, obj := range desired {
+	for _, pair := range paired.Update {
+		oldObj, obj := pair.Observed, pair.Desired
 		ns := obj.GetNamespace()
 		if ns == "" {
 			ns = parent.GetNamespace()
 		}
-		if oldObj := observed[name]; oldObj != nil {
-			// Update
-			a := Apply{}
-			newObj, err := a.Merge(oldObj, obj)
-			if err != nil {
-				errs = append(errs, err)
-				continue
-			}
+		// Update
+		a := Apply{}
+		newObj, err := a.Merge(oldObj, obj)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// A child paired by its identity is updated under its observed
+		// name since a name can't be changed.
+		if newObj.GetName() != oldObj.GetName() {
+			newObj.SetName(oldObj.GetName())
+		}
 
-			// Attempt an update, if the 3-way merge resulted in any changes.
-			if reflect.DeepEqual(newObj.UnstructuredContent(), oldObj.UnstructuredContent()) {
-				// Nothing changed.
-				continue
-			}
-			if glog.V(5) {
-				glog.Infof(
-					"reflect diff: a=observed, b=desired:\n%s",
-					diff.ObjectReflectDiff(
-						oldObj.UnstructuredContent(), newObj.UnstructuredContent(),
-					),
-				)
-			}
+		// Attempt an update, if the 3-way merge resulted in any changes.
+		if reflect.DeepEqual(newObj.UnstructuredContent(), oldObj.UnstructuredContent()) {
+			// Nothing changed.
+			continue
+		}
+		if glog.V(5) {
+			glog.Infof(
+				"reflect diff: a=observed, b=desired:\n%s",
+				diff.ObjectReflectDiff(
+					oldObj.UnstructuredContent(), newObj.UnstructuredContent(),
+				),
+			)
+		}
 
-			// Leave it alone if it's pending deletion.
-			if oldObj.GetDeletionTimestamp() != nil {
-				glog.Infof(
-					"%v: not updating %v (pending deletion)",
-					describeObject(parent),
-					describeObject(obj),
-				)
-				continue
-			}
+		// Leave it alone if it's pending deletion.
+		if oldObj.GetDeletionTimestamp() != nil {
+			glog.Infof(
+				"%v: not updating %v (pending deletion)",
+				describeObject(parent),
+				describeObject(oldObj),
+			)
+			continue
+		}
 
-			// Check the update strategy for this child kind.
-			switch method := updateStrategy.Get(client.Group, client.Kind); method {
-			case v1alpha1.ChildUpdateOnDelete, "":
-				// This means we don't try to update anything unless it gets deleted
-				// by someone else (we won't delete it ourselves).
-				glog.V(5).Infof(
-					"%v: not updating %v (OnDelete update strategy)",
-					describeObject(parent),
-					describeObject(obj),
-				)
-				continue
-			case v1alpha1.ChildUpdateRecreate, v1alpha1.ChildUpdateRollingRecreate:
-				// Delete the object (now) and recreate it (on the next sync).
-				glog.Infof(
-					"%v: deleting %v for update", describeObject(parent), describeObject(obj),
-				)
-				uid := oldObj.GetUID()
-				// Explicitly request deletion propagation, which is what users expect,
-				// since some objects default to orphaning for backwards compatibility.
-				propagation := metav1.DeletePropagationBackground
-				err := client.Namespace(ns).Delete(obj.GetName(), &metav1.DeleteOptions{
-					Preconditions:     &metav1.Preconditions{UID: &uid},
-					PropagationPolicy: &propagation,
-				})
-				if err != nil {
-					errs = append(errs, err)
-					continue
-				}
-			case v1alpha1.ChildUpdateInPlace, v1alpha1.ChildUpdateRollingInPlace:
-				// Update the object in-place.
-				glog.Infof("%v: updating %v", describeObject(parent), describeObject(obj))
-				if _, err := client.Namespace(ns).Update(newObj, metav1.UpdateOptions{}); err != nil {
-					errs = append(errs, err)
-					continue
-				}
-			default:
-				errs = append(errs,
-					fmt.Errorf(
-						"invalid update strategy for %v: unknown method %q",
-						client.Kind,
-						method,
-					),
-				)
+		// Check the update strategy for this child kind.
+		switch method := updateStrategy.Get(client.Group, client.Kind); method {
+		case v1alpha1.ChildUpdateOnDelete, "":
+			// This means we don't try to update anything unless it gets deleted
+			// by someone else (we won't delete it ourselves).
+			glog.V(5).Infof(
+				"%v: not updating %v (OnDelete update strategy)",
+				describeObject(parent),
+				describeObject(oldObj),
+			)
+			continue
+		case v1alpha1.ChildUpdateRecreate, v1alpha1.ChildUpdateRollingRecreate:
+			// Delete the object (now) and recreate it (on the next sync).
+			glog.Infof(
+				"%v: deleting %v for update", describeObject(parent), describeObject(oldObj),
+			)
+			uid := oldObj.GetUID()
+			// Explicitly request deletion propagation, which is what users expect,
+			// since some objects default to orphaning for backwards compatibility.
+			propagation := metav1.DeletePropagationBackground
+			err := client.Namespace(ns).Delete(oldObj.GetName(), &metav1.DeleteOptions{
+				Preconditions:     &metav1.Preconditions{UID: &uid},
+				PropagationPolicy: &propagation,
+			})
+			if err != nil {
+				errs = append(errs, err)
 				continue
 			}
-		} else {
-			// Create
-			glog.Infof("%v: creating %v", describeObject(parent), describeObject(obj))
-
-			// The controller should return a partial object containing only the
-			// fields it cares about. We save this partial object so we can do
-			// a 3-way merge upon update, in the style of "kubectl apply".
-			//
-			// Make sure this happens before we add anything else to the object.
-			if err := dynamicapply.SetLastApplied(obj, obj.UnstructuredContent()); err != nil {
+		case v1alpha1.ChildUpdateInPlace, v1alpha1.ChildUpdateRollingInPlace:
+			// Update the object in-place.
+			glog.Infof("%v: updating %v", describeObject(parent), describeObject(newObj))
+			if _, err := client.Namespace(ns).Update(newObj, metav1.UpdateOptions{}); err != nil {
 				errs = append(errs, err)
 				continue
 			}
+		default:
+			errs = append(errs,
+				fmt.Errorf(
+					"invalid update strategy for %v: unknown method %q",
+					client.Kind,
+					method,
+				),
+			)
+			continue
+		}
+	}
+	for _, obj := range paired.Create {
+		ns := obj.GetNamespace()
+		if ns == "" {
+			ns = parent.GetNamespace()
+		}
+		// Create
+		glog.Infof("%v: creating %v", describeObject(parent), describeObject(obj))
+
+		// The controller should return a partial object containing only the
+		// fields it cares about. We save this partial object so we can do
+		// a 3-way merge upon update, in the style of "kubectl apply".
+		//
+		// Make sure this happens before we add anything else to the object.
+		if err := dynamicapply.SetLastApplied(obj, obj.UnstructuredContent()); err != nil {
+			errs = append(errs, err)
+			continue
+		}
 
-			// We always claim everything we create.
-			controllerRef := MakeOwnerRef(parent)
-			ownerRefs := obj.GetOwnerReferences()
-			ownerRefs = append(ownerRefs, *controllerRef)
-			obj.SetOwnerReferences(ownerRefs)
+		// We always claim everything we create.
+		controllerRef := MakeOwnerRef(parent)
+		ownerRefs := obj.GetOwnerReferences()
+		ownerRefs = append(ownerRefs, *controllerRef)
+		obj.SetOwnerReferences(ownerRefs)
 
-			if _, err := client.Namespace(ns).Create(obj, metav1.CreateOptions{}); err != nil {
-				errs = append(errs, err)
-				continue
-			}
+		if _, err := client.Namespace(ns).Create(obj, metav1.CreateOptions{}); err != nil {
+			errs = append(errs, err)
+			continue
 		}
 	}
 	return utilerrors.NewAggregate(errs)
@@ -64,3 +64,105 @@ func TestRevertObjectMetaSystemFields(t *testing.T) {
 		t.Fatalf("revertObjectMetaSystemFields() = %#v, want %#v", got, want)
 	}
 }
+
+func TestPairChildrenByKind(t *testing.T) {
+	parent := &unstructured.Unstructured{}
+	parent.SetNamespace("default")
+	parent.SetName("parent")
+
+	observed := AnyUnstructRegistry{
+		"v1:ConfigMap": {
+			"cfg-old": newChild("cfg-old", "a"),
+			"cfg-b":   newChild("cfg-b", "b"),
+		},
+		"v1:Secret": {
+			"sec": newChild("sec", "a"),
+		},
+	}
+	desired := AnyUnstructRegistry{
+		"v1:ConfigMap": {
+			"cfg-new": newChild("cfg-new", "a"),
+		},
+		"v1:Service": {
+			"svc-1": newChild("svc-1", "a"),
+			"svc-2": newChild("svc-2", "a"),
+		},
+	}
+
+	_, err := pairChildrenByKind(parent, observed, desired, ChildIdentityByLabel("managed-by-id"))
+	if err == nil {
+		t.Fatalf("Expected error for duplicate identity: Got none")
+	}
+
+	delete(desired, "v1:Service")
+	paired, err := pairChildrenByKind(parent, observed, desired, ChildIdentityByLabel("managed-by-id"))
+	if err != nil {
+		t.Fatalf("Expected no error: Got %v", err)
+	}
+	cfg := paired["v1:ConfigMap"]
+	if len(cfg.Update) != 1 || cfg.Update[0].Observed.GetName() != "cfg-old" ||
+		cfg.Update[0].Desired.GetName() != "cfg-new" {
+		t.Fatalf("Expected cfg-old to be updated to cfg-new: Got %+v", cfg.Update)
+	}
+	if !reflect.DeepEqual(names(cfg.Delete), []string{"cfg-b"}) {
+		t.Fatalf("Expected cfg-b to be deleted: Got %v", names(cfg.Delete))
+	}
+	if !reflect.DeepEqual(names(paired["v1:Secret"].Delete), []string{"sec"}) {
+		t.Fatalf("Expected sec to be deleted: Got %v", names(paired["v1:Secret"].Delete))
+	}
+
+	// children are paired by name by default
+	desired["v1:ConfigMap"]["cfg-b"] = newChild("cfg-b", "")
+	paired, err = pairChildrenByKind(parent, observed, desired, nil)
+	if err != nil {
+		t.Fatalf("Expected no error: Got %v", err)
+	}
+	cfg = paired["v1:ConfigMap"]
+	if len(cfg.Update) != 1 || cfg.Update[0].Observed.GetName() != "cfg-b" {
+		t.Fatalf("Expected cfg-b to be updated: Got %+v", cfg.Update)
+	}
+	if !reflect.DeepEqual(names(cfg.Create), []string{"cfg-new"}) ||
+		!reflect.DeepEqual(names(cfg.Delete), []string{"cfg-old"}) {
+		t.Fatalf("Expected cfg-new created & cfg-old deleted: Got %v & %v", names(cfg.Create), names(cfg.Delete))
+	}
+}
+
+func TestPairChildrenByKindUnderClusterScopedParent(t *testing.T) {
+	parent := &unstructured.Unstructured{}
+	parent.SetName("parent")
+
+	newChildIn := func(ns string) *unstructured.Unstructured {
+		obj := newChild("cfg", "")
+		obj.SetNamespace(ns)
+		return obj
+	}
+	observed := AnyUnstructRegistry{
+		"v1:ConfigMap": {
+			"ns-a/cfg": newChildIn("ns-a"),
+			"ns-b/cfg": newChildIn("ns-b"),
+		},
+	}
+	desired := AnyUnstructRegistry{
+		"v1:ConfigMap": {
+			"ns-a/cfg": newChildIn("ns-a"),
+			"ns-b/cfg": newChildIn("ns-b"),
+		},
+	}
+
+	paired, err := pairChildrenByKind(parent, observed, desired, nil)
+	if err != nil {
+		t.Fatalf("Expected no error: Got %v", err)
+	}
+	cfg := paired["v1:ConfigMap"]
+	if len(cfg.Update) != 2 || len(cfg.Create) != 0 || len(cfg.Delete) != 0 {
+		t.Fatalf("Expected children of both namespaces to be updated: Got %+v", cfg)
+	}
+	for _, pair := range cfg.Update {
+		if pair.Observed.GetNamespace() != pair.Desired.GetNamespace() {
+			t.Fatalf(
+				"Expected children of same namespace to be paired: Got %s & %s",
+				pair.Observed.GetNamespace(), pair.Desired.GetNamespace(),
+			)
+		}
+	}
+}
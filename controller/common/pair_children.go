@@ -0,0 +1,119 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// ChildIdentityFn returns the identity of the given child. Observed &
+// desired children with the same identity are paired with each other.
+// An empty identity implies the child can't be identified.
+type ChildIdentityFn func(obj *unstructured.Unstructured) string
+
+// DefaultChildIdentity identifies the given child by its apiVersion,
+// kind, namespace & name
+func DefaultChildIdentity(obj *unstructured.Unstructured) string {
+	return DescObjectAsKey(obj)
+}
+
+// ChildIdentityByLabel returns a ChildIdentityFn that identifies the
+// children by the value of the given label. This suits the controllers
+// that rename their children or name them via generateName.
+func ChildIdentityByLabel(key string) ChildIdentityFn {
+	return func(obj *unstructured.Unstructured) string {
+		return obj.GetLabels()[key]
+	}
+}
+
+// ChildPair is an observed child & the desired state of the same
+type ChildPair struct {
+	Observed *unstructured.Unstructured
+	Desired  *unstructured.Unstructured
+}
+
+// PairedChildren groups the children as per the operation they need
+type PairedChildren struct {
+	// Create has the desired children that are not observed
+	Create []*unstructured.Unstructured
+
+	// Update has the desired children that are observed
+	Update []ChildPair
+
+	// Delete has the observed children that are no longer desired
+	Delete []*unstructured.Unstructured
+}
+
+// PairChildren pairs the given observed & desired children by their
+// identity. DefaultChildIdentity is used if identity function is nil.
+//
+// Observed children without an identity are not managed & are hence
+// left out. Observed children that share their identity with a former
+// observed child are deleted since only one child can be paired per
+// identity. It is an error for a desired child to be without an
+// identity or to share its identity with another desired child.
+func PairChildren(
+	observed, desired []*unstructured.Unstructured,
+	identity ChildIdentityFn,
+) (*PairedChildren, error) {
+	if identity == nil {
+		identity = DefaultChildIdentity
+	}
+	paired := &PairedChildren{}
+	observedByID := make(map[string]*unstructured.Unstructured, len(observed))
+	for _, obj := range observed {
+		id := identity(obj)
+		if id == "" {
+			continue
+		}
+		if _, found := observedByID[id]; found {
+			// this duplicate would otherwise be left orphaned
+			paired.Delete = append(paired.Delete, obj)
+			continue
+		}
+		observedByID[id] = obj
+	}
+
+	desiredIDs := make(map[string]bool, len(desired))
+	for _, obj := range desired {
+		id := identity(obj)
+		if id == "" {
+			return nil, errors.Errorf(
+				"Can't pair children: Missing identity for %s", describeObject(obj),
+			)
+		}
+		if desiredIDs[id] {
+			return nil, errors.Errorf(
+				"Can't pair children: Duplicate identity %q for %s", id, describeObject(obj),
+			)
+		}
+		desiredIDs[id] = true
+		if oldObj, found := observedByID[id]; found {
+			paired.Update = append(paired.Update, ChildPair{Observed: oldObj, Desired: obj})
+		} else {
+			paired.Create = append(paired.Create, obj)
+		}
+	}
+	for _, obj := range observed {
+		id := identity(obj)
+		if id != "" && !desiredIDs[id] && observedByID[id] == obj {
+			paired.Delete = append(paired.Delete, obj)
+		}
+	}
+	return paired, nil
+}
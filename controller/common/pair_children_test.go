@@ -0,0 +1,141 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newChild(name, id string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	if id != "" {
+		obj.SetLabels(map[string]string{"managed-by-id": id})
+	}
+	return obj
+}
+
+func names(objs []*unstructured.Unstructured) []string {
+	var res []string
+	for _, obj := range objs {
+		res = append(res, obj.GetName())
+	}
+	return res
+}
+
+func TestPairChildren(t *testing.T) {
+	byLabel := ChildIdentityByLabel("managed-by-id")
+	tests := map[string]struct {
+		observed   []*unstructured.Unstructured
+		desired    []*unstructured.Unstructured
+		identity   ChildIdentityFn
+		wantCreate []string
+		wantUpdate [][2]string
+		wantDelete []string
+		isErr      bool
+	}{
+		"pair renamed children by label": {
+			observed: []*unstructured.Unstructured{
+				newChild("cfg-old", "a"),
+				newChild("cfg-b", "b"),
+				newChild("unmanaged", ""),
+			},
+			desired: []*unstructured.Unstructured{
+				newChild("cfg-new", "a"),
+				newChild("cfg-c", "c"),
+			},
+			identity:   byLabel,
+			wantCreate: []string{"cfg-c"},
+			wantUpdate: [][2]string{{"cfg-old", "cfg-new"}},
+			wantDelete: []string{"cfg-b"},
+		},
+		"pair children by name by default": {
+			observed: []*unstructured.Unstructured{
+				newChild("cfg-old", "a"),
+			},
+			desired: []*unstructured.Unstructured{
+				newChild("cfg-new", "a"),
+			},
+			wantCreate: []string{"cfg-new"},
+			wantDelete: []string{"cfg-old"},
+		},
+		"observed children with same identity": {
+			observed: []*unstructured.Unstructured{
+				newChild("cfg-1", "a"),
+				newChild("cfg-2", "a"),
+			},
+			desired: []*unstructured.Unstructured{
+				newChild("cfg", "a"),
+			},
+			identity:   byLabel,
+			wantUpdate: [][2]string{{"cfg-1", "cfg"}},
+			wantDelete: []string{"cfg-2"},
+		},
+		"desired child without identity": {
+			desired: []*unstructured.Unstructured{
+				newChild("cfg", ""),
+			},
+			identity: byLabel,
+			isErr:    true,
+		},
+		"desired children with same identity": {
+			desired: []*unstructured.Unstructured{
+				newChild("cfg-1", "a"),
+				newChild("cfg-2", "a"),
+			},
+			identity: byLabel,
+			isErr:    true,
+		},
+	}
+	for name, mock := range tests {
+		name := name
+		mock := mock
+		t.Run(name, func(t *testing.T) {
+			got, err := PairChildren(mock.observed, mock.desired, mock.identity)
+			if mock.isErr {
+				if err == nil {
+					t.Fatalf("Expected error got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error got [%+v]", err)
+			}
+			var gotUpdate [][2]string
+			for _, pair := range got.Update {
+				gotUpdate = append(
+					gotUpdate, [2]string{pair.Observed.GetName(), pair.Desired.GetName()},
+				)
+			}
+			if !reflect.DeepEqual(names(got.Create), mock.wantCreate) {
+				t.Fatalf("Expected create %v got %v", mock.wantCreate, names(got.Create))
+			}
+			if !reflect.DeepEqual(gotUpdate, mock.wantUpdate) {
+				t.Fatalf("Expected update %v got %v", mock.wantUpdate, gotUpdate)
+			}
+			if !reflect.DeepEqual(names(got.Delete), mock.wantDelete) {
+				t.Fatalf("Expected delete %v got %v", mock.wantDelete, names(got.Delete))
+			}
+		})
+	}
+}
@@ -26,23 +26,49 @@ limitations under the License.
 package apply
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	stdjson "encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/json"
 )
 
 const (
-	lastAppliedAnnotation = "metac.openebs.io/last-applied-configuration"
+	// managedAnnotationPrefix prefixes the annotations set by metac
+	managedAnnotationPrefix = "metac.openebs.io/"
+
+	lastAppliedAnnotation = managedAnnotationPrefix + "last-applied-configuration"
 )
 
 // SetLastApplied sets the last applied state against a predefined annotation
 // key
 func SetLastApplied(obj *unstructured.Unstructured, lastApplied map[string]interface{}) error {
-	return SetLastAppliedByAnnKey(obj, lastApplied, lastAppliedAnnotation)
+	return SetLastAppliedWithOptions(obj, lastApplied, nil)
+}
+
+// SetLastAppliedWithOptions sets the last applied state of the given
+// object via the annotation key & backend decided by the provided
+// options. Default options are used if the provided options is nil.
+func SetLastAppliedWithOptions(
+	obj *unstructured.Unstructured,
+	lastApplied map[string]interface{},
+	opts *ApplyOptions,
+) error {
+	if opts == nil {
+		opts = &ApplyOptions{}
+	}
+	return opts.lastAppliedRef(obj, obj).set(obj, lastApplied)
 }
 
 // SetLastAppliedByAnnKey sets the last applied state against the
@@ -52,7 +78,13 @@ func SetLastAppliedByAnnKey(
 	lastApplied map[string]interface{},
 	annKey string,
 ) error {
+	return annotationRef(annKey).set(obj, lastApplied)
+}
 
+// set sets the last applied state of the given object as per this
+// reference
+func (r lastAppliedRef) set(obj *unstructured.Unstructured, lastApplied map[string]interface{}) error {
+	annKey := r.annKey
 	if len(lastApplied) == 0 {
 		return nil
 	}
@@ -70,20 +102,35 @@ func SetLastAppliedByAnnKey(
 		)
 	}
 
+	annValue, err := r.backend.Store(obj, lastAppliedJSON)
+	if err != nil {
+		return errors.Wrapf(
+			err,
+			"%s:%s:%s:%s: Failed to store last applied config against annotation %q",
+			obj.GetAPIVersion(),
+			obj.GetKind(),
+			obj.GetNamespace(),
+			obj.GetName(),
+			annKey,
+		)
+	}
+
 	ann := obj.GetAnnotations()
 	if ann == nil {
 		ann = make(map[string]string, 1)
 	}
-	ann[annKey] = string(lastAppliedJSON)
+	ann[annKey] = annValue
 	obj.SetAnnotations(ann)
 
+	// last applied state may have sensitive values & is hence not
+	// logged
 	glog.V(4).Infof(
-		"%s:%s:%s:%s: Will be set with following annotations: \n%v",
+		"%s:%s:%s:%s: Will be set with last applied annotation %q",
 		obj.GetAPIVersion(),
 		obj.GetKind(),
 		obj.GetNamespace(),
 		obj.GetName(),
-		ann,
+		annKey,
 	)
 
 	return nil
@@ -92,18 +139,92 @@ func SetLastAppliedByAnnKey(
 // SanitizeLastAppliedByAnnKey sanitizes the last applied state
 // by removing last applied state related info (i.e. its own info)
 // to avoid building up of a chain of last applied state storing
-// the previous last applied state & so on.
+// the previous last applied state & so on. Server managed fields are
+// removed as well since these are never applied by the controller.
 func SanitizeLastAppliedByAnnKey(last map[string]interface{}, annKey string) {
 	if len(last) == 0 {
 		return
 	}
 	unstructured.RemoveNestedField(last, "metadata", "annotations", annKey)
+	StripManagedFields(last)
+}
+
+// StripManagedFields removes metadata.managedFields from the given
+// object. These fields are maintained by the server & change on every
+// update. Hence, these fields pollute last applied state as well as
+// change detection.
+func StripManagedFields(obj map[string]interface{}) {
+	unstructured.RemoveNestedField(obj, "metadata", "managedFields")
+}
+
+// StripManagedAnnotations removes all the annotations set by metac from
+// the given object. These are the annotations prefixed with
+// `metac.openebs.io/` including the last applied state. Annotations
+// are removed altogether if none remain.
+//
+// This helps export an object to other systems.
+func StripManagedAnnotations(obj *unstructured.Unstructured) {
+	ann := obj.GetAnnotations()
+	if ann == nil {
+		return
+	}
+	for key := range ann {
+		if strings.HasPrefix(key, managedAnnotationPrefix) {
+			delete(ann, key)
+		}
+	}
+	if len(ann) == 0 {
+		unstructured.RemoveNestedField(obj.Object, "metadata", "annotations")
+		return
+	}
+	obj.SetAnnotations(ann)
 }
 
 // GetLastApplied returns the last applied state fo the given
 // object based on a predefined annotation
 func GetLastApplied(obj *unstructured.Unstructured) (map[string]interface{}, error) {
-	return GetLastAppliedByAnnKey(obj, lastAppliedAnnotation)
+	return GetLastAppliedWithOptions(obj, nil)
+}
+
+// GetLastAppliedWithOptions returns the last applied state of the given
+// object via the annotation key & backend decided by the provided
+// options. Default options are used if the provided options is nil.
+func GetLastAppliedWithOptions(
+	obj *unstructured.Unstructured, opts *ApplyOptions,
+) (map[string]interface{}, error) {
+	if opts == nil {
+		opts = &ApplyOptions{}
+	}
+	return opts.lastAppliedRef(obj, obj).get(obj, false)
+}
+
+// DeleteLastApplied releases the last applied state of the given object
+// that is stored outside of the object by the backend decided by the
+// provided options, e.g. the snapshots of HashStoreBackend. This is
+// meant to be invoked once the object is deleted. Nothing is done if
+// the backend stores the last applied state in the object itself.
+// Default options are used if the provided options is nil.
+func DeleteLastApplied(obj *unstructured.Unstructured, opts *ApplyOptions) error {
+	if opts == nil {
+		opts = &ApplyOptions{}
+	}
+	ref := opts.lastAppliedRef(obj, obj)
+	deleter, ok := ref.backend.(LastAppliedDeleter)
+	if !ok {
+		return nil
+	}
+	if err := deleter.Delete(obj, obj.GetAnnotations()[ref.annKey]); err != nil {
+		return errors.Wrapf(
+			err,
+			"%s:%s:%s:%s: Failed to delete last applied config against annotation %q",
+			obj.GetAPIVersion(),
+			obj.GetKind(),
+			obj.GetNamespace(),
+			obj.GetName(),
+			ref.annKey,
+		)
+	}
+	return nil
 }
 
 // GetLastAppliedByAnnKey returns the last applied state of the given
@@ -111,14 +232,62 @@ func GetLastApplied(obj *unstructured.Unstructured) (map[string]interface{}, err
 func GetLastAppliedByAnnKey(
 	obj *unstructured.Unstructured, annKey string,
 ) (map[string]interface{}, error) {
+	return annotationRef(annKey).get(obj, false)
+}
+
+// GetLastAppliedStrict returns the last applied state of the given
+// object similar to GetLastApplied. However, it returns error if the
+// last applied JSON has duplicate keys instead of keeping the last of
+// these. This catches corrupted annotations that would otherwise drop
+// fields silently.
+func GetLastAppliedStrict(obj *unstructured.Unstructured) (map[string]interface{}, error) {
+	return GetLastAppliedStrictByAnnKey(obj, lastAppliedAnnotation)
+}
+
+// GetLastAppliedStrictByAnnKey returns the last applied state of the
+// given object based on the provided annotation similar to
+// GetLastAppliedStrict
+func GetLastAppliedStrictByAnnKey(
+	obj *unstructured.Unstructured, annKey string,
+) (map[string]interface{}, error) {
+	return annotationRef(annKey).get(obj, true)
+}
 
-	lastAppliedJSON := obj.GetAnnotations()[annKey]
-	if lastAppliedJSON == "" {
+// get returns the last applied state of the given object as per this
+// reference. Duplicate keys result in error if strict is true.
+func (r lastAppliedRef) get(
+	obj *unstructured.Unstructured, strict bool,
+) (map[string]interface{}, error) {
+	annKey := r.annKey
+
+	annValue := obj.GetAnnotations()[annKey]
+	if annValue == "" {
 		return nil, nil
 	}
 
+	lastAppliedJSON, err := r.backend.Load(obj, annValue)
+	if err != nil {
+		return nil,
+			errors.Wrapf(
+				err,
+				"%s:%s:%s:%s: Failed to load last applied config against annotation %q",
+				obj.GetAPIVersion(),
+				obj.GetKind(),
+				obj.GetNamespace(),
+				obj.GetName(),
+				annKey,
+			)
+	}
+	if strict {
+		err = verifyNoDuplicateKeys(lastAppliedJSON)
+	}
 	lastApplied := make(map[string]interface{})
-	err := json.Unmarshal([]byte(lastAppliedJSON), &lastApplied)
+	if err == nil {
+		err = unmarshalSingleJSON(lastAppliedJSON, &lastApplied)
+	}
+	if err == nil {
+		err = verifyNoSelfReference(obj, lastApplied, annKey, strict, r.onSelfReference)
+	}
 	if err != nil {
 		return nil,
 			errors.Wrapf(
@@ -135,23 +304,434 @@ func GetLastAppliedByAnnKey(
 	return lastApplied, nil
 }
 
+// unmarshalSingleJSON unmarshals the single JSON value found in the given
+// data. Whitespace following this value is ignored while any other
+// trailing data results in an error.
+func unmarshalSingleJSON(data []byte, into interface{}) error {
+	reader := bytes.NewReader(data)
+	decoder := stdjson.NewDecoder(reader)
+	var raw stdjson.RawMessage
+	if err := decoder.Decode(&raw); err != nil {
+		return err
+	}
+	trailing, err := ioutil.ReadAll(io.MultiReader(decoder.Buffered(), reader))
+	if err != nil {
+		return err
+	}
+	if trailing = bytes.TrimSpace(trailing); len(trailing) > 0 {
+		if len(trailing) > 20 {
+			trailing = append(trailing[:20:20], "..."...)
+		}
+		return errors.Errorf("Invalid trailing data after JSON value: %q", trailing)
+	}
+	// decode via json of apimachinery to get int64 for whole numbers
+	return json.Unmarshal(raw, into)
+}
+
+// verifyNoDuplicateKeys returns error if any object of the given JSON
+// document has duplicate keys
+func verifyNoDuplicateKeys(data []byte) error {
+	decoder := stdjson.NewDecoder(bytes.NewReader(data))
+	return verifyNoDuplicateKeysAt("", decoder)
+}
+
+// verifyNoDuplicateKeysAt walks the next JSON value of the given
+// decoder found at the given field path & returns error if any of its
+// objects has duplicate keys
+func verifyNoDuplicateKeysAt(fieldPath string, decoder *stdjson.Decoder) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := token.(stdjson.Delim)
+	if !ok {
+		// scalar
+		return nil
+	}
+	switch delim {
+	case '{':
+		keys := map[string]bool{}
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := token.(string)
+			keyPath := fmt.Sprintf("%s[%s]", fieldPath, key)
+			if keys[key] {
+				return errors.Errorf("Duplicate key %q at %s", key, keyPath)
+			}
+			keys[key] = true
+			if err := verifyNoDuplicateKeysAt(keyPath, decoder); err != nil {
+				return err
+			}
+		}
+	case '[':
+		for idx := 0; decoder.More(); idx++ {
+			if err := verifyNoDuplicateKeysAt(fmt.Sprintf("%s[%d]", fieldPath, idx), decoder); err != nil {
+				return err
+			}
+		}
+	}
+	// consume the closing delimiter
+	_, err = decoder.Token()
+	return err
+}
+
 // Merge updates the given observed object to apply the desired changes.
 // It returns an updated copy of the observed object if no error occurs.
+//
+// The top level status field is not merged. It is copied from observed
+// as is. Use MergeWithOptions with MergeStatus option to merge status.
 func Merge(observed, lastApplied, desired map[string]interface{}) (map[string]interface{}, error) {
+	return MergeWithOptions(observed, lastApplied, desired, nil)
+}
+
+// MergeWithOptions updates the given observed object to apply the
+// desired changes based on the provided options. Default options are
+// used if the provided options is nil.
+//
+// It returns an updated copy of the observed object if no error occurs.
+func MergeWithOptions(
+	observed, lastApplied, desired map[string]interface{},
+	opts *MergeOptions,
+) (map[string]interface{}, error) {
+	return MergeContext(context.Background(), observed, lastApplied, desired, opts)
+}
+
+// MergeContext merges the desired state into the observed state similar
+// to MergeWithOptions. The given context is passed to the change
+// notifications, if any, along with this merge's call number. Refer
+// MergeCallFromContext.
+func MergeContext(
+	ctx context.Context,
+	observed, lastApplied, desired map[string]interface{},
+	opts *MergeOptions,
+) (map[string]interface{}, error) {
+	return newMerger(opts).run(ctx, observed, lastApplied, desired)
+}
+
+// run merges the desired state into the observed state within a
+// tracing span if a tracer is set. Every merge variant runs through
+// this & hence gets traced & notifies its changes.
+func (m *merger) run(
+	ctx context.Context,
+	observed, lastApplied, desired map[string]interface{},
+) (map[string]interface{}, error) {
+	ctx, span := m.startSpan(ctx, observed, desired)
+	merged, cached, err := m.mergeContext(ctx, observed, lastApplied, desired)
+	m.endSpan(span, cached, err)
+	return merged, err
+}
+
+// mergeContext merges the desired state into the observed state. It
+// returns true if the result was served from the cache.
+func (m *merger) mergeContext(
+	ctx context.Context,
+	observed, lastApplied, desired map[string]interface{},
+) (map[string]interface{}, bool, error) {
+	observed, lastApplied, desired, err := m.normalizeInputs(observed, lastApplied, desired)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var cacheKey [sha256.Size]byte
+	cache := m.opts.Cache
+	if cache != nil {
+		cacheKey, err = mergeCacheKey(observed, lastApplied, desired)
+		if err != nil {
+			return nil, false, err
+		}
+		if result, found := cache.get(cacheKey); found {
+			return result, true, nil
+		}
+	}
+
 	// Make a copy of observed since merge() mutates the destination.
-	destination := runtime.DeepCopyJSON(observed)
+	destination := m.deepCopy(observed)
 
-	if _, err := merge("", destination, lastApplied, desired); err != nil {
-		return nil, errors.Wrapf(err, "Can't merge desired changes")
+	err = m.mergeInto(destination, observed, lastApplied, desired)
+	if err != nil {
+		return nil, false, err
 	}
-	return destination, nil
+	if cache != nil {
+		cache.add(cacheKey, destination)
+	}
+	m.notifyChanges(ctx)
+	return destination, false, nil
+}
+
+// MergeValidate merges the desired state into the observed state &
+// runs the merged state through the given validator. This previews the
+// result of an apply without updating the cluster. The validation error
+// if any is returned along with the merged state.
+func MergeValidate(
+	observed, lastApplied, desired map[string]interface{},
+	validate func(merged map[string]interface{}) error,
+) (map[string]interface{}, error) {
+	merged, err := Merge(observed, lastApplied, desired)
+	if err != nil {
+		return nil, err
+	}
+	if err := validate(merged); err != nil {
+		return merged, errors.Wrapf(err, "Merged state is invalid")
+	}
+	return merged, nil
+}
+
+// mergeInto applies the desired changes against the destination. The
+// destination is expected to be a copy of observed.
+func (m *merger) mergeInto(destination, observed, lastApplied, desired map[string]interface{}) error {
+	if err := validateDirectives("", desired, m.opts.DirectivePrefix); err != nil {
+		return err
+	}
+	m.kind, _ = observed["kind"].(string)
+	if desiredKind, _ := desired["kind"].(string); desiredKind != "" {
+		m.kind = desiredKind
+	}
+	if m.opts.ErrorOnIdentityChange {
+		if err := verifyIdentityFields(observed, desired); err != nil {
+			return err
+		}
+	}
+	if err := m.verifyRequired(desired); err != nil {
+		return err
+	}
+	if m.opts.FinalizersOnlyOnDeletion && isDeleting(observed) {
+		glog.V(4).Infof("Will merge finalizers only: Object is being deleted")
+		lastApplied, desired = finalizersOnly(observed, lastApplied, desired)
+	}
+	desired = m.transformDesired(desired)
+	if m.opts.ManagedMetadataPrefix != "" {
+		lastApplied, desired = m.scopeMetadataToPrefix(observed, lastApplied, desired)
+	}
+	desired = normalizeEmptyMetadata(observed, desired)
+	m.atomic = m.isAtomic(observed)
+	if !m.opts.MergeStatus {
+		// status is neither merged nor deleted except for the
+		// explicitly managed status paths
+		lastApplied = m.withManagedStatus(lastApplied)
+		desired = m.withManagedStatus(desired)
+	}
+	if _, err := m.merge("", destination, lastApplied, desired); err != nil {
+		return errors.Wrapf(err, "Can't merge desired changes")
+	}
+	m.compactAllLists(destination, desired)
+	if err := m.revertObservedFields(destination, observed); err != nil {
+		return errors.Wrapf(err, "Can't merge desired changes")
+	}
+	if err := m.setHashAnnotations(destination); err != nil {
+		return errors.Wrapf(err, "Can't merge desired changes")
+	}
+	return m.verifyObjectSize(destination)
+}
+
+// withManagedStatus returns a shallow copy of the given object whose
+// status has only the fields set in StatusPaths option. Status is
+// dropped altogether if none of its fields are managed.
+func (m *merger) withManagedStatus(obj map[string]interface{}) map[string]interface{} {
+	status, isMap := obj["status"].(map[string]interface{})
+	if !isMap || len(m.opts.StatusPaths) == 0 {
+		return withoutField(obj, "status")
+	}
+	managed := map[string]interface{}{}
+	for key, val := range status {
+		if m.hasPath(m.opts.StatusPaths, fmt.Sprintf("[status][%s]", key)) {
+			managed[key] = val
+		}
+	}
+	if len(managed) == 0 {
+		return withoutField(obj, "status")
+	}
+	// status is found; hence this is a copy
+	objCopy := withoutField(obj, "status")
+	objCopy["status"] = managed
+	return objCopy
+}
+
+// withoutField returns a shallow copy of the given object without the
+// given top level field. The given object is returned as is if it does
+// not have this field.
+func withoutField(obj map[string]interface{}, field string) map[string]interface{} {
+	if _, found := obj[field]; !found {
+		return obj
+	}
+	objCopy := make(map[string]interface{}, len(obj))
+	for key, val := range obj {
+		if key != field {
+			objCopy[key] = val
+		}
+	}
+	return objCopy
+}
+
+// observedOnlyFields lists the well known fields whose values are
+// always taken from observed, irrespective of desired or last applied
+// states.
+//
+// For example, a desired state built from a typed object serializes
+// metadata.creationTimestamp as null. Merging this null would
+// otherwise overwrite the real timestamp set by the server.
+var observedOnlyFields = [][]string{
+	{"metadata", "creationTimestamp"},
+	{"metadata", "managedFields"},
+}
+
+// identityFields lists the well known fields that identify an object.
+// These fields are immutable & hence are taken from observed if they
+// are set in observed.
+var identityFields = [][]string{
+	{"metadata", "name"},
+	{"metadata", "namespace"},
+}
+
+// verifyIdentityFields returns error if desired tries to change the
+// identity fields of observed
+func verifyIdentityFields(observed, desired map[string]interface{}) error {
+	for _, fields := range identityFields {
+		obsVal, _, _ := unstructured.NestedString(observed, fields...)
+		desVal, _, _ := unstructured.NestedString(desired, fields...)
+		if obsVal != "" && desVal != "" && obsVal != desVal {
+			return errors.Errorf(
+				"desired%s: Can't change identity field: Observed %q: Desired %q",
+				toFieldPath(fields), obsVal, desVal,
+			)
+		}
+	}
+	return nil
+}
+
+// revertObservedFields sets the observed only fields as well as the
+// identity fields of destination to match what they are in observed.
+// An observed only field that is not set in observed is removed from
+// destination.
+func (m *merger) revertObservedFields(destination, observed map[string]interface{}) error {
+	for _, fields := range observedOnlyFields {
+		if err := m.revertField(destination, observed, true, fields...); err != nil {
+			return err
+		}
+	}
+	for _, fields := range identityFields {
+		if err := m.revertField(destination, observed, false, fields...); err != nil {
+			return err
+		}
+	}
+	if err := m.revertSelector(destination, observed); err != nil {
+		return err
+	}
+	return m.revertGenerateName(destination, observed)
+}
+
+// selectorFields is the path of the label selector of workloads
+var selectorFields = []string{"spec", "selector"}
+
+// isLabelSelector returns true if the given value is a label selector
+// i.e. has matchLabels or matchExpressions. Selectors of workloads e.g.
+// Deployment are label selectors while those of Services are plain
+// label maps.
+func isLabelSelector(val interface{}) bool {
+	selector, ok := val.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, hasLabels := selector["matchLabels"]
+	_, hasExpressions := selector["matchExpressions"]
+	return hasLabels || hasExpressions
+}
+
+// revertSelector handles spec.selector of an object that exists. A
+// label selector is immutable once set & is hence taken from observed.
+// It returns error if the selector was changed & ErrorOnSelectorChange
+// option is set.
+func (m *merger) revertSelector(destination, observed map[string]interface{}) error {
+	name, _, _ := unstructured.NestedString(observed, "metadata", "name")
+	obsVal, _, _ := unstructured.NestedFieldNoCopy(observed, selectorFields...)
+	if name == "" || !isLabelSelector(obsVal) {
+		return nil
+	}
+	mergedVal, _, _ := unstructured.NestedFieldNoCopy(destination, selectorFields...)
+	if reflect.DeepEqual(obsVal, mergedVal) {
+		return nil
+	}
+	if m.opts.ErrorOnSelectorChange {
+		return errors.Errorf(
+			"%s: Can't change immutable selector: Observed %v: Merged %v",
+			toFieldPath(selectorFields), obsVal, mergedVal,
+		)
+	}
+	glog.V(4).Infof("%s merge operation: Will preserve immutable selector", toFieldPath(selectorFields))
+	m.dropChangesUnder(toFieldPath(selectorFields))
+	return m.revertField(destination, observed, false, selectorFields...)
+}
+
+// revertGenerateName handles metadata.generateName of an object that
+// exists i.e. has a name assigned. Desired generateName is ignored on
+// update since it conflicts with the assigned name.
+func (m *merger) revertGenerateName(destination, observed map[string]interface{}) error {
+	name, _, _ := unstructured.NestedString(observed, "metadata", "name")
+	if name == "" {
+		// generateName is honoured on create
+		return nil
+	}
+	switch m.opts.GenerateNamePolicy {
+	case GenerateNameDrop:
+		unstructured.RemoveNestedField(destination, "metadata", "generateName")
+		m.dropChanges(toFieldPath([]string{"metadata", "generateName"}))
+		return nil
+	default:
+		return m.revertField(destination, observed, true, "metadata", "generateName")
+	}
+}
+
+// revertField sets the given field of destination to match what it is
+// in observed. The field is removed from destination if it is not set
+// in observed & removeIfUnset is true.
+func (m *merger) revertField(
+	destination, observed map[string]interface{},
+	removeIfUnset bool,
+	fields ...string,
+) error {
+	val, found, err := unstructured.NestedFieldNoCopy(observed, fields...)
+	if err != nil {
+		return errors.Wrapf(err, "Can't get observed field %v", fields)
+	}
+	if !found {
+		if removeIfUnset {
+			unstructured.RemoveNestedField(destination, fields...)
+			m.dropChanges(toFieldPath(fields))
+		}
+		return nil
+	}
+	err = unstructured.SetNestedField(destination, val, fields...)
+	if err != nil {
+		return errors.Wrapf(err, "Can't revert field %v", fields)
+	}
+	m.dropChanges(toFieldPath(fields))
+	return nil
+}
+
+// toFieldPath returns the field path notation of the given fields
+func toFieldPath(fields []string) string {
+	return fmt.Sprintf("[%s]", strings.Join(fields, "]["))
 }
 
 // merge finds the diff from lastApplied to desired,
 // and applies it to destination, returning the replacement
 // destination value.
-func merge(fieldPath string, destination, lastApplied, desired interface{}) (interface{}, error) {
+func (m *merger) merge(fieldPath string, destination, lastApplied, desired interface{}) (interface{}, error) {
 	glog.V(7).Infof("Will try merge for field %q", fieldPath)
+	if err := m.visit(fieldPath); err != nil {
+		return nil, err
+	}
+	destination, lastApplied, err := m.coerceShapes(fieldPath, destination, lastApplied, desired)
+	if err != nil {
+		return nil, err
+	}
+	if m.decision != nil {
+		parent := m.decision
+		m.decision = parent.add(fieldPath, destination, desired)
+		defer func() { m.decision = parent }()
+	}
 
 	switch destVal := destination.(type) {
 	case map[string]interface{}:
@@ -173,7 +753,7 @@ func merge(fieldPath string, destination, lastApplied, desired interface{}) (int
 					fieldPath, desired,
 				)
 		}
-		return mergeObject(fieldPath, destVal, lastVal, desVal)
+		return m.mergeObject(fieldPath, destVal, lastVal, desVal)
 	case []interface{}:
 		// destination is an array.
 		// Make sure the others are arrays too (or null).
@@ -193,67 +773,286 @@ func merge(fieldPath string, destination, lastApplied, desired interface{}) (int
 					fieldPath, desired,
 				)
 		}
-		return mergeArray(fieldPath, destVal, lastVal, desVal)
+		return m.mergeArray(fieldPath, destVal, lastVal, desVal)
 	default:
 		// destination is a scalar or null.
+		return m.mergeScalar(fieldPath, destination, lastApplied, desired)
+	}
+}
+
+// mergeScalar returns the value to be set at the given field path when
+// destination is a scalar or null.
+func (m *merger) mergeScalar(fieldPath string, destination, lastApplied, desired interface{}) (interface{}, error) {
+	destination, err := m.coerceObserved(fieldPath, destination, desired)
+	if err != nil {
+		return nil, err
+	}
+	m.recordConflict(fieldPath, destination, lastApplied, desired)
+	merged := desired
+	if appended, ok := m.appendText(fieldPath, destination, lastApplied, desired); ok {
+		glog.V(4).Infof("%s merge operation: Will append desired text", fieldPath)
+		merged = appended
+	} else if m.isSemanticallyEqual(fieldPath, destination, desired) {
+		glog.V(4).Infof("%s merge operation: Will keep semantically equal observed value", fieldPath)
+		merged = destination
+	} else if m.opts.ResolveConflict != nil && isConflict(destination, lastApplied, desired) {
+		glog.V(4).Infof("%s merge operation: Will resolve conflict", fieldPath)
+		merged = m.opts.ResolveConflict(m.currentPath(), destination, lastApplied, desired)
+	} else if desVal, ok := desired.(map[string]interface{}); ok {
 		// Just take the desired value. We won't be called if there's none.
-		return desired, nil
+		merged = m.dedupLists(fieldPath, m.withoutDirectives(desVal))
+	} else {
+		merged = m.dedupLists(fieldPath, m.clamp(fieldPath, m.canonicalBoolean(fieldPath, desired)))
 	}
+	if merged == nil {
+		if def, found := m.nullDefault(fieldPath); found {
+			merged = def
+		}
+	}
+	vetoed, err := m.vetoChange(fieldPath, m.currentPath(), destination, merged)
+	if err != nil {
+		return nil, err
+	}
+	if vetoed {
+		merged = destination
+		m.decide(strategyScalar, "", actionVeto)
+	} else {
+		m.recordNoOp(fieldPath, destination, merged)
+		m.decideScalar(destination, merged)
+	}
+	m.recordTouched(fieldPath)
+	if _, isList := merged.([]interface{}); isList {
+		m.recordListStrategy(fieldPath, strategyScalar, "")
+	}
+	m.traceScalar(fieldPath, destination, desired, merged)
+	return merged, nil
 }
 
-func mergeObject(fieldPath string, destination, lastApplied, desired map[string]interface{}) (interface{}, error) {
+func (m *merger) mergeObject(fieldPath string, destination, lastApplied, desired map[string]interface{}) (interface{}, error) {
+	if m.patchDirective(desired) == "replace" {
+		glog.V(4).Infof("%s merge operation: Will replace object as per directive", fieldPath)
+		replaced := m.withoutDirectives(desired)
+		if !reflect.DeepEqual(destination, replaced) {
+			m.recordChange(fieldPath, ReasonFieldUpdated, destination, replaced)
+		}
+		m.decide(strategyObject, "", actionReplace)
+		return replaced, nil
+	}
+	m.decide(strategyObject, "", actionMerge)
+	return m.mergeFields(
+		fieldPath,
+		false,
+		destination,
+		m.withoutDirectives(lastApplied),
+		m.withoutDirectives(desired),
+	)
+}
+
+// mergeFields merges the fields of the given objects. Each field
+// represents a list element if isListMap is true.
+func (m *merger) mergeFields(
+	fieldPath string,
+	isListMap bool,
+	destination, lastApplied, desired map[string]interface{},
+) (interface{}, error) {
 	glog.V(7).Infof("Will try merge object for field %q", fieldPath)
 
+	addedReason, removedReason := ReasonFieldAdded, ReasonFieldRemoved
+	if isListMap {
+		addedReason, removedReason = ReasonListElementAdded, ReasonListElementRemoved
+	}
+
 	// Remove fields that were present in lastApplied, but no longer in desired.
+	patchOnly := m.isPatchOnly(fieldPath)
+	passthrough := fieldPath == "" && m.opts.PassthroughUnknownTopLevel
 	for key := range lastApplied {
 		if _, present := desired[key]; !present {
+			if patchOnly {
+				glog.V(4).Infof("%s merge operation: Will retain key %s of patch only path", fieldPath, key)
+				continue
+			}
+			if passthrough {
+				glog.V(4).Infof("Merge operation: Will pass through top level key %s", key)
+				continue
+			}
 			glog.V(4).Infof("%s merge operation: Will delete key %s", fieldPath, key)
+			keyPath := fmt.Sprintf("%s[%s]", fieldPath, key)
+			if m.retainPreservedAnnotations(fieldPath, destination, key) {
+				continue
+			}
+			if isListMap && m.keepListMapElement(fieldPath, destination, key) {
+				continue
+			}
+			if err := m.verifyImmutable(keyPath, destination[key], nil); err != nil {
+				return nil, err
+			}
+			vetoed, err := m.vetoChange(keyPath, append(m.currentPath(), key), destination[key], nil)
+			if err != nil {
+				return nil, err
+			}
+			if vetoed {
+				continue
+			}
+			// deletions that survive the above filters are reviewed
+			destVal, destExists := destination[key]
+			if m.deferDeletion(keyPath, destVal, destExists) {
+				continue
+			}
+			if destExists {
+				m.recordChange(keyPath, removedReason, destination[key], nil)
+				m.decideDeletion(keyPath, destination[key])
+			}
 			delete(destination, key)
 		}
 	}
 
+	// Remove union members that are no longer active.
+	m.clearInactiveUnionMembers(fieldPath, destination, desired)
+
 	// Add/Update all fields present in desired.
-	var err error
+	shallow := m.isShallowMerge(fieldPath)
 	for key, desVal := range desired {
-		destination[key], err = merge(fmt.Sprintf("%s[%s]", fieldPath, key), destination[key], lastApplied[key], desVal)
-		if err != nil {
+		keyPath := fmt.Sprintf("%s[%s]", fieldPath, key)
+		oldVal, exists := destination[key]
+		if m.isPreservedOnEmpty(keyPath, desVal) {
+			glog.V(4).Infof("%s merge operation: Will preserve observed on empty desired", keyPath)
+			continue
+		}
+		immutableVal := m.immutableSnapshot(keyPath, oldVal)
+		atomic := shallow || m.isAtomicPath(keyPath) ||
+			(fieldPath == "" && m.atomic && key != "metadata")
+		if atomic {
+			// value of each key is replaced atomically
+			destination[key] = desVal
+			if _, isList := desVal.([]interface{}); isList {
+				m.recordListStrategy(keyPath, strategyScalar, "")
+			}
+		} else {
+			m.path = append(m.path, key)
+			newVal, err := m.merge(keyPath, oldVal, lastApplied[key], desVal)
+			m.path = m.path[:len(m.path)-1]
+			if err != nil {
+				return nil, err
+			}
+			destination[key] = newVal
+		}
+		if err := m.verifyImmutable(keyPath, immutableVal, destination[key]); err != nil {
 			return nil, err
 		}
+		switch {
+		case !exists:
+			m.recordChange(keyPath, addedReason, nil, destination[key])
+		case atomic || isScalar(oldVal) || isScalar(destination[key]):
+			// objects & lists are recorded while merging them
+			// unless they were replaced as a whole
+			if !reflect.DeepEqual(oldVal, destination[key]) {
+				m.recordChange(keyPath, ReasonFieldUpdated, oldVal, destination[key])
+			}
+		}
+	}
+	if !isListMap {
+		m.defaultOmittedNulls(fieldPath, destination, desired)
 	}
 
 	return destination, nil
 }
 
-func mergeArray(fieldPath string, destination, lastApplied, desired []interface{}) (interface{}, error) {
+func (m *merger) mergeArray(fieldPath string, destination, lastApplied, desired []interface{}) (interface{}, error) {
 	glog.V(7).Infof("Will try merge array for field %q", fieldPath)
 
 	// If it looks like a list map, use the special merge.
-	if mergeKey := detectListMapKey(destination, lastApplied, desired); mergeKey != "" {
-		return mergeListMap(fieldPath, mergeKey, destination, lastApplied, desired)
+	if keyOf, keyName := m.detectListMapKeyFunc(destination, lastApplied, desired); keyOf != nil {
+		if m.exceedsMaxListMapElements(destination, lastApplied, desired) {
+			m.decide(strategyListMap, keyName, actionReplace)
+			m.recordListStrategy(fieldPath, strategyList, "")
+			glog.Warningf(
+				"%s merge operation: Will replace list map: More than %d elements",
+				fieldPath, m.opts.MaxListMapElements,
+			)
+			if !reflect.DeepEqual(destination, desired) {
+				m.recordChange(fieldPath, ReasonListReplaced, destination, desired)
+			}
+			return desired, nil
+		}
+		m.decide(strategyListMap, keyName, actionMerge)
+		m.recordListStrategy(fieldPath, strategyListMap, keyName)
+		return m.mergeListMap(fieldPath, keyOf, m.keyFields(keyName), destination, lastApplied, desired)
 	}
 
+	if m.hasPath(m.opts.ContentMergeListPaths, fieldPath) {
+		m.decide(strategyContentList, "", actionMerge)
+		m.recordListStrategy(fieldPath, strategyContentList, "")
+		return m.mergeListByContent(fieldPath, destination, lastApplied, desired)
+	}
+	if m.hasPath(m.opts.IndexMergeListPaths, fieldPath) {
+		m.decide(strategyIndexList, "", actionMerge)
+		m.recordListStrategy(fieldPath, strategyIndexList, "")
+		return m.mergeListByIndex(fieldPath, destination, lastApplied, desired)
+	}
+	m.decide(strategyList, "", actionReplace)
+	m.recordListStrategy(fieldPath, strategyList, "")
+
 	// It's a normal array. Just replace for now.
 	// TODO(enisoc): Check if there are any common cases where we want to merge.
+	if resolved, ok := m.resolveScalarListConflict(fieldPath, destination, lastApplied, desired); ok {
+		glog.V(4).Infof("%s merge operation: Will resolve list conflict", fieldPath)
+		desired = resolved
+	}
+	if m.isDedupList(fieldPath) {
+		desired = dedupScalars(desired)
+	}
+	if !reflect.DeepEqual(destination, desired) {
+		m.recordChange(fieldPath, ReasonListReplaced, destination, desired)
+	}
 	return desired, nil
 }
 
-func mergeListMap(fieldPath, mergeKey string, destination, lastApplied, desired []interface{}) (interface{}, error) {
-	// Treat each list of objects as if it were a map, keyed by the mergeKey field.
-	destMap := makeListMap(mergeKey, destination)
-	lastMap := makeListMap(mergeKey, lastApplied)
-	desMap := makeListMap(mergeKey, desired)
+func (m *merger) mergeListMap(
+	fieldPath string,
+	keyOf listMapKeyFunc,
+	keyFields []string,
+	destination, lastApplied, desired []interface{},
+) (interface{}, error) {
+	if m.isLastWinsListMap() {
+		destination = dedupLastWins(keyOf, destination)
+		lastApplied = dedupLastWins(keyOf, lastApplied)
+		desired = dedupLastWins(keyOf, desired)
+	}
+	if err := verifyUniqueKeys(fieldPath, keyOf, desired); err != nil {
+		return nil, err
+	}
+	// Treat each list of objects as if it were a map, keyed by the merge key.
+	destMap := makeListMapBy(keyOf, destination)
+	lastMap := makeListMapBy(keyOf, lastApplied)
+	desMap := makeListMapBy(keyOf, desired)
+	if err := m.onListMapElements(fieldPath, keyOf, destMap, desMap, desired); err != nil {
+		return nil, err
+	}
 
-	_, err := mergeObject(fieldPath, destMap, lastMap, desMap)
+	m.listMaps++
+	oldKeys := keyFieldValues(keyFields, destMap, desMap)
+	var oldStatuses map[string]interface{}
+	isConditions := m.isConditions()
+	if isConditions {
+		oldStatuses = conditionStatuses(destMap)
+	}
+	_, err := m.mergeFields(fieldPath, true, destMap, lastMap, desMap)
 	if err != nil {
 		return nil, err
 	}
+	if err := verifyKeyFields(fieldPath, oldKeys, destMap); err != nil {
+		return nil, err
+	}
+	if isConditions {
+		m.stampConditionTransitions(destMap, oldStatuses, desMap)
+	}
 
 	// Turn destMap back into a list, trying to preserve partial order.
 	destList := make([]interface{}, 0, len(destMap))
 	added := make(map[string]bool, len(destMap))
 	// First take items that were already in destination.
 	for _, item := range destination {
-		key := stringMergeKey(item.(map[string]interface{})[mergeKey])
+		key := keyOf(item.(map[string]interface{}))
 		if newItem, ok := destMap[key]; ok {
 			destList = append(destList, newItem)
 			// Remember which items we've already added to the final list.
@@ -262,32 +1061,226 @@ func mergeListMap(fieldPath, mergeKey string, destination, lastApplied, desired
 	}
 	// Then take items in desired that haven't been added yet.
 	for _, item := range desired {
-		key := stringMergeKey(item.(map[string]interface{})[mergeKey])
-		if !added[key] {
-			destList = append(destList, destMap[key])
+		key := keyOf(item.(map[string]interface{}))
+		if newItem, ok := destMap[key]; ok && !added[key] {
+			destList = append(destList, newItem)
 			added[key] = true
 		}
 	}
 
-	return destList, nil
+	return m.reorderListMap(fieldPath, keyOf, destList)
 }
 
 func makeListMap(mergeKey string, list []interface{}) map[string]interface{} {
+	return makeListMapBy(mergeKeyFunc(mergeKey), list)
+}
+
+// makeListMapBy returns the given list as a map of its elements keyed by
+// the given key function
+func makeListMapBy(keyOf listMapKeyFunc, list []interface{}) map[string]interface{} {
 	res := make(map[string]interface{}, len(list))
 	for _, item := range list {
 		// We only end up here if detectListMapKey() already verified that
 		// all items are objects.
-		itemMap := item.(map[string]interface{})
-		res[stringMergeKey(itemMap[mergeKey])] = item
+		res[keyOf(item.(map[string]interface{}))] = item
 	}
 	return res
 }
 
+// verifyUniqueKeys returns error if any two elements of the given desired
+// list map share the same key
+func verifyUniqueKeys(fieldPath string, keyOf listMapKeyFunc, desired []interface{}) error {
+	keys := make(map[string]bool, len(desired))
+	for _, item := range desired {
+		key := keyOf(item.(map[string]interface{}))
+		if keys[key] {
+			return errors.Errorf("desired%s: Duplicate list map key %q", fieldPath, key)
+		}
+		keys[key] = true
+	}
+	return nil
+}
+
+// isLastWinsListMap returns true if the duplicate elements of the list
+// map currently being merged should be resolved to the last of these
+func (m *merger) isLastWinsListMap() bool {
+	return len(m.path) > 0 && lastWinsListMaps[m.path[len(m.path)-1]]
+}
+
+// dedupLastWins returns the given list map without the elements whose
+// key is repeated later in the list. The given list is returned as is
+// if its keys are unique.
+func dedupLastWins(keyOf listMapKeyFunc, list []interface{}) []interface{} {
+	seen := make(map[string]bool, len(list))
+	var dups int
+	for _, item := range list {
+		key := keyOf(item.(map[string]interface{}))
+		if seen[key] {
+			dups++
+		}
+		seen[key] = true
+	}
+	if dups == 0 {
+		return list
+	}
+	// walk backwards to keep the last of the duplicates in its place
+	deduped := make([]interface{}, len(list)-dups)
+	kept := make(map[string]bool, len(deduped))
+	idx := len(deduped)
+	for i := len(list) - 1; i >= 0; i-- {
+		key := keyOf(list[i].(map[string]interface{}))
+		if kept[key] {
+			continue
+		}
+		kept[key] = true
+		idx--
+		deduped[idx] = list[i]
+	}
+	return deduped
+}
+
+// listMapKeyFunc returns the key that identifies the given list map
+// element
+type listMapKeyFunc func(item map[string]interface{}) string
+
+// keyFields returns the names of the fields that make up the keys of
+// the list map currently being merged given the description of these
+// keys. Fields of keys set via KeyFuncs option are known only if these
+// are listed via ListMapKeys option as well.
+func (m *merger) keyFields(keyName string) []string {
+	switch keyName {
+	case "KeyFunc":
+		return m.listMapKeys()
+	case signatureKeyName:
+		return nil
+	default:
+		return strings.Split(keyName, ",")
+	}
+}
+
+// keyFieldValues returns the values of the given key fields of each
+// destination element that is matched by a desired element. These are
+// mapped by the elements' keys.
+func keyFieldValues(
+	keyFields []string, destMap, desMap map[string]interface{},
+) map[string]map[string]interface{} {
+	if len(keyFields) == 0 {
+		return nil
+	}
+	values := make(map[string]map[string]interface{}, len(desMap))
+	for key := range desMap {
+		destElem, ok := destMap[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		elemValues := make(map[string]interface{}, len(keyFields))
+		for _, field := range keyFields {
+			if val, found := destElem[field]; found {
+				elemValues[field] = val
+			}
+		}
+		values[key] = elemValues
+	}
+	return values
+}
+
+// verifyKeyFields returns error if any of the given key field values
+// of the matched elements were changed by the merge. This guards
+// against key functions that match elements whose keys differ.
+func verifyKeyFields(
+	fieldPath string, oldKeys map[string]map[string]interface{}, merged map[string]interface{},
+) error {
+	keys := make([]string, 0, len(oldKeys))
+	for key := range oldKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		elem, ok := merged[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		fields := make([]string, 0, len(oldKeys[key]))
+		for field := range oldKeys[key] {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			oldVal := oldKeys[key][field]
+			if newVal := elem[field]; !reflect.DeepEqual(oldVal, newVal) {
+				return errors.Errorf(
+					"%s[%s]: Can't change list map key field %q: Observed %v: Merged %v",
+					fieldPath, key, field, oldVal, newVal,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// mergeKeyFunc returns a key function that identifies list map
+// elements by the given merge key
+func mergeKeyFunc(mergeKey string) listMapKeyFunc {
+	return func(item map[string]interface{}) string {
+		return stringMergeKey(item[mergeKey])
+	}
+}
+
+// compositeKeyFunc returns a key function that identifies list map
+// elements by the combined values of the given keys. Keys that are not
+// set in an element are treated as empty.
+func compositeKeyFunc(keys []string) listMapKeyFunc {
+	return func(item map[string]interface{}) string {
+		pairs := make([]string, 0, len(keys))
+		for _, key := range keys {
+			val := ""
+			if item[key] != nil {
+				val = stringMergeKey(item[key])
+			}
+			pairs = append(pairs, key+"="+val)
+		}
+		return strings.Join(pairs, ",")
+	}
+}
+
+// portKeyFunc returns the function that keys the elements of a port
+// list by the given merge key & their protocol. Ports of the default
+// protocol are keyed by the merge key alone. Hence, their paths are the
+// same as those of any other list map.
+func portKeyFunc(mergeKey string) listMapKeyFunc {
+	return func(item map[string]interface{}) string {
+		key := stringMergeKey(item[mergeKey])
+		protocol, _ := item["protocol"].(string)
+		if protocol == "" || protocol == defaultProtocol {
+			return key
+		}
+		return key + "/" + protocol
+	}
+}
+
 // stringMergeKey converts merge key values that aren't strings to strings.
+//
+// Numbers are formatted without losing precision. Numbers decoded as
+// json.Number keep their exact digits, e.g. 64-bit IDs beyond the
+// precision of float64, unless these are in scientific notation. Whole
+// floats are formatted without exponent so that these match the same
+// value decoded as an integer, e.g. `1e9` matches `1000000000`.
 func stringMergeKey(val interface{}) string {
 	switch tval := val.(type) {
 	case string:
 		return tval
+	case stdjson.Number:
+		if !strings.ContainsAny(tval.String(), ".eE") {
+			return tval.String()
+		}
+		if f, err := tval.Float64(); err == nil {
+			return strconv.FormatFloat(f, 'f', -1, 64)
+		}
+		return tval.String()
+	case int64:
+		return strconv.FormatInt(tval, 10)
+	case float64:
+		return strconv.FormatFloat(tval, 'f', -1, 64)
 	default:
 		return fmt.Sprintf("%v", val)
 	}
@@ -309,11 +1302,176 @@ var knownMergeKeys = []string{
 	"ip",
 }
 
+// compositeMergeKeys maps the names of well known list map fields to
+// the keys that together identify their elements. These lists lack a
+// single merge key.
+var compositeMergeKeys = map[string][]string{
+	// e.g. spec.tolerations of a pod template
+	"tolerations": {"key", "operator", "value", "effect"},
+}
+
+// protocolMergeKeys lists the merge keys of well known port lists whose
+// elements are identified by their protocol as well e.g. a container
+// may expose the same port over both TCP & UDP
+var protocolMergeKeys = map[string]bool{
+	"containerPort": true,
+	"port":          true,
+}
+
+// defaultProtocol is the protocol of a port that does not set one
+const defaultProtocol = "TCP"
+
+// lastWinsListMaps lists the names of well known list map fields whose
+// elements may share the same key. The last of such elements wins e.g.
+// the last env var of a container with a given name is the one that
+// takes effect.
+var lastWinsListMaps = map[string]bool{
+	"env": true,
+}
+
+// MergeKeySelector chooses the merge key of a list map among the
+// candidate keys that are common to all the elements of the given
+// lists. Candidates are sorted. An empty string is returned if the
+// lists should not be treated as a list map.
+type MergeKeySelector func(candidates []string, lists ...[]interface{}) string
+
+// SelectKnownMergeKey is the default MergeKeySelector. It chooses the
+// candidate that has the highest precedence as per the known merge keys.
+func SelectKnownMergeKey(candidates []string, lists ...[]interface{}) string {
+	// If all objects have one of the known conventional merge keys in common,
+	// we'll guess that this is a list map.
+	for _, key := range knownMergeKeys {
+		for _, candidate := range candidates {
+			if candidate == key {
+				return key
+			}
+		}
+	}
+	return ""
+}
+
 // detectListMapKey tries to guess whether a field is a k8s-style "list map".
 // You pass in all known examples of values for the field.
 // If a likely merge key can be found, we return it.
 // Otherwise, we return an empty string.
 func detectListMapKey(lists ...[]interface{}) string {
+	return detectListMapKeyWith(SelectKnownMergeKey, lists...)
+}
+
+// detectListMapKey tries to guess whether a field is a k8s-style "list map"
+// based on the configured merge key selector.
+func (m *merger) detectListMapKey(lists ...[]interface{}) string {
+	if m.opts.SelectMergeKey == nil {
+		return detectListMapKey(lists...)
+	}
+	return detectListMapKeyWith(m.opts.SelectMergeKey, lists...)
+}
+
+// detectListMapKeyFunc tries to guess whether the field currently being
+// merged is a k8s-style "list map". It returns the function that keys
+// the elements of this list map along with a description of the keys.
+// Nil is returned if the field does not look like a list map.
+func (m *merger) detectListMapKeyFunc(lists ...[]interface{}) (listMapKeyFunc, string) {
+	if keyFunc := m.keyFunc(); keyFunc != nil {
+		return keyFuncOf(keyFunc, lists...), "KeyFunc"
+	}
+	if keys := m.listMapKeys(); len(keys) > 0 && allObjects(lists...) {
+		if len(keys) == 1 {
+			return mergeKeyFunc(keys[0]), keys[0]
+		}
+		return compositeKeyFunc(keys), strings.Join(keys, ",")
+	}
+	if m.isConditions() {
+		if mergeKey := detectListMapKeyWith(selectConditionKey, lists...); mergeKey != "" {
+			return mergeKeyFunc(mergeKey), mergeKey
+		}
+	}
+	if len(m.path) > 0 {
+		if keys, found := compositeMergeKeys[m.path[len(m.path)-1]]; found && allObjects(lists...) {
+			return compositeKeyFunc(keys), strings.Join(keys, ",")
+		}
+	}
+	if mergeKey := m.detectListMapKey(lists...); mergeKey != "" {
+		if protocolMergeKeys[mergeKey] {
+			return portKeyFunc(mergeKey), mergeKey + ",protocol"
+		}
+		return mergeKeyFunc(mergeKey), mergeKey
+	}
+	if m.opts.SignatureMergeKeys && !m.isPositionalOrContentList(toFieldPath(m.path)) {
+		if keyOf := signatureKeyFunc(lists...); keyOf != nil {
+			return keyOf, signatureKeyName
+		}
+	}
+	return nil, ""
+}
+
+// KeyFunc returns the identity of the given list element. It returns
+// false if the element can't be identified.
+type KeyFunc func(element map[string]interface{}) (string, bool)
+
+// keyFunc returns the function set via KeyFuncs option for the field
+// currently being merged
+func (m *merger) keyFunc() KeyFunc {
+	if len(m.opts.KeyFuncs) == 0 || len(m.path) == 0 {
+		return nil
+	}
+	if pattern, found := m.firstMatchingPattern(m.patterns.keyFuncs, toFieldPath(m.path)); found {
+		return m.opts.KeyFuncs[pattern]
+	}
+	return nil
+}
+
+// keyFuncOf returns a key function based on the given KeyFunc if it
+// identifies all the elements of the given lists. Nil is returned
+// otherwise.
+func keyFuncOf(keyFunc KeyFunc, lists ...[]interface{}) listMapKeyFunc {
+	if !allObjects(lists...) {
+		return nil
+	}
+	for _, list := range lists {
+		for _, item := range list {
+			if _, ok := keyFunc(item.(map[string]interface{})); !ok {
+				return nil
+			}
+		}
+	}
+	return func(item map[string]interface{}) string {
+		key, _ := keyFunc(item)
+		return key
+	}
+}
+
+// listMapKeys returns the keys set via ListMapKeys option for the
+// field currently being merged
+func (m *merger) listMapKeys() []string {
+	if len(m.opts.ListMapKeys) == 0 || len(m.path) == 0 {
+		return nil
+	}
+	if pattern, found := m.firstMatchingPattern(m.patterns.listMapKeys, toFieldPath(m.path)); found {
+		return m.opts.ListMapKeys[pattern]
+	}
+	return nil
+}
+
+// allObjects returns true if the given lists have at least one element
+// & all their elements are objects
+func allObjects(lists ...[]interface{}) bool {
+	var found bool
+	for _, list := range lists {
+		for _, item := range list {
+			if _, ok := item.(map[string]interface{}); !ok {
+				return false
+			}
+			found = true
+		}
+	}
+	return found
+}
+
+// detectListMapKeyWith tries to guess whether a field is a k8s-style
+// "list map" by using the given selector to choose among the keys that
+// are common to all the list elements.
+func detectListMapKeyWith(selector MergeKeySelector, lists ...[]interface{}) string {
 	// Remember the set of keys that every object has in common.
 	var commonKeys map[string]bool
 
@@ -342,13 +1500,14 @@ func detectListMapKey(lists ...[]interface{}) string {
 			}
 		}
 	}
+	if len(commonKeys) == 0 {
+		return ""
+	}
 
-	// If all objects have one of the known conventional merge keys in common,
-	// we'll guess that this is a list map.
-	for _, key := range knownMergeKeys {
-		if commonKeys[key] {
-			return key
-		}
+	candidates := make([]string, 0, len(commonKeys))
+	for key := range commonKeys {
+		candidates = append(candidates, key)
 	}
-	return ""
+	sort.Strings(candidates)
+	return selector(candidates, lists...)
 }
@@ -17,9 +17,12 @@ limitations under the License.
 package apply
 
 import (
+	stdjson "encoding/json"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/pkg/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/util/diff"
 	"k8s.io/apimachinery/pkg/util/json"
@@ -149,6 +152,191 @@ func TestMerge(t *testing.T) {
         ]
       }`,
 		},
+		{
+			name: "null creationTimestamp in desired",
+			observed: `{
+				"metadata": {
+					"name": "test",
+					"creationTimestamp": "2019-10-01T10:00:00Z"
+				}
+			}`,
+			lastApplied: `{}`,
+			desired: `{
+				"metadata": {
+					"name": "test",
+					"creationTimestamp": null
+				}
+			}`,
+			want: `{
+				"metadata": {
+					"name": "test",
+					"creationTimestamp": "2019-10-01T10:00:00Z"
+				}
+			}`,
+		},
+		{
+			name:        "creationTimestamp is cleared for create",
+			observed:    `{}`,
+			lastApplied: `{}`,
+			desired: `{
+				"metadata": {
+					"name": "test",
+					"creationTimestamp": null
+				}
+			}`,
+			want: `{
+				"metadata": {
+					"name": "test"
+				}
+			}`,
+		},
+		{
+			name: "merge tolerations by composite key",
+			observed: `{
+				"tolerations": [
+					{"key": "node.kubernetes.io/unreachable", "operator": "Exists", "effect": "NoExecute", "tolerationSeconds": 300},
+					{"key": "dedicated", "operator": "Equal", "value": "infra", "effect": "NoSchedule"}
+				]
+			}`,
+			lastApplied: `{
+				"tolerations": [
+					{"key": "node.kubernetes.io/unreachable", "operator": "Exists", "effect": "NoExecute", "tolerationSeconds": 300}
+				]
+			}`,
+			desired: `{
+				"tolerations": [
+					{"key": "node.kubernetes.io/unreachable", "operator": "Exists", "effect": "NoExecute", "tolerationSeconds": 60}
+				]
+			}`,
+			want: `{
+				"tolerations": [
+					{"key": "node.kubernetes.io/unreachable", "operator": "Exists", "effect": "NoExecute", "tolerationSeconds": 60},
+					{"key": "dedicated", "operator": "Equal", "value": "infra", "effect": "NoSchedule"}
+				]
+			}`,
+		},
+		{
+			name:        "number in scientific notation equals its decimal twin",
+			observed:    `{"limit": 1000000000, "ratio": 0.5}`,
+			lastApplied: `{"limit": 1000000000}`,
+			desired:     `{"limit": 1e9, "ratio": 5e-1}`,
+			want:        `{"limit": 1000000000, "ratio": 0.5}`,
+		},
+		{
+			name:        "merge key in scientific notation matches its decimal twin",
+			observed:    `{"ports": [{"port": 8080, "keep": "other"}]}`,
+			lastApplied: `{}`,
+			desired:     `{"ports": [{"port": 8.08e3, "add": "new"}]}`,
+			want:        `{"ports": [{"port": 8080, "keep": "other", "add": "new"}]}`,
+		},
+		{
+			name: "container port exposed over both TCP & UDP",
+			observed: `{
+				"containers": [{
+					"name": "dns",
+					"ports": [
+						{"containerPort": 53, "protocol": "UDP", "name": "dns"},
+						{"containerPort": 53, "protocol": "TCP", "name": "dns-tcp"}
+					]
+				}]
+			}`,
+			lastApplied: `{
+				"containers": [{
+					"name": "dns",
+					"ports": [
+						{"containerPort": 53, "protocol": "UDP", "name": "dns"},
+						{"containerPort": 53, "name": "dns-tcp"}
+					]
+				}]
+			}`,
+			desired: `{
+				"containers": [{
+					"name": "dns",
+					"ports": [
+						{"containerPort": 53, "protocol": "UDP", "name": "dns-udp"},
+						{"containerPort": 53, "name": "dns-tcp"},
+						{"containerPort": 9153, "name": "metrics"}
+					]
+				}]
+			}`,
+			want: `{
+				"containers": [{
+					"name": "dns",
+					"ports": [
+						{"containerPort": 53, "protocol": "UDP", "name": "dns-udp"},
+						{"containerPort": 53, "protocol": "TCP", "name": "dns-tcp"},
+						{"containerPort": 9153, "name": "metrics"}
+					]
+				}]
+			}`,
+		},
+		{
+			name:        "service port exposed over both TCP & UDP",
+			observed:    `{"ports": [{"port": 53, "protocol": "TCP", "targetPort": 53}]}`,
+			lastApplied: `{"ports": [{"port": 53}]}`,
+			desired:     `{"ports": [{"port": 53}, {"port": 53, "protocol": "UDP"}]}`,
+			want: `{"ports": [
+				{"port": 53, "protocol": "TCP", "targetPort": 53},
+				{"port": 53, "protocol": "UDP"}
+			]}`,
+		},
+		{
+			name: "last duplicate env var wins",
+			observed: `{
+				"env": [
+					{"name": "MODE", "value": "debug"},
+					{"name": "EXTRA", "value": "other"},
+					{"name": "LEVEL", "value": "1"}
+				]
+			}`,
+			lastApplied: `{
+				"env": [
+					{"name": "MODE", "value": "debug"},
+					{"name": "LEVEL", "value": "1"}
+				]
+			}`,
+			desired: `{
+				"env": [
+					{"name": "MODE", "value": "debug"},
+					{"name": "LEVEL", "value": "2"},
+					{"name": "MODE", "value": "release"}
+				]
+			}`,
+			want: `{
+				"env": [
+					{"name": "MODE", "value": "release"},
+					{"name": "EXTRA", "value": "other"},
+					{"name": "LEVEL", "value": "2"}
+				]
+			}`,
+		},
+		{
+			name: "remove toleration dropped from desired",
+			observed: `{
+				"tolerations": [
+					{"key": "a", "operator": "Exists"},
+					{"key": "b", "operator": "Exists"},
+					{"key": "c", "operator": "Exists"}
+				]
+			}`,
+			lastApplied: `{
+				"tolerations": [
+					{"key": "a", "operator": "Exists"},
+					{"key": "b", "operator": "Exists"}
+				]
+			}`,
+			desired: `{
+				"tolerations": [
+					{"key": "a", "operator": "Exists"}
+				]
+			}`,
+			want: `{
+				"tolerations": [
+					{"key": "a", "operator": "Exists"},
+					{"key": "c", "operator": "Exists"}
+				]
+			}`,
+		},
 	}
 
 	for _, tc := range table {
@@ -207,3 +395,177 @@ func TestLastAppliedAnnotation(t *testing.T) {
 		t.Errorf("got %#v, want %#v", out, in)
 	}
 }
+
+func TestGetLastAppliedTrailingData(t *testing.T) {
+	table := []struct {
+		name, annotation string
+		want             map[string]interface{}
+		wantErr          string
+	}{
+		{
+			name:       "trailing whitespace",
+			annotation: "{\"spec\": {\"replicas\": 1}}\n \t\n",
+			want: map[string]interface{}{
+				"spec": map[string]interface{}{"replicas": int64(1)},
+			},
+		},
+		{
+			name:       "trailing garbage",
+			annotation: `{"spec": {"replicas": 1}}}}`,
+			wantErr:    `Invalid trailing data after JSON value: "}}"`,
+		},
+	}
+	for _, tc := range table {
+		obj := &unstructured.Unstructured{}
+		obj.SetAnnotations(map[string]string{lastAppliedAnnotation: tc.annotation})
+		got, err := GetLastApplied(obj)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: got error %v, want %q", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: GetLastApplied error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %#v, want %#v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestGetLastAppliedStrict(t *testing.T) {
+	obj := &unstructured.Unstructured{}
+	obj.SetAnnotations(map[string]string{
+		lastAppliedAnnotation: `{"spec": {"replicas": 1, "paused": true, "replicas": 2}}`,
+	})
+
+	// lenient read keeps the last of the duplicates
+	got, err := GetLastApplied(obj)
+	if err != nil {
+		t.Fatalf("GetLastApplied error: %v", err)
+	}
+	want := map[string]interface{}{
+		"spec": map[string]interface{}{"replicas": int64(2), "paused": true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetLastApplied() = %#v, want %#v", got, want)
+	}
+
+	_, err = GetLastAppliedStrict(obj)
+	if err == nil || !strings.Contains(err.Error(), `Duplicate key "replicas" at [spec][replicas]`) {
+		t.Errorf("GetLastAppliedStrict(): got error %v, want duplicate key error", err)
+	}
+
+	obj.SetAnnotations(map[string]string{
+		lastAppliedAnnotation: `{"spec": {"containers": [{"name": "a"}, {"name": "b"}]}}`,
+	})
+	if _, err := GetLastAppliedStrict(obj); err != nil {
+		t.Errorf("GetLastAppliedStrict(): got error %v, want none", err)
+	}
+}
+
+func TestStripManagedAnnotations(t *testing.T) {
+	obj := &unstructured.Unstructured{}
+	obj.SetAnnotations(map[string]string{
+		"metac.openebs.io/last-applied-configuration": "{}",
+		"metac.openebs.io/last-merge-diff":            "[]",
+		"example.com/owner":                           "team-a",
+	})
+	StripManagedAnnotations(obj)
+	want := map[string]string{"example.com/owner": "team-a"}
+	if got := obj.GetAnnotations(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got annotations %#v, want %#v", got, want)
+	}
+
+	// annotations are removed if none remain
+	obj.SetAnnotations(map[string]string{
+		"metac.openebs.io/last-applied-configuration": "{}",
+	})
+	StripManagedAnnotations(obj)
+	if _, found, _ := unstructured.NestedFieldNoCopy(obj.Object, "metadata", "annotations"); found {
+		t.Errorf("got annotations %#v, want none", obj.GetAnnotations())
+	}
+}
+
+func TestMergeValidate(t *testing.T) {
+	observed := toJSONMap(t, `{"spec": {"replicas": 1}}`)
+	desired := toJSONMap(t, `{"spec": {"replicas": 0}}`)
+	errNoReplicas := errors.New("replicas must be positive")
+	validate := func(merged map[string]interface{}) error {
+		if merged["spec"].(map[string]interface{})["replicas"] == int64(0) {
+			return errNoReplicas
+		}
+		return nil
+	}
+
+	merged, err := MergeValidate(observed, nil, desired, validate)
+	if errors.Cause(err) != errNoReplicas {
+		t.Errorf("MergeValidate(): got error %v, want %v", err, errNoReplicas)
+	}
+	if !reflect.DeepEqual(merged, desired) {
+		t.Errorf("MergeValidate() = %#v, want preview %#v", merged, desired)
+	}
+
+	desired = toJSONMap(t, `{"spec": {"replicas": 2}}`)
+	if _, err := MergeValidate(observed, nil, desired, validate); err != nil {
+		t.Errorf("MergeValidate(): got error %v, want none", err)
+	}
+}
+
+func TestMergeLargeNumericMergeKeys(t *testing.T) {
+	decode := func(in string) map[string]interface{} {
+		decoder := stdjson.NewDecoder(strings.NewReader(in))
+		decoder.UseNumber()
+		var obj map[string]interface{}
+		if err := decoder.Decode(&obj); err != nil {
+			t.Fatalf("Decode error: %v", err)
+		}
+		return obj
+	}
+	observed := decode(`{
+		"items": [
+			{"id": 18446744073709551614, "value": "a"},
+			{"id": 18446744073709551615, "value": "b"}
+		]
+	}`)
+	desired := decode(`{
+		"items": [
+			{"id": 18446744073709551615, "value": "c"}
+		]
+	}`)
+	opts := &MergeOptions{ListMapKeys: map[string][]string{"[items]": {"id"}}}
+
+	got, err := MergeWithOptions(observed, nil, desired, opts)
+	if err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	want := decode(`{
+		"items": [
+			{"id": 18446744073709551614, "value": "a"},
+			{"id": 18446744073709551615, "value": "c"}
+		]
+	}`)
+	if !reflect.DeepEqual(got, want) {
+		t.Logf("reflect diff: a=got, b=want:\n%s", diff.ObjectReflectDiff(got, want))
+		t.Errorf("MergeWithOptions() = %#v, want %#v", got, want)
+	}
+
+	var tests = map[string]struct {
+		val  interface{}
+		want string
+	}{
+		"json number":                        {val: stdjson.Number("18446744073709551615"), want: "18446744073709551615"},
+		"int64":                              {val: int64(9007199254740993), want: "9007199254740993"},
+		"whole float":                        {val: float64(1e21), want: "1000000000000000000000"},
+		"fraction float":                     {val: 1.5, want: "1.5"},
+		"json number in scientific notation": {val: stdjson.Number("1e9"), want: "1000000000"},
+		"json number fraction":               {val: stdjson.Number("0.1"), want: "0.1"},
+	}
+	for name, mock := range tests {
+		if got := stringMergeKey(mock.val); got != mock.want {
+			t.Errorf("%s: got key %q, want %q", name, got, mock.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// MergeCache is a bounded, least recently used cache of merge results
+// keyed by the content hashes of observed, last applied & desired
+// states. It is safe for concurrent use.
+//
+// A cache must only be used with a single set of merge options since
+// options are not part of the cache key. Inputs must not be mutated
+// while a merge is in progress since results are cached against
+// the content that was hashed.
+//
+// Hashing small inputs costs about as much as merging them. Hence,
+// this cache pays off for large objects or costly merge options.
+type MergeCache struct {
+	mutex sync.Mutex
+
+	// size is the maximum number of cached results
+	size int
+
+	// entries holds the cached results with the most recently used
+	// result at the front
+	entries *list.List
+
+	// index maps a cache key to its entry
+	index map[[sha256.Size]byte]*list.Element
+
+	hits   int
+	misses int
+}
+
+// mergeCacheEntry is a cached merge result
+type mergeCacheEntry struct {
+	key    [sha256.Size]byte
+	result map[string]interface{}
+}
+
+// NewMergeCache returns a new instance of MergeCache that holds at
+// most the given number of merge results
+func NewMergeCache(size int) *MergeCache {
+	if size <= 0 {
+		size = 1
+	}
+	return &MergeCache{
+		size:    size,
+		entries: list.New(),
+		index:   make(map[[sha256.Size]byte]*list.Element, size),
+	}
+}
+
+// Stats returns the number of cache hits & misses
+func (c *MergeCache) Stats() (hits, misses int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.hits, c.misses
+}
+
+// Len returns the number of cached results
+func (c *MergeCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.entries.Len()
+}
+
+// get returns a copy of the cached result against the given key
+func (c *MergeCache) get(key [sha256.Size]byte) (map[string]interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, found := c.index[key]
+	if !found {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.entries.MoveToFront(elem)
+	return runtime.DeepCopyJSON(elem.Value.(*mergeCacheEntry).result), true
+}
+
+// add caches a copy of the given result against the given key
+func (c *MergeCache) add(key [sha256.Size]byte, result map[string]interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, found := c.index[key]; found {
+		c.entries.MoveToFront(elem)
+		return
+	}
+	c.index[key] = c.entries.PushFront(&mergeCacheEntry{
+		key:    key,
+		result: runtime.DeepCopyJSON(result),
+	})
+	for c.entries.Len() > c.size {
+		oldest := c.entries.Back()
+		c.entries.Remove(oldest)
+		delete(c.index, oldest.Value.(*mergeCacheEntry).key)
+	}
+}
+
+// mergeCacheKey returns the cache key of the given merge inputs
+func mergeCacheKey(observed, lastApplied, desired map[string]interface{}) ([sha256.Size]byte, error) {
+	// maps are marshaled with sorted keys which makes the
+	// marshaled content canonical
+	content, err := json.Marshal([]interface{}{observed, lastApplied, desired})
+	if err != nil {
+		return [sha256.Size]byte{}, errors.Wrapf(err, "Failed to build merge cache key")
+	}
+	return sha256.Sum256(content), nil
+}
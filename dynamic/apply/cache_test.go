@@ -0,0 +1,111 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeCache(t *testing.T) {
+	cache := NewMergeCache(2)
+	opts := &MergeOptions{Cache: cache}
+
+	observed := toJSONMap(t, `{"spec": {"replicas": 1, "external": true}}`)
+	lastApplied := toJSONMap(t, `{"spec": {"replicas": 1}}`)
+	desired := toJSONMap(t, `{"spec": {"replicas": 3}}`)
+	want := toJSONMap(t, `{"spec": {"replicas": 3, "external": true}}`)
+
+	for i := 0; i < 3; i++ {
+		got, err := MergeWithOptions(observed, lastApplied, desired, opts)
+		if err != nil {
+			t.Fatalf("MergeWithOptions error: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("MergeWithOptions() = %#v, want %#v", got, want)
+		}
+		// mutating the result must not corrupt the cache
+		got["mutated"] = true
+	}
+	if hits, misses := cache.Stats(); hits != 2 || misses != 1 {
+		t.Errorf("got hits %d misses %d, want hits 2 misses 1", hits, misses)
+	}
+
+	// different content is a miss
+	other := toJSONMap(t, `{"spec": {"replicas": 5}}`)
+	if _, err := MergeWithOptions(observed, lastApplied, other, opts); err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	if hits, misses := cache.Stats(); hits != 2 || misses != 2 {
+		t.Errorf("got hits %d misses %d, want hits 2 misses 2", hits, misses)
+	}
+
+	// least recently used result is evicted
+	another := toJSONMap(t, `{"spec": {"replicas": 7}}`)
+	if _, err := MergeWithOptions(observed, lastApplied, another, opts); err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	if cache.Len() != 2 {
+		t.Errorf("got cache len %d, want 2", cache.Len())
+	}
+	if _, err := MergeWithOptions(observed, lastApplied, desired, opts); err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	if hits, misses := cache.Stats(); hits != 2 || misses != 4 {
+		t.Errorf("got hits %d misses %d, want hits 2 misses 4", hits, misses)
+	}
+}
+
+// benchmarkMergeCacheInputs returns a reasonably large list map based
+// merge input
+func benchmarkMergeCacheInputs(b *testing.B) (observed, lastApplied, desired map[string]interface{}) {
+	obj := toUnstruct(b, testObservedJSON).UnstructuredContent()
+	des := toUnstruct(b, testDesiredJSON).UnstructuredContent()
+	last, err := GetLastApplied(toUnstruct(b, testObservedJSON))
+	if err != nil {
+		b.Fatalf("GetLastApplied error: %v", err)
+	}
+	return obj, last, des
+}
+
+func BenchmarkMergeWithoutCache(b *testing.B) {
+	observed, lastApplied, desired := benchmarkMergeCacheInputs(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := MergeWithOptions(observed, lastApplied, desired, nil); err != nil {
+			b.Fatalf("MergeWithOptions error: %v", err)
+		}
+	}
+}
+
+func BenchmarkMergeWithCache(b *testing.B) {
+	observed, lastApplied, desired := benchmarkMergeCacheInputs(b)
+	opts := &MergeOptions{Cache: NewMergeCache(10)}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := MergeWithOptions(observed, lastApplied, desired, opts); err != nil {
+			b.Fatalf("MergeWithOptions error: %v", err)
+		}
+	}
+	if hits, _ := opts.Cache.Stats(); hits != b.N-1 {
+		b.Errorf("got hits %d, want %d", hits, b.N-1)
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	stdjson "encoding/json"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValueComparator returns true if the given observed & desired scalar
+// values are semantically equal
+type ValueComparator func(observed, desired interface{}) bool
+
+// CompareDurations is a ValueComparator for duration strings e.g.
+// `1m` & `60s` are equal. Values that are not valid durations are
+// never equal.
+func CompareDurations(observed, desired interface{}) bool {
+	obsStr, ok := observed.(string)
+	if !ok {
+		return false
+	}
+	desStr, ok := desired.(string)
+	if !ok {
+		return false
+	}
+	obsDuration, err := time.ParseDuration(obsStr)
+	if err != nil {
+		return false
+	}
+	desDuration, err := time.ParseDuration(desStr)
+	if err != nil {
+		return false
+	}
+	return obsDuration == desDuration
+}
+
+// CompareParsed returns a ValueComparator for strings that hold
+// serialized structures e.g. YAML, TOML or INI. Both the strings are
+// parsed to their canonical forms via the given parse function & are
+// equal if their canonical forms are deeply equal. Values that are
+// not strings or fail to parse are never equal.
+//
+// Observed value is kept as is if it is equal to desired. This avoids
+// churn due to formatting differences e.g. order of keys.
+func CompareParsed(parse func(string) (interface{}, error)) ValueComparator {
+	return func(observed, desired interface{}) bool {
+		obsStr, ok := observed.(string)
+		if !ok {
+			return false
+		}
+		desStr, ok := desired.(string)
+		if !ok {
+			return false
+		}
+		obsVal, err := parse(obsStr)
+		if err != nil {
+			return false
+		}
+		desVal, err := parse(desStr)
+		if err != nil {
+			return false
+		}
+		return reflect.DeepEqual(obsVal, desVal)
+	}
+}
+
+// parseBooleanLike returns the boolean meaning of the given value. The
+// recognized spellings are `true` & `false`, `yes` & `no`, `on` & `off`,
+// `y` & `n` as well as `1` & `0` irrespective of their case. Boolean
+// values are recognized as well. It returns false if the value has no
+// boolean meaning.
+func parseBooleanLike(val interface{}) (bool, bool) {
+	switch tval := val.(type) {
+	case bool:
+		return tval, true
+	case string:
+		switch strings.ToLower(tval) {
+		case "true", "yes", "on", "y", "1":
+			return true, true
+		case "false", "no", "off", "n", "0":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// CompareBooleans is a ValueComparator for boolean like strings e.g.
+// `yes` & `true` are equal. Refer BooleanStringPaths option for the
+// recognized spellings. Values without a boolean meaning are never
+// equal.
+func CompareBooleans(observed, desired interface{}) bool {
+	obsBool, ok := parseBooleanLike(observed)
+	if !ok {
+		return false
+	}
+	desBool, ok := parseBooleanLike(desired)
+	if !ok {
+		return false
+	}
+	return obsBool == desBool
+}
+
+// canonicalBoolean returns the canonical spelling i.e. `true` or
+// `false` of the given desired string if the given field path is
+// configured via BooleanStringPaths. Desired is returned as is
+// otherwise.
+func (m *merger) canonicalBoolean(fieldPath string, desired interface{}) interface{} {
+	if _, isStr := desired.(string); !isStr || !m.hasPath(m.opts.BooleanStringPaths, fieldPath) {
+		return desired
+	}
+	if val, ok := parseBooleanLike(desired); ok {
+		return strconv.FormatBool(val)
+	}
+	return desired
+}
+
+// toBigFloat returns the given number as a big float. Integers are
+// exact irrespective of their size. It returns false if the value is
+// not a number.
+func toBigFloat(val interface{}) (*big.Float, bool) {
+	num := new(big.Float).SetPrec(256)
+	switch tval := val.(type) {
+	case int64:
+		return num.SetInt64(tval), true
+	case float64:
+		return num.SetFloat64(tval), true
+	case stdjson.Number:
+		if strings.ContainsAny(tval.String(), ".eE") {
+			// a fraction or scientific notation is as precise as the
+			// same decoded as a float
+			f, err := tval.Float64()
+			if err != nil {
+				return nil, false
+			}
+			return num.SetFloat64(f), true
+		}
+		if _, ok := num.SetString(tval.String()); ok {
+			return num, true
+		}
+	}
+	return nil, false
+}
+
+// isSameNumber returns true if the given values are numbers of the same
+// value irrespective of their representation e.g. `1e9` decoded as a
+// float & `1000000000` decoded as an integer
+func isSameNumber(observed, desired interface{}) bool {
+	obsNum, ok := toBigFloat(observed)
+	if !ok {
+		return false
+	}
+	desNum, ok := toBigFloat(desired)
+	if !ok {
+		return false
+	}
+	return obsNum.Cmp(desNum) == 0
+}
+
+// isSemanticallyEqual returns true if the given observed & desired
+// values are equal as per the comparator configured for the given
+// field path
+func (m *merger) isSemanticallyEqual(fieldPath string, observed, desired interface{}) bool {
+	if observed == nil || desired == nil {
+		return false
+	}
+	if isSameNumber(observed, desired) {
+		return true
+	}
+	if m.hasPath(m.opts.BooleanStringPaths, fieldPath) && CompareBooleans(observed, desired) {
+		return true
+	}
+	for pattern, compare := range m.opts.Comparators {
+		if m.opts.MatchPath(pattern, fieldPath) && compare(observed, desired) {
+			return true
+		}
+	}
+	return false
+}
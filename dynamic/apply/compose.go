@@ -0,0 +1,89 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// ComposeLastApplied returns the union of the given sources e.g. a
+// template & its overlays. This is meant to be stored as the last
+// applied state via SetLastApplied such that fields dropped from any
+// of the sources get deleted by subsequent merges.
+//
+// Sources are deep merged in the given order without deleting
+// anything. Objects are merged field by field & list maps element by
+// element. Other lists & scalars set by a later source replace those
+// set by an earlier one. The given sources are not modified.
+func ComposeLastApplied(sources ...map[string]interface{}) map[string]interface{} {
+	composed := map[string]interface{}{}
+	for _, source := range sources {
+		composeObject(composed, runtime.DeepCopyJSON(source))
+	}
+	return composed
+}
+
+// composeObject adds the fields of the given source to the given
+// destination
+func composeObject(destination, source map[string]interface{}) {
+	for key, srcVal := range source {
+		destination[key] = composeValue(destination[key], srcVal)
+	}
+}
+
+// composeValue returns the union of the given values
+func composeValue(destination, source interface{}) interface{} {
+	switch srcVal := source.(type) {
+	case map[string]interface{}:
+		destVal, ok := destination.(map[string]interface{})
+		if !ok {
+			return srcVal
+		}
+		composeObject(destVal, srcVal)
+		return destVal
+	case []interface{}:
+		destVal, ok := destination.([]interface{})
+		if !ok {
+			return srcVal
+		}
+		mergeKey := detectListMapKey(destVal, srcVal)
+		if mergeKey == "" {
+			return srcVal
+		}
+		return composeListMap(mergeKey, destVal, srcVal)
+	default:
+		return source
+	}
+}
+
+// composeListMap returns the union of the given list maps. Elements of
+// destination retain their order & new source elements are appended.
+func composeListMap(mergeKey string, destination, source []interface{}) []interface{} {
+	destMap := makeListMap(mergeKey, destination)
+	composed := destination
+	for _, item := range source {
+		srcElem := item.(map[string]interface{})
+		key := stringMergeKey(srcElem[mergeKey])
+		if destElem, found := destMap[key]; found {
+			composeObject(destElem.(map[string]interface{}), srcElem)
+			continue
+		}
+		destMap[key] = srcElem
+		composed = append(composed, srcElem)
+	}
+	return composed
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/diff"
+)
+
+func TestComposeLastApplied(t *testing.T) {
+	template := `{
+		"metadata": {"labels": {"app": "web"}},
+		"spec": {
+			"replicas": 1,
+			"args": ["-v"],
+			"containers": [{"name": "app", "image": "app:1"}]
+		}
+	}`
+	overlay := `{
+		"metadata": {"labels": {"tier": "frontend"}},
+		"spec": {
+			"replicas": 3,
+			"args": ["-q"],
+			"containers": [
+				{"name": "app", "resources": {"limits": {"cpu": "1"}}},
+				{"name": "sidecar", "image": "sidecar:1"}
+			]
+		}
+	}`
+	templateObj := toJSONMap(t, template)
+	overlayObj := toJSONMap(t, overlay)
+
+	got := ComposeLastApplied(templateObj, overlayObj)
+	want := toJSONMap(t, `{
+		"metadata": {"labels": {"app": "web", "tier": "frontend"}},
+		"spec": {
+			"replicas": 3,
+			"args": ["-q"],
+			"containers": [
+				{"name": "app", "image": "app:1", "resources": {"limits": {"cpu": "1"}}},
+				{"name": "sidecar", "image": "sidecar:1"}
+			]
+		}
+	}`)
+	if !reflect.DeepEqual(got, want) {
+		t.Logf("reflect diff: a=got, b=want:\n%s", diff.ObjectReflectDiff(got, want))
+		t.Errorf("ComposeLastApplied() = %#v, want %#v", got, want)
+	}
+	if !reflect.DeepEqual(templateObj, toJSONMap(t, template)) ||
+		!reflect.DeepEqual(overlayObj, toJSONMap(t, overlay)) {
+		t.Errorf("ComposeLastApplied() modified its sources")
+	}
+
+	// a field dropped from the overlay is deleted w.r.t composed state
+	desired := toJSONMap(t, `{
+		"metadata": {"labels": {"app": "web"}},
+		"spec": {"replicas": 3, "args": ["-q"], "containers": [{"name": "app", "image": "app:1"}]}
+	}`)
+	merged, err := Merge(got, got, desired)
+	if err != nil {
+		t.Fatalf("Merge error: %v", err)
+	}
+	if !reflect.DeepEqual(merged, desired) {
+		t.Logf("reflect diff: a=got, b=want:\n%s", diff.ObjectReflectDiff(merged, desired))
+		t.Errorf("Merge() = %#v, want %#v", merged, desired)
+	}
+}
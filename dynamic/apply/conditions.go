@@ -0,0 +1,105 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"reflect"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// conditionsField is the name of the list of conditions
+	conditionsField = "conditions"
+
+	// conditionKeyField identifies a condition
+	conditionKeyField = "type"
+
+	// lastTransitionTimeField is the time a condition last changed
+	// its status
+	lastTransitionTimeField = "lastTransitionTime"
+)
+
+// now returns the current time as per the configured clock
+func (m *merger) now() metav1.Time {
+	if m.opts.Now != nil {
+		return m.opts.Now()
+	}
+	return metav1.Now()
+}
+
+// isConditions returns true if the list currently being merged is a
+// list of conditions whose transitions should be stamped
+func (m *merger) isConditions() bool {
+	return m.opts.StampConditionTransitions &&
+		len(m.path) > 0 && m.path[len(m.path)-1] == conditionsField
+}
+
+// selectConditionKey is a MergeKeySelector that keys conditions by
+// their type
+func selectConditionKey(candidates []string, lists ...[]interface{}) string {
+	for _, candidate := range candidates {
+		if candidate == conditionKeyField {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// conditionStatuses returns the status of each condition of the given
+// list map keyed by the condition's key
+func conditionStatuses(conditions map[string]interface{}) map[string]interface{} {
+	statuses := make(map[string]interface{}, len(conditions))
+	for key, item := range conditions {
+		if condition, ok := item.(map[string]interface{}); ok {
+			statuses[key] = condition["status"]
+		}
+	}
+	return statuses
+}
+
+// stampConditionTransitions sets the last transition time of the
+// merged conditions that were added or changed their status w.r.t the
+// given old statuses. Conditions whose transition time is set by
+// desired are left as is.
+func (m *merger) stampConditionTransitions(
+	merged map[string]interface{},
+	oldStatuses map[string]interface{},
+	desired map[string]interface{},
+) {
+	var stamp string
+	for key, item := range desired {
+		if desCondition, ok := item.(map[string]interface{}); ok {
+			if _, found := desCondition[lastTransitionTimeField]; found {
+				continue
+			}
+		}
+		condition, ok := merged[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		oldStatus, existed := oldStatuses[key]
+		if existed && reflect.DeepEqual(oldStatus, condition["status"]) {
+			continue
+		}
+		if stamp == "" {
+			stamp = m.now().UTC().Format(time.RFC3339)
+		}
+		condition[lastTransitionTimeField] = stamp
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/diff"
+)
+
+func TestMergeStampConditionTransitions(t *testing.T) {
+	clock := metav1.NewTime(time.Date(2019, 10, 1, 10, 0, 0, 0, time.UTC))
+	opts := &MergeOptions{
+		MergeStatus:               true,
+		StampConditionTransitions: true,
+		Now:                       func() metav1.Time { return clock },
+	}
+	observed := toJSONMap(t, `{
+		"status": {
+			"conditions": [
+				{"type": "Ready", "status": "False", "lastTransitionTime": "2019-09-01T00:00:00Z"},
+				{"type": "Synced", "status": "True", "lastTransitionTime": "2019-09-01T00:00:00Z"}
+			]
+		}
+	}`)
+	desired := toJSONMap(t, `{
+		"status": {
+			"conditions": [
+				{"type": "Ready", "status": "True"},
+				{"type": "Synced", "status": "True"},
+				{"type": "Degraded", "status": "False"},
+				{"type": "Paused", "status": "True", "lastTransitionTime": "2019-09-15T00:00:00Z"}
+			]
+		}
+	}`)
+
+	got, err := MergeWithOptions(observed, nil, desired, opts)
+	if err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	want := toJSONMap(t, `{
+		"status": {
+			"conditions": [
+				{"type": "Ready", "status": "True", "lastTransitionTime": "2019-10-01T10:00:00Z"},
+				{"type": "Synced", "status": "True", "lastTransitionTime": "2019-09-01T00:00:00Z"},
+				{"type": "Degraded", "status": "False", "lastTransitionTime": "2019-10-01T10:00:00Z"},
+				{"type": "Paused", "status": "True", "lastTransitionTime": "2019-09-15T00:00:00Z"}
+			]
+		}
+	}`)
+	if !reflect.DeepEqual(got, want) {
+		t.Logf("reflect diff: a=got, b=want:\n%s", diff.ObjectReflectDiff(got, want))
+		t.Errorf("MergeWithOptions() = %#v, want %#v", got, want)
+	}
+	if _, found := desired["status"].(map[string]interface{})["conditions"].([]interface{})[0].(map[string]interface{})[lastTransitionTimeField]; found {
+		t.Errorf("MergeWithOptions() modified desired: %#v", desired)
+	}
+}
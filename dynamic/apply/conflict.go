@@ -0,0 +1,224 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// isConflict returns true if the given observed, last applied &
+// desired scalar values result in a three-way conflict. In other words,
+// the field was changed by some other actor since it was last applied
+// while desired wants to change it as well.
+func isConflict(observed, lastApplied, desired interface{}) bool {
+	if observed == nil || lastApplied == nil || !isScalar(desired) {
+		// either field was not managed before or was
+		// removed by other actor or is not a scalar
+		return false
+	}
+	return !reflect.DeepEqual(observed, lastApplied) &&
+		!reflect.DeepEqual(lastApplied, desired) &&
+		!reflect.DeepEqual(observed, desired)
+}
+
+// isScalar returns true if the given value is neither an object nor
+// a list
+func isScalar(val interface{}) bool {
+	switch val.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	default:
+		return true
+	}
+}
+
+// ScalarListStrategy decides the list to keep when a list of scalars
+// was changed by some other actor since it was last applied while
+// desired wants to change it as well
+type ScalarListStrategy string
+
+const (
+	// ScalarListPreferLonger keeps the list that has more elements
+	// among the observed & desired lists. Desired is kept if both
+	// have the same length.
+	ScalarListPreferLonger ScalarListStrategy = "PreferLonger"
+
+	// ScalarListPreferShorter keeps the list that has fewer elements
+	// among the observed & desired lists. Desired is kept if both
+	// have the same length.
+	ScalarListPreferShorter ScalarListStrategy = "PreferShorter"
+)
+
+// resolveScalarListConflict returns the list to be kept as per the
+// strategy set for the given field path if the given lists of scalars
+// conflict. It returns false if there is no conflict to resolve.
+func (m *merger) resolveScalarListConflict(
+	fieldPath string, observed, lastApplied, desired []interface{},
+) ([]interface{}, bool) {
+	var strategy ScalarListStrategy
+	if pattern, found := m.firstMatchingPattern(m.patterns.scalarListStrategies, fieldPath); found {
+		strategy = m.opts.ScalarListStrategies[pattern]
+	}
+	if strategy == "" || !isScalarList(observed) || !isScalarList(desired) {
+		return nil, false
+	}
+	if lastApplied == nil ||
+		reflect.DeepEqual(observed, lastApplied) ||
+		reflect.DeepEqual(lastApplied, desired) ||
+		reflect.DeepEqual(observed, desired) {
+		return nil, false
+	}
+	switch {
+	case strategy == ScalarListPreferLonger && len(observed) > len(desired):
+		return observed, true
+	case strategy == ScalarListPreferShorter && len(observed) < len(desired):
+		return observed, true
+	default:
+		return desired, true
+	}
+}
+
+// isScalarList returns true if all the elements of the given list are
+// scalars
+func isScalarList(list []interface{}) bool {
+	for _, item := range list {
+		if !isScalar(item) {
+			return false
+		}
+	}
+	return true
+}
+
+// coerceScalar converts the given observed scalar to the type of the
+// given desired scalar. Strings are converted to & from numbers &
+// booleans. Whole floats are converted to integers & integers to
+// floats. It returns error if the observed value can't be converted
+// safely.
+func coerceScalar(observed, desired interface{}) (interface{}, error) {
+	if observed == nil || desired == nil ||
+		reflect.TypeOf(observed) == reflect.TypeOf(desired) {
+		return observed, nil
+	}
+	switch desired.(type) {
+	case int64:
+		switch obsVal := observed.(type) {
+		case string:
+			return strconv.ParseInt(strings.TrimSpace(obsVal), 10, 64)
+		case float64:
+			if obsVal == math.Trunc(obsVal) {
+				return int64(obsVal), nil
+			}
+		}
+	case float64:
+		switch obsVal := observed.(type) {
+		case string:
+			return strconv.ParseFloat(strings.TrimSpace(obsVal), 64)
+		case int64:
+			return float64(obsVal), nil
+		}
+	case bool:
+		if obsVal, ok := observed.(string); ok {
+			return strconv.ParseBool(strings.TrimSpace(obsVal))
+		}
+	case string:
+		switch obsVal := observed.(type) {
+		case int64:
+			return strconv.FormatInt(obsVal, 10), nil
+		case float64:
+			return strconv.FormatFloat(obsVal, 'g', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(obsVal), nil
+		}
+	}
+	return nil, errors.Errorf("Can't convert %T to %T", observed, desired)
+}
+
+// coerceObserved returns the given observed scalar converted to the
+// type of the given desired scalar if coercion is enabled for the
+// given field path. It returns a type mismatch error if the observed
+// value can't be converted.
+func (m *merger) coerceObserved(fieldPath string, observed, desired interface{}) (interface{}, error) {
+	if !isScalar(observed) || !isScalar(desired) {
+		return observed, nil
+	}
+	if !m.opts.CoerceTypes && !m.hasPath(m.opts.CoerceTypePaths, fieldPath) {
+		return observed, nil
+	}
+	coerced, err := coerceScalar(observed, desired)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"%s: Type mismatch: Observed %v: Desired %v",
+			fieldPath,
+			observed,
+			desired,
+		)
+	}
+	return coerced, nil
+}
+
+// coerceShape returns the given value wrapped into a single element
+// list if desired is a list or unwrapped from a single element list if
+// desired is a scalar. It returns false if the value can't be reshaped
+// unambiguously.
+func coerceShape(val, desired interface{}) (interface{}, bool) {
+	if val == nil || desired == nil {
+		return val, true
+	}
+	list, isList := val.([]interface{})
+	_, desIsList := desired.([]interface{})
+	switch {
+	case desIsList && isScalar(val):
+		return []interface{}{val}, true
+	case isScalar(desired) && isList:
+		if len(list) != 1 || !isScalar(list[0]) {
+			return nil, false
+		}
+		return list[0], true
+	}
+	return val, true
+}
+
+// coerceShapes returns the given observed & last applied values
+// reshaped to the shape of the given desired value if shape coercion
+// is enabled for the given field path. It returns a type mismatch error
+// if a value can't be reshaped.
+func (m *merger) coerceShapes(
+	fieldPath string, observed, lastApplied, desired interface{},
+) (interface{}, interface{}, error) {
+	if len(m.opts.CoerceShapePaths) == 0 || !m.hasPath(m.opts.CoerceShapePaths, fieldPath) {
+		return observed, lastApplied, nil
+	}
+	coercedObserved, ok := coerceShape(observed, desired)
+	if !ok {
+		return nil, nil, errors.Errorf(
+			"%s: Type mismatch: Observed %v: Desired %v", fieldPath, observed, desired,
+		)
+	}
+	coercedLastApplied, ok := coerceShape(lastApplied, desired)
+	if !ok {
+		return nil, nil, errors.Errorf(
+			"%s: Type mismatch: Last applied %v: Desired %v", fieldPath, lastApplied, desired,
+		)
+	}
+	return coercedObserved, coercedLastApplied, nil
+}
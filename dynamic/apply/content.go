@@ -0,0 +1,102 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// mergeListByContent merges the given lists by treating the canonical
+// JSON of each element as its identity. Elements of destination are
+// retained unless these were dropped from desired w.r.t last applied
+// state. Desired elements that are not found in destination are then
+// appended in their order.
+func (m *merger) mergeListByContent(
+	fieldPath string,
+	destination, lastApplied, desired []interface{},
+) (interface{}, error) {
+	glog.V(7).Infof("Will try merge list by content for field %q", fieldPath)
+
+	desiredIDs, err := contentIDs(fieldPath, desired)
+	if err != nil {
+		return nil, err
+	}
+	lastAppliedIDs, err := contentIDs(fieldPath, lastApplied)
+	if err != nil {
+		return nil, err
+	}
+	destIDs, err := contentIDs(fieldPath, destination)
+	if err != nil {
+		return nil, err
+	}
+
+	inDesired := make(map[string]bool, len(desiredIDs))
+	for _, id := range desiredIDs {
+		inDesired[id] = true
+	}
+	dropped := make(map[string]bool, len(lastAppliedIDs))
+	patchOnly := m.isPatchOnly(fieldPath)
+	for _, id := range lastAppliedIDs {
+		if !inDesired[id] && !patchOnly {
+			dropped[id] = true
+		}
+	}
+
+	merged := make([]interface{}, 0, len(destination)+len(desired))
+	added := make(map[string]bool, len(destination)+len(desired))
+	for idx, item := range destination {
+		id := destIDs[idx]
+		if added[id] {
+			continue
+		}
+		elemPath := fmt.Sprintf("%s[%s]", fieldPath, id)
+		if dropped[id] && !m.deferDeletion(elemPath, item, true) {
+			m.recordChange(elemPath, ReasonListElementRemoved, item, nil)
+			continue
+		}
+		merged = append(merged, item)
+		added[id] = true
+	}
+	for idx, item := range desired {
+		id := desiredIDs[idx]
+		if added[id] {
+			continue
+		}
+		m.recordChange(fmt.Sprintf("%s[%s]", fieldPath, id), ReasonListElementAdded, nil, item)
+		merged = append(merged, item)
+		added[id] = true
+	}
+	return merged, nil
+}
+
+// contentIDs returns the canonical JSON of each element of the given
+// list found at the given field path
+func contentIDs(fieldPath string, list []interface{}) ([]string, error) {
+	ids := make([]string, 0, len(list))
+	for idx, item := range list {
+		raw, err := json.Marshal(item)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s[%d]: Can't merge list by content", fieldPath, idx)
+		}
+		ids = append(ids, string(raw))
+	}
+	return ids, nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package crd derives merge options of package apply from custom
+// resource definitions. It is kept separate from package apply so that
+// apply does not depend on apiextensions.
+package crd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+// ListMapKeysFromCRD returns the list map keys declared via
+// x-kubernetes-list-map-keys in the schema of the given version of the
+// CRD. These are keyed by field paths & can be set as ListMapKeys of
+// apply.MergeOptions.
+//
+// Elements of list maps & values of additional properties are
+// represented by `*` segments in the returned field paths.
+func ListMapKeysFromCRD(
+	crd *apiextensionsv1.CustomResourceDefinition, version string,
+) (map[string][]string, error) {
+	if crd == nil {
+		return nil, errors.Errorf("Can't get list map keys: Nil CRD")
+	}
+	for _, ver := range crd.Spec.Versions {
+		if ver.Name != version {
+			continue
+		}
+		if ver.Schema == nil || ver.Schema.OpenAPIV3Schema == nil {
+			return nil, errors.Errorf(
+				"Can't get list map keys: CRD %q: Version %q has no schema",
+				crd.GetName(),
+				version,
+			)
+		}
+		keys := map[string][]string{}
+		walkSchema(nil, ver.Schema.OpenAPIV3Schema, keys)
+		return keys, nil
+	}
+	return nil, errors.Errorf(
+		"Can't get list map keys: CRD %q: Version %q not found",
+		crd.GetName(),
+		version,
+	)
+}
+
+// walkSchema collects the list map keys of the given schema & its
+// nested schemas
+func walkSchema(path []string, schema *apiextensionsv1.JSONSchemaProps, keys map[string][]string) {
+	for name := range schema.Properties {
+		prop := schema.Properties[name]
+		walkSchema(append(path[:len(path):len(path)], name), &prop, keys)
+	}
+	if schema.AdditionalProperties != nil && schema.AdditionalProperties.Schema != nil {
+		walkSchema(append(path[:len(path):len(path)], "*"), schema.AdditionalProperties.Schema, keys)
+	}
+	if schema.Type != "array" || schema.XListType == nil || *schema.XListType != "map" {
+		// elements of other lists are replaced as a whole during merge
+		return
+	}
+	if len(schema.XListMapKeys) == 0 || len(path) == 0 {
+		return
+	}
+	keys[toFieldPath(path)] = schema.XListMapKeys
+	if schema.Items != nil && schema.Items.Schema != nil {
+		walkSchema(append(path[:len(path):len(path)], "*"), schema.Items.Schema, keys)
+	}
+}
+
+// toFieldPath returns the field path of the given segments in the
+// format used by package apply
+func toFieldPath(segments []string) string {
+	return fmt.Sprintf("[%s]", strings.Join(segments, "]["))
+}
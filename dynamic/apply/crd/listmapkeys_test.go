@@ -0,0 +1,107 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crd
+
+import (
+	"reflect"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+const testCRDJSON = `{
+	"apiVersion": "apiextensions.k8s.io/v1",
+	"kind": "CustomResourceDefinition",
+	"metadata": {"name": "pools.example.com"},
+	"spec": {
+		"group": "example.com",
+		"versions": [{
+			"name": "v1",
+			"served": true,
+			"storage": true,
+			"schema": {
+				"openAPIV3Schema": {
+					"type": "object",
+					"properties": {
+						"spec": {
+							"type": "object",
+							"properties": {
+								"disks": {
+									"type": "array",
+									"x-kubernetes-list-type": "map",
+									"x-kubernetes-list-map-keys": ["node", "device"],
+									"items": {
+										"type": "object",
+										"properties": {
+											"node": {"type": "string"},
+											"device": {"type": "string"},
+											"partitions": {
+												"type": "array",
+												"x-kubernetes-list-type": "map",
+												"x-kubernetes-list-map-keys": ["id"],
+												"items": {"type": "object"}
+											}
+										}
+									}
+								},
+								"tags": {
+									"type": "array",
+									"x-kubernetes-list-type": "set",
+									"items": {"type": "string"}
+								},
+								"profiles": {
+									"type": "object",
+									"additionalProperties": {
+										"type": "array",
+										"x-kubernetes-list-type": "map",
+										"x-kubernetes-list-map-keys": ["name"],
+										"items": {"type": "object"}
+									}
+								}
+							}
+						}
+					}
+				}
+			}
+		}]
+	}
+}`
+
+func TestListMapKeysFromCRD(t *testing.T) {
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	if err := json.Unmarshal([]byte(testCRDJSON), crd); err != nil {
+		t.Fatalf("can't unmarshal CRD: %v", err)
+	}
+
+	got, err := ListMapKeysFromCRD(crd, "v1")
+	if err != nil {
+		t.Fatalf("ListMapKeysFromCRD error: %v", err)
+	}
+	want := map[string][]string{
+		"[spec][disks]":                {"node", "device"},
+		"[spec][disks][*][partitions]": {"id"},
+		"[spec][profiles][*]":          {"name"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListMapKeysFromCRD() = %#v, want %#v", got, want)
+	}
+
+	if _, err := ListMapKeysFromCRD(crd, "v2"); err == nil {
+		t.Errorf("ListMapKeysFromCRD(): want error for unknown version, got none")
+	}
+}
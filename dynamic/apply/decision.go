@@ -0,0 +1,171 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Strategies used to merge a field
+const (
+	strategyObject      = "Object"
+	strategyListMap     = "ListMap"
+	strategyContentList = "ContentList"
+	strategyIndexList   = "IndexList"
+	strategyList        = "List"
+	strategyScalar      = "Scalar"
+)
+
+// Actions taken on a field
+const (
+	actionMerge   = "Merge"
+	actionReplace = "Replace"
+	actionSet     = "Set"
+	actionKeep    = "Keep"
+	actionVeto    = "Veto"
+	actionDelete  = "Delete"
+)
+
+// Decision records how a field was merged. Decisions of nested fields
+// are set as its children. This is JSON serializable & can be diffed
+// across versions of a controller to debug merges offline.
+type Decision struct {
+	// Path of the field
+	Path string `json:"path"`
+
+	// ObservedType is the type of the observed value
+	ObservedType string `json:"observedType"`
+
+	// DesiredType is the type of the desired value
+	DesiredType string `json:"desiredType"`
+
+	// Strategy used to merge this field e.g. ListMap
+	Strategy string `json:"strategy,omitempty"`
+
+	// MergeKey used to identify the elements of a list map
+	MergeKey string `json:"mergeKey,omitempty"`
+
+	// Action taken on this field e.g. Merge, Replace or Delete
+	Action string `json:"action"`
+
+	// Children are the decisions of the nested fields sorted by
+	// their paths
+	Children []*Decision `json:"children,omitempty"`
+}
+
+// MergeWithDecisions merges the desired state into the observed state
+// similar to MergeWithOptions. In addition, it returns the tree of the
+// decisions taken by this merge. Cache set in the options, if any, is
+// not used.
+func MergeWithDecisions(
+	observed, lastApplied, desired map[string]interface{},
+	opts *MergeOptions,
+) (map[string]interface{}, *Decision, error) {
+	m := newMerger(opts)
+	m.opts.Cache = nil
+	// root holds the decision of the root field
+	root := &Decision{}
+	m.decision = root
+
+	destination, err := m.run(context.Background(), observed, lastApplied, desired)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(root.Children) == 0 {
+		return destination, nil, nil
+	}
+	root.Children[0].sort()
+	return destination, root.Children[0], nil
+}
+
+// sort sorts the children of this decision & its nested decisions by
+// their paths
+func (d *Decision) sort() {
+	sort.SliceStable(d.Children, func(i, j int) bool {
+		return d.Children[i].Path < d.Children[j].Path
+	})
+	for _, child := range d.Children {
+		child.sort()
+	}
+}
+
+// add adds & returns the decision of the given nested field
+func (d *Decision) add(fieldPath string, observed, desired interface{}) *Decision {
+	child := &Decision{
+		Path:         fieldPath,
+		ObservedType: typeName(observed),
+		DesiredType:  typeName(desired),
+	}
+	d.Children = append(d.Children, child)
+	return child
+}
+
+// decide records the strategy & action of the field currently being
+// merged if decisions are being recorded
+func (m *merger) decide(strategy, mergeKey, action string) {
+	if m.decision == nil {
+		return
+	}
+	m.decision.Strategy = strategy
+	m.decision.MergeKey = mergeKey
+	m.decision.Action = action
+}
+
+// decideScalar records whether the scalar field currently being
+// merged is set or kept as is if decisions are being recorded
+func (m *merger) decideScalar(destination, merged interface{}) {
+	if m.decision == nil {
+		return
+	}
+	action := actionSet
+	if reflect.DeepEqual(destination, merged) {
+		action = actionKeep
+	}
+	m.decide(strategyScalar, "", action)
+}
+
+// decideDeletion records the deletion of the given nested field if
+// decisions are being recorded
+func (m *merger) decideDeletion(fieldPath string, observed interface{}) {
+	if m.decision == nil {
+		return
+	}
+	m.decision.add(fieldPath, observed, nil).Action = actionDelete
+}
+
+// typeName returns the JSON type of the given value
+func typeName(val interface{}) string {
+	switch val.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int64, float64:
+		return "number"
+	default:
+		return fmt.Sprintf("%T", val)
+	}
+}
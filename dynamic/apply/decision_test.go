@@ -0,0 +1,126 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// findDecision returns the decision of the given path from the given
+// decision tree
+func findDecision(d *Decision, fieldPath string) *Decision {
+	if d.Path == fieldPath {
+		return d
+	}
+	for _, child := range d.Children {
+		if found := findDecision(child, fieldPath); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func TestMergeWithDecisions(t *testing.T) {
+	observed := toJSONMap(t, `{
+		"spec": {
+			"containers": [
+				{"name": "app", "image": "app:1", "command": ["run"]},
+				{"name": "sidecar", "image": "sidecar:1"}
+			]
+		}
+	}`)
+	lastApplied := toJSONMap(t, `{
+		"spec": {
+			"containers": [
+				{"name": "app", "image": "app:1", "command": ["run"]}
+			]
+		}
+	}`)
+	desired := toJSONMap(t, `{
+		"spec": {
+			"containers": [
+				{"name": "app", "image": "app:2"}
+			]
+		}
+	}`)
+
+	_, tree, err := MergeWithDecisions(observed, lastApplied, desired, nil)
+	if err != nil {
+		t.Fatalf("MergeWithDecisions error: %v", err)
+	}
+	table := []struct {
+		path string
+		want Decision
+	}{
+		{
+			path: "[spec][containers]",
+			want: Decision{
+				Path:         "[spec][containers]",
+				ObservedType: "array",
+				DesiredType:  "array",
+				Strategy:     strategyListMap,
+				MergeKey:     "name",
+				Action:       actionMerge,
+			},
+		},
+		{
+			path: "[spec][containers][app][command]",
+			want: Decision{
+				Path:         "[spec][containers][app][command]",
+				ObservedType: "array",
+				DesiredType:  "null",
+				Action:       actionDelete,
+			},
+		},
+		{
+			path: "[spec][containers][app][image]",
+			want: Decision{
+				Path:         "[spec][containers][app][image]",
+				ObservedType: "string",
+				DesiredType:  "string",
+				Strategy:     strategyScalar,
+				Action:       actionSet,
+			},
+		},
+	}
+	for _, tc := range table {
+		got := findDecision(tree, tc.path)
+		if got == nil {
+			t.Errorf("%s: got no decision", tc.path)
+			continue
+		}
+		got = &Decision{
+			Path:         got.Path,
+			ObservedType: got.ObservedType,
+			DesiredType:  got.DesiredType,
+			Strategy:     got.Strategy,
+			MergeKey:     got.MergeKey,
+			Action:       got.Action,
+		}
+		if !reflect.DeepEqual(*got, tc.want) {
+			t.Errorf("%s: got decision %#v, want %#v", tc.path, *got, tc.want)
+		}
+	}
+
+	// tree must be JSON serializable
+	if _, err := json.Marshal(tree); err != nil {
+		t.Errorf("can't marshal decision tree: %v", err)
+	}
+}
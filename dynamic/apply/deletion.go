@@ -0,0 +1,65 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// isDeleting returns true if the given object has a deletion timestamp
+func isDeleting(obj map[string]interface{}) bool {
+	timestamp, _, _ := unstructured.NestedString(obj, "metadata", "deletionTimestamp")
+	return timestamp != ""
+}
+
+// finalizersOnly returns the last applied & desired states to be used
+// to merge an object that is being deleted. Only the removal of the
+// finalizers is merged. Finalizers removed from desired since last
+// applied state are removed from observed. Other observed finalizers
+// are retained & new desired finalizers are ignored since these can't
+// be added to an object that is being deleted.
+func finalizersOnly(
+	observed, lastApplied, desired map[string]interface{},
+) (map[string]interface{}, map[string]interface{}) {
+	obsFinalizers, _, _ := unstructured.NestedStringSlice(observed, "metadata", "finalizers")
+	lastFinalizers, _, _ := unstructured.NestedStringSlice(lastApplied, "metadata", "finalizers")
+	desFinalizers, _, _ := unstructured.NestedStringSlice(desired, "metadata", "finalizers")
+
+	desiredSet := make(map[string]bool, len(desFinalizers))
+	for _, finalizer := range desFinalizers {
+		desiredSet[finalizer] = true
+	}
+	removed := make(map[string]bool, len(lastFinalizers))
+	for _, finalizer := range lastFinalizers {
+		if !desiredSet[finalizer] {
+			removed[finalizer] = true
+		}
+	}
+	if len(removed) == 0 || len(obsFinalizers) == 0 {
+		return map[string]interface{}{}, map[string]interface{}{}
+	}
+	retained := make([]interface{}, 0, len(obsFinalizers))
+	for _, finalizer := range obsFinalizers {
+		if !removed[finalizer] {
+			retained = append(retained, finalizer)
+		}
+	}
+	return map[string]interface{}{},
+		map[string]interface{}{
+			"metadata": map[string]interface{}{"finalizers": retained},
+		}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DiffLastApplied compares two last applied states and reports the
+// field paths that entered (addedPaths) or left (removedPaths)
+// management between them.
+//
+// Only paths are reported; a field that is managed in both states is
+// not reported even if its value changed. Paths use the same notation
+// as merge e.g. `[spec][replicas]`. List maps are traversed per element
+// using the element's merge key as the path segment. Any other list is
+// considered as a single managed field.
+func DiffLastApplied(old, new map[string]interface{}) (addedPaths, removedPaths []string) {
+	addedPaths = []string{}
+	removedPaths = []string{}
+	diffManagedPaths("", old, new, &addedPaths, &removedPaths)
+	sort.Strings(addedPaths)
+	sort.Strings(removedPaths)
+	return addedPaths, removedPaths
+}
+
+// diffManagedPaths walks the old & new values found at the given
+// field path & records the leaf paths that are present in only one
+// of them
+func diffManagedPaths(fieldPath string, old, new interface{}, added, removed *[]string) {
+	switch oldVal := old.(type) {
+	case map[string]interface{}:
+		newVal, ok := new.(map[string]interface{})
+		if !ok || len(oldVal) == 0 || len(newVal) == 0 {
+			break
+		}
+		diffManagedMaps(fieldPath, oldVal, newVal, added, removed)
+		return
+	case []interface{}:
+		newVal, ok := new.([]interface{})
+		if !ok {
+			break
+		}
+		mergeKey := detectListMapKey(oldVal, newVal)
+		if mergeKey == "" {
+			break
+		}
+		diffManagedMaps(
+			fieldPath,
+			makeListMap(mergeKey, oldVal),
+			makeListMap(mergeKey, newVal),
+			added,
+			removed,
+		)
+		return
+	}
+	// The shapes differ or this is a leaf. If the shapes differ
+	// then the leaves of one are replaced by the leaves of other.
+	oldLeaves := leafPaths(fieldPath, old, nil)
+	newLeaves := leafPaths(fieldPath, new, nil)
+	oldSet := make(map[string]bool, len(oldLeaves))
+	for _, p := range oldLeaves {
+		oldSet[p] = true
+	}
+	newSet := make(map[string]bool, len(newLeaves))
+	for _, p := range newLeaves {
+		newSet[p] = true
+		if !oldSet[p] {
+			*added = append(*added, p)
+		}
+	}
+	for _, p := range oldLeaves {
+		if !newSet[p] {
+			*removed = append(*removed, p)
+		}
+	}
+}
+
+// diffManagedMaps compares the keys of old & new maps found at the
+// given field path
+func diffManagedMaps(fieldPath string, old, new map[string]interface{}, added, removed *[]string) {
+	for key, oldVal := range old {
+		keyPath := fmt.Sprintf("%s[%s]", fieldPath, key)
+		newVal, present := new[key]
+		if !present {
+			*removed = append(*removed, leafPaths(keyPath, oldVal, nil)...)
+			continue
+		}
+		diffManagedPaths(keyPath, oldVal, newVal, added, removed)
+	}
+	for key, newVal := range new {
+		if _, present := old[key]; present {
+			continue
+		}
+		keyPath := fmt.Sprintf("%s[%s]", fieldPath, key)
+		*added = append(*added, leafPaths(keyPath, newVal, nil)...)
+	}
+}
+
+// leafPaths appends the paths of all the leaf fields found in the
+// given value to the provided list & returns the resulting list
+func leafPaths(fieldPath string, val interface{}, paths []string) []string {
+	switch tval := val.(type) {
+	case map[string]interface{}:
+		if len(tval) == 0 {
+			break
+		}
+		for key, item := range tval {
+			paths = leafPaths(fmt.Sprintf("%s[%s]", fieldPath, key), item, paths)
+		}
+		return paths
+	case []interface{}:
+		mergeKey := detectListMapKey(tval)
+		if mergeKey == "" {
+			break
+		}
+		for key, item := range makeListMap(mergeKey, tval) {
+			paths = leafPaths(fmt.Sprintf("%s[%s]", fieldPath, key), item, paths)
+		}
+		return paths
+	}
+	if fieldPath == "" {
+		// an empty root is not a managed field
+		return paths
+	}
+	return append(paths, fieldPath)
+}
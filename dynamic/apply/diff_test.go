@@ -0,0 +1,101 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+func TestDiffLastApplied(t *testing.T) {
+	table := []struct {
+		name, old, new string
+		wantAdded      []string
+		wantRemoved    []string
+	}{
+		{
+			name:        "empty",
+			old:         `{}`,
+			new:         `{}`,
+			wantAdded:   []string{},
+			wantRemoved: []string{},
+		},
+		{
+			name: "no ownership change",
+			old:  `{"spec": {"replicas": 1}}`,
+			new:  `{"spec": {"replicas": 3}}`,
+
+			wantAdded:   []string{},
+			wantRemoved: []string{},
+		},
+		{
+			name: "newly managed & relinquished fields",
+			old: `{
+				"metadata": {"labels": {"app": "test"}},
+				"spec": {"replicas": 1}
+			}`,
+			new: `{
+				"metadata": {"labels": {"app": "test", "tier": "web"}},
+				"spec": {"paused": true}
+			}`,
+			wantAdded:   []string{"[metadata][labels][tier]", "[spec][paused]"},
+			wantRemoved: []string{"[spec][replicas]"},
+		},
+		{
+			name: "list map elements",
+			old: `{
+				"containers": [
+					{"name": "app", "image": "app:1"},
+					{"name": "sidecar", "image": "sidecar:1"}
+				]
+			}`,
+			new: `{
+				"containers": [
+					{"name": "app", "image": "app:2", "command": ["run"]}
+				]
+			}`,
+			wantAdded: []string{"[containers][app][command]"},
+			wantRemoved: []string{
+				"[containers][sidecar][image]",
+				"[containers][sidecar][name]",
+			},
+		},
+	}
+
+	for _, tc := range table {
+		old := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(tc.old), &old); err != nil {
+			t.Errorf("%v: can't unmarshal tc.old: %v", tc.name, err)
+			continue
+		}
+		new := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(tc.new), &new); err != nil {
+			t.Errorf("%v: can't unmarshal tc.new: %v", tc.name, err)
+			continue
+		}
+
+		added, removed := DiffLastApplied(old, new)
+		if !reflect.DeepEqual(added, tc.wantAdded) {
+			t.Errorf("%v: got added %#v, want %#v", tc.name, added, tc.wantAdded)
+		}
+		if !reflect.DeepEqual(removed, tc.wantRemoved) {
+			t.Errorf("%v: got removed %#v, want %#v", tc.name, removed, tc.wantRemoved)
+		}
+	}
+}
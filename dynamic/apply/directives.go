@@ -0,0 +1,166 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultDirectivePrefix is the prefix of directive keys used
+	// during merge if none is configured
+	defaultDirectivePrefix = "$"
+
+	// patchDirectiveName is the name of patch directive without its
+	// prefix
+	patchDirectiveName = "patch"
+
+	// retainKeysDirectiveName lists the keys of an object to be
+	// retained. This is not implemented by merge.
+	retainKeysDirectiveName = "retainKeys"
+
+	// setElementOrderDirectiveName prefixes the name of the list whose
+	// elements are ordered as per this directive. This is not
+	// implemented by merge.
+	setElementOrderDirectiveName = "setElementOrder/"
+
+	// deleteFromPrimitiveListDirectiveName prefixes the name of the
+	// list whose values are deleted as per this directive. This is not
+	// implemented by merge.
+	deleteFromPrimitiveListDirectiveName = "deleteFromPrimitiveList/"
+)
+
+// validPatchDirectiveValues lists the supported values of patch
+// directive
+var validPatchDirectiveValues = []string{"replace"}
+
+// ValidateDirectives verifies if the directives (in the style of
+// strategic merge patch) found in the desired state are supported by
+// merge. It returns the first unsupported or malformed directive along
+// with its field path. Directives are prefixed with `$`.
+//
+// Only `$patch: replace` is supported. Other values of `$patch` as well
+// as `$retainKeys`, `$setElementOrder/<list>` &
+// `$deleteFromPrimitiveList/<list>` are rejected since merge would
+// otherwise ignore these or set these as data.
+func ValidateDirectives(desired map[string]interface{}) error {
+	return validateDirectives("", desired, defaultDirectivePrefix)
+}
+
+// ValidateDirectivesWithPrefix verifies the directives found in the
+// desired state similar to ValidateDirectives. Directives are prefixed
+// with the given prefix. Refer DirectivePrefix option for details.
+func ValidateDirectivesWithPrefix(desired map[string]interface{}, prefix string) error {
+	if prefix == "" {
+		prefix = defaultDirectivePrefix
+	}
+	return validateDirectives("", desired, prefix)
+}
+
+// validateDirectives verifies the directives with the given prefix
+// found in the given value at the given field path
+func validateDirectives(fieldPath string, val interface{}, prefix string) error {
+	switch tval := val.(type) {
+	case map[string]interface{}:
+		// iterate in a sorted order to report errors deterministically
+		keys := make([]string, 0, len(tval))
+		for key := range tval {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			keyPath := fmt.Sprintf("%s[%s]", fieldPath, key)
+			err := validateDirective(keyPath, key, tval, prefix)
+			if err != nil {
+				return err
+			}
+			err = validateDirectives(keyPath, tval[key], prefix)
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for idx, item := range tval {
+			err := validateDirectives(fmt.Sprintf("%s[%d]", fieldPath, idx), item, prefix)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateDirective verifies the given key of the given object if
+// this key is a directive with the given prefix
+func validateDirective(fieldPath, key string, obj map[string]interface{}, prefix string) error {
+	if !strings.HasPrefix(key, prefix) {
+		return nil
+	}
+	name := strings.TrimPrefix(key, prefix)
+	switch {
+	case name == patchDirectiveName:
+		patch, ok := obj[key].(string)
+		if !ok {
+			return errors.Errorf(
+				"desired%s: Invalid directive: Expecting string, got %T",
+				fieldPath, obj[key],
+			)
+		}
+		for _, valid := range validPatchDirectiveValues {
+			if patch == valid {
+				return nil
+			}
+		}
+		return errors.Errorf(
+			"desired%s: Invalid directive: Unsupported value %q: Want one of %v",
+			fieldPath, patch, validPatchDirectiveValues,
+		)
+	case name == retainKeysDirectiveName,
+		strings.HasPrefix(name, setElementOrderDirectiveName),
+		strings.HasPrefix(name, deleteFromPrimitiveListDirectiveName):
+		return errors.Errorf("desired%s: Invalid directive: Unsupported directive %q", fieldPath, key)
+	}
+	return nil
+}
+
+// patchDirective returns the value of the patch directive set in the
+// given object. An empty string is returned if this directive is not
+// set.
+func (m *merger) patchDirective(obj map[string]interface{}) string {
+	patch, _ := obj[m.opts.DirectivePrefix+patchDirectiveName].(string)
+	return patch
+}
+
+// withoutDirectives returns the given object without its directive
+// keys. The given object is returned as is if it has no directives.
+func (m *merger) withoutDirectives(obj map[string]interface{}) map[string]interface{} {
+	key := m.opts.DirectivePrefix + patchDirectiveName
+	if _, found := obj[key]; !found {
+		return obj
+	}
+	objCopy := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		if k != key {
+			objCopy[k] = v
+		}
+	}
+	return objCopy
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateDirectives(t *testing.T) {
+	table := []struct {
+		name, desired string
+		// wantErr is the expected substring of the error
+		// if empty, no error is expected
+		wantErr string
+	}{
+		{
+			name:    "no directives",
+			desired: `{"spec": {"replicas": 1}}`,
+		},
+		{
+			name:    "well formed directives",
+			desired: `{"spec": {"$patch": "replace", "containers": [{"name": "app"}]}}`,
+		},
+		{
+			name:    "unsupported patch value",
+			desired: `{"spec": {"containers": [{"name": "app", "$patch": "delete"}]}}`,
+			wantErr: `desired[spec][containers][0][$patch]: Invalid directive: Unsupported value "delete"`,
+		},
+		{
+			name:    "bogus patch",
+			desired: `{"spec": {"$patch": "bogus"}}`,
+			wantErr: `desired[spec][$patch]: Invalid directive: Unsupported value "bogus"`,
+		},
+		{
+			name:    "non string patch",
+			desired: `{"spec": {"$patch": true}}`,
+			wantErr: `desired[spec][$patch]: Invalid directive: Expecting string`,
+		},
+		{
+			name:    "retain keys",
+			desired: `{"spec": {"$retainKeys": ["replicas"]}}`,
+			wantErr: `desired[spec][$retainKeys]: Invalid directive: Unsupported directive`,
+		},
+		{
+			name:    "set element order",
+			desired: `{"spec": {"$setElementOrder/containers": [{"name": "app"}], "containers": []}}`,
+			wantErr: `desired[spec][$setElementOrder/containers]: Invalid directive: Unsupported directive`,
+		},
+		{
+			name:    "delete from primitive list",
+			desired: `{"spec": {"$deleteFromPrimitiveList/args": ["-v"]}}`,
+			wantErr: `desired[spec][$deleteFromPrimitiveList/args]: Invalid directive: Unsupported directive`,
+		},
+		{
+			name:    "data keys with other prefix",
+			desired: `{"spec": {"schema": {"$ref": "#/a"}}}`,
+		},
+		{
+			name:    "malformed directive within a list",
+			desired: `{"spec": {"containers": [{"name": "app"}, {"$patch": "bogus"}]}}`,
+			wantErr: `desired[spec][containers][1][$patch]`,
+		},
+	}
+
+	for _, tc := range table {
+		err := ValidateDirectives(toJSONMap(t, tc.desired))
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%v: want no error, got %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%v: want error %q, got none", tc.name, tc.wantErr)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%v: want error %q, got %v", tc.name, tc.wantErr, err)
+		}
+	}
+}
+
+func TestMergeRejectsUnsupportedDirectives(t *testing.T) {
+	observed := toJSONMap(t, `{"spec": {"containers": [{"name": "app"}, {"name": "sidecar"}]}}`)
+	desired := toJSONMap(t, `{"spec": {"containers": [{"name": "app"}, {"name": "sidecar", "$patch": "delete"}]}}`)
+	_, err := Merge(observed, nil, desired)
+	if err == nil || !strings.Contains(err.Error(), `Unsupported value "delete"`) {
+		t.Errorf("Merge(): want unsupported directive error, got %v", err)
+	}
+
+	// directives with other prefixes are data
+	desired = toJSONMap(t, `{"spec": {"$retainKeys": ["a"]}}`)
+	opts := &MergeOptions{DirectivePrefix: "x-metac-"}
+	if _, err = MergeWithOptions(observed, nil, desired, opts); err != nil {
+		t.Errorf("MergeWithOptions(): want no error, got %v", err)
+	}
+	desired = toJSONMap(t, `{"spec": {"x-metac-retainKeys": ["a"]}}`)
+	if _, err = MergeWithOptions(observed, nil, desired, opts); err == nil {
+		t.Errorf("MergeWithOptions(): want unsupported directive error, got none")
+	}
+}
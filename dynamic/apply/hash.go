@@ -0,0 +1,101 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// setHashAnnotations sets the configured hash annotations of the given
+// merged object. Each annotation is set to the hash of the subtree found
+// at its field path. The annotation is removed if the subtree is not
+// found.
+func (m *merger) setHashAnnotations(merged map[string]interface{}) error {
+	if len(m.opts.HashAnnotations) == 0 {
+		return nil
+	}
+	// metadata may be shared with desired & is hence copied
+	metadata, _ := merged["metadata"].(map[string]interface{})
+	metadata = copyMap(metadata)
+	annotations, _ := metadata["annotations"].(map[string]interface{})
+	annotations = copyMap(annotations)
+
+	names := make([]string, 0, len(m.opts.HashAnnotations))
+	for name := range m.opts.HashAnnotations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fieldPath := m.opts.HashAnnotations[name]
+		subtree, found := fieldValue(merged, splitFieldPath(fieldPath))
+		if !found {
+			delete(annotations, name)
+			continue
+		}
+		raw, err := json.Marshal(subtree)
+		if err != nil {
+			return errors.Wrapf(err, "Can't hash %s for annotation %q", fieldPath, name)
+		}
+		annotations[name] = fmt.Sprintf("%x", sha256.Sum256(raw))
+	}
+
+	if len(annotations) == 0 {
+		delete(metadata, "annotations")
+	} else {
+		metadata["annotations"] = annotations
+	}
+	if len(metadata) == 0 {
+		delete(merged, "metadata")
+	} else {
+		merged["metadata"] = metadata
+	}
+	return nil
+}
+
+// fieldValue returns the value found at the given field path segments
+// of the given object. List map elements are looked up by their merge
+// key values.
+func fieldValue(obj interface{}, segments []string) (interface{}, bool) {
+	for _, segment := range segments {
+		switch tval := obj.(type) {
+		case map[string]interface{}:
+			val, found := tval[segment]
+			if !found {
+				return nil, false
+			}
+			obj = val
+		case []interface{}:
+			mergeKey := detectListMapKey(tval)
+			if mergeKey == "" {
+				return nil, false
+			}
+			val, found := makeListMap(mergeKey, tval)[segment]
+			if !found {
+				return nil, false
+			}
+			obj = val
+		default:
+			return nil, false
+		}
+	}
+	return obj, true
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"testing"
+)
+
+func TestMergeHashAnnotations(t *testing.T) {
+	const hashAnnotation = "example.com/template-hash"
+	opts := &MergeOptions{
+		HashAnnotations: map[string]string{
+			hashAnnotation: "[spec][template][spec]",
+		},
+	}
+	hashOf := func(obj map[string]interface{}) string {
+		annotations, _ := obj["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+		hash, _ := annotations[hashAnnotation].(string)
+		return hash
+	}
+	observed := toJSONMap(t, `{
+		"metadata": {"name": "test", "annotations": {"owner": "team-a"}},
+		"spec": {
+			"replicas": 1,
+			"template": {"spec": {"containers": [{"name": "app", "image": "app:1"}]}}
+		}
+	}`)
+	desired := toJSONMap(t, `{
+		"metadata": {"name": "test"},
+		"spec": {
+			"replicas": 1,
+			"template": {"spec": {"containers": [{"name": "app", "image": "app:1"}]}}
+		}
+	}`)
+
+	first, err := MergeWithOptions(observed, desired, desired, opts)
+	if err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	hash := hashOf(first)
+	if hash == "" {
+		t.Fatalf("got no hash annotation in %#v", first)
+	}
+	if owner := first["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})["owner"]; owner != "team-a" {
+		t.Errorf("got owner annotation %v, want team-a", owner)
+	}
+	if _, found := desired["metadata"].(map[string]interface{})["annotations"]; found {
+		t.Errorf("MergeWithOptions() modified desired: %#v", desired)
+	}
+
+	// changes outside the subtree keep the hash
+	scaled := toJSONMap(t, `{
+		"metadata": {"name": "test"},
+		"spec": {
+			"replicas": 3,
+			"template": {"spec": {"containers": [{"name": "app", "image": "app:1"}]}}
+		}
+	}`)
+	got, err := MergeWithOptions(first, desired, scaled, opts)
+	if err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	if hashOf(got) != hash {
+		t.Errorf("got hash %q, want unchanged %q", hashOf(got), hash)
+	}
+
+	// changes to the subtree update the hash
+	updated := toJSONMap(t, `{
+		"metadata": {"name": "test"},
+		"spec": {
+			"replicas": 1,
+			"template": {"spec": {"containers": [{"name": "app", "image": "app:2"}]}}
+		}
+	}`)
+	got, err = MergeWithOptions(first, desired, updated, opts)
+	if err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	if hashOf(got) == hash || hashOf(got) == "" {
+		t.Errorf("got hash %q, want a new hash", hashOf(got))
+	}
+	again, err := MergeWithOptions(first, desired, updated, opts)
+	if err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	if hashOf(again) != hashOf(got) {
+		t.Errorf("got hash %q, want consistent hash %q", hashOf(again), hashOf(got))
+	}
+}
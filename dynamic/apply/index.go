@@ -0,0 +1,209 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// NullElementPolicy decides how a null desired element of a list that
+// is merged by index is handled
+type NullElementPolicy string
+
+const (
+	// NullElementKeep keeps the observed element found at the index
+	// of the null desired element. Null is set if there is no observed
+	// element at this index.
+	NullElementKeep NullElementPolicy = "Keep"
+
+	// NullElementDelete deletes the observed element found at the
+	// index of the null desired element. Elements that follow are
+	// shifted to fill its place.
+	NullElementDelete NullElementPolicy = "Delete"
+)
+
+// mergeListByIndex merges the given lists element by element based on
+// their positions. Each desired element is merged with the destination
+// & last applied elements found at its index. Destination elements
+// beyond the desired elements are removed if these are found in last
+// applied state & are retained otherwise. These are retained as well if
+// the list is found at a patch only path. A removed element that is
+// followed by a retained element is set to null instead so that the
+// retained elements keep their positions.
+func (m *merger) mergeListByIndex(
+	fieldPath string,
+	destination, lastApplied, desired []interface{},
+) (interface{}, error) {
+	glog.V(7).Infof("Will try merge list by index for field %q", fieldPath)
+
+	size := len(destination)
+	if len(desired) > size {
+		size = len(desired)
+	}
+	merged := make([]interface{}, 0, size)
+	// length of merged list without the trailing removed elements
+	var trimmed int
+	patchOnly := m.isPatchOnly(fieldPath)
+	for idx := 0; idx < size; idx++ {
+		elemPath := fmt.Sprintf("%s[%d]", fieldPath, idx)
+		var destVal, lastVal interface{}
+		destExists := idx < len(destination)
+		if destExists {
+			destVal = destination[idx]
+		}
+		if idx < len(lastApplied) {
+			lastVal = lastApplied[idx]
+		}
+
+		if idx >= len(desired) {
+			if idx < len(lastApplied) && !patchOnly && !m.deferDeletion(elemPath, destVal, destExists) {
+				m.recordChange(elemPath, ReasonListElementRemoved, destVal, nil)
+				// placeholder is trimmed unless an element follows
+				merged = append(merged, nil)
+				continue
+			}
+			// element was added by some other actor
+			merged = append(merged, destVal)
+			trimmed = len(merged)
+			continue
+		}
+
+		if desired[idx] == nil {
+			if m.opts.NullListElements == NullElementDelete &&
+				!m.deferDeletion(elemPath, destVal, destExists) {
+				if destExists {
+					m.recordChange(elemPath, ReasonListElementRemoved, destVal, nil)
+				}
+				continue
+			}
+			merged = append(merged, destVal)
+			trimmed = len(merged)
+			continue
+		}
+
+		m.path = append(m.path, strconv.Itoa(idx))
+		newVal, err := m.merge(elemPath, destVal, lastVal, desired[idx])
+		m.path = m.path[:len(m.path)-1]
+		if err != nil {
+			return nil, err
+		}
+		if !destExists {
+			m.recordChange(elemPath, ReasonListElementAdded, nil, newVal)
+		}
+		merged = append(merged, newVal)
+		trimmed = len(merged)
+	}
+	return merged[:trimmed], nil
+}
+
+// isCompactList returns true if null elements of the list found at the
+// given field path should be removed
+func (m *merger) isCompactList(fieldPath string) bool {
+	return m.opts.CompactLists || m.hasPath(m.opts.CompactListPaths, fieldPath)
+}
+
+// compactAllLists removes the null elements of the lists of the given
+// merged state as per the configured options. Only the fields set in
+// the given desired state are compacted since the rest are not merged.
+// Each removed element is recorded as a change.
+func (m *merger) compactAllLists(merged, desired map[string]interface{}) {
+	if !m.opts.CompactLists && len(m.opts.CompactListPaths) == 0 {
+		return
+	}
+	if compacted, changed := m.compactLists("", merged, desired); changed {
+		for key, item := range compacted.(map[string]interface{}) {
+			merged[key] = item
+		}
+	}
+}
+
+// compactLists returns the given value found at the given field path
+// with null elements removed from its lists as per the configured
+// options along with a flag that tells if anything was removed. Fields
+// of objects are compacted only if these are set in the given desired
+// value. Lists are compacted along with all their elements. List map
+// elements are addressed by their keys while other list elements are
+// addressed by their indexes. Objects & lists are copied only if they
+// have nulls. The flag spares the callers from comparing the compacted
+// value with the given value.
+func (m *merger) compactLists(fieldPath string, val, desired interface{}) (interface{}, bool) {
+	switch tval := val.(type) {
+	case map[string]interface{}:
+		desMap, _ := desired.(map[string]interface{})
+		keys := make([]string, 0, len(desMap))
+		for key := range desMap {
+			if _, found := tval[key]; found {
+				keys = append(keys, key)
+			}
+		}
+		// keys are sorted to record the changes in a stable order
+		sort.Strings(keys)
+		var out map[string]interface{}
+		for _, key := range keys {
+			compacted, changed := m.compactLists(
+				fmt.Sprintf("%s[%s]", fieldPath, key), tval[key], desMap[key],
+			)
+			if !changed {
+				continue
+			}
+			if out == nil {
+				out = copyMap(tval)
+			}
+			out[key] = compacted
+		}
+		if out == nil {
+			return tval, false
+		}
+		return out, true
+	case []interface{}:
+		compact := m.isCompactList(fieldPath)
+		mergeKey := m.detectListMapKey(tval)
+		var out []interface{}
+		for idx, item := range tval {
+			if item == nil && compact {
+				if out == nil {
+					out = append(make([]interface{}, 0, len(tval)), tval[:idx]...)
+				}
+				m.recordChange(
+					fmt.Sprintf("%s[%d]", fieldPath, idx), ReasonListElementRemoved, nil, nil,
+				)
+				continue
+			}
+			itemPath := fmt.Sprintf("%s[%d]", fieldPath, idx)
+			if elem, ok := item.(map[string]interface{}); ok && mergeKey != "" {
+				itemPath = fmt.Sprintf("%s[%s]", fieldPath, stringMergeKey(elem[mergeKey]))
+			}
+			// every field of a list element is compacted
+			compacted, changed := m.compactLists(itemPath, item, item)
+			if out == nil && changed {
+				out = append(make([]interface{}, 0, len(tval)), tval[:idx]...)
+			}
+			if out != nil {
+				out = append(out, compacted)
+			}
+		}
+		if out == nil {
+			return tval, false
+		}
+		return out, true
+	}
+	return val, false
+}
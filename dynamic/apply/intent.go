@@ -0,0 +1,242 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// fieldsV1Type is the fields type of managed fields entries whose
+// fields are represented in FieldsV1 format
+const fieldsV1Type = "FieldsV1"
+
+// ManagedFieldsIntent returns the managed fields entry that claims the
+// field paths set in the desired state on behalf of the given manager.
+// This follows the format used by server side apply & hence can be
+// used to transition from metac's apply to server side apply.
+//
+// Top level apiVersion & kind are not claimed since these identify
+// the object. List maps are claimed per element using the element's
+// merge key. Any other list is claimed as a whole. Time of the returned
+// entry is not set since this is an intent rather than a record of an
+// operation.
+func ManagedFieldsIntent(
+	desired map[string]interface{}, manager string,
+) (metav1.ManagedFieldsEntry, error) {
+	fields := make(map[string]interface{}, len(desired))
+	for key, val := range desired {
+		if key == "apiVersion" || key == "kind" {
+			continue
+		}
+		set, err := fieldSet(fmt.Sprintf("[%s]", key), val)
+		if err != nil {
+			return metav1.ManagedFieldsEntry{}, err
+		}
+		fields["f:"+key] = set
+	}
+
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return metav1.ManagedFieldsEntry{},
+			errors.Wrapf(err, "Failed to marshal managed fields of %q", manager)
+	}
+
+	apiVersion, _ := desired["apiVersion"].(string)
+	return metav1.ManagedFieldsEntry{
+		Manager:    manager,
+		Operation:  metav1.ManagedFieldsOperationApply,
+		APIVersion: apiVersion,
+		FieldsType: fieldsV1Type,
+		FieldsV1:   &metav1.FieldsV1{Raw: raw},
+	}, nil
+}
+
+// fieldSet returns the FieldsV1 representation of the given value
+// found at the given field path
+func fieldSet(fieldPath string, val interface{}) (map[string]interface{}, error) {
+	switch tval := val.(type) {
+	case map[string]interface{}:
+		set := make(map[string]interface{}, len(tval))
+		for key, item := range tval {
+			child, err := fieldSet(fmt.Sprintf("%s[%s]", fieldPath, key), item)
+			if err != nil {
+				return nil, err
+			}
+			set["f:"+key] = child
+		}
+		return set, nil
+	case []interface{}:
+		mergeKey := detectListMapKey(tval)
+		if mergeKey == "" {
+			// this list is claimed as a whole
+			return map[string]interface{}{}, nil
+		}
+		set := make(map[string]interface{}, len(tval))
+		for _, item := range tval {
+			itemMap := item.(map[string]interface{})
+			keyJSON, err := json.Marshal(
+				map[string]interface{}{mergeKey: itemMap[mergeKey]},
+			)
+			if err != nil {
+				return nil, errors.Wrapf(
+					err, "%s: Failed to marshal merge key %q", fieldPath, mergeKey,
+				)
+			}
+			child, err := fieldSet(
+				fmt.Sprintf("%s[%s]", fieldPath, stringMergeKey(itemMap[mergeKey])),
+				itemMap,
+			)
+			if err != nil {
+				return nil, err
+			}
+			// the element itself is claimed as well
+			child["."] = map[string]interface{}{}
+			set["k:"+string(keyJSON)] = child
+		}
+		return set, nil
+	default:
+		return map[string]interface{}{}, nil
+	}
+}
+
+// OwnershipConflict is a field claimed by more than one manager
+type OwnershipConflict struct {
+	// Path of the field
+	Path string `json:"path"`
+
+	// Managers claiming this field sorted by their names
+	Managers []string `json:"managers"`
+}
+
+// DetectOwnershipConflicts returns the fields claimed by more than one
+// of the given managed fields intents keyed by their managers. This
+// helps detect controllers that would fight over an object before
+// these are deployed. Conflicts are sorted by their paths.
+//
+// Only the leaf fields are compared. Claims of list map elements & their
+// key fields are ignored since managers may own distinct fields of the
+// same element.
+func DetectOwnershipConflicts(intents map[string]metav1.FieldsV1) ([]OwnershipConflict, error) {
+	owners := map[string][]string{}
+	for manager, fields := range intents {
+		set := map[string]interface{}{}
+		if len(fields.Raw) > 0 {
+			if err := json.Unmarshal(fields.Raw, &set); err != nil {
+				return nil, errors.Wrapf(err, "Failed to unmarshal managed fields of %q", manager)
+			}
+		}
+		paths, err := claimedPaths("", set, nil, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid managed fields of %q", manager)
+		}
+		for _, path := range paths {
+			owners[path] = append(owners[path], manager)
+		}
+	}
+
+	conflicts := []OwnershipConflict{}
+	for path, managers := range owners {
+		if len(managers) < 2 {
+			continue
+		}
+		sort.Strings(managers)
+		conflicts = append(conflicts, OwnershipConflict{Path: path, Managers: managers})
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Path < conflicts[j].Path
+	})
+	return conflicts, nil
+}
+
+// claimedPaths appends the paths of the leaf fields claimed by the given
+// FieldsV1 set found at the given field path & returns the resulting
+// list. Given key fields are skipped.
+func claimedPaths(
+	fieldPath string, set map[string]interface{}, keyFields map[string]bool, paths []string,
+) ([]string, error) {
+	for key, val := range set {
+		if key == "." || keyFields[key] {
+			continue
+		}
+		child, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("%s: Invalid fields entry %q: Got %T", fieldPath, key, val)
+		}
+		var segment string
+		var childKeyFields map[string]bool
+		switch {
+		case strings.HasPrefix(key, "f:"):
+			segment = strings.TrimPrefix(key, "f:")
+		case strings.HasPrefix(key, "k:"):
+			segment, childKeyFields = elementSegment(strings.TrimPrefix(key, "k:"))
+		case strings.HasPrefix(key, "v:"):
+			segment = strings.TrimPrefix(key, "v:")
+		default:
+			return nil, errors.Errorf("%s: Unsupported fields entry %q", fieldPath, key)
+		}
+		childPath := fmt.Sprintf("%s[%s]", fieldPath, segment)
+		if isLeafSet(child) {
+			paths = append(paths, childPath)
+			continue
+		}
+		var err error
+		paths, err = claimedPaths(childPath, child, childKeyFields, paths)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// isLeafSet returns true if the given FieldsV1 set claims no nested
+// fields
+func isLeafSet(set map[string]interface{}) bool {
+	for key := range set {
+		if key != "." {
+			return false
+		}
+	}
+	return true
+}
+
+// elementSegment returns the path segment of the list map element
+// identified by the given JSON key along with the entries of its key
+// fields. A key having a single field results in the value of this
+// field similar to merge. The JSON is used as is otherwise.
+func elementSegment(keyJSON string) (string, map[string]bool) {
+	key := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(keyJSON), &key); err != nil {
+		return keyJSON, nil
+	}
+	keyFields := make(map[string]bool, len(key))
+	for name := range key {
+		keyFields["f:"+name] = true
+	}
+	if len(key) != 1 {
+		return keyJSON, keyFields
+	}
+	for _, val := range key {
+		return stringMergeKey(val), keyFields
+	}
+	return keyJSON, keyFields
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/diff"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+func TestManagedFieldsIntent(t *testing.T) {
+	desired := toJSONMap(t, `{
+		"apiVersion": "apps/v1",
+		"kind": "Deployment",
+		"metadata": {
+			"name": "test",
+			"labels": {"app": "test"}
+		},
+		"spec": {
+			"replicas": 3,
+			"template": {
+				"spec": {
+					"containers": [
+						{"name": "app", "image": "app:1", "args": ["run"]}
+					]
+				}
+			}
+		}
+	}`)
+	wantFields := toJSONMap(t, `{
+		"f:metadata": {
+			"f:name": {},
+			"f:labels": {"f:app": {}}
+		},
+		"f:spec": {
+			"f:replicas": {},
+			"f:template": {
+				"f:spec": {
+					"f:containers": {
+						"k:{\"name\":\"app\"}": {
+							".": {},
+							"f:name": {},
+							"f:image": {},
+							"f:args": {}
+						}
+					}
+				}
+			}
+		}
+	}`)
+
+	got, err := ManagedFieldsIntent(desired, "test-controller")
+	if err != nil {
+		t.Fatalf("ManagedFieldsIntent error: %v", err)
+	}
+	if got.Manager != "test-controller" {
+		t.Errorf("got manager %q, want %q", got.Manager, "test-controller")
+	}
+	if got.Operation != metav1.ManagedFieldsOperationApply {
+		t.Errorf("got operation %q, want %q", got.Operation, metav1.ManagedFieldsOperationApply)
+	}
+	if got.APIVersion != "apps/v1" {
+		t.Errorf("got apiVersion %q, want %q", got.APIVersion, "apps/v1")
+	}
+	if got.FieldsType != "FieldsV1" || got.FieldsV1 == nil {
+		t.Fatalf("got fieldsType %q with fields %v, want FieldsV1", got.FieldsType, got.FieldsV1)
+	}
+
+	gotFields := make(map[string]interface{})
+	if err := json.Unmarshal(got.FieldsV1.Raw, &gotFields); err != nil {
+		t.Fatalf("can't unmarshal FieldsV1: %v", err)
+	}
+	if !reflect.DeepEqual(gotFields, wantFields) {
+		t.Logf("reflect diff: a=got, b=want:\n%s", diff.ObjectReflectDiff(gotFields, wantFields))
+		t.Errorf("got FieldsV1 %s", got.FieldsV1.Raw)
+	}
+}
+
+func TestDetectOwnershipConflicts(t *testing.T) {
+	scaler, err := ManagedFieldsIntent(toJSONMap(t, `{
+		"spec": {"replicas": 3}
+	}`), "scaler")
+	if err != nil {
+		t.Fatalf("ManagedFieldsIntent error: %v", err)
+	}
+	deployer, err := ManagedFieldsIntent(toJSONMap(t, `{
+		"spec": {
+			"replicas": 1,
+			"template": {"spec": {"containers": [{"name": "app", "image": "app:1"}]}}
+		}
+	}`), "deployer")
+	if err != nil {
+		t.Fatalf("ManagedFieldsIntent error: %v", err)
+	}
+	injector, err := ManagedFieldsIntent(toJSONMap(t, `{
+		"spec": {
+			"template": {"spec": {"containers": [{"name": "app", "image": "app:2", "env": [{"name": "PROXY", "value": "on"}]}]}}
+		}
+	}`), "injector")
+	if err != nil {
+		t.Fatalf("ManagedFieldsIntent error: %v", err)
+	}
+
+	got, err := DetectOwnershipConflicts(map[string]metav1.FieldsV1{
+		"scaler":   *scaler.FieldsV1,
+		"deployer": *deployer.FieldsV1,
+		"injector": *injector.FieldsV1,
+	})
+	if err != nil {
+		t.Fatalf("DetectOwnershipConflicts error: %v", err)
+	}
+	want := []OwnershipConflict{
+		{
+			Path:     "[spec][replicas]",
+			Managers: []string{"deployer", "scaler"},
+		},
+		{
+			Path:     "[spec][template][spec][containers][app][image]",
+			Managers: []string{"deployer", "injector"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DetectOwnershipConflicts() = %#v, want %#v", got, want)
+	}
+}
@@ -0,0 +1,293 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// LastAppliedBackend decides how the last applied state of an object
+// is represented in its annotation. Apply & its variants as well as
+// SetLastAppliedWithOptions & GetLastAppliedWithOptions delegate to the
+// backend set in ApplyOptions. SetLastApplied, GetLastApplied & their
+// annotation key variants use the default backend that stores the last
+// applied JSON in the annotation.
+type LastAppliedBackend interface {
+	// Store returns the annotation value that represents the given
+	// last applied JSON of the given object
+	Store(obj *unstructured.Unstructured, lastAppliedJSON []byte) (string, error)
+
+	// Load returns the last applied JSON of the given object that is
+	// represented by the given annotation value
+	Load(obj *unstructured.Unstructured, annValue string) ([]byte, error)
+}
+
+// annotationBackend stores the last applied JSON in the annotation
+// itself. This is the default backend.
+type annotationBackend struct{}
+
+// Store returns the given JSON as is
+func (annotationBackend) Store(obj *unstructured.Unstructured, lastAppliedJSON []byte) (string, error) {
+	return string(lastAppliedJSON), nil
+}
+
+// Load returns the given annotation value as is
+func (annotationBackend) Load(obj *unstructured.Unstructured, annValue string) ([]byte, error) {
+	return []byte(annValue), nil
+}
+
+// lastAppliedRef refers to the last applied state of an object, i.e.
+// the annotation that holds it & the backend that stores it
+type lastAppliedRef struct {
+	annKey  string
+	backend LastAppliedBackend
+
+	// onSelfReference is invoked if the loaded state holds its own
+	// annotation
+	onSelfReference SelfReferenceHandler
+}
+
+// annotationRef returns the reference to the last applied state that
+// is stored as JSON in the given annotation
+func annotationRef(annKey string) lastAppliedRef {
+	return lastAppliedRef{
+		annKey:          annKey,
+		backend:         annotationBackend{},
+		onSelfReference: warnSelfReference,
+	}
+}
+
+// SelfReferenceHandler is invoked when the last applied state of the
+// given object holds the given last applied annotation of its own. This
+// indicates that the last applied state was not sanitized before it was
+// set. Loading the last applied state fails if the handler returns an
+// error. Apply & its variants invoke the handler set in ApplyOptions
+// while GetLastApplied & its variants log a warning.
+type SelfReferenceHandler func(obj *unstructured.Unstructured, annKey string) error
+
+// warnSelfReference logs the self reference & lets the last applied
+// state be loaded. This is the default SelfReferenceHandler.
+func warnSelfReference(obj *unstructured.Unstructured, annKey string) error {
+	glog.Warningf(
+		"%s:%s:%s:%s: Last applied config has its own annotation %q: Was it sanitized?",
+		obj.GetAPIVersion(),
+		obj.GetKind(),
+		obj.GetNamespace(),
+		obj.GetName(),
+		annKey,
+	)
+	return nil
+}
+
+// verifyNoSelfReference returns error if the given last applied state
+// of the given object holds a non empty annotation of the given key &
+// either strict is true or the given handler returns error
+func verifyNoSelfReference(
+	obj *unstructured.Unstructured,
+	lastApplied map[string]interface{},
+	annKey string,
+	strict bool,
+	handler SelfReferenceHandler,
+) error {
+	nested, _, _ := unstructured.NestedString(lastApplied, "metadata", "annotations", annKey)
+	if nested == "" {
+		return nil
+	}
+	if strict {
+		return errors.Errorf("Self referencing last applied config: Has annotation %q", annKey)
+	}
+	return handler(obj, annKey)
+}
+
+// LastAppliedDeleter is implemented by the LastAppliedBackend that
+// stores last applied states outside of the objects. It releases these
+// states once the objects are deleted. Refer DeleteLastApplied.
+type LastAppliedDeleter interface {
+	// Delete releases the last applied state of the given object that
+	// is represented by the given annotation value
+	Delete(obj *unstructured.Unstructured, annValue string) error
+}
+
+// LastAppliedStore stores last applied snapshots outside of the object
+// e.g. in a ConfigMap or Secret
+type LastAppliedStore interface {
+	// Put stores the given snapshot against the given hash
+	Put(hash string, snapshot []byte) error
+
+	// Get returns the snapshot stored against the given hash. It
+	// returns nil if there is no such snapshot.
+	Get(hash string) ([]byte, error)
+
+	// Delete removes the snapshot stored against the given hash. It
+	// is not an error if there is no such snapshot.
+	Delete(hash string) error
+}
+
+// lastAppliedHashPrefix prefixes the annotation values that hold the
+// hash of a last applied snapshot
+const lastAppliedHashPrefix = "sha256:"
+
+// HashStoreBackend stores the last applied snapshot in a store keyed
+// by the hash of the snapshot & the object's kind, namespace & name.
+// The annotation holds only this hash. This keeps the annotations of
+// huge objects small. Since the hash is scoped to the object, objects
+// never share their snapshots.
+//
+// Annotation values that are not hashes are loaded as JSON. This helps
+// migrate objects whose last applied state was stored as JSON.
+//
+// Snapshots are deleted via DeleteLastApplied once their objects are
+// deleted. A backend created via NewHashStoreBackend deletes the stale
+// snapshots of an object as well. Refer NewHashStoreBackend.
+type HashStoreBackend struct {
+	Snapshots LastAppliedStore
+
+	// index if not nil tracks the snapshots stored per object
+	index *snapshotIndex
+}
+
+// NewHashStoreBackend returns a HashStoreBackend that deletes the stale
+// snapshots of an object. Snapshots of an object are tracked in the
+// order these are stored. When a snapshot is loaded, the ones stored
+// before it are no longer referenced by the object & are deleted. The
+// ones stored after it are retained since the loaded object may be
+// stale. Snapshots stored before the backend was created are not
+// tracked & are deleted only via DeleteLastApplied.
+func NewHashStoreBackend(store LastAppliedStore) HashStoreBackend {
+	return HashStoreBackend{
+		Snapshots: store,
+		index:     &snapshotIndex{hashes: map[string][]string{}},
+	}
+}
+
+// snapshotObjectKey returns the key of the given object that scopes the
+// hash of its snapshots
+func snapshotObjectKey(obj *unstructured.Unstructured) string {
+	return fmt.Sprintf("%s:%s:%s", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+}
+
+// Store puts the given JSON in the store & returns its hash
+func (b HashStoreBackend) Store(obj *unstructured.Unstructured, lastAppliedJSON []byte) (string, error) {
+	objKey := snapshotObjectKey(obj)
+	sum := sha256.Sum256(append([]byte(objKey+"\n"), lastAppliedJSON...))
+	hash := lastAppliedHashPrefix + hex.EncodeToString(sum[:])
+	if err := b.Snapshots.Put(hash, lastAppliedJSON); err != nil {
+		return "", errors.Wrapf(err, "Failed to store last applied snapshot %q", hash)
+	}
+	if b.index != nil {
+		b.index.add(objKey, hash)
+	}
+	return hash, nil
+}
+
+// Load returns the JSON stored against the given hash. Snapshots of the
+// given object that were stored before this one are deleted if these
+// are tracked.
+func (b HashStoreBackend) Load(obj *unstructured.Unstructured, annValue string) ([]byte, error) {
+	if !strings.HasPrefix(annValue, lastAppliedHashPrefix) {
+		return []byte(annValue), nil
+	}
+	snapshot, err := b.Snapshots.Get(annValue)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to load last applied snapshot %q", annValue)
+	}
+	if snapshot == nil {
+		return nil, errors.Errorf("Last applied snapshot %q not found", annValue)
+	}
+	if b.index != nil {
+		for _, stale := range b.index.removeBefore(snapshotObjectKey(obj), annValue) {
+			if err := b.Snapshots.Delete(stale); err != nil {
+				// this is retried when the object is deleted
+				glog.Warningf("Failed to delete stale last applied snapshot %q: %v", stale, err)
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+// Delete removes the snapshot of the given object that is referred to
+// by the given hash as well as its other tracked snapshots
+func (b HashStoreBackend) Delete(obj *unstructured.Unstructured, annValue string) error {
+	var hashes []string
+	if b.index != nil {
+		hashes = b.index.removeAll(snapshotObjectKey(obj))
+	}
+	if strings.HasPrefix(annValue, lastAppliedHashPrefix) {
+		hashes = append(hashes, annValue)
+	}
+	for _, hash := range hashes {
+		if err := b.Snapshots.Delete(hash); err != nil {
+			return errors.Wrapf(err, "Failed to delete last applied snapshot %q", hash)
+		}
+	}
+	return nil
+}
+
+// snapshotIndex tracks the hashes of the snapshots of each object in
+// the order these were stored
+type snapshotIndex struct {
+	mu     sync.Mutex
+	hashes map[string][]string
+}
+
+// add tracks the given hash as the latest snapshot of the given object
+func (i *snapshotIndex) add(objKey, hash string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	hashes := i.hashes[objKey]
+	for idx, existing := range hashes {
+		if existing == hash {
+			hashes = append(hashes[:idx:idx], hashes[idx+1:]...)
+			break
+		}
+	}
+	i.hashes[objKey] = append(hashes, hash)
+}
+
+// removeBefore stops tracking the snapshots of the given object that
+// were stored before the given hash & returns them. Nothing is removed
+// if the given hash is not tracked.
+func (i *snapshotIndex) removeBefore(objKey, hash string) []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	hashes := i.hashes[objKey]
+	for idx, existing := range hashes {
+		if existing == hash {
+			i.hashes[objKey] = hashes[idx:]
+			return hashes[:idx:idx]
+		}
+	}
+	return nil
+}
+
+// removeAll stops tracking the snapshots of the given object & returns
+// them
+func (i *snapshotIndex) removeAll(objKey string) []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	hashes := i.hashes[objKey]
+	delete(i.hashes, objKey)
+	return hashes
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+type fakeSnapshotStore map[string][]byte
+
+func (s fakeSnapshotStore) Put(hash string, snapshot []byte) error {
+	s[hash] = snapshot
+	return nil
+}
+
+func (s fakeSnapshotStore) Get(hash string) ([]byte, error) {
+	return s[hash], nil
+}
+
+func (s fakeSnapshotStore) Delete(hash string) error {
+	delete(s, hash)
+	return nil
+}
+
+func TestHashStoreBackend(t *testing.T) {
+	store := fakeSnapshotStore{}
+	ref := lastAppliedRef{
+		annKey:  lastAppliedAnnotation,
+		backend: HashStoreBackend{Snapshots: store},
+	}
+
+	lastApplied := toJSONMap(t, `{"spec": {"replicas": 3, "image": "app:1"}}`)
+	obj := &unstructured.Unstructured{Object: toJSONMap(t, `{"metadata": {"name": "app"}}`)}
+	if err := ref.set(obj, lastApplied); err != nil {
+		t.Fatalf("set error: %v", err)
+	}
+	hash := obj.GetAnnotations()[lastAppliedAnnotation]
+	if !strings.HasPrefix(hash, "sha256:") || len(store) != 1 || store[hash] == nil {
+		t.Fatalf("got annotation %q & store %v, want hash of stored snapshot", hash, store)
+	}
+
+	got, err := ref.get(obj, false)
+	if err != nil {
+		t.Fatalf("get error: %v", err)
+	}
+	if !reflect.DeepEqual(got, lastApplied) {
+		t.Errorf("got last applied %v, want %v", got, lastApplied)
+	}
+
+	// JSON annotations are loaded as is
+	obj.SetAnnotations(map[string]string{lastAppliedAnnotation: `{"spec": {"replicas": 1}}`})
+	got, err = ref.get(obj, false)
+	if err != nil {
+		t.Fatalf("get error: %v", err)
+	}
+	if want := toJSONMap(t, `{"spec": {"replicas": 1}}`); !reflect.DeepEqual(got, want) {
+		t.Errorf("got last applied %v, want %v", got, want)
+	}
+
+	obj.SetAnnotations(map[string]string{lastAppliedAnnotation: "sha256:missing"})
+	if _, err = ref.get(obj, false); err == nil {
+		t.Errorf("got no error, want error for missing snapshot")
+	}
+}
+
+func TestApplyWithLastAppliedBackend(t *testing.T) {
+	store := fakeSnapshotStore{}
+	opts := &ApplyOptions{LastAppliedBackend: HashStoreBackend{Snapshots: store}}
+	desired := &unstructured.Unstructured{
+		Object: toJSONMap(t, `{"metadata": {"name": "app"}, "spec": {"replicas": 3}}`),
+	}
+
+	obj, changed, err := ApplyWithOptions(nil, desired, opts)
+	if err != nil {
+		t.Fatalf("ApplyWithOptions error: %v", err)
+	}
+	hash := obj.GetAnnotations()[lastAppliedAnnotation]
+	if !changed || len(store) != 1 || store[hash] == nil {
+		t.Fatalf("got annotation %q & store %v, want hash of stored snapshot", hash, store)
+	}
+	if _, changed, err = ApplyWithOptions(obj, desired, opts); err != nil || changed {
+		t.Errorf("ApplyWithOptions(): got changed %t & error %v, want no change", changed, err)
+	}
+
+	// other objects are not affected by the backend
+	plain := &unstructured.Unstructured{Object: toJSONMap(t, `{"metadata": {"name": "app"}}`)}
+	if err := SetLastApplied(plain, desired.Object); err != nil {
+		t.Fatalf("SetLastApplied error: %v", err)
+	}
+	if len(store) != 1 || strings.HasPrefix(plain.GetAnnotations()[lastAppliedAnnotation], "sha256:") {
+		t.Errorf("SetLastApplied(): want JSON annotation & store as is, got store %v", store)
+	}
+}
+
+func TestHashStoreBackendDeletesStaleSnapshots(t *testing.T) {
+	store := fakeSnapshotStore{}
+	opts := &ApplyOptions{LastAppliedBackend: NewHashStoreBackend(store)}
+	obj := &unstructured.Unstructured{Object: toJSONMap(t, `{"metadata": {"name": "app"}}`)}
+	other := &unstructured.Unstructured{Object: toJSONMap(t, `{"metadata": {"name": "other"}}`)}
+
+	setLastApplied := func(obj *unstructured.Unstructured, replicas int64) string {
+		lastApplied := map[string]interface{}{
+			"spec": map[string]interface{}{"replicas": replicas},
+		}
+		if err := SetLastAppliedWithOptions(obj, lastApplied, opts); err != nil {
+			t.Fatalf("SetLastAppliedWithOptions error: %v", err)
+		}
+		return obj.GetAnnotations()[lastAppliedAnnotation]
+	}
+	first := setLastApplied(obj, 1)
+	otherHash := setLastApplied(other, 1)
+	if first == otherHash {
+		t.Fatalf("got same hash %q for different objects, want hashes scoped to objects", first)
+	}
+	stale := obj.DeepCopy()
+	second := setLastApplied(obj, 2)
+
+	// a stale object does not delete the snapshots stored after it
+	if _, err := GetLastAppliedWithOptions(stale, opts); err != nil {
+		t.Fatalf("GetLastAppliedWithOptions error: %v", err)
+	}
+	if store[first] == nil || store[second] == nil {
+		t.Fatalf("got store %v, want both snapshots retained", store)
+	}
+
+	got, err := GetLastAppliedWithOptions(obj, opts)
+	if err != nil {
+		t.Fatalf("GetLastAppliedWithOptions error: %v", err)
+	}
+	if want := toJSONMap(t, `{"spec": {"replicas": 2}}`); !reflect.DeepEqual(got, want) {
+		t.Errorf("got last applied %v, want %v", got, want)
+	}
+	if store[first] != nil || store[second] == nil || store[otherHash] == nil {
+		t.Errorf("got store %v, want only the stale snapshot %q deleted", store, first)
+	}
+
+	if err := DeleteLastApplied(obj, opts); err != nil {
+		t.Fatalf("DeleteLastApplied error: %v", err)
+	}
+	if len(store) != 1 || store[otherHash] == nil {
+		t.Errorf("DeleteLastApplied(): got store %v, want snapshots of other object only", store)
+	}
+
+	// last applied state stored in the object has nothing to delete
+	if err := DeleteLastApplied(other, nil); err != nil || len(store) != 1 {
+		t.Errorf("DeleteLastApplied(): got error %v & store %v, want no change", err, store)
+	}
+}
+
+func TestGetLastAppliedSelfReference(t *testing.T) {
+	obj := &unstructured.Unstructured{}
+	obj.SetAnnotations(map[string]string{
+		lastAppliedAnnotation: `{"metadata": {"annotations": {"` +
+			lastAppliedAnnotation + `": "{\"spec\": {}}"}}, "spec": {"replicas": 1}}`,
+	})
+
+	got, err := GetLastApplied(obj)
+	if err != nil {
+		t.Fatalf("GetLastApplied error: %v", err)
+	}
+	if replicas, _, _ := unstructured.NestedInt64(got, "spec", "replicas"); replicas != 1 {
+		t.Errorf("GetLastApplied(): want replicas 1, got %#v", got)
+	}
+
+	_, err = GetLastAppliedStrict(obj)
+	if err == nil || !strings.Contains(err.Error(), "Self referencing last applied config") {
+		t.Errorf("GetLastAppliedStrict(): want self reference error, got %v", err)
+	}
+}
+
+func TestApplyWithSelfReferenceHandler(t *testing.T) {
+	observed := &unstructured.Unstructured{}
+	observed.SetName("app")
+	observed.SetAnnotations(map[string]string{
+		lastAppliedAnnotation: `{"metadata": {"annotations": {"` +
+			lastAppliedAnnotation + `": "{\"spec\": {}}"}}, "spec": {"replicas": 1}}`,
+	})
+	desired := &unstructured.Unstructured{
+		Object: toJSONMap(t, `{"metadata": {"name": "app"}, "spec": {"replicas": 2}}`),
+	}
+
+	var reported []string
+	opts := &ApplyOptions{
+		SelfReferenceHandler: func(obj *unstructured.Unstructured, annKey string) error {
+			reported = append(reported, annKey)
+			return nil
+		},
+	}
+	merged, _, err := ApplyWithOptions(observed, desired, opts)
+	if err != nil {
+		t.Fatalf("ApplyWithOptions error: %v", err)
+	}
+	if !reflect.DeepEqual(reported, []string{lastAppliedAnnotation}) {
+		t.Errorf("SelfReferenceHandler: want %q reported, got %v", lastAppliedAnnotation, reported)
+	}
+
+	// a sanitized snapshot is not reported
+	reported = nil
+	if _, _, err := ApplyWithOptions(merged, desired, opts); err != nil || len(reported) != 0 {
+		t.Errorf("ApplyWithOptions(): want no error & no report, got %v & %v", err, reported)
+	}
+
+	opts.SelfReferenceHandler = func(obj *unstructured.Unstructured, annKey string) error {
+		return errors.Errorf("Not sanitized")
+	}
+	if _, _, err = ApplyWithOptions(observed, desired, opts); err == nil {
+		t.Errorf("ApplyWithOptions(): want error from handler, got none")
+	}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+)
+
+// ChangeEvent describes a change made by a merge
+type ChangeEvent struct {
+	// Path of the changed field
+	Path string
+
+	// Reason categorizes this change
+	Reason ChangeReason
+
+	// OldValue of the field. This is nil if the field was added.
+	OldValue interface{}
+
+	// NewValue of the field. This is nil if the field was removed.
+	NewValue interface{}
+}
+
+// mergeCallKey is the context key of the merge call number
+type mergeCallKey struct{}
+
+// mergeCalls counts the merges that notified their changes
+var mergeCalls uint64
+
+// MergeCallFromContext returns the call number of the merge that
+// notified its changes with the given context. Call numbers increase
+// monotonically across merges. It returns false if the context does
+// not belong to a merge.
+func MergeCallFromContext(ctx context.Context) (uint64, bool) {
+	call, ok := ctx.Value(mergeCallKey{}).(uint64)
+	return call, ok
+}
+
+// notifyChanges notifies the changes of this merge if OnChange option
+// is set
+func (m *merger) notifyChanges(ctx context.Context) {
+	if m.opts.OnChange == nil {
+		return
+	}
+	ctx = context.WithValue(ctx, mergeCallKey{}, atomic.AddUint64(&mergeCalls, 1))
+	sort.SliceStable(m.events, func(i, j int) bool {
+		return m.events[i].Path < m.events[j].Path
+	})
+	for _, event := range m.events {
+		m.opts.OnChange(ctx, event)
+	}
+	m.events = nil
+}
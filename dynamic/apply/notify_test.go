@@ -0,0 +1,122 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestMergeOnChange(t *testing.T) {
+	observed := toJSONMap(t, `{
+		"metadata": {"creationTimestamp": "2019-10-01T10:00:00Z"},
+		"spec": {"replicas": 1, "paused": true}
+	}`)
+	lastApplied := toJSONMap(t, `{"spec": {"replicas": 1, "paused": true}}`)
+	desired := toJSONMap(t, `{
+		"metadata": {"creationTimestamp": null},
+		"spec": {"replicas": 2, "image": "app:1"}
+	}`)
+
+	var events []ChangeEvent
+	var calls []uint64
+	opts := &MergeOptions{
+		OnChange: func(ctx context.Context, event ChangeEvent) {
+			call, ok := MergeCallFromContext(ctx)
+			if !ok {
+				t.Errorf("want merge call in context, got none")
+			}
+			calls = append(calls, call)
+			events = append(events, event)
+		},
+	}
+	if _, err := MergeWithOptions(observed, lastApplied, desired, opts); err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	want := []ChangeEvent{
+		{Path: "[spec][image]", Reason: ReasonFieldAdded, NewValue: "app:1"},
+		{Path: "[spec][paused]", Reason: ReasonFieldRemoved, OldValue: true},
+		{Path: "[spec][replicas]", Reason: ReasonFieldUpdated, OldValue: int64(1), NewValue: int64(2)},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events %#v, want %#v", events, want)
+	}
+	if len(calls) != 3 || calls[0] != calls[1] || calls[1] != calls[2] {
+		t.Fatalf("got calls %v, want 3 events of the same call", calls)
+	}
+
+	// call number increases across merges
+	first := calls[0]
+	calls = nil
+	if _, err := MergeWithOptions(observed, lastApplied, desired, opts); err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	if len(calls) == 0 || calls[0] <= first {
+		t.Errorf("got calls %v, want calls after %d", calls, first)
+	}
+}
+
+func TestMergeVariantsOnChangeAndTracing(t *testing.T) {
+	observed := toJSONMap(t, `{"kind": "Test", "spec": {"replicas": 1}}`)
+	lastApplied := toJSONMap(t, `{"spec": {"replicas": 1}}`)
+	desired := toJSONMap(t, `{"kind": "Test", "spec": {"replicas": 2}}`)
+
+	var tests = map[string]func(opts *MergeOptions) error{
+		"merge with stats": func(opts *MergeOptions) error {
+			_, _, err := MergeWithStats(observed, lastApplied, desired, opts)
+			return err
+		},
+		"merge with decisions": func(opts *MergeOptions) error {
+			_, _, err := MergeWithDecisions(observed, lastApplied, desired, opts)
+			return err
+		},
+		"merge with deletion review": func(opts *MergeOptions) error {
+			_, _, err := MergeWithDeletionReview(observed, lastApplied, desired, opts)
+			return err
+		},
+	}
+	for name, merge := range tests {
+		name := name
+		merge := merge
+		t.Run(name, func(t *testing.T) {
+			var events []ChangeEvent
+			tracer := &fakeTracer{}
+			opts := &MergeOptions{
+				Tracer: tracer,
+				OnChange: func(ctx context.Context, event ChangeEvent) {
+					events = append(events, event)
+				},
+			}
+			if err := merge(opts); err != nil {
+				t.Fatalf("Expected no error: Got %v", err)
+			}
+			want := []ChangeEvent{
+				{Path: "[spec][replicas]", Reason: ReasonFieldUpdated, OldValue: int64(1), NewValue: int64(2)},
+			}
+			if !reflect.DeepEqual(events, want) {
+				t.Fatalf("Expected events %#v: Got %#v", want, events)
+			}
+			if len(tracer.spans) != 1 || !tracer.spans[0].ended {
+				t.Fatalf("Expected 1 ended span: Got %+v", tracer.spans)
+			}
+			if got := tracer.spans[0].attrs[SpanAttrChanges]; got != 1 {
+				t.Fatalf("Expected %s 1: Got %v", SpanAttrChanges, got)
+			}
+		})
+	}
+}
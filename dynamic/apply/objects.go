@@ -0,0 +1,699 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// MergeObjects merges the desired object into the observed object in
+// the style of kubectl apply. Last applied state is read from observed's
+// annotations.
+//
+// It returns an updated copy of observed that has desired recorded as
+// its new last applied state.
+func MergeObjects(observed, desired *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	return mergeObjectsByRef(observed, desired, annotationRef(lastAppliedAnnotation), nil)
+}
+
+// mergeObjectsByRef merges the desired object into the observed
+// object similar to MergeObjects. Last applied state is read from &
+// recorded as per the given reference. Default merge options are used
+// if the provided merge options is nil.
+func mergeObjectsByRef(
+	observed, desired *unstructured.Unstructured,
+	ref lastAppliedRef,
+	mergeOpts *MergeOptions,
+) (*unstructured.Unstructured, error) {
+	lastApplied, err := ref.get(observed, false)
+	if err != nil {
+		return nil, err
+	}
+	return mergeObjects(observed, lastApplied, desired, ref, mergeOpts)
+}
+
+// mergeObjects merges the desired object into the observed object
+// based on the given last applied state. Desired is recorded as the
+// new last applied state as per the given reference.
+func mergeObjects(
+	observed *unstructured.Unstructured,
+	lastApplied map[string]interface{},
+	desired *unstructured.Unstructured,
+	ref lastAppliedRef,
+	mergeOpts *MergeOptions,
+) (*unstructured.Unstructured, error) {
+	merged, err := MergeWithOptions(
+		observed.UnstructuredContent(), lastApplied, desired.UnstructuredContent(), mergeOpts,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	target := &unstructured.Unstructured{Object: merged}
+	if err := setLastAppliedFromDesired(target, desired, ref); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// AdoptAndMerge merges the desired object into the observed object
+// similar to MergeObjects. It is meant for the first merge of an
+// object that was created by some other actor & is now being managed.
+//
+// An observed object without last applied state is adopted, i.e. its
+// last applied state is treated as empty. Hence, desired fields are
+// added or updated while none of the existing fields get deleted. The
+// desired state is then recorded as the new last applied state.
+func AdoptAndMerge(observed, desired *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	return AdoptAndMergeByAnnKey(observed, desired, lastAppliedAnnotation)
+}
+
+// AdoptAndMergeByAnnKey adopts & merges the desired object into the
+// observed object similar to AdoptAndMerge. Last applied state is read
+// from & recorded in the provided annotation.
+func AdoptAndMergeByAnnKey(
+	observed, desired *unstructured.Unstructured, annKey string,
+) (*unstructured.Unstructured, error) {
+	ref := annotationRef(annKey)
+	lastApplied, err := ref.get(observed, false)
+	if err != nil {
+		return nil, err
+	}
+	if lastApplied == nil {
+		glog.V(4).Infof(
+			"%s:%s:%s:%s: Will adopt object without last applied state",
+			observed.GetAPIVersion(),
+			observed.GetKind(),
+			observed.GetNamespace(),
+			observed.GetName(),
+		)
+		lastApplied = map[string]interface{}{}
+	}
+	return mergeObjects(observed, lastApplied, desired, ref, nil)
+}
+
+// MergeObjectsInto merges the desired object into the observed object
+// the same way MergeObjects does, but writes the result into the
+// provided target instead of allocating a new object.
+//
+// Target's existing map is cleared & reused if it is not nil. Hence,
+// target is overwritten & must not alias observed or desired. Values
+// set in target do not alias observed. However, values that are set
+// from desired may continue to alias desired, same as MergeObjects.
+func MergeObjectsInto(observed, desired, target *unstructured.Unstructured) error {
+	return MergeObjectsIntoByAnnKey(observed, desired, target, lastAppliedAnnotation)
+}
+
+// MergeObjectsIntoByAnnKey merges the desired object into the provided
+// target similar to MergeObjectsInto. Last applied state is read from
+// & recorded in the provided annotation.
+func MergeObjectsIntoByAnnKey(
+	observed, desired, target *unstructured.Unstructured, annKey string,
+) error {
+	if target == nil {
+		return errors.Errorf("Can't merge objects: Nil target")
+	}
+	if target == observed || target == desired ||
+		isSameMap(target.Object, observed.Object) ||
+		isSameMap(target.Object, desired.Object) {
+		return errors.Errorf("Can't merge objects: Target aliases observed or desired")
+	}
+
+	lastApplied, err := GetLastAppliedByAnnKey(observed, annKey)
+	if err != nil {
+		return err
+	}
+
+	// reuse target's map as the merge destination
+	destination := target.Object
+	if destination == nil {
+		destination = make(map[string]interface{}, len(observed.Object))
+	}
+	for key := range destination {
+		delete(destination, key)
+	}
+	for key, val := range observed.Object {
+		destination[key] = runtime.DeepCopyJSONValue(val)
+	}
+	target.Object = destination
+
+	err = newMerger(nil).mergeInto(destination, observed.Object, lastApplied, desired.Object)
+	if err != nil {
+		return err
+	}
+	return setLastAppliedFromDesired(target, desired, annotationRef(annKey))
+}
+
+// ApplyOptions tunes the way Apply works
+type ApplyOptions struct {
+	// CreateOnly when set applies desired only if the object does not
+	// exist yet. An existing object is returned as is & is never
+	// updated. This suits objects that are set & then left for users
+	// to edit.
+	CreateOnly bool
+
+	// RecordDiff when set records the paths changed by the merge as a
+	// JSON list in the last merge diff annotation of the merged object.
+	// The list is capped in size. The annotation is left as is if the
+	// merge changes nothing & is ignored while detecting changes.
+	//
+	// This helps debug merges after the fact without access to logs.
+	RecordDiff bool
+
+	// FinalizersOnlyOnDeletion when set applies only the removal of
+	// finalizers to an object that has a deletion timestamp. Other
+	// desired changes are skipped & the last applied state is left as
+	// is. Hence, Apply reports no update unless finalizers are removed.
+	FinalizersOnlyOnDeletion bool
+
+	// LastAppliedAnnKey when set returns the annotation key that stores
+	// the last applied state of the given object. The object is observed
+	// if it exists & desired otherwise. This lets multiple controllers
+	// manage the same object, each with its own last applied state e.g.
+	// via ControllerLastAppliedAnnKey or a key named by the object's
+	// label. The default key is used if this returns an empty key.
+	LastAppliedAnnKey func(obj *unstructured.Unstructured) string
+
+	// LastAppliedBackend when set stores & loads the last applied state
+	// e.g. via HashStoreBackend. The last applied JSON is stored in the
+	// annotation itself if this is not set.
+	LastAppliedBackend LastAppliedBackend
+
+	// SelfReferenceHandler when set is invoked if the loaded last
+	// applied state holds its own last applied annotation. Apply fails
+	// if the handler returns an error. A warning is logged if this is
+	// not set.
+	SelfReferenceHandler SelfReferenceHandler
+
+	// RedactPaths lists the field paths of sensitive fields whose values
+	// are redacted in merge logs. Refer MergeOptions.RedactPaths.
+	RedactPaths []string
+}
+
+// mergeOptions returns the merge options that apply uses
+func (o *ApplyOptions) mergeOptions() *MergeOptions {
+	return &MergeOptions{RedactPaths: o.RedactPaths}
+}
+
+// lastAppliedRef returns the reference to the last applied state of
+// the given object that is being applied
+func (o *ApplyOptions) lastAppliedRef(observed, desired *unstructured.Unstructured) lastAppliedRef {
+	ref := annotationRef(lastAppliedAnnotation)
+	if o.LastAppliedBackend != nil {
+		ref.backend = o.LastAppliedBackend
+	}
+	if o.SelfReferenceHandler != nil {
+		ref.onSelfReference = o.SelfReferenceHandler
+	}
+	if o.LastAppliedAnnKey == nil {
+		return ref
+	}
+	obj := observed
+	if len(obj.Object) == 0 {
+		obj = desired
+	}
+	if annKey := o.LastAppliedAnnKey(obj); annKey != "" {
+		ref.annKey = annKey
+	}
+	return ref
+}
+
+// ControllerLastAppliedAnnKey returns a LastAppliedAnnKey function that
+// names the last applied annotation after the given controller. The
+// annotation is prefixed with `metac.openebs.io/` like other annotations
+// managed by metac.
+func ControllerLastAppliedAnnKey(controllerName string) func(*unstructured.Unstructured) string {
+	annKey := managedAnnotationPrefix + controllerName + "-last-applied-configuration"
+	return func(*unstructured.Unstructured) string {
+		return annKey
+	}
+}
+
+// ApplyPausedAnnotation when set to "true" on an observed object pauses
+// its management. Apply returns such an object as is & reports that it
+// needs no update irrespective of desired. Removing the annotation
+// resumes the merges. This lets operators debug an object without the
+// controller overwriting their edits.
+const ApplyPausedAnnotation = managedAnnotationPrefix + "apply-paused"
+
+// IsApplyPaused returns true if the given observed object has its
+// management paused via ApplyPausedAnnotation
+func IsApplyPaused(observed *unstructured.Unstructured) bool {
+	return observed != nil && observed.GetAnnotations()[ApplyPausedAnnotation] == "true"
+}
+
+// lastMergeDiffAnnotation records the paths changed by the last merge
+const lastMergeDiffAnnotation = managedAnnotationPrefix + "last-merge-diff"
+
+// maxMergeDiffBytes is the maximum size of the last merge diff
+// annotation's value
+const maxMergeDiffBytes = 1024
+
+// Apply merges the desired object into the observed object & reports
+// whether the merged object differs from observed, i.e. whether it
+// needs to be sent to the server. A nil observed object means the
+// object does not exist yet & hence needs to be created from desired.
+// Observed is returned as is if it has ApplyPausedAnnotation set.
+func Apply(observed, desired *unstructured.Unstructured) (*unstructured.Unstructured, bool, error) {
+	return ApplyWithOptions(observed, desired, nil)
+}
+
+// ApplyWithOptions applies the desired object against the observed
+// object similar to Apply based on the provided options. Default
+// options are used if the provided options is nil.
+func ApplyWithOptions(
+	observed, desired *unstructured.Unstructured,
+	opts *ApplyOptions,
+) (*unstructured.Unstructured, bool, error) {
+	if opts == nil {
+		opts = &ApplyOptions{}
+	}
+	exists := observed != nil && len(observed.Object) > 0
+	if exists && opts.CreateOnly {
+		glog.V(4).Infof(
+			"%s:%s:%s:%s: Will skip apply: Object exists & is create only",
+			observed.GetAPIVersion(),
+			observed.GetKind(),
+			observed.GetNamespace(),
+			observed.GetName(),
+		)
+		return observed, false, nil
+	}
+	if exists && IsApplyPaused(observed) {
+		glog.V(4).Infof(
+			"%s:%s:%s:%s: Will skip apply: Object has %q set",
+			observed.GetAPIVersion(),
+			observed.GetKind(),
+			observed.GetNamespace(),
+			observed.GetName(),
+			ApplyPausedAnnotation,
+		)
+		return observed, false, nil
+	}
+	if !exists {
+		observed = &unstructured.Unstructured{Object: map[string]interface{}{}}
+	}
+	ref := opts.lastAppliedRef(observed, desired)
+	if opts.FinalizersOnlyOnDeletion && isDeleting(observed.Object) {
+		merged, err := mergeFinalizers(observed, desired, ref, opts.mergeOptions())
+		if err != nil {
+			return nil, false, err
+		}
+		return merged, ShouldUpdate(observed, merged), nil
+	}
+	if opts.RecordDiff {
+		merged, err := mergeObjectsWithDiff(observed, desired, ref, opts.mergeOptions())
+		if err != nil {
+			return nil, false, err
+		}
+		return merged, ShouldUpdate(observed, merged), nil
+	}
+	merged, err := mergeObjectsByRef(observed, desired, ref, opts.mergeOptions())
+	if err != nil {
+		return nil, false, err
+	}
+	return merged, ShouldUpdate(observed, merged), nil
+}
+
+// PreparedApply is the result of applying a desired object whose new
+// last applied state is yet to be committed
+type PreparedApply struct {
+	// Object is the merged object. Its last applied annotation is left
+	// as observed.
+	Object *unstructured.Unstructured
+
+	// LastApplied is the new last applied state to be committed via
+	// CommitLastApplied
+	LastApplied map[string]interface{}
+
+	// Changed is true if the object with its new last applied state
+	// differs from observed & hence needs to be sent to the server
+	Changed bool
+}
+
+// PrepareApply merges the desired object into the observed object
+// similar to ApplyWithOptions. However, the new last applied state is
+// returned separately instead of being set in the merged object. This
+// lets the caller commit the new last applied state via
+// CommitLastApplied only when it sends the update. The merged object
+// as well as observed retain the old last applied state if the update
+// is never sent or fails. Default options are used if the provided
+// options is nil.
+//
+// The last applied state is compared as JSON to decide if it changed.
+// Hence, nothing is stored by the last applied backend until the new
+// state is committed.
+func PrepareApply(
+	observed, desired *unstructured.Unstructured,
+	opts *ApplyOptions,
+) (*PreparedApply, error) {
+	if opts == nil {
+		opts = &ApplyOptions{}
+	}
+	exists := observed != nil && len(observed.Object) > 0
+	if !exists {
+		observed = &unstructured.Unstructured{Object: map[string]interface{}{}}
+	}
+	ref := opts.lastAppliedRef(observed, desired)
+	lastApplied, err := ref.get(observed, false)
+	if err != nil {
+		return nil, err
+	}
+	if exists && (opts.CreateOnly || IsApplyPaused(observed)) {
+		// nothing is merged & hence the last applied state is as is
+		return &PreparedApply{Object: observed, LastApplied: lastApplied}, nil
+	}
+	if opts.FinalizersOnlyOnDeletion && isDeleting(observed.Object) {
+		merged, err := mergeFinalizers(observed, desired, ref, opts.mergeOptions())
+		if err != nil {
+			return nil, err
+		}
+		return &PreparedApply{
+			Object:      merged,
+			LastApplied: lastApplied,
+			Changed:     ShouldUpdate(observed, merged),
+		}, nil
+	}
+
+	merged, stats, err := MergeWithStats(
+		observed.UnstructuredContent(),
+		lastApplied,
+		desired.UnstructuredContent(),
+		opts.mergeOptions(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	target := &unstructured.Unstructured{Object: merged}
+	if opts.RecordDiff {
+		if err := setMergeDiff(target, stats.Changes); err != nil {
+			return nil, err
+		}
+	}
+	newLastApplied := runtime.DeepCopyJSON(desired.UnstructuredContent())
+	SanitizeLastAppliedByAnnKey(newLastApplied, ref.annKey)
+
+	lastAppliedChanged, err := isLastAppliedChanged(lastApplied, newLastApplied)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"%s:%s:%s:%s: Failed to compare last applied config",
+			target.GetAPIVersion(),
+			target.GetKind(),
+			target.GetNamespace(),
+			target.GetName(),
+		)
+	}
+	return &PreparedApply{
+		Object:      target,
+		LastApplied: newLastApplied,
+		Changed:     lastAppliedChanged || ShouldUpdate(observed, target),
+	}, nil
+}
+
+// isLastAppliedChanged returns true if the JSON encodings of the given
+// old & new last applied states differ
+func isLastAppliedChanged(oldLastApplied, newLastApplied map[string]interface{}) (bool, error) {
+	if len(newLastApplied) == 0 {
+		// an empty last applied state is never set
+		return false, nil
+	}
+	oldJSON, err := json.Marshal(oldLastApplied)
+	if err != nil {
+		return false, err
+	}
+	newJSON, err := json.Marshal(newLastApplied)
+	if err != nil {
+		return false, err
+	}
+	return string(oldJSON) != string(newJSON), nil
+}
+
+// CommitLastApplied returns a copy of the given object with the given
+// state set as its last applied state. The annotation key is decided by
+// the provided options. Default options are used if the provided
+// options is nil. The given object is not modified.
+func CommitLastApplied(
+	obj *unstructured.Unstructured,
+	lastApplied map[string]interface{},
+	opts *ApplyOptions,
+) (*unstructured.Unstructured, error) {
+	if opts == nil {
+		opts = &ApplyOptions{}
+	}
+	committed := &unstructured.Unstructured{Object: copyMap(obj.Object)}
+	// metadata is copied before the annotation is set
+	if metadata, ok := committed.Object["metadata"].(map[string]interface{}); ok {
+		committed.Object["metadata"] = copyMap(metadata)
+	}
+	if err := opts.lastAppliedRef(obj, obj).set(committed, lastApplied); err != nil {
+		return nil, err
+	}
+	return committed, nil
+}
+
+// mergeFinalizers merges only the removal of finalizers of the desired
+// object into the observed object that is being deleted. The last
+// applied state of observed is retained since desired is not applied.
+// The given merge options are copied & must not be nil.
+func mergeFinalizers(
+	observed, desired *unstructured.Unstructured,
+	ref lastAppliedRef,
+	mergeOpts *MergeOptions,
+) (*unstructured.Unstructured, error) {
+	lastApplied, err := ref.get(observed, false)
+	if err != nil {
+		return nil, err
+	}
+	glog.V(4).Infof(
+		"%s:%s:%s:%s: Will apply finalizers only: Object is being deleted",
+		observed.GetAPIVersion(),
+		observed.GetKind(),
+		observed.GetNamespace(),
+		observed.GetName(),
+	)
+	finalizersOpts := *mergeOpts
+	finalizersOpts.FinalizersOnlyOnDeletion = true
+	merged, err := MergeWithOptions(
+		observed.UnstructuredContent(),
+		lastApplied,
+		desired.UnstructuredContent(),
+		&finalizersOpts,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: merged}, nil
+}
+
+// mergeObjectsWithDiff merges the desired object into the observed
+// object similar to MergeObjects & records the changed paths in the
+// last merge diff annotation of the merged object
+func mergeObjectsWithDiff(
+	observed, desired *unstructured.Unstructured,
+	ref lastAppliedRef,
+	mergeOpts *MergeOptions,
+) (*unstructured.Unstructured, error) {
+	lastApplied, err := ref.get(observed, false)
+	if err != nil {
+		return nil, err
+	}
+	merged, stats, err := MergeWithStats(
+		observed.UnstructuredContent(), lastApplied, desired.UnstructuredContent(), mergeOpts,
+	)
+	if err != nil {
+		return nil, err
+	}
+	target := &unstructured.Unstructured{Object: merged}
+	if err := setLastAppliedFromDesired(target, desired, ref); err != nil {
+		return nil, err
+	}
+	if err := setMergeDiff(target, stats.Changes); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// setMergeDiff records the paths of the given changes in the last merge
+// diff annotation of the given object. The annotation is left as is if
+// there are no changes.
+func setMergeDiff(target *unstructured.Unstructured, changes []Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	diff, err := mergeDiff(changes, maxMergeDiffBytes)
+	if err != nil {
+		return errors.Wrapf(
+			err,
+			"%s:%s:%s:%s: Failed to record merge diff",
+			target.GetAPIVersion(),
+			target.GetKind(),
+			target.GetNamespace(),
+			target.GetName(),
+		)
+	}
+	annotations := target.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[lastMergeDiffAnnotation] = diff
+	target.SetAnnotations(annotations)
+	return nil
+}
+
+// mergeDiff returns the JSON list of the paths of the given changes.
+// Paths that don't fit within the given size are dropped & counted in
+// a trailing entry.
+func mergeDiff(changes []Change, maxBytes int) (string, error) {
+	paths := make([]string, 0, len(changes))
+	for _, change := range changes {
+		paths = append(paths, change.Path)
+	}
+	for kept := len(paths); kept >= 0; kept-- {
+		list := paths[:kept:kept]
+		if kept < len(paths) {
+			list = append(list, fmt.Sprintf("+%d more", len(paths)-kept))
+		}
+		raw, err := json.Marshal(list)
+		if err != nil {
+			return "", err
+		}
+		if len(raw) <= maxBytes || kept == 0 {
+			return string(raw), nil
+		}
+	}
+	return "[]", nil
+}
+
+// ApplyJSON applies the desired object against the observed object
+// similar to Apply. In addition, it returns the JSON encoding of the
+// merged object that is ready to be sent to the server. This encoding
+// is canonical, i.e. object keys are sorted.
+func ApplyJSON(
+	observed, desired *unstructured.Unstructured,
+) (obj *unstructured.Unstructured, body []byte, changed bool, err error) {
+	return ApplyJSONWithOptions(observed, desired, nil)
+}
+
+// ApplyJSONWithOptions applies the desired object against the observed
+// object similar to ApplyJSON based on the provided options. Default
+// options are used if the provided options is nil.
+func ApplyJSONWithOptions(
+	observed, desired *unstructured.Unstructured,
+	opts *ApplyOptions,
+) (obj *unstructured.Unstructured, body []byte, changed bool, err error) {
+	obj, changed, err = ApplyWithOptions(observed, desired, opts)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	body, err = json.Marshal(obj.Object)
+	if err != nil {
+		return nil, nil, false, errors.Wrapf(
+			err,
+			"%s:%s:%s:%s: Failed to marshal merged object",
+			obj.GetAPIVersion(),
+			obj.GetKind(),
+			obj.GetNamespace(),
+			obj.GetName(),
+		)
+	}
+	return obj, body, changed, nil
+}
+
+// setLastAppliedFromDesired records the desired state as the last
+// applied state of the given object as per the given reference
+func setLastAppliedFromDesired(obj, desired *unstructured.Unstructured, ref lastAppliedRef) error {
+	// metadata may alias desired's metadata & hence is copied before
+	// the annotation is set
+	if metadata, ok := obj.Object["metadata"].(map[string]interface{}); ok {
+		obj.Object["metadata"] = copyMap(metadata)
+	}
+	lastApplied := runtime.DeepCopyJSON(desired.UnstructuredContent())
+	SanitizeLastAppliedByAnnKey(lastApplied, ref.annKey)
+	return ref.set(obj, lastApplied)
+}
+
+// isSameMap returns true if both the given maps refer to the same
+// underlying map
+func isSameMap(a, b map[string]interface{}) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+// ShouldUpdate returns true if the merged object differs from the
+// observed object & hence needs to be updated. Server managed fields
+// & the last merge diff annotation are ignored while comparing. It
+// returns false if observed has its management paused.
+func ShouldUpdate(observed, merged *unstructured.Unstructured) bool {
+	if IsApplyPaused(observed) {
+		return false
+	}
+	return !reflect.DeepEqual(
+		withoutManagedFields(observed.UnstructuredContent()),
+		withoutManagedFields(merged.UnstructuredContent()),
+	)
+}
+
+// withoutManagedFields returns a shallow copy of the given object
+// without its server managed fields & the last merge diff annotation.
+// The given object is returned as is if it has none of these.
+func withoutManagedFields(obj map[string]interface{}) map[string]interface{} {
+	metadata, ok := obj["metadata"].(map[string]interface{})
+	if !ok {
+		return obj
+	}
+	annotations, _ := metadata["annotations"].(map[string]interface{})
+	_, hasManagedFields := metadata["managedFields"]
+	_, hasDiff := annotations[lastMergeDiffAnnotation]
+	if !hasManagedFields && !hasDiff {
+		return obj
+	}
+	metaCopy := make(map[string]interface{}, len(metadata))
+	for key, val := range metadata {
+		if key != "managedFields" {
+			metaCopy[key] = val
+		}
+	}
+	if hasDiff {
+		annotationsCopy := make(map[string]interface{}, len(annotations))
+		for key, val := range annotations {
+			if key != lastMergeDiffAnnotation {
+				annotationsCopy[key] = val
+			}
+		}
+		if len(annotationsCopy) == 0 {
+			delete(metaCopy, "annotations")
+		} else {
+			metaCopy["annotations"] = annotationsCopy
+		}
+	}
+	objCopy := make(map[string]interface{}, len(obj))
+	for key, val := range obj {
+		objCopy[key] = val
+	}
+	objCopy["metadata"] = metaCopy
+	return objCopy
+}
@@ -0,0 +1,721 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/diff"
+)
+
+const (
+	testObservedJSON = `{
+		"apiVersion": "apps/v1",
+		"kind": "Deployment",
+		"metadata": {
+			"name": "test",
+			"namespace": "default",
+			"annotations": {
+				"metac.openebs.io/last-applied-configuration": "{\"spec\":{\"replicas\":1,\"paused\":false}}"
+			}
+		},
+		"spec": {
+			"replicas": 1,
+			"paused": false,
+			"template": {
+				"spec": {
+					"containers": [
+						{"name": "app", "image": "app:1"},
+						{"name": "external", "image": "external:1"}
+					]
+				}
+			}
+		}
+	}`
+
+	testDesiredJSON = `{
+		"apiVersion": "apps/v1",
+		"kind": "Deployment",
+		"metadata": {
+			"name": "test",
+			"namespace": "default"
+		},
+		"spec": {
+			"replicas": 3,
+			"template": {
+				"spec": {
+					"containers": [
+						{"name": "app", "image": "app:2"}
+					]
+				}
+			}
+		}
+	}`
+)
+
+// toUnstruct returns a new unstructured instance from the given JSON
+// document
+func toUnstruct(t testing.TB, in string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON([]byte(in)); err != nil {
+		t.Fatalf("can't unmarshal %s: %v", in, err)
+	}
+	return obj
+}
+
+func TestMergeObjectsInto(t *testing.T) {
+	observed := toUnstruct(t, testObservedJSON)
+	desired := toUnstruct(t, testDesiredJSON)
+
+	want, err := MergeObjects(observed, desired)
+	if err != nil {
+		t.Fatalf("MergeObjects error: %v", err)
+	}
+
+	// target has stale content that must be overwritten
+	target := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"stale": "value",
+		},
+	}
+	if err := MergeObjectsInto(observed, desired, target); err != nil {
+		t.Fatalf("MergeObjectsInto error: %v", err)
+	}
+	if !reflect.DeepEqual(target.Object, want.Object) {
+		t.Logf("reflect diff: a=got, b=want:\n%s", diff.ObjectReflectDiff(target.Object, want.Object))
+		t.Errorf("MergeObjectsInto() = %#v, want %#v", target.Object, want.Object)
+	}
+
+	// merging into a nil map must work as well
+	empty := &unstructured.Unstructured{}
+	if err := MergeObjectsInto(observed, desired, empty); err != nil {
+		t.Fatalf("MergeObjectsInto error: %v", err)
+	}
+	if !reflect.DeepEqual(empty.Object, want.Object) {
+		t.Errorf("MergeObjectsInto() = %#v, want %#v", empty.Object, want.Object)
+	}
+
+	// target must not alias observed
+	if err := MergeObjectsInto(observed, desired, observed); err == nil {
+		t.Errorf("MergeObjectsInto(): want error for aliased target, got none")
+	}
+}
+
+func TestAdoptAndMerge(t *testing.T) {
+	observed := toUnstruct(t, `{
+		"apiVersion": "apps/v1",
+		"kind": "Deployment",
+		"metadata": {
+			"name": "test",
+			"labels": {"owner": "someone-else"}
+		},
+		"spec": {
+			"replicas": 1,
+			"paused": true,
+			"template": {
+				"spec": {
+					"containers": [
+						{"name": "external", "image": "external:1"}
+					]
+				}
+			}
+		}
+	}`)
+	desired := toUnstruct(t, testDesiredJSON)
+
+	got, err := AdoptAndMerge(observed, desired)
+	if err != nil {
+		t.Fatalf("AdoptAndMerge error: %v", err)
+	}
+	want := toUnstruct(t, `{
+		"apiVersion": "apps/v1",
+		"kind": "Deployment",
+		"metadata": {
+			"name": "test",
+			"namespace": "default",
+			"labels": {"owner": "someone-else"}
+		},
+		"spec": {
+			"replicas": 3,
+			"paused": true,
+			"template": {
+				"spec": {
+					"containers": [
+						{"name": "external", "image": "external:1"},
+						{"name": "app", "image": "app:2"}
+					]
+				}
+			}
+		}
+	}`)
+	lastApplied, err := GetLastApplied(got)
+	if err != nil {
+		t.Fatalf("GetLastApplied error: %v", err)
+	}
+	if !reflect.DeepEqual(lastApplied, desired.Object) {
+		t.Errorf("got last applied %#v, want %#v", lastApplied, desired.Object)
+	}
+	got.SetAnnotations(nil)
+	if !reflect.DeepEqual(got.Object, want.Object) {
+		t.Logf("reflect diff: a=got, b=want:\n%s", diff.ObjectReflectDiff(got.Object, want.Object))
+		t.Errorf("AdoptAndMerge() = %#v, want %#v", got.Object, want.Object)
+	}
+}
+
+func BenchmarkMergeObjects(b *testing.B) {
+	observed := toUnstruct(b, testObservedJSON)
+	desired := toUnstruct(b, testDesiredJSON)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := MergeObjects(observed, desired); err != nil {
+			b.Fatalf("MergeObjects error: %v", err)
+		}
+	}
+}
+
+func BenchmarkMergeObjectsInto(b *testing.B) {
+	observed := toUnstruct(b, testObservedJSON)
+	desired := toUnstruct(b, testDesiredJSON)
+	target := &unstructured.Unstructured{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := MergeObjectsInto(observed, desired, target); err != nil {
+			b.Fatalf("MergeObjectsInto error: %v", err)
+		}
+	}
+}
+
+func TestMergeObjectsByCustomAnnKey(t *testing.T) {
+	annKey := managedAnnotationPrefix + "test-last-applied-configuration"
+	observed := toUnstruct(t, `{
+		"apiVersion": "v1",
+		"kind": "Test",
+		"metadata": {
+			"name": "test",
+			"annotations": {
+				"metac.openebs.io/test-last-applied-configuration": "{\"spec\":{\"old\":true}}"
+			}
+		},
+		"spec": {"old": true, "other": true}
+	}`)
+	desired := toUnstruct(t, `{
+		"apiVersion": "v1",
+		"kind": "Test",
+		"metadata": {"name": "test"},
+		"spec": {"new": true}
+	}`)
+	want := toJSONMap(t, `{"new": true, "other": true}`)
+
+	adopted, err := AdoptAndMergeByAnnKey(observed, desired, annKey)
+	if err != nil {
+		t.Fatalf("AdoptAndMergeByAnnKey error: %v", err)
+	}
+	target := &unstructured.Unstructured{}
+	if err := MergeObjectsIntoByAnnKey(observed, desired, target, annKey); err != nil {
+		t.Fatalf("MergeObjectsIntoByAnnKey error: %v", err)
+	}
+	opts := &ApplyOptions{LastAppliedAnnKey: ControllerLastAppliedAnnKey("test")}
+	applied, _, _, err := ApplyJSONWithOptions(observed, desired, opts)
+	if err != nil {
+		t.Fatalf("ApplyJSONWithOptions error: %v", err)
+	}
+	for _, got := range []*unstructured.Unstructured{adopted, target, applied} {
+		if !reflect.DeepEqual(got.Object["spec"], want) {
+			t.Errorf("got spec %v, want %v", got.Object["spec"], want)
+		}
+		annotations := got.GetAnnotations()
+		if _, found := annotations[lastAppliedAnnotation]; found || annotations[annKey] == "" {
+			t.Errorf("got annotations %v, want last applied state only in %q", annotations, annKey)
+		}
+	}
+}
+
+func TestApplyJSON(t *testing.T) {
+	observed := toUnstruct(t, testObservedJSON)
+	desired := toUnstruct(t, testDesiredJSON)
+
+	obj, body, changed, err := ApplyJSON(observed, desired)
+	if err != nil {
+		t.Fatalf("ApplyJSON error: %v", err)
+	}
+	if !changed {
+		t.Errorf("ApplyJSON(): got changed false, want true")
+	}
+	decoded := toUnstruct(t, string(body))
+	if !reflect.DeepEqual(decoded.Object, obj.Object) {
+		t.Logf("reflect diff: a=decoded, b=obj:\n%s", diff.ObjectReflectDiff(decoded.Object, obj.Object))
+		t.Errorf("ApplyJSON(): body %s does not match the returned object", body)
+	}
+
+	// applying the same desired state again results in no change
+	_, again, changed, err := ApplyJSON(obj, desired)
+	if err != nil {
+		t.Fatalf("ApplyJSON error: %v", err)
+	}
+	if changed {
+		t.Errorf("ApplyJSON(): got changed true, want false")
+	}
+	if string(again) != string(body) {
+		t.Errorf("ApplyJSON(): got body %s, want canonical body %s", again, body)
+	}
+
+	// create path
+	created, _, changed, err := ApplyJSON(nil, desired)
+	if err != nil {
+		t.Fatalf("ApplyJSON error: %v", err)
+	}
+	if !changed || created.GetName() != "test" {
+		t.Errorf("ApplyJSON(): got changed %t & name %q, want true & test", changed, created.GetName())
+	}
+}
+
+func TestApplyPerControllerLastApplied(t *testing.T) {
+	optsA := &ApplyOptions{LastAppliedAnnKey: ControllerLastAppliedAnnKey("ctrl-a")}
+	optsB := &ApplyOptions{LastAppliedAnnKey: ControllerLastAppliedAnnKey("ctrl-b")}
+	observed := toUnstruct(t, `{"kind": "Deployment", "metadata": {"name": "test"}, "spec": {}}`)
+	desiredA := toUnstruct(t, `{"kind": "Deployment", "metadata": {"name": "test"}, "spec": {"replicas": 3}}`)
+	desiredB := toUnstruct(t, `{"kind": "Deployment", "metadata": {"name": "test"}, "spec": {"paused": true}}`)
+
+	obj, _, err := ApplyWithOptions(observed, desiredA, optsA)
+	if err != nil {
+		t.Fatalf("ApplyWithOptions error: %v", err)
+	}
+	obj, _, err = ApplyWithOptions(obj, desiredB, optsB)
+	if err != nil {
+		t.Fatalf("ApplyWithOptions error: %v", err)
+	}
+	for annKey, want := range map[string]*unstructured.Unstructured{
+		"metac.openebs.io/ctrl-a-last-applied-configuration": desiredA,
+		"metac.openebs.io/ctrl-b-last-applied-configuration": desiredB,
+	} {
+		got, err := GetLastAppliedByAnnKey(obj, annKey)
+		if err != nil {
+			t.Fatalf("GetLastAppliedByAnnKey error: %v", err)
+		}
+		if !reflect.DeepEqual(got, want.Object) {
+			t.Errorf("got last applied %#v at %s, want %#v", got, annKey, want.Object)
+		}
+	}
+	if _, found := obj.GetAnnotations()[lastAppliedAnnotation]; found {
+		t.Errorf("got default last applied annotation, want none")
+	}
+
+	// re-applying the same desired state changes nothing
+	if _, changed, err := ApplyWithOptions(obj, desiredA, optsA); err != nil || changed {
+		t.Errorf("ApplyWithOptions(): got changed %t & error %v, want no change", changed, err)
+	}
+
+	// dropping a field removes it without touching the other's field
+	desiredA = toUnstruct(t, `{"kind": "Deployment", "metadata": {"name": "test"}, "spec": {}}`)
+	obj, _, err = ApplyWithOptions(obj, desiredA, optsA)
+	if err != nil {
+		t.Fatalf("ApplyWithOptions error: %v", err)
+	}
+	want := map[string]interface{}{"paused": true}
+	if got := obj.Object["spec"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got spec %#v, want %#v", got, want)
+	}
+}
+
+func TestApplyCreateOnly(t *testing.T) {
+	observed := toUnstruct(t, testObservedJSON)
+	desired := toUnstruct(t, testDesiredJSON)
+	opts := &ApplyOptions{CreateOnly: true}
+
+	got, changed, err := ApplyWithOptions(observed, desired, opts)
+	if err != nil {
+		t.Fatalf("ApplyWithOptions error: %v", err)
+	}
+	if changed {
+		t.Errorf("ApplyWithOptions(): got changed true, want false for existing object")
+	}
+	if !reflect.DeepEqual(got.Object, toUnstruct(t, testObservedJSON).Object) {
+		t.Errorf("ApplyWithOptions() = %#v, want observed as is", got.Object)
+	}
+
+	got, changed, err = ApplyWithOptions(nil, desired, opts)
+	if err != nil {
+		t.Fatalf("ApplyWithOptions error: %v", err)
+	}
+	if !changed {
+		t.Errorf("ApplyWithOptions(): got changed false, want true for missing object")
+	}
+	lastApplied, err := GetLastApplied(got)
+	if err != nil {
+		t.Fatalf("GetLastApplied error: %v", err)
+	}
+	if !reflect.DeepEqual(lastApplied, desired.Object) {
+		t.Errorf("got last applied %#v, want %#v", lastApplied, desired.Object)
+	}
+	got.SetAnnotations(nil)
+	if !reflect.DeepEqual(got.Object, desired.Object) {
+		t.Errorf("ApplyWithOptions() = %#v, want %#v", got.Object, desired.Object)
+	}
+}
+
+func TestApplyPaused(t *testing.T) {
+	observed := toUnstruct(t, testObservedJSON)
+	ann := observed.GetAnnotations()
+	if ann == nil {
+		ann = map[string]string{}
+	}
+	ann[ApplyPausedAnnotation] = "true"
+	observed.SetAnnotations(ann)
+	desired := toUnstruct(t, testDesiredJSON)
+
+	got, changed, err := Apply(observed, desired)
+	if err != nil {
+		t.Fatalf("Apply error: %v", err)
+	}
+	if changed || !IsApplyPaused(got) {
+		t.Errorf("Apply(): got changed %t, want false for paused object", changed)
+	}
+	if !reflect.DeepEqual(got.Object, observed.Object) {
+		t.Errorf("Apply() = %#v, want observed as is", got.Object)
+	}
+	prepared, err := PrepareApply(observed, desired, nil)
+	if err != nil {
+		t.Fatalf("PrepareApply error: %v", err)
+	}
+	if prepared.Changed || !reflect.DeepEqual(prepared.Object.Object, observed.Object) {
+		t.Errorf("PrepareApply(): got changed %t, want false for paused object", prepared.Changed)
+	}
+
+	// removing the annotation resumes the merges
+	delete(ann, ApplyPausedAnnotation)
+	observed.SetAnnotations(ann)
+	_, changed, err = Apply(observed, desired)
+	if err != nil {
+		t.Fatalf("Apply error: %v", err)
+	}
+	if !changed {
+		t.Errorf("Apply(): got changed false, want true once resumed")
+	}
+}
+
+func TestApplyFinalizersOnlyOnDeletion(t *testing.T) {
+	observed := toUnstruct(t, `{
+		"apiVersion": "v1",
+		"kind": "Test",
+		"metadata": {
+			"name": "test",
+			"deletionTimestamp": "2019-10-01T10:00:00Z",
+			"finalizers": ["other.io/cleanup", "test.io/cleanup"],
+			"annotations": {
+				"metac.openebs.io/last-applied-configuration": "{\"metadata\":{\"finalizers\":[\"test.io/cleanup\"]},\"spec\":{\"replicas\":1}}"
+			}
+		},
+		"spec": {"replicas": 1}
+	}`)
+	opts := &ApplyOptions{FinalizersOnlyOnDeletion: true}
+
+	desired := toUnstruct(t, `{
+		"apiVersion": "v1",
+		"kind": "Test",
+		"metadata": {"name": "test", "finalizers": ["test.io/cleanup", "new.io/cleanup"]},
+		"spec": {"replicas": 3}
+	}`)
+	got, changed, err := ApplyWithOptions(observed, desired, opts)
+	if err != nil {
+		t.Fatalf("ApplyWithOptions error: %v", err)
+	}
+	if changed {
+		t.Errorf("ApplyWithOptions(): got changed true, want false for spec change of deleting object")
+	}
+	if !reflect.DeepEqual(got.Object, observed.Object) {
+		t.Errorf("ApplyWithOptions() = %#v, want observed as is", got.Object)
+	}
+
+	desired.SetFinalizers(nil)
+	got, changed, err = ApplyWithOptions(observed, desired, opts)
+	if err != nil {
+		t.Fatalf("ApplyWithOptions error: %v", err)
+	}
+	if !changed {
+		t.Errorf("ApplyWithOptions(): got changed false, want true for finalizer removal")
+	}
+	if finalizers := got.GetFinalizers(); !reflect.DeepEqual(finalizers, []string{"other.io/cleanup"}) {
+		t.Errorf("got finalizers %v, want [other.io/cleanup]", finalizers)
+	}
+	if replicas, _, _ := unstructured.NestedInt64(got.Object, "spec", "replicas"); replicas != 1 {
+		t.Errorf("got replicas %d, want 1", replicas)
+	}
+	if !reflect.DeepEqual(got.GetAnnotations(), observed.GetAnnotations()) {
+		t.Errorf("got annotations %v, want last applied state as is", got.GetAnnotations())
+	}
+}
+
+func TestPrepareApplyAndCommitLastApplied(t *testing.T) {
+	observed := toUnstruct(t, testObservedJSON)
+	desired := toUnstruct(t, testDesiredJSON)
+	oldLastApplied, err := GetLastApplied(observed)
+	if err != nil {
+		t.Fatalf("GetLastApplied error: %v", err)
+	}
+
+	prepared, err := PrepareApply(observed, desired, nil)
+	if err != nil {
+		t.Fatalf("PrepareApply error: %v", err)
+	}
+	if !prepared.Changed {
+		t.Errorf("PrepareApply(): got changed false, want true")
+	}
+	if !reflect.DeepEqual(prepared.LastApplied, desired.Object) {
+		t.Errorf("got new last applied %#v, want %#v", prepared.LastApplied, desired.Object)
+	}
+
+	// a failed update doesn't commit; the old last applied state remains
+	for _, obj := range []*unstructured.Unstructured{observed, prepared.Object} {
+		got, err := GetLastApplied(obj)
+		if err != nil {
+			t.Fatalf("GetLastApplied error: %v", err)
+		}
+		if !reflect.DeepEqual(got, oldLastApplied) {
+			t.Errorf("got last applied %#v, want old %#v", got, oldLastApplied)
+		}
+	}
+	retried, err := PrepareApply(observed, desired, nil)
+	if err != nil {
+		t.Fatalf("PrepareApply error: %v", err)
+	}
+	if !reflect.DeepEqual(retried, prepared) {
+		t.Errorf("PrepareApply() on retry = %#v, want %#v", retried, prepared)
+	}
+
+	// a successful update commits the new last applied state
+	committed, err := CommitLastApplied(prepared.Object, prepared.LastApplied, nil)
+	if err != nil {
+		t.Fatalf("CommitLastApplied error: %v", err)
+	}
+	got, err := GetLastApplied(committed)
+	if err != nil {
+		t.Fatalf("GetLastApplied error: %v", err)
+	}
+	if !reflect.DeepEqual(got, desired.Object) {
+		t.Errorf("got committed last applied %#v, want %#v", got, desired.Object)
+	}
+	want, _, err := Apply(observed, desired)
+	if err != nil {
+		t.Fatalf("Apply error: %v", err)
+	}
+	if !reflect.DeepEqual(committed.Object, want.Object) {
+		t.Errorf("CommitLastApplied() = %#v, want %#v", committed.Object, want.Object)
+	}
+}
+
+func TestPrepareApplyWithOptions(t *testing.T) {
+	store := fakeSnapshotStore{}
+	observed := toUnstruct(t, testObservedJSON)
+	desired := toUnstruct(t, testDesiredJSON)
+	opts := &ApplyOptions{
+		LastAppliedAnnKey:  ControllerLastAppliedAnnKey("test"),
+		LastAppliedBackend: HashStoreBackend{Snapshots: store},
+		RecordDiff:         true,
+	}
+	annKey := managedAnnotationPrefix + "test-last-applied-configuration"
+
+	prepared, err := PrepareApply(observed, desired, opts)
+	if err != nil {
+		t.Fatalf("PrepareApply error: %v", err)
+	}
+	if !prepared.Changed {
+		t.Errorf("PrepareApply(): got changed false, want true")
+	}
+	if len(store) != 0 {
+		t.Errorf("PrepareApply(): got stored snapshots %v, want none before commit", store)
+	}
+	if prepared.Object.GetAnnotations()[lastMergeDiffAnnotation] == "" {
+		t.Errorf("PrepareApply(): want merge diff recorded, got none")
+	}
+
+	committed, err := CommitLastApplied(prepared.Object, prepared.LastApplied, opts)
+	if err != nil {
+		t.Fatalf("CommitLastApplied error: %v", err)
+	}
+	if len(store) != 1 || committed.GetAnnotations()[annKey] == "" {
+		t.Errorf("CommitLastApplied(): want snapshot stored against %q, got %v", annKey, committed.GetAnnotations())
+	}
+	again, err := PrepareApply(committed, desired, opts)
+	if err != nil {
+		t.Fatalf("PrepareApply error: %v", err)
+	}
+	if again.Changed {
+		t.Errorf("PrepareApply(): got changed true, want false once committed")
+	}
+
+	created, err := PrepareApply(committed, desired, &ApplyOptions{CreateOnly: true})
+	if err != nil {
+		t.Fatalf("PrepareApply error: %v", err)
+	}
+	if created.Changed || created.Object != committed {
+		t.Errorf("PrepareApply(): want existing object as is for create only")
+	}
+}
+
+func TestShouldUpdateIgnoresManagedFields(t *testing.T) {
+	observed := toUnstruct(t, `{
+		"apiVersion": "v1",
+		"kind": "Test",
+		"metadata": {
+			"name": "test",
+			"managedFields": [{"manager": "kubectl", "operation": "Update"}]
+		},
+		"spec": {"replicas": 1}
+	}`)
+	desired := toUnstruct(t, `{
+		"apiVersion": "v1",
+		"kind": "Test",
+		"metadata": {
+			"name": "test",
+			"managedFields": [{"manager": "other", "operation": "Apply"}]
+		},
+		"spec": {"replicas": 1}
+	}`)
+
+	merged, err := MergeObjects(observed, desired)
+	if err != nil {
+		t.Fatalf("MergeObjects error: %v", err)
+	}
+	// last applied state should not have managed fields
+	last, err := GetLastApplied(merged)
+	if err != nil {
+		t.Fatalf("GetLastApplied error: %v", err)
+	}
+	if _, found, _ := unstructured.NestedFieldNoCopy(last, "metadata", "managedFields"); found {
+		t.Errorf("got managedFields in last applied state %#v", last)
+	}
+
+	// ignore the last applied annotation to verify change detection
+	// of managed fields
+	merged.SetAnnotations(nil)
+	if ShouldUpdate(observed, merged) {
+		t.Errorf("ShouldUpdate() = true, want false for changes confined to managedFields")
+	}
+
+	changed := merged.DeepCopy()
+	changed.Object["spec"] = map[string]interface{}{"replicas": int64(2)}
+	if !ShouldUpdate(observed, changed) {
+		t.Errorf("ShouldUpdate() = false, want true for a spec change")
+	}
+}
+
+func TestStripManagedFields(t *testing.T) {
+	obj := toJSONMap(t, `{
+		"metadata": {
+			"name": "test",
+			"managedFields": [{"manager": "kubectl"}]
+		}
+	}`)
+	StripManagedFields(obj)
+	want := toJSONMap(t, `{"metadata": {"name": "test"}}`)
+	if !reflect.DeepEqual(obj, want) {
+		t.Errorf("StripManagedFields() = %#v, want %#v", obj, want)
+	}
+}
+
+func TestApplyRecordDiff(t *testing.T) {
+	observed := toUnstruct(t, testObservedJSON)
+	desired := toUnstruct(t, testDesiredJSON)
+	opts := &ApplyOptions{RecordDiff: true}
+
+	merged, changed, err := ApplyWithOptions(observed, desired, opts)
+	if err != nil {
+		t.Fatalf("ApplyWithOptions error: %v", err)
+	}
+	if !changed {
+		t.Errorf("ApplyWithOptions(): got changed false, want true")
+	}
+	want := `["[spec][paused]","[spec][replicas]","[spec][template][spec][containers][app][image]"]`
+	if got := merged.GetAnnotations()[lastMergeDiffAnnotation]; got != want {
+		t.Errorf("got diff annotation %s, want %s", got, want)
+	}
+	lastApplied, err := GetLastApplied(merged)
+	if err != nil {
+		t.Fatalf("GetLastApplied error: %v", err)
+	}
+	if !reflect.DeepEqual(lastApplied, desired.Object) {
+		t.Errorf("got last applied %#v, want %#v", lastApplied, desired.Object)
+	}
+
+	// subsequent merge changes nothing & keeps the annotation as is
+	again, changed, err := ApplyWithOptions(merged, desired, opts)
+	if err != nil {
+		t.Fatalf("ApplyWithOptions error: %v", err)
+	}
+	if changed {
+		t.Errorf("ApplyWithOptions(): got changed true, want false")
+	}
+	if got := again.GetAnnotations()[lastMergeDiffAnnotation]; got != want {
+		t.Errorf("got diff annotation %s, want %s", got, want)
+	}
+
+	// annotation alone does not call for an update
+	stale := merged.DeepCopy()
+	annotations := stale.GetAnnotations()
+	annotations[lastMergeDiffAnnotation] = `["[spec][other]"]`
+	stale.SetAnnotations(annotations)
+	if ShouldUpdate(stale, merged) {
+		t.Errorf("ShouldUpdate() = true, want false for diff annotation change")
+	}
+}
+
+func TestMergeDiffIsCapped(t *testing.T) {
+	changes := make([]Change, 0, 100)
+	for idx := 0; idx < 100; idx++ {
+		changes = append(changes, Change{Path: fmt.Sprintf("[spec][field%03d]", idx)})
+	}
+	got, err := mergeDiff(changes, 100)
+	if err != nil {
+		t.Fatalf("mergeDiff error: %v", err)
+	}
+	if len(got) > 100 {
+		t.Errorf("got diff of %d bytes, want at most 100: %s", len(got), got)
+	}
+	if !strings.HasSuffix(got, `more"]`) {
+		t.Errorf("got diff %s, want count of dropped paths", got)
+	}
+}
+
+func TestApplyOptionsMergeOptions(t *testing.T) {
+	opts := &ApplyOptions{RedactPaths: []string{"[spec][password]"}}
+	got := opts.mergeOptions()
+	if !reflect.DeepEqual(got.RedactPaths, opts.RedactPaths) {
+		t.Errorf("got redact paths %v, want %v", got.RedactPaths, opts.RedactPaths)
+	}
+
+	observed := &unstructured.Unstructured{
+		Object: toJSONMap(t, `{"metadata": {"name": "app"}, "spec": {"password": "old"}}`),
+	}
+	desired := &unstructured.Unstructured{
+		Object: toJSONMap(t, `{"metadata": {"name": "app"}, "spec": {"password": "new"}}`),
+	}
+	merged, changed, err := ApplyWithOptions(observed, desired, opts)
+	if err != nil {
+		t.Fatalf("ApplyWithOptions error: %v", err)
+	}
+	if !changed || merged.Object["spec"].(map[string]interface{})["password"] != "new" {
+		t.Errorf("ApplyWithOptions(): want password updated to new, got %v", merged.Object["spec"])
+	}
+}
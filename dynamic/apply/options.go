@@ -0,0 +1,1563 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// MergeOptions tunes the way desired state gets merged into the
+// observed state
+//
+// Field paths used by these options follow the notation used by merge
+// e.g. `[spec][template][metadata]`. List map elements are represented
+// by their merge key value e.g. `[spec][containers][app]`. These paths
+// are matched as glob patterns by default e.g. `[spec][containers][*]`
+// matches every container. Refer MatchGlobPath for details. Options
+// that map paths to values use the value of the field's exact path if
+// set or else that of the first of the sorted matching paths.
+type MergeOptions struct {
+	// MatchPath when set matches the field paths set in these options
+	// against the field being merged. MatchGlobPath is used if this is
+	// not set.
+	MatchPath PathMatcher
+
+	// ShallowMergePaths lists the field paths of objects that are
+	// merged at their top level only. Keys set by desired are added
+	// or updated & keys dropped from desired (w.r.t last applied state)
+	// are deleted. However, the value of each key is replaced
+	// atomically instead of being merged recursively.
+	//
+	// This suits free-form objects e.g. a config blob with arbitrary
+	// user keys. This also manages string maps cooperatively, similar
+	// to what CooperativeDataMaps does for the well known data maps.
+	ShallowMergePaths []string
+
+	// PassthroughUnknownTopLevel when set never deletes top level
+	// fields that are not set in desired, even if these are found in
+	// last applied state. These fields are passed through from
+	// observed as is. Nested fields are deleted as usual.
+	//
+	// This suits opaque objects e.g. resources embedded verbatim.
+	PassthroughUnknownTopLevel bool
+
+	// PatchOnlyPaths lists the field paths whose desired values are
+	// partial patches. Fields & list elements under these paths are
+	// added or updated but never deleted, even if these are dropped
+	// from desired. Fields outside these paths are deleted as usual.
+	//
+	// This lets a controller own some subtrees of an object
+	// authoritatively while only contributing to others.
+	PatchOnlyPaths []string
+
+	// UnionFields maps the field path of an object to its tagged union
+	// (i.e. oneOf) members. These members are mutually exclusive. In
+	// other words, when desired sets one of these members, all the
+	// other members are removed from the result even if they were not
+	// part of the last applied state.
+	//
+	// For example, `[spec][probe]` mapped to `tcp`, `udp` & `http`
+	// clears the `tcp` block when desired switches to `http`.
+	UnionFields map[string][]string
+
+	// MaxListMapElements when set to a positive value replaces a list
+	// map wholesale instead of merging it if any of its observed, last
+	// applied or desired versions has more elements than this value.
+	//
+	// This is a performance escape hatch for very large lists. It comes
+	// at the cost of correctness since elements added to the list by
+	// other actors are lost.
+	MaxListMapElements int
+
+	// CooperativeDataMaps when set manages the data maps of Secret &
+	// ConfigMap objects cooperatively. Only the keys set by desired
+	// are managed, i.e. added, updated, or deleted once dropped from
+	// desired. Keys set by other actors are preserved. Each value is
+	// replaced as a whole. Use ShallowMergePaths to manage other maps
+	// the same way.
+	CooperativeDataMaps bool
+
+	// PreserveAnnotations lists the annotations that merge never
+	// deletes even if these were dropped from desired w.r.t last applied
+	// state. These annotations are set by other tools & are not meant to
+	// be removed by cooperative controllers. Desired may still update
+	// them. DefaultPreserveAnnotations is used if this is nil. Set this
+	// to an empty list to preserve none.
+	PreserveAnnotations []string
+
+	// ResolveConflict when set is invoked to resolve a three-way
+	// conflict at a scalar field. A conflict is said to occur when
+	// observed, last applied & desired values of a field differ from
+	// each other. The returned value is set in the result. Desired
+	// value wins if this is not set.
+	ResolveConflict func(path []string, observed, lastApplied, desired interface{}) interface{}
+
+	// ErrorOnIdentityChange when set returns error if desired sets
+	// metadata.name or metadata.namespace to a value that differs from
+	// observed. By default, these identity fields are silently taken
+	// from observed on update.
+	ErrorOnIdentityChange bool
+
+	// ErrorOnSelectorChange when set returns error if the merge changes
+	// spec.selector of an existing object. Label selectors i.e. those
+	// having matchLabels or matchExpressions e.g. of a Deployment are
+	// immutable once set. By default, these are silently taken from
+	// observed on update.
+	ErrorOnSelectorChange bool
+
+	// PreserveOnEmpty maps field paths to the kinds of empty desired
+	// values that are treated as "don't change" instead of "set to
+	// empty". The observed value (or its absence) is preserved when
+	// desired value at such a path is empty.
+	//
+	// Following are the empty values per kind:
+	// - EmptyString: ""
+	// - EmptyNumber: 0
+	// - EmptyList: []
+	// - EmptyObject: {}
+	//
+	// Boolean false & null are never considered as empty.
+	PreserveOnEmpty map[string]EmptyKind
+
+	// NormalizeInputs when set converts observed, last applied &
+	// desired states to JSON native values before merging. This is
+	// done by round tripping these states through JSON.
+	//
+	// Merge expects JSON native values i.e. the ones produced by
+	// unmarshaling JSON. Other values e.g. time.Time or metav1.Time
+	// are treated as scalars & are set as is in the result if these
+	// are found in desired. However, these values result in a panic
+	// if found in observed since observed is deep copied before merge.
+	// Enable this option if states are built from typed objects
+	// without conversion.
+	NormalizeInputs bool
+
+	// SelectMergeKey when set chooses the merge key of list maps.
+	// SelectKnownMergeKey is used if this is not set.
+	SelectMergeKey MergeKeySelector
+
+	// ListMapKeys maps field paths of list maps to the keys that
+	// identify their elements. Paths are matched via MatchPath. This
+	// takes precedence over merge key detection & is meant to be fed
+	// with authoritative keys e.g. x-kubernetes-list-map-keys of a
+	// CRD schema.
+	ListMapKeys map[string][]string
+
+	// KeyFuncs maps field paths of list maps to the functions that
+	// compute the identity of their elements e.g. by joining host &
+	// port. A list is replaced as a whole if the function can't
+	// identify any of its elements. Paths are matched via MatchPath.
+	// This takes precedence over ListMapKeys.
+	//
+	// Merge returns an error if desired changes the value of a key
+	// field of a matched element. ListMapKeys of a path that has a key
+	// function lists its key fields, if any, for this check.
+	KeyFuncs map[string]KeyFunc
+
+	// ImmutablePaths lists the field paths whose values must never
+	// change once set, not even by desired. Merge returns an error if
+	// it would change or remove an existing non-null value at any of
+	// these paths.
+	//
+	// This surfaces policy violations. Use this when a change attempt
+	// is a bug rather than something to be silently ignored.
+	ImmutablePaths []string
+
+	// RequiredPaths lists the field paths that desired must set to a
+	// non-null value. Merge returns an error listing all the missing
+	// paths before anything is merged. List map elements are addressed
+	// by their merge key values.
+	//
+	// This catches templates that silently drop fields.
+	RequiredPaths []string
+
+	// DirectivePrefix is the prefix of the keys that are treated as
+	// merge directives instead of data. It defaults to `$` i.e. the
+	// prefix used by strategic merge patch.
+	//
+	// Set this to an unlikely prefix e.g. `x-metac-` when objects
+	// carry `$` prefixed keys as data e.g. `$ref` of JSON schema.
+	//
+	// Only `<prefix>patch: replace` is supported. It replaces the object
+	// it is set in instead of merging it. Merge returns an error if
+	// desired has any other strategic merge patch directive. Refer
+	// ValidateDirectives for details.
+	DirectivePrefix string
+
+	// Trace when set is invoked once per scalar field that is merged.
+	// This helps debug the merge of a particular field.
+	Trace TraceFunc
+
+	// RedactPaths lists the field paths of sensitive fields. Scalar
+	// values at or below these paths are replaced by `***` in traces
+	// & logs. The merged result is not affected. Data & stringData of
+	// a Secret are always redacted.
+	RedactPaths []string
+
+	// MergeStatus when set merges the top level status field like any
+	// other field. By default, status is not managed by merge. It is
+	// copied from observed as is, irrespective of desired or last
+	// applied states, since status is owned by the object's
+	// controller & is typically updated via its own subresource.
+	MergeStatus bool
+
+	// StatusPaths lists the field paths of status subtrees that are
+	// merged even when MergeStatus is not set e.g. `[status][conditions]`.
+	// Rest of the status is copied from observed as is. This lets a
+	// controller own only a part of the status. The strategy of each
+	// subtree is set via the usual options, e.g. ListMapKeys to merge
+	// conditions cooperatively or AtomicPaths to replace a subtree as
+	// a whole.
+	StatusPaths []string
+
+	// AtomicPaths lists the field paths of objects & lists that are
+	// replaced as a whole by desired instead of being merged. Fields
+	// set by other actors within these are lost.
+	AtomicPaths []string
+
+	// MaxObjectSizeBytes when set to a positive value returns error if
+	// the JSON serialized size of the merged object exceeds this value.
+	//
+	// This catches runaway objects before these get rejected by the
+	// API server with a less helpful error.
+	MaxObjectSizeBytes int
+
+	// Comparators maps field paths to the comparators of their scalar
+	// values. Observed value is retained if it is semantically equal to
+	// desired value as per the comparator. This avoids the churn due to
+	// different representations of the same value e.g. `1m` & `60s`.
+	Comparators map[string]ValueComparator
+
+	// BooleanStringPaths lists the field paths of string fields that
+	// hold booleans. Spellings of the same boolean are equal, e.g.
+	// observed `yes` is retained if desired is `true`. A changed value
+	// is set in its canonical spelling i.e. `true` or `false`. The
+	// recognized spellings are `true` & `false`, `yes` & `no`, `on` &
+	// `off`, `y` & `n` as well as `1` & `0` irrespective of their case.
+	BooleanStringPaths []string
+
+	// VetoChange when set is invoked for each change to a scalar field
+	// including its removal. The new value is nil for a removal. A
+	// returned error aborts the merge unless SkipVetoedChanges is set.
+	//
+	// This lets the caller enforce policies e.g. refuse to lower the
+	// replicas below a floor.
+	VetoChange func(path []string, oldValue, newValue interface{}) error
+
+	// SkipVetoedChanges when set retains the old value of a field whose
+	// change is vetoed instead of aborting the merge
+	SkipVetoedChanges bool
+
+	// DedupScalarLists when set removes the duplicate values of every
+	// list of scalars set by desired. The first occurrence of each value
+	// is retained in its order.
+	DedupScalarLists bool
+
+	// DedupScalarListPaths lists the field paths of the scalar lists
+	// whose duplicate values are removed similar to DedupScalarLists
+	DedupScalarListPaths []string
+
+	// ManagedMetadataPrefix when set manages only those labels &
+	// annotations whose keys have this prefix e.g. `app.example.com/`.
+	// Prefixed keys set by desired are added or updated, while other
+	// prefixed keys are deleted irrespective of the last applied state.
+	// Keys without this prefix are left as observed even if desired
+	// sets them.
+	ManagedMetadataPrefix string
+
+	// DeepCopy when set is used to copy observed state before merging
+	// it. runtime.DeepCopyJSON is used if this is not set. This copier
+	// must return a copy that does not share any map or slice with the
+	// given object since merge mutates the copy in place.
+	//
+	// The default copier panics on values that are not JSON native.
+	// Set this to a faster copier if states are known to be JSON
+	// native or to a copier that tolerates other values.
+	DeepCopy func(obj map[string]interface{}) map[string]interface{}
+
+	// SignatureMergeKeys when set merges lists of objects without a
+	// merge key as list maps keyed by the structural signatures of their
+	// elements. The signature of an element is a hash of its scalar
+	// fields i.e. their names & values. Elements having the same scalar
+	// fields are merged cooperatively, i.e. their nested objects & lists
+	// are merged, while elements whose scalar fields differ are treated
+	// as different elements.
+	//
+	// This is a heuristic & is hence off by default. Lists having an
+	// element without scalar fields are not merged by signature. Merge
+	// returns an error if desired has elements with the same signature.
+	SignatureMergeKeys bool
+
+	// ContentMergeListPaths lists the field paths of lists without a
+	// merge key that are merged by the content of their elements. The
+	// canonical JSON of an element is its identity. Elements set by
+	// desired are added if not present, while elements dropped from
+	// desired (w.r.t last applied state) are removed. Elements added
+	// by other actors are retained. Duplicates are never added.
+	//
+	// This is costly & hence suits small lists only.
+	ContentMergeListPaths []string
+
+	// IndexMergeListPaths lists the field paths of lists without a
+	// merge key that are merged element by element based on their
+	// positions e.g. sparse fixed index arrays. Destination elements
+	// beyond the desired elements are removed if these were applied
+	// before & are retained otherwise. Removed elements are set to null
+	// if retained elements follow these so that positions are kept.
+	//
+	// Null desired elements are handled as per NullListElements.
+	// Lists that are not merged by index take null elements of desired
+	// verbatim.
+	IndexMergeListPaths []string
+
+	// NullListElements decides how null desired elements of lists that
+	// are merged by index are handled. Observed elements are kept if
+	// this is not set.
+	NullListElements NullElementPolicy
+
+	// CompactLists when set removes the null elements of every list of
+	// the merged state. This is done after the merge & hence removes the
+	// nulls retained as per NullElementKeep as well as the nulls set by
+	// desired verbatim. Unlike list map deletions which are driven by
+	// the last applied state, nulls are removed irrespective of who set
+	// them. Only the fields set in desired are compacted. Each removed
+	// null is reported as a removed list element.
+	CompactLists bool
+
+	// CompactListPaths lists the field paths of the lists whose null
+	// elements are removed similar to CompactLists
+	CompactListPaths []string
+
+	// GenerateNamePolicy decides metadata.generateName of an object
+	// that exists i.e. that has a name assigned. Desired generateName
+	// is not applied to such an object since it conflicts with the
+	// assigned name. GenerateNameFromObserved is used if this is not
+	// set.
+	GenerateNamePolicy GenerateNamePolicy
+
+	// NullDefaults maps field paths to the values that are set instead
+	// of null. A default is set if desired sets its field to null or if
+	// desired omits its field while observed has it as null. Deletion
+	// takes precedence, i.e. a field dropped from desired w.r.t last
+	// applied state is removed rather than defaulted. Paths are matched
+	// via MatchPath.
+	//
+	// This suits fields that consumers expect to never be null.
+	NullDefaults map[string]interface{}
+
+	// ClampPaths maps field paths to the range that their numeric
+	// desired values are clamped to. Unlike VetoChange which rejects
+	// changes, out of range desired values are clamped to the nearest
+	// bound & applied with a warning. Paths are matched via MatchPath.
+	ClampPaths map[string]ClampRange
+
+	// AppendPaths maps field paths of string fields to the separator
+	// used to append desired text to the observed text instead of
+	// replacing it, e.g. a history field. Desired is appended only if
+	// it differs from last applied state, i.e. the text appended last
+	// time, & is not already at the end of observed. Hence repeated
+	// applies don't duplicate the appended text. Paths are matched via
+	// MatchPath.
+	AppendPaths map[string]string
+
+	// ReorderListMap when set is invoked with every merged list map
+	// & returns the list in the order it should be set. The returned
+	// list must have the same elements as the merged list. Merge
+	// returns an error otherwise.
+	//
+	// This suits orderings that depend on the merged elements e.g.
+	// keeping the controller's sidecar as the last container.
+	ReorderListMap func(fieldPath string, merged []interface{}) []interface{}
+
+	// AnchorListMaps maps field paths of list maps to the keys of the
+	// elements that are pinned to the front or the back of the merged
+	// list, e.g. an init step that must run first. Rest of the elements
+	// keep their partial order. Merge returns an error if an anchored
+	// element is not found in the merged list. Anchors are applied after
+	// ReorderListMap. Paths are matched via MatchPath.
+	AnchorListMaps map[string]ListMapAnchors
+
+	// OnListMapElement when set is invoked before each desired element
+	// of a list map is merged. It is given the field path of the list,
+	// the element's key & the observed element if any. The desired
+	// element is a copy that may be modified to normalize it e.g. set
+	// a default field. The observed element must not be modified.
+	//
+	// A returned error vetoes the element & aborts the merge unless
+	// SkipVetoedChanges is set, in which case the observed element is
+	// retained as is.
+	OnListMapElement func(fieldPath, key string, observed, desired map[string]interface{}) error
+
+	// KeepListMapElement when set is invoked before an observed element
+	// of a list map is deleted since desired dropped it. It is given the
+	// field path of the list & the observed element that must not be
+	// modified. The element is retained if this returns true e.g. if
+	// the element is marked to be kept by some other actor.
+	KeepListMapElement func(fieldPath string, observed map[string]interface{}) bool
+
+	// HashAnnotations maps annotation names to field paths. Each of
+	// these annotations is set to a hash of the subtree found at its
+	// field path of the merged object. The annotation is removed if the
+	// subtree is not found. List map elements are addressed by their
+	// merge key values.
+	//
+	// This keeps annotations like a config or template hash in sync
+	// with the final state instead of merging these from last applied
+	// state.
+	HashAnnotations map[string]string
+
+	// RecordNoOps when set records the paths of scalar fields that
+	// were merged but left unchanged in the statistics returned by
+	// MergeWithStats. This is off by default to avoid the overhead.
+	RecordNoOps bool
+
+	// RecordCost when set records the approximate cost of the merge in
+	// the statistics returned by MergeWithStats. This helps correlate
+	// the size of objects with the cost of reconciles.
+	RecordCost bool
+
+	// RecordTouched when set records the paths of all the fields that
+	// were merged, changed or not, in the statistics returned by
+	// MergeWithStats
+	RecordTouched bool
+
+	// RecordConflicts when set records the three-way conflicts found
+	// while merging scalar fields in the statistics returned by
+	// MergeWithStats. A conflict is a field changed by some other
+	// actor since it was last applied while desired wants to change it
+	// as well. Merge result is not affected.
+	RecordConflicts bool
+
+	// MaxConflicts when set to a positive value caps the number of
+	// conflicts recorded via RecordConflicts. The conflicts with the
+	// lowest paths are kept & ConflictsTruncated of the statistics is
+	// set if any were left out. This bounds the conflicts reported for
+	// objects that were edited wholesale by other actors.
+	MaxConflicts int
+
+	// ScalarListStrategies maps field paths of lists of scalars to the
+	// strategy that decides the list to keep on a conflict. A conflict
+	// happens when the list was changed by some other actor since it
+	// was last applied while desired wants to change it as well.
+	// Desired is kept if there is no conflict or no strategy is set.
+	// Paths are matched via MatchPath.
+	ScalarListStrategies map[string]ScalarListStrategy
+
+	// AtomicBelowSizeBytes when set replaces the top level fields of
+	// objects whose serialized observed state is smaller than this
+	// size as a whole instead of merging these field by field. Fields
+	// dropped from desired w.r.t last applied state are still deleted.
+	// Metadata is always merged field by field.
+	//
+	// This trades the cost of a field by field merge for plain
+	// comparisons when managing fleets of small objects.
+	AtomicBelowSizeBytes int
+
+	// CoerceTypes when set converts observed scalars to the type of
+	// their desired scalars before these are merged e.g. an observed
+	// `"3"` is treated as `3` if desired is `3`. Strings are converted
+	// to & from numbers & booleans. Merge returns a type mismatch error
+	// if an observed value can't be converted.
+	//
+	// Observed values that are retained by the merge e.g. via
+	// ResolveConflict or SkipVetoedChanges are retained as converted.
+	// Hence, the merged object has the desired types throughout.
+	//
+	// This helps merge objects whose field types were changed by an
+	// upstream migration.
+	CoerceTypes bool
+
+	// CoerceTypePaths lists the field paths whose observed scalars are
+	// converted similar to CoerceTypes. This is ignored if CoerceTypes
+	// is set.
+	CoerceTypePaths []string
+
+	// CoerceShapePaths lists the field paths whose observed & last
+	// applied values are reshaped to the shape of the desired value
+	// before these are merged. A scalar is wrapped into a single element
+	// list if desired is a list. A single element list is unwrapped if
+	// desired is a scalar. Merge returns a type mismatch error if a list
+	// to be unwrapped doesn't have exactly one element.
+	//
+	// This helps migrate fields that were changed from a scalar to a
+	// list or vice versa.
+	CoerceShapePaths []string
+
+	// Transforms maps field paths to the functions that normalize the
+	// desired values found at these paths before merge e.g. lowercase
+	// a host name. Normalized values are compared & set. Paths are
+	// matched via MatchPath. Elements of list maps are addressed by
+	// their merge key values.
+	Transforms map[string]TransformFunc
+
+	// MaxVisitedFields when set aborts the merge with an error once it
+	// visits more than these many fields. This bounds the work done on
+	// runaway or adversarial objects e.g. ones having millions of keys.
+	// There is no limit by default.
+	MaxVisitedFields int
+
+	// Now when set returns the current time used by merge to stamp
+	// timestamps. Real time is used if this is not set. This lets
+	// time dependent merges be tested deterministically.
+	Now func() metav1.Time
+
+	// StampConditionTransitions when set stamps the current time as
+	// the lastTransitionTime of conditions that are added or change
+	// their status. Conditions are the elements of list maps named
+	// conditions. The observed lastTransitionTime is retained if the
+	// status does not change. Transition times set by desired are used
+	// as is. Conditions are merged by their type.
+	//
+	// Note that status is merged only if MergeStatus is set.
+	StampConditionTransitions bool
+
+	// FinalizersOnlyOnDeletion when set merges only the removal of
+	// finalizers if observed has a deletion timestamp. Other desired
+	// changes including the spec are skipped so that the controller
+	// doesn't fight the deletion.
+	FinalizersOnlyOnDeletion bool
+
+	// Tracer when set traces every merge done via MergeContext or
+	// MergeWithOptions as a span. A tracer set in the context via
+	// WithTracer is used if this is not set. Refer Tracer.
+	Tracer Tracer
+
+	// OnChange when set is notified of every change made by the merge
+	// once the merge succeeds. Changes are notified in the order of
+	// their paths. The context carries the call number of the merge.
+	// Refer MergeCallFromContext.
+	//
+	// This lets the caller detect fields that keep changing across
+	// reconciles & dampen them. Changes are not notified if the result
+	// is served from the cache.
+	OnChange func(ctx context.Context, event ChangeEvent)
+
+	// Cache when set is looked up for the result of a merge before
+	// merging. Results get cached after merging.
+	Cache *MergeCache
+}
+
+// EmptyKind selects the kinds of empty values. Kinds can be combined
+// e.g. EmptyString | EmptyNumber.
+type EmptyKind int
+
+const (
+	// EmptyString selects the empty string
+	EmptyString EmptyKind = 1 << iota
+
+	// EmptyNumber selects zero
+	EmptyNumber
+
+	// EmptyList selects the empty list
+	EmptyList
+
+	// EmptyObject selects the empty object
+	EmptyObject
+
+	// EmptyAny selects all the empty values
+	EmptyAny = EmptyString | EmptyNumber | EmptyList | EmptyObject
+)
+
+// GenerateNamePolicy decides metadata.generateName of objects that
+// exist
+type GenerateNamePolicy string
+
+const (
+	// GenerateNameFromObserved takes generateName from observed
+	GenerateNameFromObserved GenerateNamePolicy = "FromObserved"
+
+	// GenerateNameDrop removes generateName
+	GenerateNameDrop GenerateNamePolicy = "Drop"
+)
+
+// dataMapKinds lists the kinds whose data maps are managed
+// cooperatively when CooperativeDataMaps option is set
+var dataMapKinds = map[string][]string{
+	"Secret":    {"[data]", "[stringData]"},
+	"ConfigMap": {"[data]", "[binaryData]"},
+}
+
+// merger merges desired state into observed state based on the
+// configured options
+type merger struct {
+	opts MergeOptions
+
+	// kind of the object being merged
+	kind string
+
+	// path has the keys of the field currently being merged
+	path []string
+
+	// stats if not nil collects the statistics of the merge
+	stats *MergeStats
+
+	// deletions if not nil collects the deletions instead of deleting
+	deletions *[]Deletion
+
+	// events are the changes to be notified once merge succeeds
+	events []ChangeEvent
+
+	// atomic is true if top level fields are replaced as a whole
+	atomic bool
+
+	// listMaps is the number of list maps merged so far
+	listMaps int
+
+	// visited is the number of fields visited by merge so far
+	visited int
+
+	// decision if not nil records the decisions of the field that is
+	// currently being merged
+	decision *Decision
+
+	// patterns has the sorted paths of the options that map paths to
+	// values
+	patterns optionPatterns
+}
+
+// optionPatterns has the sorted paths of each of the options that map
+// paths to values. These are sorted once per merge since these are
+// matched against every field.
+type optionPatterns struct {
+	unionFields          []string
+	preserveOnEmpty      []string
+	listMapKeys          []string
+	keyFuncs             []string
+	scalarListStrategies []string
+	anchorListMaps       []string
+	appendPaths          []string
+	nullDefaults         []string
+	clampPaths           []string
+	transforms           []string
+}
+
+// sortedPatterns returns the sorted keys of the given map of paths
+func sortedPatterns(paths interface{}) []string {
+	keys := reflect.ValueOf(paths).MapKeys()
+	if len(keys) == 0 {
+		return nil
+	}
+	patterns := make([]string, 0, len(keys))
+	for _, key := range keys {
+		patterns = append(patterns, key.String())
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// firstMatchingPattern returns the given field path if it is one of
+// the given sorted patterns. It returns the first of these patterns
+// that matches the field path otherwise. It returns false if none of
+// the patterns match.
+func (m *merger) firstMatchingPattern(patterns []string, fieldPath string) (string, bool) {
+	if idx := sort.SearchStrings(patterns, fieldPath); idx < len(patterns) && patterns[idx] == fieldPath {
+		return fieldPath, true
+	}
+	for _, pattern := range patterns {
+		if m.opts.MatchPath(pattern, fieldPath) {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// newMerger returns a new instance of merger based on the provided
+// options. Default options are used if provided options is nil.
+func newMerger(opts *MergeOptions) *merger {
+	m := &merger{}
+	if opts != nil {
+		m.opts = *opts
+	}
+	if m.opts.MatchPath == nil {
+		m.opts.MatchPath = MatchGlobPath
+	}
+	if m.opts.DirectivePrefix == "" {
+		m.opts.DirectivePrefix = defaultDirectivePrefix
+	}
+	if m.opts.GenerateNamePolicy == "" {
+		m.opts.GenerateNamePolicy = GenerateNameFromObserved
+	}
+	if m.opts.NullListElements == "" {
+		m.opts.NullListElements = NullElementKeep
+	}
+	if m.opts.PreserveAnnotations == nil {
+		m.opts.PreserveAnnotations = DefaultPreserveAnnotations
+	}
+	m.patterns = optionPatterns{
+		unionFields:          sortedPatterns(m.opts.UnionFields),
+		preserveOnEmpty:      sortedPatterns(m.opts.PreserveOnEmpty),
+		listMapKeys:          sortedPatterns(m.opts.ListMapKeys),
+		keyFuncs:             sortedPatterns(m.opts.KeyFuncs),
+		scalarListStrategies: sortedPatterns(m.opts.ScalarListStrategies),
+		anchorListMaps:       sortedPatterns(m.opts.AnchorListMaps),
+		appendPaths:          sortedPatterns(m.opts.AppendPaths),
+		nullDefaults:         sortedPatterns(m.opts.NullDefaults),
+		clampPaths:           sortedPatterns(m.opts.ClampPaths),
+		transforms:           sortedPatterns(m.opts.Transforms),
+	}
+	return m
+}
+
+// EffectiveOptions returns the options that a merge uses given the
+// provided options, i.e. with defaults set for the unset options. This
+// helps log or assert the resolved merge configuration. The provided
+// options are not modified.
+func EffectiveOptions(opts *MergeOptions) MergeOptions {
+	return newMerger(opts).opts
+}
+
+// clearInactiveUnionMembers removes the union members of the object
+// found at the given field path that are not set in desired. Nothing
+// is removed if desired does not set any of the union members.
+func (m *merger) clearInactiveUnionMembers(
+	fieldPath string, destination, desired map[string]interface{},
+) {
+	pattern, found := m.firstMatchingPattern(m.patterns.unionFields, fieldPath)
+	if !found {
+		return
+	}
+	members := m.opts.UnionFields[pattern]
+	if len(members) == 0 {
+		return
+	}
+	var active bool
+	for _, member := range members {
+		if _, present := desired[member]; present {
+			active = true
+			break
+		}
+	}
+	if !active || m.isPatchOnly(fieldPath) {
+		return
+	}
+	for _, member := range members {
+		if _, present := desired[member]; !present {
+			val, exists := destination[member]
+			if m.deferDeletion(fmt.Sprintf("%s[%s]", fieldPath, member), val, exists) {
+				continue
+			}
+			glog.V(4).Infof(
+				"%s merge operation: Will delete inactive union member %s",
+				fieldPath, member,
+			)
+			delete(destination, member)
+		}
+	}
+}
+
+// exceedsMaxListMapElements returns true if any of the given lists
+// has more elements than the configured maximum
+func (m *merger) exceedsMaxListMapElements(lists ...[]interface{}) bool {
+	if m.opts.MaxListMapElements <= 0 {
+		return false
+	}
+	for _, list := range lists {
+		if len(list) > m.opts.MaxListMapElements {
+			return true
+		}
+	}
+	return false
+}
+
+// isAtomicPath returns true if the value found at the given field
+// path should be replaced as a whole
+func (m *merger) isAtomicPath(fieldPath string) bool {
+	return m.hasPath(m.opts.AtomicPaths, fieldPath)
+}
+
+// isShallowMerge returns true if the object found at the given field
+// path should be merged at its top level only
+func (m *merger) isShallowMerge(fieldPath string) bool {
+	if m.hasPath(m.opts.ShallowMergePaths, fieldPath) {
+		return true
+	}
+	return m.opts.CooperativeDataMaps && m.hasPath(dataMapKinds[m.kind], fieldPath)
+}
+
+// isPatchOnly returns true if the given field path or any of its
+// parents is set as a patch only path
+func (m *merger) isPatchOnly(fieldPath string) bool {
+	return matchesAnyPathOrParent(m.opts.MatchPath, m.opts.PatchOnlyPaths, fieldPath)
+}
+
+// currentPath returns a copy of the keys of the field currently
+// being merged
+func (m *merger) currentPath() []string {
+	path := make([]string, len(m.path))
+	copy(path, m.path)
+	return path
+}
+
+// isPreservedOnEmpty returns true if the given desired value at the
+// given field path is an empty value that should preserve observed
+func (m *merger) isPreservedOnEmpty(fieldPath string, desired interface{}) bool {
+	pattern, found := m.firstMatchingPattern(m.patterns.preserveOnEmpty, fieldPath)
+	if !found {
+		return false
+	}
+	kinds := m.opts.PreserveOnEmpty[pattern]
+	switch val := desired.(type) {
+	case string:
+		return kinds&EmptyString != 0 && val == ""
+	case int64:
+		return kinds&EmptyNumber != 0 && val == 0
+	case float64:
+		return kinds&EmptyNumber != 0 && val == 0
+	case int:
+		return kinds&EmptyNumber != 0 && val == 0
+	case []interface{}:
+		return kinds&EmptyList != 0 && len(val) == 0
+	case map[string]interface{}:
+		return kinds&EmptyObject != 0 && len(val) == 0
+	default:
+		return false
+	}
+}
+
+// normalizeInputs returns the given states as JSON native values if
+// NormalizeInputs option is set. The given states are returned as is
+// otherwise.
+func (m *merger) normalizeInputs(
+	observed, lastApplied, desired map[string]interface{},
+) (map[string]interface{}, map[string]interface{}, map[string]interface{}, error) {
+	if !m.opts.NormalizeInputs {
+		return observed, lastApplied, desired, nil
+	}
+	var err error
+	if observed, err = NormalizeJSON(observed); err != nil {
+		return nil, nil, nil, errors.Wrapf(err, "Can't normalize observed")
+	}
+	if lastApplied, err = NormalizeJSON(lastApplied); err != nil {
+		return nil, nil, nil, errors.Wrapf(err, "Can't normalize last applied")
+	}
+	if desired, err = NormalizeJSON(desired); err != nil {
+		return nil, nil, nil, errors.Wrapf(err, "Can't normalize desired")
+	}
+	return observed, lastApplied, desired, nil
+}
+
+// NormalizeJSON returns a copy of the given object that has JSON native
+// values only. This is done by round tripping the object through JSON.
+// A nil object is returned as is.
+func NormalizeJSON(obj map[string]interface{}) (map[string]interface{}, error) {
+	if obj == nil {
+		return nil, nil
+	}
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to marshal object")
+	}
+	normalized := make(map[string]interface{}, len(obj))
+	if err := json.Unmarshal(raw, &normalized); err != nil {
+		return nil, errors.Wrapf(err, "Failed to unmarshal object")
+	}
+	return normalized, nil
+}
+
+// immutableSnapshot returns a copy of the given observed value if the
+// given field path is immutable. It returns nil otherwise.
+func (m *merger) immutableSnapshot(fieldPath string, observed interface{}) interface{} {
+	if observed == nil || !m.hasPath(m.opts.ImmutablePaths, fieldPath) {
+		return nil
+	}
+	// a copy is needed since merge mutates objects & lists in place
+	return m.deepCopyValue(observed)
+}
+
+// deepCopy returns a deep copy of the given object using the configured
+// copier
+func (m *merger) deepCopy(obj map[string]interface{}) map[string]interface{} {
+	if m.opts.DeepCopy == nil {
+		return runtime.DeepCopyJSON(obj)
+	}
+	return m.opts.DeepCopy(obj)
+}
+
+// deepCopyValue returns a deep copy of the given value using the
+// configured copier
+func (m *merger) deepCopyValue(val interface{}) interface{} {
+	if m.opts.DeepCopy == nil {
+		return runtime.DeepCopyJSONValue(val)
+	}
+	return m.opts.DeepCopy(map[string]interface{}{"value": val})["value"]
+}
+
+// verifyImmutable returns error if the given field path is immutable
+// & its non-null observed value differs from the merged value
+func (m *merger) verifyImmutable(fieldPath string, observed, merged interface{}) error {
+	if observed == nil || !m.hasPath(m.opts.ImmutablePaths, fieldPath) {
+		return nil
+	}
+	if reflect.DeepEqual(observed, merged) {
+		return nil
+	}
+	return errors.Errorf(
+		"%s: Can't change immutable field: Observed %v: Merged %v",
+		fieldPath, observed, merged,
+	)
+}
+
+// verifyRequired returns error if the given desired state doesn't set
+// any of the required field paths. All the missing paths are reported.
+func (m *merger) verifyRequired(desired map[string]interface{}) error {
+	var missing []string
+	for _, fieldPath := range m.opts.RequiredPaths {
+		val, found := fieldValue(desired, splitFieldPath(fieldPath))
+		if !found || val == nil {
+			missing = append(missing, fieldPath)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return errors.Errorf("Missing required desired fields: %s", strings.Join(missing, ", "))
+}
+
+// verifyObjectSize returns error if the serialized size of the given
+// merged object exceeds the configured maximum
+func (m *merger) verifyObjectSize(merged map[string]interface{}) error {
+	if m.opts.MaxObjectSizeBytes <= 0 {
+		return nil
+	}
+	raw, err := json.Marshal(merged)
+	if err != nil {
+		return errors.Wrapf(err, "Can't verify merged object size")
+	}
+	if len(raw) > m.opts.MaxObjectSizeBytes {
+		return errors.Errorf(
+			"Merged object is too large: Size %d bytes: Max %d bytes",
+			len(raw), m.opts.MaxObjectSizeBytes,
+		)
+	}
+	return nil
+}
+
+// visit counts the visit of the given field path. It returns error if
+// the visits exceed the configured maximum.
+func (m *merger) visit(fieldPath string) error {
+	m.visited++
+	if m.opts.MaxVisitedFields > 0 && m.visited > m.opts.MaxVisitedFields {
+		return errors.Errorf(
+			"%s: Merge visited too many fields: Max %d fields",
+			fieldPath,
+			m.opts.MaxVisitedFields,
+		)
+	}
+	return nil
+}
+
+// isAtomic returns true if the top level fields of the given observed
+// state should be replaced as a whole
+func (m *merger) isAtomic(observed map[string]interface{}) bool {
+	if m.opts.AtomicBelowSizeBytes <= 0 {
+		return false
+	}
+	// size is walked instead of marshaled since marshaling costs more
+	// than the merge that this option avoids
+	size, ok := jsonSize(observed, m.opts.AtomicBelowSizeBytes)
+	return ok && size < m.opts.AtomicBelowSizeBytes
+}
+
+// jsonSize returns the serialized size of the given JSON native value.
+// Walk stops once the size exceeds the given limit. It returns false if
+// the value has types that are not JSON native.
+func jsonSize(val interface{}, limit int) (int, bool) {
+	switch tval := val.(type) {
+	case nil:
+		return 4, true
+	case bool:
+		if tval {
+			return 4, true
+		}
+		return 5, true
+	case string:
+		// escaped characters are not accounted for
+		return len(tval) + 2, true
+	case int64:
+		return len(strconv.FormatInt(tval, 10)), true
+	case float64:
+		return len(strconv.FormatFloat(tval, 'g', -1, 64)), true
+	case map[string]interface{}:
+		size := 2 + len(tval)
+		for key, item := range tval {
+			itemSize, ok := jsonSize(item, limit-size)
+			if !ok {
+				return 0, false
+			}
+			size += len(key) + 3 + itemSize
+			if size > limit {
+				return size, true
+			}
+		}
+		return size, true
+	case []interface{}:
+		size := 2 + len(tval)
+		for _, item := range tval {
+			itemSize, ok := jsonSize(item, limit-size)
+			if !ok {
+				return 0, false
+			}
+			size += itemSize
+			if size > limit {
+				return size, true
+			}
+		}
+		return size, true
+	default:
+		return 0, false
+	}
+}
+
+// reorderListMap returns the given merged list map reordered by the
+// configured callback. It returns error if the reordered list does not
+// have the same elements as the merged list.
+func (m *merger) reorderListMap(
+	fieldPath string, keyOf listMapKeyFunc, merged []interface{},
+) ([]interface{}, error) {
+	if m.opts.ReorderListMap == nil {
+		return m.anchorListMap(fieldPath, keyOf, merged)
+	}
+	reordered := m.opts.ReorderListMap(fieldPath, merged)
+	if len(reordered) != len(merged) {
+		return nil, errors.Errorf(
+			"%s: Invalid list map reorder: Want %d elements: Got %d",
+			fieldPath,
+			len(merged),
+			len(reordered),
+		)
+	}
+	keys := make(map[string]bool, len(merged))
+	for _, item := range merged {
+		keys[keyOf(item.(map[string]interface{}))] = true
+	}
+	for _, item := range reordered {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf(
+				"%s: Invalid list map reorder: Want object elements: Got %T",
+				fieldPath,
+				item,
+			)
+		}
+		key := keyOf(obj)
+		if !keys[key] {
+			return nil, errors.Errorf(
+				"%s: Invalid list map reorder: Unknown or duplicate element %q",
+				fieldPath,
+				key,
+			)
+		}
+		delete(keys, key)
+	}
+	return m.anchorListMap(fieldPath, keyOf, reordered)
+}
+
+// ListMapAnchors has the keys of the list map elements that are pinned
+// to the ends of the list. A key is the value of the element's merge
+// key e.g. the name of a container.
+type ListMapAnchors struct {
+	// First has the keys of the elements set at the front of the list
+	// in this order
+	First []string `json:"first"`
+
+	// Last has the keys of the elements set at the back of the list
+	// in this order
+	Last []string `json:"last"`
+}
+
+// anchorListMap returns the given merged list map with its anchored
+// elements moved to the ends of the list
+func (m *merger) anchorListMap(
+	fieldPath string, keyOf listMapKeyFunc, merged []interface{},
+) ([]interface{}, error) {
+	if len(m.opts.AnchorListMaps) == 0 {
+		return merged, nil
+	}
+	pattern, found := m.firstMatchingPattern(m.patterns.anchorListMaps, fieldPath)
+	if !found {
+		return merged, nil
+	}
+	anchors := m.opts.AnchorListMaps[pattern]
+	byKey := make(map[string]interface{}, len(merged))
+	for _, item := range merged {
+		byKey[keyOf(item.(map[string]interface{}))] = item
+	}
+	anchored := make(map[string]bool, len(anchors.First)+len(anchors.Last))
+	for _, key := range append(append([]string{}, anchors.First...), anchors.Last...) {
+		if _, found := byKey[key]; !found {
+			return nil, errors.Errorf(
+				"%s: Invalid list map anchor: Missing element %q", fieldPath, key,
+			)
+		}
+		if anchored[key] {
+			return nil, errors.Errorf(
+				"%s: Invalid list map anchor: Duplicate element %q", fieldPath, key,
+			)
+		}
+		anchored[key] = true
+	}
+	res := make([]interface{}, 0, len(merged))
+	for _, key := range anchors.First {
+		res = append(res, byKey[key])
+	}
+	for _, item := range merged {
+		if !anchored[keyOf(item.(map[string]interface{}))] {
+			res = append(res, item)
+		}
+	}
+	for _, key := range anchors.Last {
+		res = append(res, byKey[key])
+	}
+	return res, nil
+}
+
+// keepListMapElement returns true if the observed element of the given
+// key should be retained although desired dropped it
+func (m *merger) keepListMapElement(fieldPath string, destination map[string]interface{}, key string) bool {
+	if m.opts.KeepListMapElement == nil {
+		return false
+	}
+	obsElem, ok := destination[key].(map[string]interface{})
+	if !ok || !m.opts.KeepListMapElement(fieldPath, obsElem) {
+		return false
+	}
+	glog.V(4).Infof("%s merge operation: Will keep list map element %s", fieldPath, key)
+	return true
+}
+
+// onListMapElements invokes the configured callback with each desired
+// element of a list map in the order of the given desired list. The
+// desired elements of the given list map are replaced by copies that
+// the callback may modify. A vetoed element is removed from desired if
+// vetoes are skipped such that the observed element is retained.
+func (m *merger) onListMapElements(
+	fieldPath string,
+	keyOf listMapKeyFunc,
+	destMap, desMap map[string]interface{},
+	desired []interface{},
+) error {
+	if m.opts.OnListMapElement == nil {
+		return nil
+	}
+	for _, item := range desired {
+		key := keyOf(item.(map[string]interface{}))
+		desElem := m.deepCopy(item.(map[string]interface{}))
+		obsElem, _ := destMap[key].(map[string]interface{})
+		err := m.opts.OnListMapElement(fieldPath, key, obsElem, desElem)
+		if err == nil {
+			desMap[key] = desElem
+			continue
+		}
+		if !m.opts.SkipVetoedChanges {
+			return errors.Wrapf(err, "%s[%s]: List map element vetoed", fieldPath, key)
+		}
+		// veto errors may quote the vetoed values
+		glog.V(4).Infof(
+			"%s[%s] merge operation: Will skip vetoed element: %v",
+			fieldPath, key, m.redacted(fmt.Sprintf("%s[%s]", fieldPath, key), err.Error()),
+		)
+		if obsElem == nil {
+			delete(desMap, key)
+		} else {
+			desMap[key] = m.deepCopy(obsElem)
+		}
+	}
+	return nil
+}
+
+// appendText returns the observed text with the desired text appended
+// if the given field path is configured via AppendPaths. It returns
+// false if the field is not configured or is not a string.
+func (m *merger) appendText(fieldPath string, destination, lastApplied, desired interface{}) (interface{}, bool) {
+	if len(m.opts.AppendPaths) == 0 {
+		return nil, false
+	}
+	pattern, found := m.firstMatchingPattern(m.patterns.appendPaths, fieldPath)
+	if !found {
+		return nil, false
+	}
+	sep := m.opts.AppendPaths[pattern]
+	desText, isDesText := desired.(string)
+	obsText, isObsText := destination.(string)
+	if !isDesText || (destination != nil && !isObsText) {
+		return nil, false
+	}
+	if obsText == "" {
+		return desText, true
+	}
+	if lastApplied == desired || desText == "" ||
+		obsText == desText || strings.HasSuffix(obsText, sep+desText) {
+		// already appended
+		return obsText, true
+	}
+	return obsText + sep + desText, true
+}
+
+// ClampRange is the inclusive range of numeric values
+type ClampRange struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// nullDefault returns a copy of the value configured to be set instead
+// of null at the given field path. It returns false if there is none.
+func (m *merger) nullDefault(fieldPath string) (interface{}, bool) {
+	if len(m.opts.NullDefaults) == 0 {
+		return nil, false
+	}
+	pattern, found := m.firstMatchingPattern(m.patterns.nullDefaults, fieldPath)
+	if !found {
+		return nil, false
+	}
+	val := m.opts.NullDefaults[pattern]
+	if val == nil {
+		return nil, false
+	}
+	return m.deepCopyValue(val), true
+}
+
+// defaultOmittedNulls sets the configured defaults of the null fields of
+// the given destination object that are not set in desired
+func (m *merger) defaultOmittedNulls(fieldPath string, destination, desired map[string]interface{}) {
+	if len(m.opts.NullDefaults) == 0 {
+		return
+	}
+	for key, val := range destination {
+		if _, inDesired := desired[key]; val != nil || inDesired {
+			continue
+		}
+		keyPath := fmt.Sprintf("%s[%s]", fieldPath, key)
+		if def, found := m.nullDefault(keyPath); found {
+			destination[key] = def
+			m.recordChange(keyPath, ReasonFieldUpdated, nil, def)
+		}
+	}
+}
+
+// clamp returns the given desired value clamped to the range set for
+// the given field path. Values that are not numbers are returned as is.
+func (m *merger) clamp(fieldPath string, desired interface{}) interface{} {
+	if len(m.opts.ClampPaths) == 0 {
+		return desired
+	}
+	pattern, found := m.firstMatchingPattern(m.patterns.clampPaths, fieldPath)
+	if !found {
+		return desired
+	}
+	bounds := m.opts.ClampPaths[pattern]
+	var clamped interface{}
+	switch val := desired.(type) {
+	case int64:
+		// fractional bounds are narrowed to the integers within these
+		if min := math.Ceil(bounds.Min); float64(val) < min {
+			clamped = int64(min)
+		} else if max := math.Floor(bounds.Max); float64(val) > max {
+			clamped = int64(max)
+		}
+	case float64:
+		if val < bounds.Min {
+			clamped = bounds.Min
+		} else if val > bounds.Max {
+			clamped = bounds.Max
+		}
+	}
+	if clamped == nil {
+		return desired
+	}
+	glog.Warningf(
+		"%s merge operation: Desired value %v is clamped to %v: Range [%v, %v]",
+		fieldPath,
+		m.redacted(fieldPath, desired),
+		m.redacted(fieldPath, clamped),
+		bounds.Min,
+		bounds.Max,
+	)
+	return clamped
+}
+
+// vetoChange invokes the configured veto callback if the given old &
+// new scalar values of the given field differ. It returns true if the change
+// is vetoed & should be skipped. It returns error if the change is
+// vetoed & the merge should be aborted.
+func (m *merger) vetoChange(
+	fieldPath string, path []string, oldValue, newValue interface{},
+) (bool, error) {
+	if m.opts.VetoChange == nil || !isScalar(oldValue) || !isScalar(newValue) ||
+		reflect.DeepEqual(oldValue, newValue) {
+		return false, nil
+	}
+	err := m.opts.VetoChange(path, oldValue, newValue)
+	if err == nil {
+		return false, nil
+	}
+	if m.opts.SkipVetoedChanges {
+		// veto errors may quote the vetoed values
+		glog.V(4).Infof(
+			"%s merge operation: Will skip vetoed change: %v",
+			fieldPath, m.redacted(fieldPath, err.Error()),
+		)
+		return true, nil
+	}
+	return false, errors.Wrapf(err, "%s: Change vetoed", fieldPath)
+}
+
+// isDedupList returns true if duplicates of the list found at the
+// given field path should be removed
+func (m *merger) isDedupList(fieldPath string) bool {
+	return m.opts.DedupScalarLists || m.hasPath(m.opts.DedupScalarListPaths, fieldPath)
+}
+
+// dedupLists returns the given value found at the given field path
+// with its scalar lists deduplicated as per the configured options.
+// Nested values are deduplicated as well. Objects & lists are copied
+// only if they have duplicates.
+func (m *merger) dedupLists(fieldPath string, val interface{}) interface{} {
+	if !m.opts.DedupScalarLists && len(m.opts.DedupScalarListPaths) == 0 {
+		return val
+	}
+	switch tval := val.(type) {
+	case map[string]interface{}:
+		var out map[string]interface{}
+		for key, item := range tval {
+			deduped := m.dedupLists(fmt.Sprintf("%s[%s]", fieldPath, key), item)
+			if reflect.DeepEqual(deduped, item) {
+				continue
+			}
+			if out == nil {
+				out = make(map[string]interface{}, len(tval))
+				for k, v := range tval {
+					out[k] = v
+				}
+			}
+			out[key] = deduped
+		}
+		if out == nil {
+			return tval
+		}
+		return out
+	case []interface{}:
+		if m.isDedupList(fieldPath) {
+			return dedupScalars(tval)
+		}
+	}
+	return val
+}
+
+// dedupScalars returns the given list without duplicate values if all
+// its elements are JSON scalars. The first occurrence of each value is
+// retained. The given list is not modified & is returned as is if it
+// has no duplicates or has other elements.
+func dedupScalars(list []interface{}) []interface{} {
+	seen := make(map[interface{}]bool, len(list))
+	for _, item := range list {
+		switch item.(type) {
+		case string, bool, int64, float64, nil:
+			seen[item] = true
+		default:
+			return list
+		}
+	}
+	if len(seen) == len(list) {
+		return list
+	}
+	deduped := make([]interface{}, 0, len(seen))
+	for _, item := range list {
+		if seen[item] {
+			deduped = append(deduped, item)
+			delete(seen, item)
+		}
+	}
+	return deduped
+}
+
+// DefaultPreserveAnnotations lists the well known annotations that are
+// preserved unless PreserveAnnotations option is set
+var DefaultPreserveAnnotations = []string{
+	"kubectl.kubernetes.io/last-applied-configuration",
+	"kubectl.kubernetes.io/restartedAt",
+	"deployment.kubernetes.io/revision",
+	"deployment.kubernetes.io/desired-replicas",
+	"deployment.kubernetes.io/max-replicas",
+}
+
+// annotationsPath is the field path of the annotations
+const annotationsPath = "[metadata][annotations]"
+
+// retainPreservedAnnotations returns true if the given key of the given
+// object found at the given field path should not be deleted since it
+// is a preserved annotation. If the key is the annotations map itself,
+// the map is reduced to its preserved annotations instead of being
+// deleted & true is returned if any of these are found.
+func (m *merger) retainPreservedAnnotations(
+	fieldPath string, destination map[string]interface{}, key string,
+) bool {
+	switch {
+	case fieldPath == annotationsPath:
+		for _, name := range m.opts.PreserveAnnotations {
+			if key == name {
+				glog.V(4).Infof("%s merge operation: Will preserve annotation %s", fieldPath, key)
+				return true
+			}
+		}
+	case fieldPath == "[metadata]" && key == "annotations":
+		annotations, _ := destination[key].(map[string]interface{})
+		preserved := map[string]interface{}{}
+		for _, name := range m.opts.PreserveAnnotations {
+			if val, found := annotations[name]; found {
+				preserved[name] = val
+			}
+		}
+		if len(preserved) == 0 {
+			return false
+		}
+		glog.V(4).Infof(
+			"%s merge operation: Will preserve annotations %v",
+			fieldPath, m.redacted(annotationsPath, preserved),
+		)
+		if len(preserved) != len(annotations) {
+			m.recordChange(annotationsPath, ReasonFieldUpdated, annotations, preserved)
+			destination[key] = preserved
+		}
+		return true
+	}
+	return false
+}
+
+// prefixedMetadataFields lists the metadata maps that are managed as
+// per ManagedMetadataPrefix option. Empty values of these maps are
+// normalized before merge.
+var prefixedMetadataFields = []string{"labels", "annotations"}
+
+// scopeMetadataToPrefix returns the last applied & desired states to
+// be used to merge the labels & annotations having the configured
+// prefix. The last applied labels & annotations are replaced by the
+// prefixed ones found in observed. This deletes the observed prefixed
+// keys that are not set in desired. Desired labels & annotations are
+// filtered to have the prefixed keys only.
+func (m *merger) scopeMetadataToPrefix(
+	observed, lastApplied, desired map[string]interface{},
+) (map[string]interface{}, map[string]interface{}) {
+	obsMeta, _ := observed["metadata"].(map[string]interface{})
+	lastMeta, _ := lastApplied["metadata"].(map[string]interface{})
+	desMeta, _ := desired["metadata"].(map[string]interface{})
+
+	scopedLastMeta := copyMap(lastMeta)
+	scopedDesMeta := copyMap(desMeta)
+	for _, field := range prefixedMetadataFields {
+		obsMap, _ := obsMeta[field].(map[string]interface{})
+		obsPrefixed := m.withPrefixedKeys(obsMap)
+		desMap, desSet := desMeta[field].(map[string]interface{})
+		if len(obsPrefixed) == 0 && !desSet {
+			// nothing to manage
+			delete(scopedLastMeta, field)
+			delete(scopedDesMeta, field)
+			continue
+		}
+		scopedLastMeta[field] = obsPrefixed
+		scopedDesMeta[field] = m.withPrefixedKeys(desMap)
+	}
+
+	scopedLastApplied := copyMap(lastApplied)
+	scopedLastApplied["metadata"] = scopedLastMeta
+	scopedDesired := copyMap(desired)
+	if desMeta != nil || len(scopedDesMeta) > 0 {
+		scopedDesired["metadata"] = scopedDesMeta
+	}
+	return scopedLastApplied, scopedDesired
+}
+
+// isEmptyMetadataMap returns true if the given labels or annotations
+// are null or empty
+func isEmptyMetadataMap(val interface{}) bool {
+	if val == nil {
+		return true
+	}
+	obj, ok := val.(map[string]interface{})
+	return ok && len(obj) == 0
+}
+
+// normalizeEmptyMetadata returns the desired state to be merged such
+// that null, absent & empty labels or annotations are treated alike.
+// Desired labels or annotations that are empty are set to their empty
+// observed representation if any & are removed otherwise. This avoids
+// the churn of replacing one empty representation with another.
+func normalizeEmptyMetadata(observed, desired map[string]interface{}) map[string]interface{} {
+	obsMeta, _ := observed["metadata"].(map[string]interface{})
+	desMeta, ok := desired["metadata"].(map[string]interface{})
+	if !ok {
+		return desired
+	}
+	var normalizedMeta map[string]interface{}
+	for _, field := range prefixedMetadataFields {
+		obsVal, obsFound := obsMeta[field]
+		desVal, desFound := desMeta[field]
+		if !isEmptyMetadataMap(obsVal) || !isEmptyMetadataMap(desVal) {
+			continue
+		}
+		if !obsFound && !desFound {
+			continue
+		}
+		if normalizedMeta == nil {
+			normalizedMeta = copyMap(desMeta)
+		}
+		if obsFound {
+			normalizedMeta[field] = obsVal
+		} else {
+			delete(normalizedMeta, field)
+		}
+	}
+	if normalizedMeta == nil {
+		return desired
+	}
+	normalized := copyMap(desired)
+	normalized["metadata"] = normalizedMeta
+	return normalized
+}
+
+// copyMap returns a shallow copy of the given map. An empty map is
+// returned if the given map is nil.
+func copyMap(obj map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(obj))
+	for key, val := range obj {
+		out[key] = val
+	}
+	return out
+}
+
+// withPrefixedKeys returns a copy of the given map having only the
+// keys with the configured metadata prefix
+func (m *merger) withPrefixedKeys(obj map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(obj))
+	for key, val := range obj {
+		if strings.HasPrefix(key, m.opts.ManagedMetadataPrefix) {
+			out[key] = val
+		}
+	}
+	return out
+}
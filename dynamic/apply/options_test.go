@@ -0,0 +1,2116 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/diff"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// toJSONMap unmarshals the given JSON document into a map
+func toJSONMap(t testing.TB, in string) map[string]interface{} {
+	t.Helper()
+	out := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(in), &out); err != nil {
+		t.Fatalf("can't unmarshal %s: %v", in, err)
+	}
+	return out
+}
+
+// selectMostUniqueMergeKey is a merge key selector that selects the
+// candidate with the most unique values
+func selectMostUniqueMergeKey(candidates []string, lists ...[]interface{}) string {
+	var selected string
+	var maxUnique int
+	for _, candidate := range candidates {
+		unique := make(map[string]bool)
+		for _, list := range lists {
+			for _, item := range list {
+				unique[stringMergeKey(item.(map[string]interface{})[candidate])] = true
+			}
+		}
+		if len(unique) > maxUnique {
+			selected, maxUnique = candidate, len(unique)
+		}
+	}
+	return selected
+}
+
+func TestMergeWithOptions(t *testing.T) {
+	table := []struct {
+		name, observed, lastApplied, desired, want string
+		opts                                       *MergeOptions
+		wantErr                                    bool
+	}{
+		{
+			name:        "nil options",
+			observed:    `{"keep": "other", "remove": "other"}`,
+			lastApplied: `{"remove": "old"}`,
+			desired:     `{"add": "new"}`,
+			want:        `{"keep": "other", "add": "new"}`,
+		},
+		{
+			name: "shallow merge replaces nested values",
+			observed: `{
+				"spec": {
+					"config": {
+						"managed": {"user": "value", "level": 1},
+						"dropped": "old",
+						"external": {"user": "value"}
+					}
+				}
+			}`,
+			lastApplied: `{
+				"spec": {
+					"config": {
+						"managed": {"level": 1},
+						"dropped": "old"
+					}
+				}
+			}`,
+			desired: `{
+				"spec": {
+					"config": {
+						"managed": {"level": 2}
+					}
+				}
+			}`,
+			want: `{
+				"spec": {
+					"config": {
+						"managed": {"level": 2},
+						"external": {"user": "value"}
+					}
+				}
+			}`,
+			opts: &MergeOptions{
+				ShallowMergePaths: []string{"[spec][config]"},
+			},
+		},
+		{
+			name: "recursive merge without shallow merge paths",
+			observed: `{
+				"spec": {
+					"config": {
+						"managed": {"user": "value", "level": 1}
+					}
+				}
+			}`,
+			lastApplied: `{"spec": {"config": {"managed": {"level": 1}}}}`,
+			desired:     `{"spec": {"config": {"managed": {"level": 2}}}}`,
+			want: `{
+				"spec": {
+					"config": {
+						"managed": {"user": "value", "level": 2}
+					}
+				}
+			}`,
+		},
+		{
+			name: "switch union member",
+			observed: `{
+				"spec": {
+					"probe": {
+						"tcp": {"port": 80},
+						"periodSeconds": 10
+					}
+				}
+			}`,
+			lastApplied: `{}`,
+			desired: `{
+				"spec": {
+					"probe": {
+						"http": {"path": "/healthz"}
+					}
+				}
+			}`,
+			want: `{
+				"spec": {
+					"probe": {
+						"http": {"path": "/healthz"},
+						"periodSeconds": 10
+					}
+				}
+			}`,
+			opts: &MergeOptions{
+				UnionFields: map[string][]string{
+					"[spec][probe]": {"tcp", "udp", "http"},
+				},
+			},
+		},
+		{
+			name: "union members as per the first of the sorted matching patterns",
+			observed: `{
+				"spec": {
+					"probe": {
+						"tcp": {"port": 80},
+						"udp": {"port": 53}
+					}
+				}
+			}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"probe": {"http": {"path": "/healthz"}}}}`,
+			want: `{
+				"spec": {
+					"probe": {
+						"udp": {"port": 53},
+						"http": {"path": "/healthz"}
+					}
+				}
+			}`,
+			opts: &MergeOptions{
+				UnionFields: map[string][]string{
+					"[*][probe]": {"tcp", "http"},
+					"[spec][*]":  {"tcp", "udp", "http"},
+				},
+			},
+		},
+		{
+			name: "union members are retained if desired sets none",
+			observed: `{
+				"spec": {
+					"probe": {
+						"tcp": {"port": 80}
+					}
+				}
+			}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"probe": {"periodSeconds": 5}}}`,
+			want: `{
+				"spec": {
+					"probe": {
+						"tcp": {"port": 80},
+						"periodSeconds": 5
+					}
+				}
+			}`,
+			opts: &MergeOptions{
+				UnionFields: map[string][]string{
+					"[spec][probe]": {"tcp", "udp", "http"},
+				},
+			},
+		},
+		{
+			name: "list map above max elements is replaced",
+			observed: `{
+				"ports": [
+					{"port": 80},
+					{"port": 81},
+					{"port": 82, "external": true}
+				]
+			}`,
+			lastApplied: `{"ports": [{"port": 80}, {"port": 81}]}`,
+			desired:     `{"ports": [{"port": 80}, {"port": 81}]}`,
+			want:        `{"ports": [{"port": 80}, {"port": 81}]}`,
+			opts: &MergeOptions{
+				MaxListMapElements: 2,
+			},
+		},
+		{
+			name: "list map within max elements is merged",
+			observed: `{
+				"ports": [
+					{"port": 80},
+					{"port": 82, "external": true}
+				]
+			}`,
+			lastApplied: `{"ports": [{"port": 80}]}`,
+			desired:     `{"ports": [{"port": 80}, {"port": 81}]}`,
+			want: `{
+				"ports": [
+					{"port": 80},
+					{"port": 82, "external": true},
+					{"port": 81}
+				]
+			}`,
+			opts: &MergeOptions{
+				MaxListMapElements: 2,
+			},
+		},
+		{
+			name: "cooperative secret data",
+			observed: `{
+				"kind": "Secret",
+				"data": {
+					"managed": "b2xk",
+					"dropped": "b2xk",
+					"external": "ZXh0"
+				}
+			}`,
+			lastApplied: `{
+				"kind": "Secret",
+				"data": {"managed": "b2xk", "dropped": "b2xk"}
+			}`,
+			desired: `{
+				"kind": "Secret",
+				"data": {"managed": "bmV3"}
+			}`,
+			want: `{
+				"kind": "Secret",
+				"data": {
+					"managed": "bmV3",
+					"external": "ZXh0"
+				}
+			}`,
+			opts: &MergeOptions{
+				CooperativeDataMaps: true,
+			},
+		},
+		{
+			name: "resolve conflict by keeping observed at a path",
+			observed: `{
+				"spec": {"replicas": 5, "image": "app:external"}
+			}`,
+			lastApplied: `{
+				"spec": {"replicas": 1, "image": "app:1"}
+			}`,
+			desired: `{
+				"spec": {"replicas": 2, "image": "app:2"}
+			}`,
+			want: `{
+				"spec": {"replicas": 5, "image": "app:2"}
+			}`,
+			opts: &MergeOptions{
+				ResolveConflict: func(path []string, observed, lastApplied, desired interface{}) interface{} {
+					if reflect.DeepEqual(path, []string{"spec", "replicas"}) {
+						return observed
+					}
+					return desired
+				},
+			},
+		},
+		{
+			name:        "resolve conflict is not invoked without conflict",
+			observed:    `{"spec": {"replicas": 1}}`,
+			lastApplied: `{"spec": {"replicas": 1}}`,
+			desired:     `{"spec": {"replicas": 2}}`,
+			want:        `{"spec": {"replicas": 2}}`,
+			opts: &MergeOptions{
+				ResolveConflict: func(path []string, observed, lastApplied, desired interface{}) interface{} {
+					return observed
+				},
+			},
+		},
+		{
+			name: "identity fields are taken from observed",
+			observed: `{
+				"metadata": {"name": "test", "namespace": "default"}
+			}`,
+			lastApplied: `{}`,
+			desired: `{
+				"metadata": {"name": "test", "namespace": "template", "labels": {"app": "test"}}
+			}`,
+			want: `{
+				"metadata": {"name": "test", "namespace": "default", "labels": {"app": "test"}}
+			}`,
+		},
+		{
+			name:        "identity fields are taken from desired on create",
+			observed:    `{}`,
+			lastApplied: `{}`,
+			desired:     `{"metadata": {"name": "test", "namespace": "default"}}`,
+			want:        `{"metadata": {"name": "test", "namespace": "default"}}`,
+		},
+		{
+			name: "error on identity change",
+			observed: `{
+				"metadata": {"name": "test", "namespace": "default"}
+			}`,
+			lastApplied: `{}`,
+			desired: `{
+				"metadata": {"name": "test", "namespace": "template"}
+			}`,
+			opts: &MergeOptions{
+				ErrorOnIdentityChange: true,
+			},
+			want:    `{}`,
+			wantErr: true,
+		},
+		{
+			name: "preserve observed on empty desired",
+			observed: `{
+				"spec": {"hostname": "observed", "domain": "observed", "port": 80}
+			}`,
+			lastApplied: `{}`,
+			desired: `{
+				"spec": {"hostname": "", "domain": "desired", "port": 0}
+			}`,
+			want: `{
+				"spec": {"hostname": "observed", "domain": "desired", "port": 0}
+			}`,
+			opts: &MergeOptions{
+				PreserveOnEmpty: map[string]EmptyKind{
+					"[spec][hostname]": EmptyString,
+					"[spec][domain]":   EmptyString,
+					"[spec][port]":     EmptyString,
+				},
+			},
+		},
+		{
+			name:        "preserve on empty as per the first of the sorted matching patterns",
+			observed:    `{"spec": {"hostname": "observed"}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"hostname": ""}}`,
+			want:        `{"spec": {"hostname": ""}}`,
+			opts: &MergeOptions{
+				PreserveOnEmpty: map[string]EmptyKind{
+					"[*][hostname]": EmptyNumber,
+					"[spec][*]":     EmptyString,
+				},
+			},
+		},
+		{
+			name: "select the most unique merge key",
+			observed: `{
+				"ports": [
+					{"port": 80, "name": "http", "external": true},
+					{"port": 80, "name": "metrics"}
+				]
+			}`,
+			lastApplied: `{"ports": [{"port": 80, "name": "metrics"}]}`,
+			desired:     `{"ports": [{"port": 80, "name": "admin"}]}`,
+			want: `{
+				"ports": [
+					{"port": 80, "name": "http", "external": true},
+					{"port": 80, "name": "admin"}
+				]
+			}`,
+			opts: &MergeOptions{
+				SelectMergeKey: selectMostUniqueMergeKey,
+			},
+		},
+		{
+			name: "atomic small object replaces top level fields",
+			observed: `{
+				"metadata": {"labels": {"keep": "other"}},
+				"data": {"keep": "other", "key": "old"},
+				"remove": "old"
+			}`,
+			lastApplied: `{"data": {"key": "old"}, "remove": "old"}`,
+			desired: `{
+				"metadata": {"labels": {"add": "new"}},
+				"data": {"key": "new"}
+			}`,
+			want: `{
+				"metadata": {"labels": {"keep": "other", "add": "new"}},
+				"data": {"key": "new"}
+			}`,
+			opts: &MergeOptions{
+				AtomicBelowSizeBytes: 1024,
+			},
+		},
+		{
+			name: "object above atomic size is merged field by field",
+			observed: `{
+				"data": {"keep": "other", "key": "old"},
+				"remove": "old"
+			}`,
+			lastApplied: `{"data": {"key": "old"}, "remove": "old"}`,
+			desired:     `{"data": {"key": "new"}}`,
+			want:        `{"data": {"keep": "other", "key": "new"}}`,
+			opts: &MergeOptions{
+				AtomicBelowSizeBytes: 10,
+			},
+		},
+		{
+			name:        "null list element is taken verbatim on replace",
+			observed:    `{"slots": ["a", "b", "c"]}`,
+			lastApplied: `{"slots": ["a", "b", "c"]}`,
+			desired:     `{"slots": ["x", null, "z"]}`,
+			want:        `{"slots": ["x", null, "z"]}`,
+		},
+		{
+			name:        "null list element keeps observed on index merge",
+			observed:    `{"slots": ["a", "b", {"c": 1, "other": true}, "d"]}`,
+			lastApplied: `{"slots": ["a", "b", {"c": 1}]}`,
+			desired:     `{"slots": ["x", null, {"c": 2}]}`,
+			want:        `{"slots": ["x", "b", {"c": 2, "other": true}, "d"]}`,
+			opts: &MergeOptions{
+				IndexMergeListPaths: []string{"[slots]"},
+			},
+		},
+		{
+			name:        "removed element keeps the position of the element that follows on index merge",
+			observed:    `{"slots": [1, 2, 3, 4]}`,
+			lastApplied: `{"slots": [1, 2, 3]}`,
+			desired:     `{"slots": [5, null]}`,
+			want:        `{"slots": [5, 2, null, 4]}`,
+			opts: &MergeOptions{
+				IndexMergeListPaths: []string{"[slots]"},
+			},
+		},
+		{
+			name:        "trailing removed elements are trimmed on index merge",
+			observed:    `{"slots": [1, 2, 3]}`,
+			lastApplied: `{"slots": [1, 2, 3]}`,
+			desired:     `{"slots": [5]}`,
+			want:        `{"slots": [5]}`,
+			opts: &MergeOptions{
+				IndexMergeListPaths: []string{"[slots]"},
+			},
+		},
+		{
+			name:        "null list element deletes observed on index merge",
+			observed:    `{"slots": ["a", "b", "c", "d"]}`,
+			lastApplied: `{"slots": ["a", "b", "c", "d"]}`,
+			desired:     `{"slots": ["x", null]}`,
+			want:        `{"slots": ["x"]}`,
+			opts: &MergeOptions{
+				IndexMergeListPaths: []string{"[slots]"},
+				NullListElements:    NullElementDelete,
+			},
+		},
+		{
+			name:        "index merge retains dropped elements at a patch only path",
+			observed:    `{"slots": ["a", "b", "c"]}`,
+			lastApplied: `{"slots": ["a", "b", "c"]}`,
+			desired:     `{"slots": ["x"]}`,
+			want:        `{"slots": ["x", "b", "c"]}`,
+			opts: &MergeOptions{
+				IndexMergeListPaths: []string{"[slots]"},
+				PatchOnlyPaths:      []string{"[slots]"},
+			},
+		},
+		{
+			name:        "null list elements are compacted",
+			observed:    `{"slots": ["a", "b"], "spec": {"args": ["-v"]}}`,
+			lastApplied: `{}`,
+			desired:     `{"slots": ["x", null, "z", null], "spec": {"args": [null, "-q"]}}`,
+			want:        `{"slots": ["x", "z"], "spec": {"args": ["-q"]}}`,
+			opts: &MergeOptions{
+				CompactLists: true,
+			},
+		},
+		{
+			name:        "null list elements are compacted at a path",
+			observed:    `{"slots": ["a", "b"], "spec": {"args": ["-v"]}}`,
+			lastApplied: `{}`,
+			desired:     `{"slots": ["x", null, "z"], "spec": {"args": [null, "-q"]}}`,
+			want:        `{"slots": ["x", null, "z"], "spec": {"args": ["-q"]}}`,
+			opts: &MergeOptions{
+				CompactListPaths: []string{"[spec][args]"},
+			},
+		},
+		{
+			name:        "null list elements nested in list maps are compacted",
+			observed:    `{}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"containers": [{"name": "app", "args": [null, "-q"]}, {"name": "sidecar", "args": ["-v"]}]}}`,
+			want:        `{"spec": {"containers": [{"name": "app", "args": ["-q"]}, {"name": "sidecar", "args": ["-v"]}]}}`,
+			opts: &MergeOptions{
+				CompactLists: true,
+			},
+		},
+		{
+			name:        "null list element kept on index merge is compacted",
+			observed:    `{"slots": ["a"]}`,
+			lastApplied: `{"slots": ["a"]}`,
+			desired:     `{"slots": ["x", null, "z"]}`,
+			want:        `{"slots": ["x", "z"]}`,
+			opts: &MergeOptions{
+				IndexMergeListPaths: []string{"[slots]"},
+				CompactLists:        true,
+			},
+		},
+		{
+			name:        "add first label to null labels",
+			observed:    `{"metadata": {"name": "app", "labels": null}}`,
+			lastApplied: `{}`,
+			desired:     `{"metadata": {"labels": {"app": "web"}}}`,
+			want:        `{"metadata": {"name": "app", "labels": {"app": "web"}}}`,
+		},
+		{
+			name:        "add first prefixed label to null labels",
+			observed:    `{"metadata": {"name": "app", "labels": null}}`,
+			lastApplied: `{}`,
+			desired:     `{"metadata": {"labels": {"app.example.com/tier": "web"}}}`,
+			want:        `{"metadata": {"name": "app", "labels": {"app.example.com/tier": "web"}}}`,
+			opts: &MergeOptions{
+				ManagedMetadataPrefix: "app.example.com/",
+			},
+		},
+		{
+			name:        "empty desired labels & annotations keep empty observed as is",
+			observed:    `{"metadata": {"name": "app", "labels": null}}`,
+			lastApplied: `{"metadata": {"labels": {}, "annotations": {}}}`,
+			desired:     `{"metadata": {"labels": {}, "annotations": null}}`,
+			want:        `{"metadata": {"name": "app", "labels": null}}`,
+		},
+		{
+			name:        "label selector is preserved on update",
+			observed:    `{"metadata": {"name": "web"}, "spec": {"selector": {"matchLabels": {"app": "web"}}, "replicas": 1}}`,
+			lastApplied: `{"spec": {"selector": {"matchLabels": {"app": "web"}}, "replicas": 1}}`,
+			desired:     `{"spec": {"selector": {"matchLabels": {"app": "web", "tier": "a"}}, "replicas": 2}}`,
+			want:        `{"metadata": {"name": "web"}, "spec": {"selector": {"matchLabels": {"app": "web"}}, "replicas": 2}}`,
+		},
+		{
+			name:        "label selector change on update errors",
+			observed:    `{"metadata": {"name": "web"}, "spec": {"selector": {"matchLabels": {"app": "web"}}}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"selector": {"matchLabels": {"app": "api"}}}}`,
+			want:        `{}`,
+			wantErr:     true,
+			opts: &MergeOptions{
+				ErrorOnSelectorChange: true,
+			},
+		},
+		{
+			name:        "label selector is set on create",
+			observed:    `{}`,
+			lastApplied: `{}`,
+			desired:     `{"metadata": {"name": "web"}, "spec": {"selector": {"matchLabels": {"app": "web"}}}}`,
+			want:        `{"metadata": {"name": "web"}, "spec": {"selector": {"matchLabels": {"app": "web"}}}}`,
+			opts: &MergeOptions{
+				ErrorOnSelectorChange: true,
+			},
+		},
+		{
+			name:        "plain selector of a service is updated",
+			observed:    `{"metadata": {"name": "web"}, "spec": {"selector": {"app": "web"}}}`,
+			lastApplied: `{"spec": {"selector": {"app": "web"}}}`,
+			desired:     `{"spec": {"selector": {"app": "api"}}}`,
+			want:        `{"metadata": {"name": "web"}, "spec": {"selector": {"app": "api"}}}`,
+			opts: &MergeOptions{
+				ErrorOnSelectorChange: true,
+			},
+		},
+		{
+			name:        "managed status paths are merged per their strategy",
+			observed:    `{"status": {"observedGeneration": 1, "phase": "Running", "summary": {"ready": 1, "note": "warm"}, "conditions": [{"type": "Ready", "status": "False"}, {"type": "Synced", "status": "True"}]}}`,
+			lastApplied: `{"status": {"observedGeneration": 1, "summary": {"ready": 1}, "conditions": [{"type": "Ready", "status": "False"}]}}`,
+			desired:     `{"status": {"observedGeneration": 2, "phase": "Failed", "summary": {"ready": 2}, "conditions": [{"type": "Ready", "status": "True"}]}}`,
+			want:        `{"status": {"observedGeneration": 2, "phase": "Running", "summary": {"ready": 2}, "conditions": [{"type": "Ready", "status": "True"}, {"type": "Synced", "status": "True"}]}}`,
+			opts: &MergeOptions{
+				StatusPaths: []string{
+					"[status][observedGeneration]",
+					"[status][summary]",
+					"[status][conditions]",
+				},
+				AtomicPaths: []string{"[status][summary]"},
+				ListMapKeys: map[string][]string{"[status][conditions]": {"type"}},
+			},
+		},
+		{
+			name:        "status is not merged without managed status paths",
+			observed:    `{"status": {"observedGeneration": 1}}`,
+			lastApplied: `{}`,
+			desired:     `{"status": {"observedGeneration": 2}}`,
+			want:        `{"status": {"observedGeneration": 1}}`,
+			opts: &MergeOptions{
+				AtomicPaths: []string{"[status][summary]"},
+			},
+		},
+		{
+			name:        "anchor list map elements to both ends",
+			observed:    `{"steps": [{"name": "build"}, {"name": "init"}, {"name": "test"}]}`,
+			lastApplied: `{}`,
+			desired:     `{"steps": [{"name": "cleanup"}, {"name": "deploy"}]}`,
+			want:        `{"steps": [{"name": "init"}, {"name": "build"}, {"name": "test"}, {"name": "deploy"}, {"name": "cleanup"}]}`,
+			opts: &MergeOptions{
+				AnchorListMaps: map[string]ListMapAnchors{
+					"[steps]": {First: []string{"init"}, Last: []string{"cleanup"}},
+				},
+			},
+		},
+		{
+			name:        "anchor as per the first of the sorted matching patterns",
+			observed:    `{"spec": {"steps": [{"name": "build"}, {"name": "init"}]}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"steps": [{"name": "test"}]}}`,
+			want:        `{"spec": {"steps": [{"name": "init"}, {"name": "build"}, {"name": "test"}]}}`,
+			opts: &MergeOptions{
+				AnchorListMaps: map[string]ListMapAnchors{
+					"[*][steps]": {First: []string{"init"}},
+					"[spec][*]":  {Last: []string{"build"}},
+				},
+			},
+		},
+		{
+			name:        "anchored list map element must exist",
+			observed:    `{"steps": [{"name": "build"}]}`,
+			lastApplied: `{}`,
+			desired:     `{"steps": [{"name": "test"}]}`,
+			want:        `{}`,
+			wantErr:     true,
+			opts: &MergeOptions{
+				AnchorListMaps: map[string]ListMapAnchors{
+					"[steps]": {First: []string{"init"}},
+				},
+			},
+		},
+		{
+			name:        "append desired text to observed text",
+			observed:    `{"status": "ok", "spec": {"history": "v1 deployed"}}`,
+			lastApplied: `{"spec": {"history": "v1 deployed"}}`,
+			desired:     `{"spec": {"history": "v2 deployed"}}`,
+			want:        `{"status": "ok", "spec": {"history": "v1 deployed; v2 deployed"}}`,
+			opts: &MergeOptions{
+				AppendPaths: map[string]string{"[spec][history]": "; "},
+			},
+		},
+		{
+			name:        "text appended last time is not appended again",
+			observed:    `{"spec": {"history": "v1 deployed; v2 deployed"}}`,
+			lastApplied: `{"spec": {"history": "v2 deployed"}}`,
+			desired:     `{"spec": {"history": "v2 deployed"}}`,
+			want:        `{"spec": {"history": "v1 deployed; v2 deployed"}}`,
+			opts: &MergeOptions{
+				AppendPaths: map[string]string{"[spec][history]": "; "},
+			},
+		},
+		{
+			name:        "text at the end of observed is not appended again",
+			observed:    `{"spec": {"history": "v1 deployed; v2 deployed"}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"history": "v2 deployed"}}`,
+			want:        `{"spec": {"history": "v1 deployed; v2 deployed"}}`,
+			opts: &MergeOptions{
+				AppendPaths: map[string]string{"[spec][*]": "; "},
+			},
+		},
+		{
+			name:        "append as per the first of the sorted matching patterns",
+			observed:    `{"spec": {"history": "v1 deployed"}}`,
+			lastApplied: `{"spec": {"history": "v1 deployed"}}`,
+			desired:     `{"spec": {"history": "v2 deployed"}}`,
+			want:        `{"spec": {"history": "v1 deployed; v2 deployed"}}`,
+			opts: &MergeOptions{
+				AppendPaths: map[string]string{"[*][history]": "; ", "[spec][*]": ", "},
+			},
+		},
+		{
+			name:        "list map element marked to be kept survives deletion",
+			observed:    `{"rules": [{"name": "a"}, {"name": "b", "keep": true}, {"name": "c"}]}`,
+			lastApplied: `{"rules": [{"name": "a"}, {"name": "b"}, {"name": "c"}]}`,
+			desired:     `{"rules": [{"name": "a"}]}`,
+			want:        `{"rules": [{"name": "a"}, {"name": "b", "keep": true}]}`,
+			opts: &MergeOptions{
+				KeepListMapElement: func(fieldPath string, observed map[string]interface{}) bool {
+					return fieldPath == "[rules]" && observed["keep"] == true
+				},
+			},
+		},
+		{
+			name:        "null desired field gets its default",
+			observed:    `{"spec": {"strategy": "Recreate", "replicas": 2}}`,
+			lastApplied: `{"spec": {"strategy": "Recreate"}}`,
+			desired:     `{"spec": {"strategy": null, "mode": null}}`,
+			want:        `{"spec": {"strategy": "RollingUpdate", "mode": {"type": "auto"}, "replicas": 2}}`,
+			opts: &MergeOptions{
+				NullDefaults: map[string]interface{}{
+					"[spec][strategy]": "RollingUpdate",
+					"[*][mode]":        map[string]interface{}{"type": "auto"},
+				},
+			},
+		},
+		{
+			name:        "null default as per the first of the sorted matching patterns",
+			observed:    `{"spec": {"strategy": "Recreate"}}`,
+			lastApplied: `{"spec": {"strategy": "Recreate"}}`,
+			desired:     `{"spec": {"strategy": null}}`,
+			want:        `{"spec": {"strategy": "RollingUpdate"}}`,
+			opts: &MergeOptions{
+				NullDefaults: map[string]interface{}{
+					"[*][strategy]": "RollingUpdate",
+					"[spec][*]":     "Recreate",
+				},
+			},
+		},
+		{
+			name:        "omitted field that is null in observed gets its default",
+			observed:    `{"spec": {"strategy": null, "paused": null, "replicas": 2}}`,
+			lastApplied: `{"spec": {"paused": true}}`,
+			desired:     `{"spec": {"replicas": 3}}`,
+			want:        `{"spec": {"strategy": "RollingUpdate", "replicas": 3}}`,
+			opts: &MergeOptions{
+				NullDefaults: map[string]interface{}{
+					"[spec][strategy]": "RollingUpdate",
+					"[spec][paused]":   false,
+				},
+			},
+		},
+		{
+			name:        "well known annotations are preserved",
+			observed:    `{"metadata": {"annotations": {"deployment.kubernetes.io/revision": "3", "kubectl.kubernetes.io/last-applied-configuration": "{}", "app": "web"}}}`,
+			lastApplied: `{"metadata": {"annotations": {"deployment.kubernetes.io/revision": "2", "kubectl.kubernetes.io/last-applied-configuration": "{}", "app": "web"}}}`,
+			desired:     `{"metadata": {"annotations": {"app": "api"}}}`,
+			want:        `{"metadata": {"annotations": {"deployment.kubernetes.io/revision": "3", "kubectl.kubernetes.io/last-applied-configuration": "{}", "app": "api"}}}`,
+		},
+		{
+			name:        "well known annotations are preserved when annotations are dropped",
+			observed:    `{"metadata": {"annotations": {"deployment.kubernetes.io/revision": "3", "app": "web"}}}`,
+			lastApplied: `{"metadata": {"annotations": {"deployment.kubernetes.io/revision": "2", "app": "web"}}}`,
+			desired:     `{"metadata": {}}`,
+			want:        `{"metadata": {"annotations": {"deployment.kubernetes.io/revision": "3"}}}`,
+		},
+		{
+			name:        "preserved annotations are overridden",
+			observed:    `{"metadata": {"annotations": {"deployment.kubernetes.io/revision": "3", "team": "a"}}}`,
+			lastApplied: `{"metadata": {"annotations": {"deployment.kubernetes.io/revision": "2", "team": "a"}}}`,
+			desired:     `{"metadata": {"annotations": {}}}`,
+			want:        `{"metadata": {"annotations": {"team": "a"}}}`,
+			opts: &MergeOptions{
+				PreserveAnnotations: []string{"team"},
+			},
+		},
+		{
+			name:        "merge keyless list by structural signature",
+			observed:    `{"rules": [{"host": "a", "weight": 10, "paths": ["/"], "other": {"x": 1}}, {"host": "b", "weight": 10}]}`,
+			lastApplied: `{"rules": [{"host": "a", "weight": 10, "paths": ["/"]}, {"host": "b", "weight": 10}]}`,
+			desired:     `{"rules": [{"host": "a", "weight": 10, "paths": ["/", "/api"]}, {"host": "c", "weight": 10}]}`,
+			want:        `{"rules": [{"host": "a", "weight": 10, "paths": ["/", "/api"], "other": {"x": 1}}, {"host": "c", "weight": 10}]}`,
+			opts: &MergeOptions{
+				SignatureMergeKeys: true,
+			},
+		},
+		{
+			name:        "keyless list is replaced without signature merge keys",
+			observed:    `{"rules": [{"host": "a", "weight": 10, "paths": ["/"], "other": {"x": 1}}, {"host": "b", "weight": 10}]}`,
+			lastApplied: `{"rules": [{"host": "a", "weight": 10, "paths": ["/"]}, {"host": "b", "weight": 10}]}`,
+			desired:     `{"rules": [{"host": "a", "weight": 10, "paths": ["/", "/api"]}, {"host": "c", "weight": 10}]}`,
+			want:        `{"rules": [{"host": "a", "weight": 10, "paths": ["/", "/api"]}, {"host": "c", "weight": 10}]}`,
+		},
+		{
+			name:        "duplicate signatures in desired",
+			observed:    `{"rules": []}`,
+			lastApplied: `{}`,
+			desired:     `{"rules": [{"host": "a", "paths": ["/"]}, {"host": "a", "paths": ["/api"]}]}`,
+			want:        `{}`,
+			wantErr:     true,
+			opts: &MergeOptions{
+				SignatureMergeKeys: true,
+			},
+		},
+		{
+			name:        "required paths set by desired",
+			observed:    `{}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"replicas": 0, "containers": [{"name": "app", "image": "app:1"}]}}`,
+			want:        `{"spec": {"replicas": 0, "containers": [{"name": "app", "image": "app:1"}]}}`,
+			opts: &MergeOptions{
+				RequiredPaths: []string{"[spec][replicas]", "[spec][containers][app][image]"},
+			},
+		},
+		{
+			name:        "required paths missing or null in desired",
+			observed:    `{"spec": {"replicas": 1}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"replicas": null, "containers": [{"name": "app"}]}}`,
+			want:        `{}`,
+			wantErr:     true,
+			opts: &MergeOptions{
+				RequiredPaths: []string{"[spec][replicas]", "[spec][containers][app][image]"},
+			},
+		},
+		{
+			name:        "wrap observed scalar into list at a migrating path",
+			observed:    `{"spec": {"hosts": "a.example.com", "port": 80}}`,
+			lastApplied: `{"spec": {"hosts": "a.example.com"}}`,
+			desired:     `{"spec": {"hosts": ["a.example.com", "b.example.com"]}}`,
+			want:        `{"spec": {"hosts": ["a.example.com", "b.example.com"], "port": 80}}`,
+			opts: &MergeOptions{
+				CoerceShapePaths: []string{"[spec][hosts]"},
+			},
+		},
+		{
+			name:        "unwrap observed single element list at a migrating path",
+			observed:    `{"spec": {"host": ["a.example.com"]}}`,
+			lastApplied: `{"spec": {"host": ["a.example.com"]}}`,
+			desired:     `{"spec": {"host": "b.example.com"}}`,
+			want:        `{"spec": {"host": "b.example.com"}}`,
+			opts: &MergeOptions{
+				CoerceShapePaths: []string{"[spec][host]"},
+			},
+		},
+		{
+			name:        "unwrap observed list of many elements errors",
+			observed:    `{"spec": {"host": ["a.example.com", "b.example.com"]}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"host": "b.example.com"}}`,
+			want:        `{}`,
+			wantErr:     true,
+			opts: &MergeOptions{
+				CoerceShapePaths: []string{"[spec][host]"},
+			},
+		},
+		{
+			name:        "skip spec but remove finalizer when deleting",
+			observed:    `{"metadata": {"deletionTimestamp": "2019-10-01T10:00:00Z", "finalizers": ["a", "b"]}, "spec": {"replicas": 1}}`,
+			lastApplied: `{"metadata": {"finalizers": ["b"]}, "spec": {"replicas": 1}}`,
+			desired:     `{"metadata": {"finalizers": []}, "spec": {"replicas": 3}}`,
+			want:        `{"metadata": {"deletionTimestamp": "2019-10-01T10:00:00Z", "finalizers": ["a"]}, "spec": {"replicas": 1}}`,
+			opts: &MergeOptions{
+				FinalizersOnlyOnDeletion: true,
+			},
+		},
+		{
+			name:        "merge spec when not deleting",
+			observed:    `{"metadata": {"finalizers": ["a", "b"]}, "spec": {"replicas": 1}}`,
+			lastApplied: `{"metadata": {"finalizers": ["b"]}, "spec": {"replicas": 1}}`,
+			desired:     `{"metadata": {"finalizers": ["b"]}, "spec": {"replicas": 3}}`,
+			want:        `{"metadata": {"finalizers": ["b"]}, "spec": {"replicas": 3}}`,
+			opts: &MergeOptions{
+				FinalizersOnlyOnDeletion: true,
+			},
+		},
+		{
+			name:        "coerce observed string to desired number",
+			observed:    `{"spec": {"replicas": "3", "paused": "false", "port": 80}}`,
+			lastApplied: `{"spec": {"replicas": 2, "paused": true, "port": "81"}}`,
+			desired:     `{"spec": {"replicas": 4, "paused": false, "port": "80"}}`,
+			want:        `{"spec": {"replicas": 3, "paused": false, "port": "80"}}`,
+			opts: &MergeOptions{
+				CoerceTypes: true,
+				// observed wins conflicts & is retained as coerced
+				ResolveConflict: func(path []string, observed, lastApplied, desired interface{}) interface{} {
+					return observed
+				},
+			},
+		},
+		{
+			name:        "coerce observed at a path errors on invalid value",
+			observed:    `{"spec": {"replicas": "three"}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"replicas": 3}}`,
+			want:        `{}`,
+			wantErr:     true,
+			opts: &MergeOptions{
+				CoerceTypePaths: []string{"[spec][replicas]"},
+			},
+		},
+		{
+			name:        "duplicate keys in desired list map",
+			observed:    `{"spec": {"ports": [{"name": "http", "port": 80}]}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"ports": [{"port": 80, "name": "http"}, {"port": 80, "name": "web"}]}}`,
+			want:        `{}`,
+			wantErr:     true,
+		},
+		{
+			name:        "transform desired before merge",
+			observed:    `{"spec": {"rules": [{"name": "web", "host": "example.com"}]}}`,
+			lastApplied: `{"spec": {"rules": [{"name": "web", "host": "example.com"}]}}`,
+			desired:     `{"spec": {"rules": [{"name": "web", "host": " Example.COM "}], "replicas": 1}}`,
+			want:        `{"spec": {"rules": [{"name": "web", "host": "example.com"}], "replicas": 1}}`,
+			opts: &MergeOptions{
+				Transforms: map[string]TransformFunc{
+					"[spec][rules][*][host]": func(value interface{}) interface{} {
+						if host, ok := value.(string); ok {
+							return strings.ToLower(strings.TrimSpace(host))
+						}
+						return value
+					},
+				},
+			},
+		},
+		{
+			name:        "transform as per the first of the sorted matching patterns",
+			observed:    `{"spec": {"host": "example.com"}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"host": " Example.COM "}}`,
+			want:        `{"spec": {"host": "example.com"}}`,
+			opts: &MergeOptions{
+				Transforms: map[string]TransformFunc{
+					"[*][host]": func(value interface{}) interface{} {
+						return strings.ToLower(strings.TrimSpace(value.(string)))
+					},
+					"[spec][*]": func(value interface{}) interface{} {
+						return strings.TrimSpace(value.(string))
+					},
+				},
+			},
+		},
+		{
+			name:        "prefer longer list on conflict",
+			observed:    `{"hosts": ["a", "b", "c"]}`,
+			lastApplied: `{"hosts": ["a"]}`,
+			desired:     `{"hosts": ["a", "d"]}`,
+			want:        `{"hosts": ["a", "b", "c"]}`,
+			opts: &MergeOptions{
+				ScalarListStrategies: map[string]ScalarListStrategy{"[hosts]": ScalarListPreferLonger},
+			},
+		},
+		{
+			name:        "prefer shorter list on conflict",
+			observed:    `{"hosts": ["a", "b", "c"]}`,
+			lastApplied: `{"hosts": ["a"]}`,
+			desired:     `{"hosts": ["a", "d"]}`,
+			want:        `{"hosts": ["a", "d"]}`,
+			opts: &MergeOptions{
+				ScalarListStrategies: map[string]ScalarListStrategy{"[hosts]": ScalarListPreferShorter},
+			},
+		},
+		{
+			name:        "prefer longer list keeps desired without conflict",
+			observed:    `{"hosts": ["a"]}`,
+			lastApplied: `{"hosts": ["a"]}`,
+			desired:     `{"hosts": ["d"]}`,
+			want:        `{"hosts": ["d"]}`,
+			opts: &MergeOptions{
+				ScalarListStrategies: map[string]ScalarListStrategy{"[hosts]": ScalarListPreferLonger},
+			},
+		},
+		{
+			name:        "list strategy as per the first of the sorted matching patterns",
+			observed:    `{"spec": {"hosts": ["a", "b", "c"]}}`,
+			lastApplied: `{"spec": {"hosts": ["a"]}}`,
+			desired:     `{"spec": {"hosts": ["a", "d"]}}`,
+			want:        `{"spec": {"hosts": ["a", "b", "c"]}}`,
+			opts: &MergeOptions{
+				ScalarListStrategies: map[string]ScalarListStrategy{
+					"[*][hosts]": ScalarListPreferLonger,
+					"[spec][*]":  ScalarListPreferShorter,
+				},
+			},
+		},
+		{
+			name: "pass through top level fields not in desired",
+			observed: `{
+				"spec": {"keep": "other", "remove": "old"},
+				"extra": {"owner": "other"}
+			}`,
+			lastApplied: `{
+				"spec": {"remove": "old"},
+				"extra": {"owner": "other"}
+			}`,
+			desired: `{"spec": {"add": "new"}}`,
+			want: `{
+				"spec": {"keep": "other", "add": "new"},
+				"extra": {"owner": "other"}
+			}`,
+			opts: &MergeOptions{
+				PassthroughUnknownTopLevel: true,
+			},
+		},
+		{
+			name: "patch only path retains fields dropped from desired",
+			observed: `{
+				"spec": {
+					"config": {"a": "1", "b": "2", "nested": {"c": "3"}},
+					"remove": "old"
+				}
+			}`,
+			lastApplied: `{
+				"spec": {
+					"config": {"a": "1", "b": "2", "nested": {"c": "3"}},
+					"remove": "old"
+				}
+			}`,
+			desired: `{
+				"spec": {
+					"config": {"a": "10", "nested": {"d": "4"}}
+				}
+			}`,
+			want: `{
+				"spec": {
+					"config": {"a": "10", "b": "2", "nested": {"c": "3", "d": "4"}}
+				}
+			}`,
+			opts: &MergeOptions{
+				PatchOnlyPaths: []string{"[spec][config]"},
+			},
+		},
+		{
+			name:        "clamp desired value above max",
+			observed:    `{"spec": {"replicas": 3}}`,
+			lastApplied: `{"spec": {"replicas": 3}}`,
+			desired:     `{"spec": {"replicas": 500, "paused": false}}`,
+			want:        `{"spec": {"replicas": 100, "paused": false}}`,
+			opts: &MergeOptions{
+				ClampPaths: map[string]ClampRange{"[spec][replicas]": {Min: 1, Max: 100}},
+			},
+		},
+		{
+			name:        "clamp desired value below min",
+			observed:    `{"spec": {"replicas": 3}}`,
+			lastApplied: `{"spec": {"replicas": 3}}`,
+			desired:     `{"spec": {"replicas": 0}}`,
+			want:        `{"spec": {"replicas": 1}}`,
+			opts: &MergeOptions{
+				ClampPaths: map[string]ClampRange{"[spec][replicas]": {Min: 1, Max: 100}},
+			},
+		},
+		{
+			name:        "clamp int to fractional bounds",
+			observed:    `{"spec": {"replicas": 3, "surge": 3}}`,
+			lastApplied: `{"spec": {"replicas": 3, "surge": 3}}`,
+			desired:     `{"spec": {"replicas": 1, "surge": 9}}`,
+			want:        `{"spec": {"replicas": 2, "surge": 7}}`,
+			opts: &MergeOptions{
+				ClampPaths: map[string]ClampRange{
+					"[spec][replicas]": {Min: 1.5, Max: 10},
+					"[spec][surge]":    {Min: 0, Max: 7.5},
+				},
+			},
+		},
+		{
+			name:        "clamp as per the first of the sorted matching patterns",
+			observed:    `{"spec": {"replicas": 3}}`,
+			lastApplied: `{"spec": {"replicas": 3}}`,
+			desired:     `{"spec": {"replicas": 500}}`,
+			want:        `{"spec": {"replicas": 10}}`,
+			opts: &MergeOptions{
+				ClampPaths: map[string]ClampRange{
+					"[*][replicas]": {Min: 1, Max: 10},
+					"[spec][*]":     {Min: 1, Max: 100},
+				},
+			},
+		},
+		{
+			name: "list map keys override detection",
+			observed: `{
+				"disks": [
+					{"node": "n1", "device": "sda", "size": 1},
+					{"node": "n2", "device": "sda", "size": 1}
+				]
+			}`,
+			lastApplied: `{"disks": [{"node": "n1", "device": "sda", "size": 1}]}`,
+			desired:     `{"disks": [{"node": "n1", "device": "sda", "size": 2}]}`,
+			want: `{
+				"disks": [
+					{"node": "n1", "device": "sda", "size": 2},
+					{"node": "n2", "device": "sda", "size": 1}
+				]
+			}`,
+			opts: &MergeOptions{
+				ListMapKeys: map[string][]string{"[disks]": {"node", "device"}},
+			},
+		},
+		{
+			name:        "immutable field may be set once",
+			observed:    `{"spec": {}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"volumeID": "vol-1"}}`,
+			want:        `{"spec": {"volumeID": "vol-1"}}`,
+			opts: &MergeOptions{
+				ImmutablePaths: []string{"[spec][volumeID]"},
+			},
+		},
+		{
+			name:        "immutable field may be set to its current value",
+			observed:    `{"spec": {"volumeID": "vol-1"}}`,
+			lastApplied: `{"spec": {"volumeID": "vol-1"}}`,
+			desired:     `{"spec": {"volumeID": "vol-1", "size": 1}}`,
+			want:        `{"spec": {"volumeID": "vol-1", "size": 1}}`,
+			opts: &MergeOptions{
+				ImmutablePaths: []string{"[spec][volumeID]"},
+			},
+		},
+		{
+			name:        "immutable object can't be changed",
+			observed:    `{"spec": {"selector": {"app": "test"}}}`,
+			lastApplied: `{"spec": {"selector": {"app": "test"}}}`,
+			desired:     `{"spec": {"selector": {"app": "other"}}}`,
+			want:        `{}`,
+			opts: &MergeOptions{
+				ImmutablePaths: []string{"[spec][selector]"},
+			},
+			wantErr: true,
+		},
+		{
+			name:        "immutable field can't be removed",
+			observed:    `{"spec": {"volumeID": "vol-1"}}`,
+			lastApplied: `{"spec": {"volumeID": "vol-1"}}`,
+			desired:     `{"spec": {}}`,
+			want:        `{}`,
+			opts: &MergeOptions{
+				ImmutablePaths: []string{"[spec][volumeID]"},
+			},
+			wantErr: true,
+		},
+		{
+			name:        "patch directive replaces object",
+			observed:    `{"spec": {"config": {"a": 1, "b": 2}}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"config": {"$patch": "replace", "c": 3}}}`,
+			want:        `{"spec": {"config": {"c": 3}}}`,
+		},
+		{
+			name:        "custom directive prefix preserves $ keys as data",
+			observed:    `{"spec": {"schema": {"$ref": "#/a", "type": "object"}, "config": {"a": 1}}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"schema": {"$ref": "#/b", "$patch": "replace"}, "config": {"x-metac-patch": "replace", "c": 3}}}`,
+			want:        `{"spec": {"schema": {"$ref": "#/b", "$patch": "replace", "type": "object"}, "config": {"c": 3}}}`,
+			opts: &MergeOptions{
+				DirectivePrefix: "x-metac-",
+			},
+		},
+		{
+			name:        "directive is not set in a new object",
+			observed:    `{"spec": {}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"config": {"x-metac-patch": "replace", "c": 3}}}`,
+			want:        `{"spec": {"config": {"c": 3}}}`,
+			opts: &MergeOptions{
+				DirectivePrefix: "x-metac-",
+			},
+		},
+		{
+			name:        "status is not managed by default",
+			observed:    `{"spec": {"replicas": 1}, "status": {"phase": "Running"}}`,
+			lastApplied: `{"status": {"message": "hello"}}`,
+			desired:     `{"spec": {"replicas": 2}, "status": {"phase": "Pending"}}`,
+			want:        `{"spec": {"replicas": 2}, "status": {"phase": "Running"}}`,
+		},
+		{
+			name:        "status is not added by default",
+			observed:    `{"spec": {"replicas": 1}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"replicas": 1}, "status": {"phase": "Pending"}}`,
+			want:        `{"spec": {"replicas": 1}}`,
+		},
+		{
+			name:        "status is merged if enabled",
+			observed:    `{"spec": {"replicas": 1}, "status": {"phase": "Running", "message": "hello"}}`,
+			lastApplied: `{"status": {"message": "hello"}}`,
+			desired:     `{"spec": {"replicas": 1}, "status": {"phase": "Pending"}}`,
+			want:        `{"spec": {"replicas": 1}, "status": {"phase": "Pending"}}`,
+			opts: &MergeOptions{
+				MergeStatus: true,
+			},
+		},
+		{
+			name:        "glob path matches image of every container",
+			observed:    `{"spec": {"containers": [{"name": "app", "image": "app:1"}, {"name": "sidecar", "image": "sidecar:1"}]}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"containers": [{"name": "app", "image": ""}, {"name": "sidecar", "image": ""}]}}`,
+			want:        `{"spec": {"containers": [{"name": "app", "image": "app:1"}, {"name": "sidecar", "image": "sidecar:1"}]}}`,
+			opts: &MergeOptions{
+				PreserveOnEmpty: map[string]EmptyKind{
+					"[spec][containers][*][image]": EmptyString,
+				},
+			},
+		},
+		{
+			name:        "custom path matcher",
+			observed:    `{"spec": {"config": {"a": {"x": 1}}}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"config": {"a": {"y": 2}}}}`,
+			want:        `{"spec": {"config": {"a": {"y": 2}}}}`,
+			opts: &MergeOptions{
+				ShallowMergePaths: []string{"config"},
+				MatchPath: func(pattern, fieldPath string) bool {
+					return strings.HasSuffix(fieldPath, "["+pattern+"]")
+				},
+			},
+		},
+		{
+			name:        "equal durations retain observed",
+			observed:    `{"spec": {"timeout": "60s", "interval": "1m"}}`,
+			lastApplied: `{"spec": {"timeout": "1m", "interval": "1m"}}`,
+			desired:     `{"spec": {"timeout": "1m", "interval": "2m"}}`,
+			want:        `{"spec": {"timeout": "60s", "interval": "2m"}}`,
+			opts: &MergeOptions{
+				Comparators: map[string]ValueComparator{
+					"[spec][timeout]":  CompareDurations,
+					"[spec][interval]": CompareDurations,
+				},
+			},
+		},
+		{
+			name:        "equal YAML retains observed",
+			observed:    `{"data": {"config": "b: 2\na: [x, y]\n", "other": "a: 1\n"}}`,
+			lastApplied: `{"data": {"config": "a: [x, y]\nb: 2\n", "other": "a: 1\n"}}`,
+			desired:     `{"data": {"config": "a:\n- x\n- y\nb: 2\n", "other": "a: 2\n"}}`,
+			want:        `{"data": {"config": "b: 2\na: [x, y]\n", "other": "a: 2\n"}}`,
+			opts: &MergeOptions{
+				Comparators: map[string]ValueComparator{
+					"[data][*]": CompareParsed(parseYAML),
+				},
+			},
+		},
+		{
+			name:        "equal boolean spellings retain observed",
+			observed:    `{"metadata": {"annotations": {"sidecar/inject": "yes", "debug": "on", "trace": "yes"}}}`,
+			lastApplied: `{}`,
+			desired:     `{"metadata": {"annotations": {"sidecar/inject": "true", "debug": "NO", "trace": "true"}}}`,
+			want:        `{"metadata": {"annotations": {"sidecar/inject": "yes", "debug": "false", "trace": "true"}}}`,
+			opts: &MergeOptions{
+				BooleanStringPaths: []string{
+					"[metadata][annotations][sidecar/inject]",
+					"[metadata][annotations][debug]",
+				},
+			},
+		},
+		{
+			name:        "durations are compared at configured paths only",
+			observed:    `{"spec": {"timeout": "60s"}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"timeout": "1m"}}`,
+			want:        `{"spec": {"timeout": "1m"}}`,
+		},
+		{
+			name:        "dedup scalar list at a path",
+			observed:    `{"spec": {"args": ["-v"], "hosts": ["a"]}}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"args": ["-v", "-x", "-v", "-y", "-x"], "hosts": ["a", "b", "a"]}}`,
+			want:        `{"spec": {"args": ["-v", "-x", "-y"], "hosts": ["a", "b", "a"]}}`,
+			opts: &MergeOptions{
+				DedupScalarListPaths: []string{"[spec][args]"},
+			},
+		},
+		{
+			name:        "dedup all scalar lists",
+			observed:    `{}`,
+			lastApplied: `{}`,
+			desired:     `{"spec": {"ports": [80, 80, 443], "hosts": ["a", "b", "a"], "items": [{"a": 1}, {"a": 1}]}}`,
+			want:        `{"spec": {"ports": [80, 443], "hosts": ["a", "b"], "items": [{"a": 1}, {"a": 1}]}}`,
+			opts: &MergeOptions{
+				DedupScalarLists: true,
+			},
+		},
+		{
+			name: "manage prefixed labels & annotations only",
+			observed: `{
+				"metadata": {
+					"labels": {"app.example.com/tier": "web", "app.example.com/old": "x", "team": "a"},
+					"annotations": {"note": "keep"}
+				},
+				"spec": {"replicas": 1}
+			}`,
+			lastApplied: `{"metadata": {"labels": {"team": "a"}}, "spec": {"replicas": 1}}`,
+			desired: `{
+				"metadata": {
+					"labels": {"app.example.com/tier": "api", "team": "b"},
+					"annotations": {"app.example.com/owner": "ctrl"}
+				}
+			}`,
+			want: `{
+				"metadata": {
+					"labels": {"app.example.com/tier": "api", "team": "a"},
+					"annotations": {"note": "keep", "app.example.com/owner": "ctrl"}
+				}
+			}`,
+			opts: &MergeOptions{
+				ManagedMetadataPrefix: "app.example.com/",
+			},
+		},
+		{
+			name: "delete prefixed labels if desired sets none",
+			observed: `{
+				"metadata": {
+					"name": "test",
+					"labels": {"app.example.com/tier": "web", "team": "a"},
+					"annotations": {"note": "keep"}
+				}
+			}`,
+			lastApplied: `{}`,
+			desired:     `{"metadata": {"name": "test"}}`,
+			want: `{
+				"metadata": {
+					"name": "test",
+					"labels": {"team": "a"},
+					"annotations": {"note": "keep"}
+				}
+			}`,
+			opts: &MergeOptions{
+				ManagedMetadataPrefix: "app.example.com/",
+			},
+		},
+		{
+			name: "merge keyless list by content",
+			observed: `{"spec": {"rules": [
+				{"verbs": ["get"], "resources": ["pods"]},
+				{"verbs": ["list"], "resources": ["nodes"]},
+				{"verbs": ["watch"], "resources": ["external"]}
+			]}}`,
+			lastApplied: `{"spec": {"rules": [
+				{"verbs": ["get"], "resources": ["pods"]},
+				{"verbs": ["list"], "resources": ["nodes"]}
+			]}}`,
+			desired: `{"spec": {"rules": [
+				{"resources": ["pods"], "verbs": ["get"]},
+				{"verbs": ["create"], "resources": ["jobs"]},
+				{"verbs": ["create"], "resources": ["jobs"]}
+			]}}`,
+			want: `{"spec": {"rules": [
+				{"verbs": ["get"], "resources": ["pods"]},
+				{"verbs": ["watch"], "resources": ["external"]},
+				{"verbs": ["create"], "resources": ["jobs"]}
+			]}}`,
+			opts: &MergeOptions{
+				ContentMergeListPaths: []string{"[spec][rules]"},
+			},
+		},
+		{
+			name:        "generateName is taken from observed on update",
+			observed:    `{"metadata": {"name": "job-x7k2p", "generateName": "job-"}}`,
+			lastApplied: `{}`,
+			desired:     `{"metadata": {"generateName": "task-", "labels": {"app": "job"}}}`,
+			want:        `{"metadata": {"name": "job-x7k2p", "generateName": "job-", "labels": {"app": "job"}}}`,
+		},
+		{
+			name:        "generateName is dropped on update",
+			observed:    `{"metadata": {"name": "job-x7k2p", "generateName": "job-"}}`,
+			lastApplied: `{}`,
+			desired:     `{"metadata": {"name": "", "generateName": "job-"}}`,
+			want:        `{"metadata": {"name": "job-x7k2p"}}`,
+			opts: &MergeOptions{
+				GenerateNamePolicy: GenerateNameDrop,
+			},
+		},
+		{
+			name:        "generateName is set on create",
+			observed:    `{}`,
+			lastApplied: `{}`,
+			desired:     `{"metadata": {"generateName": "job-"}}`,
+			want:        `{"metadata": {"generateName": "job-"}}`,
+			opts: &MergeOptions{
+				GenerateNamePolicy: GenerateNameDrop,
+			},
+		},
+	}
+
+	for _, tc := range table {
+		observed := toJSONMap(t, tc.observed)
+		lastApplied := toJSONMap(t, tc.lastApplied)
+		desired := toJSONMap(t, tc.desired)
+		want := toJSONMap(t, tc.want)
+
+		got, err := MergeWithOptions(observed, lastApplied, desired, tc.opts)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%v: want error, got none", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: MergeWithOptions error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Logf("reflect diff: a=got, b=want:\n%s", diff.ObjectReflectDiff(got, want))
+			t.Errorf("%v: MergeWithOptions() = %#v, want %#v", tc.name, got, want)
+		}
+	}
+}
+
+func TestMergeMaxVisitedFields(t *testing.T) {
+	data := make(map[string]interface{}, 1000)
+	for idx := 0; idx < 1000; idx++ {
+		data[fmt.Sprintf("key%d", idx)] = "value"
+	}
+	large := map[string]interface{}{"data": data}
+	opts := &MergeOptions{MaxVisitedFields: 100}
+
+	_, err := MergeWithOptions(large, large, large, opts)
+	if err == nil || !strings.Contains(err.Error(), "Merge visited too many fields: Max 100 fields") {
+		t.Errorf("MergeWithOptions(): got error %v, want visited fields error", err)
+	}
+
+	normal := toJSONMap(t, testDesiredJSON)
+	if _, err := MergeWithOptions(normal, normal, normal, opts); err != nil {
+		t.Errorf("MergeWithOptions(): got error %v, want none", err)
+	}
+}
+
+func TestMergeCoerceTypes(t *testing.T) {
+	observed := toJSONMap(t, `{"spec": {"replicas": "3"}}`)
+	desired := toJSONMap(t, `{"spec": {"replicas": 3}}`)
+	opts := &MergeOptions{
+		// replicas are owned by an autoscaler
+		VetoChange: func(path []string, oldValue, newValue interface{}) error {
+			return errors.Errorf("replicas changed from %v to %v", oldValue, newValue)
+		},
+	}
+
+	// coerced observed value equals desired & is not a change
+	opts.CoerceTypes = true
+	got, err := MergeWithOptions(observed, desired, desired, opts)
+	if err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	if !reflect.DeepEqual(got, desired) {
+		t.Errorf("MergeWithOptions() = %#v, want %#v", got, desired)
+	}
+
+	opts.CoerceTypes = false
+	if _, err := MergeWithOptions(observed, desired, desired, opts); err == nil {
+		t.Errorf("MergeWithOptions(): want veto error without coercion, got none")
+	}
+
+	opts.CoerceTypes = true
+	observed = toJSONMap(t, `{"spec": {"replicas": "three"}}`)
+	_, err = MergeWithOptions(observed, desired, desired, opts)
+	if err == nil || !strings.Contains(err.Error(), "[spec][replicas]: Type mismatch") {
+		t.Errorf("MergeWithOptions(): got error %v, want type mismatch error", err)
+	}
+}
+
+func TestMergeImmutablePathsError(t *testing.T) {
+	_, err := MergeWithOptions(
+		toJSONMap(t, `{"spec": {"volumeID": "vol-1"}}`),
+		toJSONMap(t, `{"spec": {"volumeID": "vol-1"}}`),
+		toJSONMap(t, `{"spec": {"volumeID": "vol-2"}}`),
+		&MergeOptions{ImmutablePaths: []string{"[spec][volumeID]"}},
+	)
+	if err == nil {
+		t.Fatalf("want error, got none")
+	}
+	if !strings.Contains(err.Error(), "[spec][volumeID]") {
+		t.Errorf("want error with path [spec][volumeID], got %v", err)
+	}
+}
+
+func TestMergeCooperativeDataMapsAcrossReconciles(t *testing.T) {
+	table := []struct {
+		name     string
+		observed string
+		opts     *MergeOptions
+	}{
+		{
+			name:     "well known config map data",
+			observed: `{"kind": "ConfigMap", "data": {"external": "keep"}}`,
+			opts:     &MergeOptions{CooperativeDataMaps: true},
+		},
+		{
+			name:     "generic string map",
+			observed: `{"kind": "Custom", "data": {"external": "keep"}}`,
+			opts:     &MergeOptions{ShallowMergePaths: []string{"[data]"}},
+		},
+	}
+	for _, tc := range table {
+		observed := toJSONMap(t, tc.observed)
+		kind := observed["kind"]
+
+		// first reconcile adds the controller's keys
+		desired := map[string]interface{}{
+			"kind": kind,
+			"data": map[string]interface{}{"a": "1", "b": "2"},
+		}
+		observed, err := MergeWithOptions(observed, nil, desired, tc.opts)
+		if err != nil {
+			t.Fatalf("%s: MergeWithOptions error: %v", tc.name, err)
+		}
+		lastApplied := desired
+
+		// second reconcile drops one of the controller's keys
+		desired = map[string]interface{}{
+			"kind": kind,
+			"data": map[string]interface{}{"a": "1"},
+		}
+		got, err := MergeWithOptions(observed, lastApplied, desired, tc.opts)
+		if err != nil {
+			t.Fatalf("%s: MergeWithOptions error: %v", tc.name, err)
+		}
+		want := map[string]interface{}{
+			"kind": kind,
+			"data": map[string]interface{}{"a": "1", "external": "keep"},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: MergeWithOptions() = %#v, want %#v", tc.name, got, want)
+		}
+	}
+}
+
+// parseYAML parses the given YAML document to its canonical form
+func parseYAML(in string) (interface{}, error) {
+	var out interface{}
+	err := yaml.Unmarshal([]byte(in), &out)
+	return out, err
+}
+
+func TestMergeKeyFuncs(t *testing.T) {
+	hostPort := func(element map[string]interface{}) (string, bool) {
+		host, ok := element["host"].(string)
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("%s:%v", host, element["port"]), true
+	}
+	opts := &MergeOptions{
+		KeyFuncs: map[string]KeyFunc{"[spec][endpoints]": hostPort},
+	}
+	observed := toJSONMap(t, `{
+		"spec": {
+			"endpoints": [
+				{"host": "a", "port": 80, "weight": 1},
+				{"host": "a", "port": 443, "weight": 1},
+				{"host": "b", "port": 80, "weight": 1}
+			]
+		}
+	}`)
+	lastApplied := toJSONMap(t, `{
+		"spec": {
+			"endpoints": [
+				{"host": "a", "port": 80, "weight": 1},
+				{"host": "a", "port": 443, "weight": 1}
+			]
+		}
+	}`)
+	desired := toJSONMap(t, `{
+		"spec": {
+			"endpoints": [
+				{"host": "a", "port": 80, "weight": 5},
+				{"host": "c", "port": 80}
+			]
+		}
+	}`)
+	got, err := MergeWithOptions(observed, lastApplied, desired, opts)
+	if err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	want := toJSONMap(t, `{
+		"spec": {
+			"endpoints": [
+				{"host": "a", "port": 80, "weight": 5},
+				{"host": "b", "port": 80, "weight": 1},
+				{"host": "c", "port": 80}
+			]
+		}
+	}`)
+	if !reflect.DeepEqual(got, want) {
+		t.Logf("reflect diff: a=got, b=want:\n%s", diff.ObjectReflectDiff(got, want))
+		t.Errorf("MergeWithOptions() = %#v, want %#v", got, want)
+	}
+
+	// list is replaced if any element can't be identified
+	desired = toJSONMap(t, `{"spec": {"endpoints": [{"port": 80}]}}`)
+	got, err = MergeWithOptions(observed, lastApplied, desired, opts)
+	if err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	if !reflect.DeepEqual(got, desired) {
+		t.Errorf("MergeWithOptions() = %#v, want %#v", got, desired)
+	}
+}
+
+func TestEffectiveOptions(t *testing.T) {
+	got := EffectiveOptions(nil)
+	if got.MatchPath == nil {
+		t.Errorf("got nil MatchPath, want default")
+	}
+	if got.DirectivePrefix != "$" ||
+		got.GenerateNamePolicy != GenerateNameFromObserved ||
+		got.NullListElements != NullElementKeep ||
+		!reflect.DeepEqual(got.PreserveAnnotations, DefaultPreserveAnnotations) {
+		t.Errorf("got effective options %+v, want defaults", got)
+	}
+
+	opts := &MergeOptions{
+		DirectivePrefix:     "x-",
+		NullListElements:    NullElementDelete,
+		PreserveAnnotations: []string{},
+		MergeStatus:         true,
+	}
+	got = EffectiveOptions(opts)
+	if got.DirectivePrefix != "x-" ||
+		got.GenerateNamePolicy != GenerateNameFromObserved ||
+		got.NullListElements != NullElementDelete ||
+		len(got.PreserveAnnotations) != 0 || got.PreserveAnnotations == nil ||
+		!got.MergeStatus {
+		t.Errorf("got effective options %+v, want overrides", got)
+	}
+	if opts.GenerateNamePolicy != "" || opts.MatchPath != nil {
+		t.Errorf("got options %+v, want them unmodified", opts)
+	}
+}
+
+func TestMergeRequiredPaths(t *testing.T) {
+	opts := &MergeOptions{
+		RequiredPaths: []string{"[spec][replicas]", "[spec][selector]", "[spec][template]"},
+	}
+	_, err := MergeWithOptions(
+		toJSONMap(t, `{}`),
+		nil,
+		toJSONMap(t, `{"spec": {"replicas": null, "template": {}}}`),
+		opts,
+	)
+	want := "Missing required desired fields: [spec][replicas], [spec][selector]"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("MergeWithOptions(): want error %q, got %v", want, err)
+	}
+}
+
+func TestMergeOnListMapElement(t *testing.T) {
+	observed := `{
+		"containers": [
+			{"name": "app", "image": "app:1", "imagePullPolicy": "Always"},
+			{"name": "sidecar", "image": "sidecar:1"}
+		]
+	}`
+	desired := `{
+		"containers": [
+			{"name": "app", "image": "app:2"},
+			{"name": "sidecar"},
+			{"name": "init", "image": "init:1"}
+		]
+	}`
+	var keys []string
+	hook := func(fieldPath, key string, observed, desired map[string]interface{}) error {
+		keys = append(keys, fieldPath+"["+key+"]")
+		if desired["image"] == nil {
+			return errors.Errorf("Image is required")
+		}
+		if observed == nil && desired["imagePullPolicy"] == nil {
+			desired["imagePullPolicy"] = "IfNotPresent"
+		}
+		return nil
+	}
+	desiredObj := toJSONMap(t, desired)
+
+	_, err := MergeWithOptions(toJSONMap(t, observed), nil, desiredObj, &MergeOptions{
+		OnListMapElement: hook,
+	})
+	if err == nil || !strings.Contains(err.Error(), "[containers][sidecar]: List map element vetoed") {
+		t.Errorf("MergeWithOptions(): want veto error, got %v", err)
+	}
+
+	keys = nil
+	got, err := MergeWithOptions(toJSONMap(t, observed), nil, desiredObj, &MergeOptions{
+		OnListMapElement:  hook,
+		SkipVetoedChanges: true,
+	})
+	if err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	want := toJSONMap(t, `{
+		"containers": [
+			{"name": "app", "image": "app:2", "imagePullPolicy": "Always"},
+			{"name": "sidecar", "image": "sidecar:1"},
+			{"name": "init", "image": "init:1", "imagePullPolicy": "IfNotPresent"}
+		]
+	}`)
+	if !reflect.DeepEqual(got, want) {
+		t.Logf("reflect diff: a=got, b=want:\n%s", diff.ObjectReflectDiff(got, want))
+		t.Errorf("MergeWithOptions() = %#v, want %#v", got, want)
+	}
+	wantKeys := []string{"[containers][app]", "[containers][sidecar]", "[containers][init]"}
+	if !reflect.DeepEqual(keys, wantKeys) {
+		t.Errorf("got hook keys %v, want %v", keys, wantKeys)
+	}
+	// desired must not be modified by the hook
+	if !reflect.DeepEqual(desiredObj, toJSONMap(t, desired)) {
+		t.Errorf("got desired %#v, want it unmodified", desiredObj)
+	}
+}
+
+func TestMergeKeyFieldsAreImmutable(t *testing.T) {
+	caseInsensitiveName := func(element map[string]interface{}) (string, bool) {
+		name, ok := element["name"].(string)
+		return strings.ToLower(name), ok
+	}
+	observed := toJSONMap(t, `{"spec": {"users": [{"name": "admin", "role": "a"}]}}`)
+	desired := toJSONMap(t, `{"spec": {"users": [{"name": "Admin", "role": "b"}]}}`)
+
+	// key fields are unknown
+	opts := &MergeOptions{
+		KeyFuncs: map[string]KeyFunc{"[spec][users]": caseInsensitiveName},
+	}
+	if _, err := MergeWithOptions(observed, nil, desired, opts); err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+
+	opts.ListMapKeys = map[string][]string{"[spec][users]": {"name"}}
+	_, err := MergeWithOptions(observed, nil, desired, opts)
+	want := `[spec][users][admin]: Can't change list map key field "name"`
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("MergeWithOptions(): want error %q, got %v", want, err)
+	}
+}
+
+func TestMergeReorderListMap(t *testing.T) {
+	observed := toJSONMap(t, `{
+		"containers": [
+			{"name": "sidecar", "image": "sidecar:1"},
+			{"name": "app", "image": "app:1"}
+		]
+	}`)
+	desired := toJSONMap(t, `{
+		"containers": [
+			{"name": "sidecar", "image": "sidecar:1"},
+			{"name": "app", "image": "app:2"},
+			{"name": "init", "image": "init:1"}
+		]
+	}`)
+	sidecarLast := func(fieldPath string, merged []interface{}) []interface{} {
+		var reordered, sidecars []interface{}
+		for _, item := range merged {
+			if item.(map[string]interface{})["name"] == "sidecar" {
+				sidecars = append(sidecars, item)
+			} else {
+				reordered = append(reordered, item)
+			}
+		}
+		return append(reordered, sidecars...)
+	}
+
+	got, err := MergeWithOptions(observed, nil, desired, &MergeOptions{ReorderListMap: sidecarLast})
+	if err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	want := toJSONMap(t, `{
+		"containers": [
+			{"name": "app", "image": "app:2"},
+			{"name": "init", "image": "init:1"},
+			{"name": "sidecar", "image": "sidecar:1"}
+		]
+	}`)
+	if !reflect.DeepEqual(got, want) {
+		t.Logf("reflect diff: a=got, b=want:\n%s", diff.ObjectReflectDiff(got, want))
+		t.Errorf("MergeWithOptions() = %#v, want %#v", got, want)
+	}
+
+	// reorder must preserve the elements
+	dropFirst := func(fieldPath string, merged []interface{}) []interface{} {
+		return append(merged[1:], merged[1])
+	}
+	_, err = MergeWithOptions(observed, nil, desired, &MergeOptions{ReorderListMap: dropFirst})
+	if err == nil || !strings.Contains(err.Error(), "Invalid list map reorder") {
+		t.Errorf("MergeWithOptions(): want reorder error, got %v", err)
+	}
+}
+
+func TestMergeVetoChange(t *testing.T) {
+	vetoDecrease := func(path []string, oldValue, newValue interface{}) error {
+		if !reflect.DeepEqual(path, []string{"spec", "replicas"}) {
+			return nil
+		}
+		oldReplicas, _ := oldValue.(int64)
+		newReplicas, _ := newValue.(int64)
+		if newReplicas < oldReplicas {
+			return errors.Errorf("Can't lower replicas from %d to %d", oldReplicas, newReplicas)
+		}
+		return nil
+	}
+	observed := toJSONMap(t, `{"spec": {"replicas": 3, "paused": true}}`)
+	lastApplied := toJSONMap(t, `{"spec": {"replicas": 3, "paused": true}}`)
+
+	// increase is allowed
+	got, err := MergeWithOptions(
+		observed, lastApplied, toJSONMap(t, `{"spec": {"replicas": 5}}`),
+		&MergeOptions{VetoChange: vetoDecrease},
+	)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if want := toJSONMap(t, `{"spec": {"replicas": 5}}`); !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeWithOptions() = %#v, want %#v", got, want)
+	}
+
+	// decrease is vetoed
+	_, err = MergeWithOptions(
+		observed, lastApplied, toJSONMap(t, `{"spec": {"replicas": 1}}`),
+		&MergeOptions{VetoChange: vetoDecrease},
+	)
+	if err == nil || !strings.Contains(err.Error(), "Can't lower replicas from 3 to 1") {
+		t.Errorf("want veto error, got %v", err)
+	}
+
+	// vetoed decrease is skipped
+	got, err = MergeWithOptions(
+		observed, lastApplied, toJSONMap(t, `{"spec": {"replicas": 1}}`),
+		&MergeOptions{VetoChange: vetoDecrease, SkipVetoedChanges: true},
+	)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if want := toJSONMap(t, `{"spec": {"replicas": 3}}`); !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeWithOptions() = %#v, want %#v", got, want)
+	}
+}
+
+func TestMergeMaxObjectSizeError(t *testing.T) {
+	observed := toJSONMap(t, `{"spec": {"replicas": 1}}`)
+	desired := toJSONMap(t, `{"spec": {"replicas": 1, "data": "0123456789"}}`)
+
+	_, err := MergeWithOptions(observed, nil, desired, &MergeOptions{MaxObjectSizeBytes: 64})
+	if err != nil {
+		t.Fatalf("want no error within limit, got %v", err)
+	}
+	_, err = MergeWithOptions(observed, nil, desired, &MergeOptions{MaxObjectSizeBytes: 16})
+	if err == nil {
+		t.Fatalf("want error, got none")
+	}
+	if !strings.Contains(err.Error(), "Size 43 bytes: Max 16 bytes") {
+		t.Errorf("want error with size, got %v", err)
+	}
+}
+
+func TestMergeNonJSONNativeValues(t *testing.T) {
+	ts := metav1.NewTime(time.Date(2019, 10, 1, 10, 0, 0, 0, time.UTC))
+	observed := toJSONMap(t, `{"spec": {"replicas": 1}}`)
+	desired := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"replicas":  int64(1),
+			"startTime": ts,
+		},
+	}
+
+	// non JSON native values are set as is by default
+	got, err := MergeWithOptions(observed, nil, desired, nil)
+	if err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	if _, ok := got["spec"].(map[string]interface{})["startTime"].(metav1.Time); !ok {
+		t.Errorf("got startTime %#v, want metav1.Time", got["spec"])
+	}
+	gotJSON, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("can't marshal merged: %v", err)
+	}
+
+	// these values are converted to JSON native values when normalized
+	normalized, err := MergeWithOptions(observed, nil, desired, &MergeOptions{
+		NormalizeInputs: true,
+	})
+	if err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	want := toJSONMap(t, `{
+		"spec": {"replicas": 1, "startTime": "2019-10-01T10:00:00Z"}
+	}`)
+	if !reflect.DeepEqual(normalized, want) {
+		t.Errorf("MergeWithOptions() = %#v, want %#v", normalized, want)
+	}
+	normalizedJSON, err := json.Marshal(normalized)
+	if err != nil {
+		t.Fatalf("can't marshal normalized: %v", err)
+	}
+
+	// both should serialize the same
+	if string(gotJSON) != string(normalizedJSON) {
+		t.Errorf("got serialized %s, want %s", gotJSON, normalizedJSON)
+	}
+
+	// observed with non JSON native values can be merged if normalized
+	if _, err := MergeWithOptions(desired, nil, observed, &MergeOptions{
+		NormalizeInputs: true,
+	}); err != nil {
+		t.Errorf("MergeWithOptions error: %v", err)
+	}
+}
+
+// copyTolerant is a deep copier that copies maps & lists while setting
+// all the other values as is
+func copyTolerant(obj map[string]interface{}) map[string]interface{} {
+	return copyTolerantValue(obj).(map[string]interface{})
+}
+
+func copyTolerantValue(val interface{}) interface{} {
+	switch tval := val.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(tval))
+		for key, item := range tval {
+			out[key] = copyTolerantValue(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(tval))
+		for idx, item := range tval {
+			out[idx] = copyTolerantValue(item)
+		}
+		return out
+	default:
+		return val
+	}
+}
+
+func TestMergeDeepCopy(t *testing.T) {
+	observed := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"replicas":  int64(1),
+			"startTime": metav1.NewTime(time.Date(2019, 10, 1, 10, 0, 0, 0, time.UTC)),
+		},
+	}
+	desired := toJSONMap(t, `{"spec": {"replicas": 2}}`)
+
+	// default copier guards against non JSON native values
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("want panic for non JSON native observed, got none")
+			}
+		}()
+		_, _ = MergeWithOptions(observed, nil, desired, nil)
+	}()
+
+	got, err := MergeWithOptions(observed, nil, desired, &MergeOptions{DeepCopy: copyTolerant})
+	if err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+	if got["spec"].(map[string]interface{})["replicas"] != int64(2) {
+		t.Errorf("got spec %#v, want replicas 2", got["spec"])
+	}
+	// observed must not be modified
+	if observed["spec"].(map[string]interface{})["replicas"] != int64(1) {
+		t.Errorf("got observed spec %#v, want replicas 1", observed["spec"])
+	}
+}
+
+func BenchmarkMergeWithDefaultDeepCopy(b *testing.B) {
+	benchmarkMergeWithDeepCopy(b, nil)
+}
+
+func BenchmarkMergeWithCustomDeepCopy(b *testing.B) {
+	benchmarkMergeWithDeepCopy(b, &MergeOptions{DeepCopy: copyTolerant})
+}
+
+func benchmarkMergeWithDeepCopy(b *testing.B, opts *MergeOptions) {
+	observed := toUnstruct(b, testObservedJSON).Object
+	desired := toUnstruct(b, testDesiredJSON).Object
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := MergeWithOptions(observed, nil, desired, opts); err != nil {
+			b.Fatalf("MergeWithOptions error: %v", err)
+		}
+	}
+}
+
+func BenchmarkMergeSmallObject(b *testing.B) {
+	benchmarkMergeSmallObject(b, nil)
+}
+
+func BenchmarkMergeSmallObjectAtomic(b *testing.B) {
+	benchmarkMergeSmallObject(b, &MergeOptions{AtomicBelowSizeBytes: 1024})
+}
+
+func benchmarkMergeSmallObject(b *testing.B, opts *MergeOptions) {
+	observed := toJSONMap(b, `{
+		"apiVersion": "v1",
+		"kind": "ConfigMap",
+		"metadata": {"name": "test", "namespace": "default"},
+		"data": {"a": "1", "b": "2", "c": "3"}
+	}`)
+	desired := toJSONMap(b, `{
+		"apiVersion": "v1",
+		"kind": "ConfigMap",
+		"metadata": {"name": "test", "namespace": "default"},
+		"data": {"a": "1", "b": "2", "c": "3"}
+	}`)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := MergeWithOptions(observed, desired, desired, opts); err != nil {
+			b.Fatalf("MergeWithOptions error: %v", err)
+		}
+	}
+}
+
+func TestCompactListsReportsChanges(t *testing.T) {
+	observed := toJSONMap(t, `{
+		"metadata": {"finalizers": ["a", null]},
+		"spec": {"args": ["-v"], "ports": [{"name": "http", "hosts": ["a", null]}]},
+		"status": {"nodes": ["n1", null]}
+	}`)
+	lastApplied := toJSONMap(t, `{}`)
+	desired := toJSONMap(t, `{
+		"spec": {"args": [null, "-q"], "ports": [{"name": "http"}]}
+	}`)
+
+	var events []ChangeEvent
+	opts := &MergeOptions{
+		CompactLists: true,
+		OnChange: func(ctx context.Context, event ChangeEvent) {
+			events = append(events, event)
+		},
+	}
+	merged, stats, err := MergeWithStats(observed, lastApplied, desired, opts)
+	if err != nil {
+		t.Fatalf("MergeWithStats error: %v", err)
+	}
+	want := toJSONMap(t, `{
+		"metadata": {"finalizers": ["a", null]},
+		"spec": {"args": ["-q"], "ports": [{"name": "http", "hosts": ["a"]}]},
+		"status": {"nodes": ["n1", null]}
+	}`)
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("got merged %v, want %v", merged, want)
+	}
+
+	wantChanges := map[string]bool{
+		"[spec][args][0]":               true,
+		"[spec][ports][http][hosts][1]": true,
+	}
+	var got []string
+	for _, change := range stats.Changes {
+		if change.Reason == ReasonListElementRemoved {
+			got = append(got, change.Path)
+		}
+	}
+	if len(got) != len(wantChanges) {
+		t.Fatalf("got removed elements %v, want %v", got, wantChanges)
+	}
+	for _, path := range got {
+		if !wantChanges[path] {
+			t.Errorf("got unexpected removed element %s", path)
+		}
+	}
+	var notified int
+	for _, event := range events {
+		if event.Reason == ReasonListElementRemoved && wantChanges[event.Path] {
+			notified++
+		}
+	}
+	if notified != len(wantChanges) {
+		t.Errorf("got %d removed elements notified, want %d: %v", notified, len(wantChanges), events)
+	}
+}
+
+func TestFirstMatchingPattern(t *testing.T) {
+	var tests = map[string]struct {
+		patterns  []string
+		fieldPath string
+		want      string
+		wantFound bool
+	}{
+		"exact path wins over patterns sorted before it": {
+			patterns:  []string{"[*][replicas]", "[spec][replicas]"},
+			fieldPath: "[spec][replicas]",
+			want:      "[spec][replicas]",
+			wantFound: true,
+		},
+		"first of the sorted matching patterns": {
+			patterns:  []string{"[*][replicas]", "[spec][*]"},
+			fieldPath: "[spec][replicas]",
+			want:      "[*][replicas]",
+			wantFound: true,
+		},
+		"no matching pattern": {
+			patterns:  []string{"[status][*]"},
+			fieldPath: "[spec][replicas]",
+		},
+		"no patterns": {
+			fieldPath: "[spec][replicas]",
+		},
+	}
+	for name, mock := range tests {
+		name, mock := name, mock
+		t.Run(name, func(t *testing.T) {
+			m := newMerger(nil)
+			got, found := m.firstMatchingPattern(mock.patterns, mock.fieldPath)
+			if got != mock.want || found != mock.wantFound {
+				t.Errorf(
+					"got %q %t, want %q %t", got, found, mock.want, mock.wantFound,
+				)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// PatchType is the kind of request recommended to update an object
+type PatchType string
+
+const (
+	// PatchTypeNone recommends no request since nothing changed
+	PatchTypeNone PatchType = "None"
+
+	// PatchTypeJSON recommends a JSON patch
+	PatchTypeJSON PatchType = "JSONPatch"
+
+	// PatchTypeStrategicMerge recommends a strategic merge patch
+	PatchTypeStrategicMerge PatchType = "StrategicMergePatch"
+
+	// PatchTypeReplace recommends replacing the object i.e. a PUT
+	PatchTypeReplace PatchType = "Replace"
+)
+
+// maxJSONPatchChanges is the maximum number of changed fields that
+// are recommended to be sent as a JSON patch
+const maxJSONPatchChanges = 5
+
+// patchShape summarizes the changes between two states
+type patchShape struct {
+	// changed is the number of changed leaf fields
+	changed int
+
+	// listMapDelta is true if any list map elements were added or
+	// removed
+	listMapDelta bool
+}
+
+// RecommendPatchType suggests the kind of request that suits the
+// changes from observed to merged state along with the rationale.
+// This is advisory only:
+//
+// - a few field changes are best sent as a JSON patch,
+// - addition or removal of list map elements as a strategic merge
+// patch, &
+// - changes to most of the object as a replace.
+func RecommendPatchType(observed, merged map[string]interface{}) (PatchType, string) {
+	var shape patchShape
+	shape.diff("", observed, merged)
+	total := len(leafPaths("", merged, nil))
+
+	switch {
+	case shape.changed == 0:
+		return PatchTypeNone, "No fields changed"
+	case shape.changed*2 > total:
+		return PatchTypeReplace, fmt.Sprintf(
+			"Most of the object changed: %d of %d fields", shape.changed, total,
+		)
+	case shape.listMapDelta:
+		return PatchTypeStrategicMerge, "List map elements were added or removed"
+	case shape.changed <= maxJSONPatchChanges:
+		return PatchTypeJSON, fmt.Sprintf("Few fields changed: %d", shape.changed)
+	default:
+		return PatchTypeStrategicMerge, fmt.Sprintf("Many fields changed: %d", shape.changed)
+	}
+}
+
+// diff walks the old & new values found at the given field path &
+// records their changes
+func (s *patchShape) diff(fieldPath string, old, new interface{}) {
+	switch oldVal := old.(type) {
+	case map[string]interface{}:
+		if newVal, ok := new.(map[string]interface{}); ok {
+			s.diffMaps(fieldPath, oldVal, newVal, false)
+			return
+		}
+	case []interface{}:
+		newVal, ok := new.([]interface{})
+		if !ok {
+			break
+		}
+		if mergeKey := detectListMapKey(oldVal, newVal); mergeKey != "" {
+			s.diffMaps(
+				fieldPath,
+				makeListMap(mergeKey, oldVal),
+				makeListMap(mergeKey, newVal),
+				true,
+			)
+			return
+		}
+	}
+	if reflect.DeepEqual(old, new) {
+		return
+	}
+	// every leaf of the new value replaces the old value
+	s.changed += leafCount(fieldPath, new)
+}
+
+// diffMaps compares the fields of old & new maps found at the given
+// field path. Fields represent list map elements if isListMap is true.
+func (s *patchShape) diffMaps(fieldPath string, old, new map[string]interface{}, isListMap bool) {
+	for key, oldVal := range old {
+		keyPath := fmt.Sprintf("%s[%s]", fieldPath, key)
+		newVal, present := new[key]
+		if !present {
+			s.changed += leafCount(keyPath, oldVal)
+			s.listMapDelta = s.listMapDelta || isListMap
+			continue
+		}
+		s.diff(keyPath, oldVal, newVal)
+	}
+	for key, newVal := range new {
+		if _, present := old[key]; present {
+			continue
+		}
+		s.changed += leafCount(fmt.Sprintf("%s[%s]", fieldPath, key), newVal)
+		s.listMapDelta = s.listMapDelta || isListMap
+	}
+}
+
+// leafCount returns the number of leaf fields of the given value. A
+// value without leaves e.g. nil counts as a single field.
+func leafCount(fieldPath string, val interface{}) int {
+	if count := len(leafPaths(fieldPath, val, nil)); count > 0 {
+		return count
+	}
+	return 1
+}
+
+// CreateMergePatch returns the JSON merge patch i.e. RFC 7386 patch
+// that updates the observed state to the merged state. Lists are
+// replaced as a whole as per RFC 7386. An empty patch i.e. `{}` is
+// returned if nothing changed.
+func CreateMergePatch(observed, merged map[string]interface{}) ([]byte, error) {
+	patch, _ := mergePatchOf(observed, true, merged, true)
+	if patch == nil {
+		patch = map[string]interface{}{}
+	}
+	return json.Marshal(patch)
+}
+
+// CreateScopedMergePatch returns the JSON merge patch similar to
+// CreateMergePatch. However, the patch is limited to the subtree found
+// at the given field path e.g. `[spec][replicas]`. Changes outside this
+// subtree are silently omitted from the patch. This suits controllers
+// that update only the fields they own.
+//
+// Each segment of the field path must be the name of an object field
+// since a merge patch can't address list elements.
+func CreateScopedMergePatch(
+	observed, merged map[string]interface{}, fieldPath string,
+) ([]byte, error) {
+	segments := splitFieldPath(fieldPath)
+	if len(segments) == 0 {
+		return nil, errors.Errorf("Can't create scoped merge patch: Invalid field path %q", fieldPath)
+	}
+	oldVal, oldFound := objectFieldValue(observed, segments)
+	newVal, newFound := objectFieldValue(merged, segments)
+	patchVal, changed := mergePatchOf(oldVal, oldFound, newVal, newFound)
+	if !changed {
+		return []byte("{}"), nil
+	}
+	// nest the patch of the subtree within its parents
+	for idx := len(segments) - 1; idx >= 0; idx-- {
+		patchVal = map[string]interface{}{segments[idx]: patchVal}
+	}
+	return json.Marshal(patchVal)
+}
+
+// objectFieldValue returns the value found at the given object field
+// segments. It returns false if the value is not found.
+func objectFieldValue(obj map[string]interface{}, segments []string) (interface{}, bool) {
+	var val interface{} = obj
+	for _, segment := range segments {
+		fields, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if val, ok = fields[segment]; !ok {
+			return nil, false
+		}
+	}
+	return val, true
+}
+
+// mergePatchOf returns the merge patch that updates the old value to
+// the new value. It returns false if nothing changed. A nil patch value
+// deletes the old value.
+func mergePatchOf(old interface{}, oldFound bool, new interface{}, newFound bool) (interface{}, bool) {
+	if !newFound {
+		return nil, oldFound
+	}
+	oldMap, oldIsMap := old.(map[string]interface{})
+	newMap, newIsMap := new.(map[string]interface{})
+	if oldFound && oldIsMap && newIsMap {
+		patch := map[string]interface{}{}
+		for key := range oldMap {
+			if _, present := newMap[key]; !present {
+				patch[key] = nil
+			}
+		}
+		for key, newVal := range newMap {
+			oldVal, present := oldMap[key]
+			if patchVal, changed := mergePatchOf(oldVal, present, newVal, true); changed {
+				patch[key] = patchVal
+			}
+		}
+		return patch, len(patch) > 0
+	}
+	if oldFound && reflect.DeepEqual(old, new) {
+		return nil, false
+	}
+	return new, true
+}
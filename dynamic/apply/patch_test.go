@@ -0,0 +1,162 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRecommendPatchType(t *testing.T) {
+	observed := `{
+		"metadata": {"name": "test", "labels": {"app": "test"}},
+		"spec": {
+			"replicas": 1,
+			"paused": false,
+			"containers": [
+				{"name": "app", "image": "app:1"},
+				{"name": "sidecar", "image": "sidecar:1"}
+			]
+		}
+	}`
+	table := []struct {
+		name, observed, merged string
+		want                   PatchType
+	}{
+		{
+			name:     "no change",
+			observed: observed,
+			merged:   observed,
+			want:     PatchTypeNone,
+		},
+		{
+			name:     "single scalar change",
+			observed: observed,
+			merged: `{
+				"metadata": {"name": "test", "labels": {"app": "test"}},
+				"spec": {
+					"replicas": 3,
+					"paused": false,
+					"containers": [
+						{"name": "app", "image": "app:1"},
+						{"name": "sidecar", "image": "sidecar:1"}
+					]
+				}
+			}`,
+			want: PatchTypeJSON,
+		},
+		{
+			name:     "list map element added",
+			observed: observed,
+			merged: `{
+				"metadata": {"name": "test", "labels": {"app": "test"}},
+				"spec": {
+					"replicas": 1,
+					"paused": false,
+					"containers": [
+						{"name": "app", "image": "app:1"},
+						{"name": "sidecar", "image": "sidecar:1"},
+						{"name": "proxy", "image": "proxy:1"}
+					]
+				}
+			}`,
+			want: PatchTypeStrategicMerge,
+		},
+		{
+			name:     "large structural change",
+			observed: observed,
+			merged: `{
+				"metadata": {"name": "test", "labels": {"tier": "web", "env": "prod"}},
+				"spec": {
+					"strategy": {"type": "Recreate"},
+					"template": {"spec": {"nodeName": "node-1"}}
+				}
+			}`,
+			want: PatchTypeReplace,
+		},
+	}
+
+	for _, tc := range table {
+		got, reason := RecommendPatchType(toJSONMap(t, tc.observed), toJSONMap(t, tc.merged))
+		if got != tc.want {
+			t.Errorf("%s: RecommendPatchType() = %s (%s), want %s", tc.name, got, reason, tc.want)
+		}
+		if reason == "" {
+			t.Errorf("%s: RecommendPatchType(): want rationale, got none", tc.name)
+		}
+	}
+}
+
+func TestCreateScopedMergePatch(t *testing.T) {
+	observed := `{
+		"metadata": {"labels": {"app": "web", "tier": "front"}},
+		"spec": {"replicas": 1, "paused": true, "template": {"image": "app:1"}}
+	}`
+	merged := `{
+		"metadata": {"labels": {"app": "web"}},
+		"spec": {"replicas": 3, "template": {"image": "app:2"}}
+	}`
+	var tests = map[string]struct {
+		fieldPath string
+		want      string
+		isErr     bool
+	}{
+		"whole object": {
+			want: `{
+				"metadata": {"labels": {"tier": null}},
+				"spec": {"replicas": 3, "paused": null, "template": {"image": "app:2"}}
+			}`,
+		},
+		"replicas only": {
+			fieldPath: "[spec][replicas]",
+			want:      `{"spec": {"replicas": 3}}`,
+		},
+		"removed field": {
+			fieldPath: "[spec][paused]",
+			want:      `{"spec": {"paused": null}}`,
+		},
+		"unchanged subtree": {
+			fieldPath: "[metadata][labels][app]",
+			want:      `{}`,
+		},
+		"invalid field path": {
+			fieldPath: "spec.replicas",
+			isErr:     true,
+		},
+	}
+	for name, mock := range tests {
+		var got []byte
+		var err error
+		if mock.fieldPath == "" && !mock.isErr {
+			got, err = CreateMergePatch(toJSONMap(t, observed), toJSONMap(t, merged))
+		} else {
+			got, err = CreateScopedMergePatch(toJSONMap(t, observed), toJSONMap(t, merged), mock.fieldPath)
+		}
+		if mock.isErr {
+			if err == nil {
+				t.Errorf("%s: want error, got none", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: got error %v", name, err)
+		}
+		if !reflect.DeepEqual(toJSONMap(t, string(got)), toJSONMap(t, mock.want)) {
+			t.Errorf("%s: got patch %s, want %s", name, got, mock.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"strings"
+)
+
+// PathMatcher returns true if the given field path matches the given
+// pattern. Patterns are the field paths set in path scoped options.
+type PathMatcher func(pattern, fieldPath string) bool
+
+// MatchGlobPath matches field paths against glob patterns. A `*`
+// segment of the pattern matches any single segment of the field
+// path. All the other segments must match exactly.
+//
+// For example, `[spec][containers][*][image]` matches the image of
+// every container of a list map.
+func MatchGlobPath(pattern, fieldPath string) bool {
+	if pattern == fieldPath {
+		return true
+	}
+	patternSegments := splitFieldPath(pattern)
+	pathSegments := splitFieldPath(fieldPath)
+	if len(patternSegments) != len(pathSegments) {
+		return false
+	}
+	for idx, segment := range patternSegments {
+		if segment != "*" && segment != pathSegments[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// splitFieldPath returns the segments of the given field path e.g.
+// `[spec][replicas]` results in `spec` & `replicas`. Root path i.e.
+// an empty string has no segments.
+func splitFieldPath(fieldPath string) []string {
+	if len(fieldPath) < 2 || fieldPath[0] != '[' || fieldPath[len(fieldPath)-1] != ']' {
+		return nil
+	}
+	return strings.Split(fieldPath[1:len(fieldPath)-1], "][")
+}
+
+// matchesAnyPath returns true if the given field path matches any of
+// the given patterns
+func matchesAnyPath(match PathMatcher, patterns []string, fieldPath string) bool {
+	for _, pattern := range patterns {
+		if match(pattern, fieldPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAnyPathOrParent returns true if the given field path or any
+// of its parents matches any of the given patterns
+func matchesAnyPathOrParent(match PathMatcher, patterns []string, fieldPath string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	segments := splitFieldPath(fieldPath)
+	for idx := range segments {
+		if matchesAnyPath(match, patterns, toFieldPath(segments[:idx+1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPath returns true if the given field path matches any of the
+// provided paths
+func (m *merger) hasPath(paths []string, fieldPath string) bool {
+	return matchesAnyPath(m.opts.MatchPath, paths, fieldPath)
+}
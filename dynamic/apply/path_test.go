@@ -0,0 +1,46 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"testing"
+)
+
+func TestMatchGlobPath(t *testing.T) {
+	table := []struct {
+		pattern   string
+		fieldPath string
+		want      bool
+	}{
+		{"", "", true},
+		{"[spec]", "[spec]", true},
+		{"[spec]", "[status]", false},
+		{"[spec]", "[spec][replicas]", false},
+		{"[*]", "[spec]", true},
+		{"[*]", "", false},
+		{"[spec][containers][*][image]", "[spec][containers][app][image]", true},
+		{"[spec][containers][*][image]", "[spec][containers][sidecar][image]", true},
+		{"[spec][containers][*][image]", "[spec][containers][app][name]", false},
+		{"[spec][containers][*][image]", "[spec][containers][app]", false},
+		{"[metadata][annotations][*]", "[metadata][annotations][example.io/owner]", true},
+	}
+	for _, tc := range table {
+		if got := MatchGlobPath(tc.pattern, tc.fieldPath); got != tc.want {
+			t.Errorf("MatchGlobPath(%q, %q) = %t, want %t", tc.pattern, tc.fieldPath, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"context"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// Deletion is a field that merge would delete
+type Deletion struct {
+	// Path of the field
+	Path string `json:"path"`
+
+	// Value of the field that would be deleted
+	Value interface{} `json:"value"`
+}
+
+// MergeWithDeletionReview merges the desired state into the observed
+// state similar to MergeWithOptions except that fields are never
+// deleted. Fields that would have been deleted are kept as observed &
+// are returned sorted by their paths instead.
+//
+// This enables a two phase flow. Deletions are reviewed first & then
+// performed by a subsequent merge e.g. MergeWithOptions once these are
+// confirmed. Cache set in the options, if any, is not used.
+func MergeWithDeletionReview(
+	observed, lastApplied, desired map[string]interface{},
+	opts *MergeOptions,
+) (map[string]interface{}, []Deletion, error) {
+	m := newMerger(opts)
+	m.opts.Cache = nil
+	m.deletions = &[]Deletion{}
+	destination, err := m.run(context.Background(), observed, lastApplied, desired)
+	if err != nil {
+		return nil, nil, err
+	}
+	deletions := *m.deletions
+	sort.SliceStable(deletions, func(i, j int) bool {
+		return deletions[i].Path < deletions[j].Path
+	})
+	return destination, deletions, nil
+}
+
+// deferDeletion returns true if the given value found at the given
+// field path should be kept since deletions are being reviewed. The
+// deletion is recorded for review if the value exists.
+func (m *merger) deferDeletion(fieldPath string, val interface{}, exists bool) bool {
+	if m.deletions == nil {
+		return false
+	}
+	if exists {
+		glog.V(4).Infof("%s merge operation: Will defer deletion for review", fieldPath)
+		*m.deletions = append(*m.deletions, Deletion{Path: fieldPath, Value: val})
+	}
+	return true
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeWithDeletionReview(t *testing.T) {
+	observed := toJSONMap(t, `{
+		"spec": {
+			"replicas": 1,
+			"paused": true,
+			"containers": [
+				{"name": "app", "image": "app:1"},
+				{"name": "sidecar", "image": "sidecar:1"}
+			]
+		}
+	}`)
+	lastApplied := toJSONMap(t, `{
+		"spec": {
+			"replicas": 1,
+			"paused": true,
+			"containers": [
+				{"name": "app", "image": "app:1"},
+				{"name": "sidecar", "image": "sidecar:1"}
+			]
+		}
+	}`)
+	desired := toJSONMap(t, `{
+		"spec": {
+			"replicas": 2,
+			"containers": [
+				{"name": "app", "image": "app:1"}
+			]
+		}
+	}`)
+
+	got, deletions, err := MergeWithDeletionReview(observed, lastApplied, desired, nil)
+	if err != nil {
+		t.Fatalf("MergeWithDeletionReview error: %v", err)
+	}
+	wantDeletions := []Deletion{
+		{Path: "[spec][containers][sidecar]", Value: map[string]interface{}{"name": "sidecar", "image": "sidecar:1"}},
+		{Path: "[spec][paused]", Value: true},
+	}
+	if !reflect.DeepEqual(deletions, wantDeletions) {
+		t.Errorf("got deletions %#v, want %#v", deletions, wantDeletions)
+	}
+	want := toJSONMap(t, `{
+		"spec": {
+			"replicas": 2,
+			"paused": true,
+			"containers": [
+				{"name": "app", "image": "app:1"},
+				{"name": "sidecar", "image": "sidecar:1"}
+			]
+		}
+	}`)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeWithDeletionReview() = %#v, want %#v", got, want)
+	}
+
+	// confirmed deletions are performed by a normal merge
+	got, err = Merge(got, lastApplied, desired)
+	if err != nil {
+		t.Fatalf("Merge error: %v", err)
+	}
+	want = toJSONMap(t, `{
+		"spec": {
+			"replicas": 2,
+			"containers": [
+				{"name": "app", "image": "app:1"}
+			]
+		}
+	}`)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Merge() = %#v, want %#v", got, want)
+	}
+}
+
+func TestMergeWithDeletionReviewOfIndexList(t *testing.T) {
+	observed := toJSONMap(t, `{"slots": ["a", "b", "c"]}`)
+	lastApplied := toJSONMap(t, `{"slots": ["a", "b", "c"]}`)
+	desired := toJSONMap(t, `{"slots": ["x", null]}`)
+	opts := &MergeOptions{
+		IndexMergeListPaths: []string{"[slots]"},
+		NullListElements:    NullElementDelete,
+	}
+
+	got, deletions, err := MergeWithDeletionReview(observed, lastApplied, desired, opts)
+	if err != nil {
+		t.Fatalf("MergeWithDeletionReview error: %v", err)
+	}
+	wantDeletions := []Deletion{
+		{Path: "[slots][1]", Value: "b"},
+		{Path: "[slots][2]", Value: "c"},
+	}
+	if !reflect.DeepEqual(deletions, wantDeletions) {
+		t.Errorf("got deletions %#v, want %#v", deletions, wantDeletions)
+	}
+	want := toJSONMap(t, `{"slots": ["x", "b", "c"]}`)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeWithDeletionReview() = %#v, want %#v", got, want)
+	}
+}
+
+func TestMergeWithDeletionReviewSkipsKeptFields(t *testing.T) {
+	observed := toJSONMap(t, `{
+		"metadata": {"annotations": {"kubectl.kubernetes.io/restartedAt": "now", "team": "a"}},
+		"spec": {
+			"rules": [{"name": "keep", "pinned": true}, {"name": "drop"}],
+			"args": ["-v", "-q"]
+		}
+	}`)
+	lastApplied := toJSONMap(t, `{
+		"metadata": {"annotations": {"kubectl.kubernetes.io/restartedAt": "now", "team": "a"}},
+		"spec": {
+			"rules": [{"name": "keep"}, {"name": "drop"}],
+			"args": ["-v", "-q"]
+		}
+	}`)
+	desired := toJSONMap(t, `{
+		"metadata": {"annotations": {"owner": "b"}},
+		"spec": {"rules": [], "args": ["-v"]}
+	}`)
+	opts := &MergeOptions{
+		PreserveAnnotations:   []string{"kubectl.kubernetes.io/restartedAt"},
+		ContentMergeListPaths: []string{"[spec][args]"},
+		KeepListMapElement: func(fieldPath string, observed map[string]interface{}) bool {
+			return observed["pinned"] == true
+		},
+	}
+
+	_, deletions, err := MergeWithDeletionReview(observed, lastApplied, desired, opts)
+	if err != nil {
+		t.Fatalf("MergeWithDeletionReview error: %v", err)
+	}
+	var paths []string
+	for _, deletion := range deletions {
+		paths = append(paths, deletion.Path)
+	}
+	// kept list map element & preserved annotation are not reported
+	wantPaths := []string{
+		`[metadata][annotations][team]`,
+		`[spec][args]["-q"]`,
+		`[spec][rules][drop]`,
+	}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Errorf("got deletions %v, want %v", paths, wantPaths)
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// signatureKeyName describes the list map keys derived from the
+// structural signatures of the elements
+const signatureKeyName = "Signature"
+
+// elementSignature returns the structural signature of the given list
+// element. This is the first 16 hex digits of the SHA-256 hash of the
+// element's scalar fields. The fields are hashed in the order of their
+// names as `"name":value` pairs where value is the field's type & its
+// string form. Nested objects & lists are not part of the signature.
+//
+// It returns false if the element has no scalar fields.
+func elementSignature(item map[string]interface{}) (string, bool) {
+	names := make([]string, 0, len(item))
+	for name, val := range item {
+		if isScalar(val) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", false
+	}
+	sort.Strings(names)
+	hash := sha256.New()
+	for _, name := range names {
+		val := item[name]
+		fmt.Fprintf(hash, "%s:%T:%s,", strconv.Quote(name), val, stringMergeKey(val))
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))[:16], true
+}
+
+// signatureKeyFunc returns a key function that identifies list map
+// elements by their structural signatures if every element of the
+// given lists has one. Nil is returned otherwise.
+func signatureKeyFunc(lists ...[]interface{}) listMapKeyFunc {
+	if !allObjects(lists...) {
+		return nil
+	}
+	for _, list := range lists {
+		for _, item := range list {
+			if _, ok := elementSignature(item.(map[string]interface{})); !ok {
+				return nil
+			}
+		}
+	}
+	return func(item map[string]interface{}) string {
+		signature, _ := elementSignature(item)
+		return signature
+	}
+}
+
+// isPositionalOrContentList returns true if the list found at the given
+// field path is configured to be merged by index or by content. Such
+// lists are never merged by signature.
+func (m *merger) isPositionalOrContentList(fieldPath string) bool {
+	return m.hasPath(m.opts.IndexMergeListPaths, fieldPath) ||
+		m.hasPath(m.opts.ContentMergeListPaths, fieldPath)
+}
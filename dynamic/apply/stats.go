@@ -0,0 +1,344 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ChangeReason categorizes a change made by a merge
+type ChangeReason string
+
+const (
+	// ReasonFieldAdded is used when a field is added
+	ReasonFieldAdded ChangeReason = "FieldAdded"
+
+	// ReasonFieldUpdated is used when the value of a field is updated
+	ReasonFieldUpdated ChangeReason = "FieldUpdated"
+
+	// ReasonFieldRemoved is used when a field is removed
+	ReasonFieldRemoved ChangeReason = "FieldRemoved"
+
+	// ReasonListElementAdded is used when an element is added to
+	// a list map
+	ReasonListElementAdded ChangeReason = "ListElementAdded"
+
+	// ReasonListElementRemoved is used when an element is removed
+	// from a list map
+	ReasonListElementRemoved ChangeReason = "ListElementRemoved"
+
+	// ReasonListReplaced is used when a list is replaced as a whole
+	ReasonListReplaced ChangeReason = "ListReplaced"
+)
+
+// Change is a single change made by a merge
+type Change struct {
+	// Path of the changed field
+	Path string `json:"path"`
+
+	// Reason categorizes this change
+	Reason ChangeReason `json:"reason"`
+}
+
+// MergeStats describes the changes made by a merge
+type MergeStats struct {
+	// Changes made by the merge sorted by their paths
+	Changes []Change `json:"changes"`
+
+	// OldValues maps the paths of changed fields to their observed
+	// values prior to the merge. Fields added by the merge are not
+	// included since these had no value.
+	//
+	// This helps build a reversible change log.
+	OldValues map[string]interface{} `json:"oldValues,omitempty"`
+
+	// NoOps lists the sorted paths of scalar fields that were merged
+	// but left unchanged. This is recorded only if RecordNoOps option
+	// is set & helps report the coverage of a merge.
+	NoOps []string `json:"noOps,omitempty"`
+
+	// Touched lists the sorted & unique paths of the fields that were
+	// merged whether changed or not. This includes the paths of scalar
+	// fields as well as the paths of changes. This is recorded only if
+	// RecordTouched option is set & helps compare the fields managed
+	// by a controller across reconciles.
+	Touched []string `json:"touched,omitempty"`
+
+	// ListStrategies maps the paths of merged lists to the strategies
+	// used to merge these. This helps spot lists that need explicit
+	// configuration e.g. a list map that is replaced for want of a
+	// merge key.
+	ListStrategies map[string]ListStrategy `json:"listStrategies,omitempty"`
+
+	// Conflicts lists the three-way conflicts sorted by their paths.
+	// This is recorded only if RecordConflicts option is set.
+	Conflicts []Conflict `json:"conflicts,omitempty"`
+
+	// ConflictsTruncated is true if some conflicts were left out of
+	// Conflicts due to MaxConflicts option
+	ConflictsTruncated bool `json:"conflictsTruncated,omitempty"`
+
+	// Cost is the approximate cost of the merge. This is recorded only
+	// if RecordCost option is set.
+	Cost *MergeCost `json:"cost,omitempty"`
+}
+
+// Conflict is a field that was changed by some other actor since it
+// was last applied while desired wants to change it as well. Base is
+// the last applied value i.e. the merge base of observed & desired.
+type Conflict struct {
+	Path     string      `json:"path"`
+	Base     interface{} `json:"base"`
+	Observed interface{} `json:"observed"`
+	Desired  interface{} `json:"desired"`
+}
+
+// MergeCost is the approximate resource use of a merge
+type MergeCost struct {
+	// Nodes is the number of values visited by the merge including the
+	// root object
+	Nodes int `json:"nodes"`
+
+	// MapAllocs is the number of maps allocated by the merge. This
+	// counts the maps of the observed copy & the maps that index the
+	// elements of the merged list maps.
+	MapAllocs int `json:"mapAllocs"`
+}
+
+// ListStrategy is the strategy used to merge a list. Strategy is one
+// of ListMap, ContentList, IndexList, List or Scalar. ListMap merges
+// the elements by their MergeKey. ContentList & IndexList merge the
+// elements by their content & positions respectively. List replaces
+// observed list with desired list. Scalar sets desired list since
+// observed has none or the list is merged atomically.
+type ListStrategy struct {
+	Strategy string `json:"strategy"`
+	MergeKey string `json:"mergeKey,omitempty"`
+}
+
+// MergeWithStats merges the desired state into the observed state
+// similar to MergeWithOptions. In addition, it returns the statistics
+// of this merge. Cache set in the options, if any, is not used.
+func MergeWithStats(
+	observed, lastApplied, desired map[string]interface{},
+	opts *MergeOptions,
+) (map[string]interface{}, *MergeStats, error) {
+	m := newMerger(opts)
+	m.opts.Cache = nil
+	m.stats = &MergeStats{
+		Changes:   []Change{},
+		OldValues: map[string]interface{}{},
+	}
+	destination, err := m.run(context.Background(), observed, lastApplied, desired)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.SliceStable(m.stats.Changes, func(i, j int) bool {
+		return m.stats.Changes[i].Path < m.stats.Changes[j].Path
+	})
+	sort.Strings(m.stats.NoOps)
+	m.truncateConflicts()
+	m.finalizeTouched()
+	if m.opts.RecordCost {
+		m.stats.Cost = &MergeCost{
+			Nodes: m.visited,
+			// list maps are indexed for each of the three states
+			MapAllocs: countMaps(observed) + 3*m.listMaps,
+		}
+	}
+	return destination, m.stats, nil
+}
+
+// recordListStrategy records the strategy used to merge the list found
+// at the given field path if statistics are being collected
+func (m *merger) recordListStrategy(fieldPath, strategy, mergeKey string) {
+	if m.stats == nil {
+		return
+	}
+	if m.stats.ListStrategies == nil {
+		m.stats.ListStrategies = map[string]ListStrategy{}
+	}
+	m.stats.ListStrategies[fieldPath] = ListStrategy{Strategy: strategy, MergeKey: mergeKey}
+}
+
+// recordTouched records the given field path as touched if touched
+// paths are being recorded
+func (m *merger) recordTouched(fieldPath string) {
+	if m.stats == nil || !m.opts.RecordTouched {
+		return
+	}
+	m.stats.Touched = append(m.stats.Touched, fieldPath)
+}
+
+// finalizeTouched adds the paths of changes to the touched paths &
+// sorts these without duplicates
+func (m *merger) finalizeTouched() {
+	if !m.opts.RecordTouched {
+		return
+	}
+	touched := m.stats.Touched
+	for _, change := range m.stats.Changes {
+		touched = append(touched, change.Path)
+	}
+	sort.Strings(touched)
+	unique := touched[:0]
+	for idx, fieldPath := range touched {
+		if idx > 0 && fieldPath == touched[idx-1] {
+			continue
+		}
+		unique = append(unique, fieldPath)
+	}
+	m.stats.Touched = unique
+}
+
+// recordChange records a change made at the given field path along
+// with the field's old & new values if statistics are being collected
+// or changes are being notified
+func (m *merger) recordChange(fieldPath string, reason ChangeReason, oldValue, newValue interface{}) {
+	if m.opts.OnChange != nil {
+		m.events = append(m.events, ChangeEvent{
+			Path:     fieldPath,
+			Reason:   reason,
+			OldValue: oldValue,
+			NewValue: newValue,
+		})
+	}
+	if m.stats == nil {
+		return
+	}
+	m.stats.Changes = append(m.stats.Changes, Change{Path: fieldPath, Reason: reason})
+	if reason != ReasonFieldAdded && reason != ReasonListElementAdded {
+		m.stats.OldValues[fieldPath] = oldValue
+	}
+}
+
+// recordNoOp records the given field path as a no-op if no-ops are
+// being recorded & the merged value is same as the destination value
+func (m *merger) recordNoOp(fieldPath string, destination, merged interface{}) {
+	if m.stats == nil || !m.opts.RecordNoOps {
+		return
+	}
+	if reflect.DeepEqual(destination, merged) {
+		m.stats.NoOps = append(m.stats.NoOps, fieldPath)
+	}
+}
+
+// recordConflict records the given field path as a conflict if
+// conflicts are being recorded & the given values conflict
+func (m *merger) recordConflict(fieldPath string, observed, lastApplied, desired interface{}) {
+	if m.stats == nil || !m.opts.RecordConflicts || !isConflict(observed, lastApplied, desired) {
+		return
+	}
+	m.stats.Conflicts = append(m.stats.Conflicts, Conflict{
+		Path:     fieldPath,
+		Base:     lastApplied,
+		Observed: observed,
+		Desired:  desired,
+	})
+	// truncate in batches to bound the memory without sorting the
+	// conflicts on every record
+	if m.opts.MaxConflicts > 0 && len(m.stats.Conflicts) >= 2*m.opts.MaxConflicts {
+		m.truncateConflicts()
+	}
+}
+
+// truncateConflicts sorts the recorded conflicts by their paths & drops
+// the conflicts beyond MaxConflicts
+func (m *merger) truncateConflicts() {
+	sort.SliceStable(m.stats.Conflicts, func(i, j int) bool {
+		return m.stats.Conflicts[i].Path < m.stats.Conflicts[j].Path
+	})
+	if m.opts.MaxConflicts > 0 && len(m.stats.Conflicts) > m.opts.MaxConflicts {
+		m.stats.Conflicts = m.stats.Conflicts[:m.opts.MaxConflicts]
+		m.stats.ConflictsTruncated = true
+	}
+}
+
+// dropChanges removes the recorded changes made at the given field
+// path. This is used when a field is reverted after merge.
+func (m *merger) dropChanges(fieldPath string) {
+	if len(m.events) > 0 {
+		events := m.events[:0]
+		for _, event := range m.events {
+			if event.Path != fieldPath {
+				events = append(events, event)
+			}
+		}
+		m.events = events
+	}
+	if m.stats == nil {
+		return
+	}
+	changes := m.stats.Changes[:0]
+	for _, change := range m.stats.Changes {
+		if change.Path != fieldPath {
+			changes = append(changes, change)
+		}
+	}
+	m.stats.Changes = changes
+	delete(m.stats.OldValues, fieldPath)
+}
+
+// dropChangesUnder removes the recorded changes made at the given field
+// path & its nested fields
+func (m *merger) dropChangesUnder(fieldPath string) {
+	var paths []string
+	for _, event := range m.events {
+		if isPathOrChild(event.Path, fieldPath) {
+			paths = append(paths, event.Path)
+		}
+	}
+	if m.stats != nil {
+		for _, change := range m.stats.Changes {
+			if isPathOrChild(change.Path, fieldPath) {
+				paths = append(paths, change.Path)
+			}
+		}
+	}
+	for _, path := range paths {
+		m.dropChanges(path)
+	}
+}
+
+// isPathOrChild returns true if the given path is the given parent
+// path or is nested under it. Sibling paths that merely share the
+// parent's prefix e.g. `[spec][selectorTerms]` for `[spec][selector]`
+// are not.
+func isPathOrChild(path, parent string) bool {
+	return path == parent || strings.HasPrefix(path, parent+"[")
+}
+
+// countMaps returns the number of maps found in the given value
+// including the value itself
+func countMaps(val interface{}) int {
+	var count int
+	switch tval := val.(type) {
+	case map[string]interface{}:
+		count++
+		for _, item := range tval {
+			count += countMaps(item)
+		}
+	case []interface{}:
+		for _, item := range tval {
+			count += countMaps(item)
+		}
+	}
+	return count
+}
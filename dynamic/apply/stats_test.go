@@ -0,0 +1,440 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestMergeWithStats(t *testing.T) {
+	observed := toJSONMap(t, `{
+		"metadata": {
+			"creationTimestamp": "2019-10-01T10:00:00Z",
+			"labels": {"keep": "other", "remove": "old", "update": "old"}
+		},
+		"spec": {
+			"args": ["old"],
+			"containers": [
+				{"name": "keep", "image": "keep:1"},
+				{"name": "remove", "image": "remove:1"}
+			]
+		}
+	}`)
+	lastApplied := toJSONMap(t, `{
+		"metadata": {
+			"labels": {"remove": "old", "update": "old"}
+		},
+		"spec": {
+			"args": ["old"],
+			"containers": [
+				{"name": "keep", "image": "keep:1"},
+				{"name": "remove", "image": "remove:1"}
+			]
+		}
+	}`)
+	desired := toJSONMap(t, `{
+		"metadata": {
+			"creationTimestamp": null,
+			"labels": {"update": "new", "add": "new"}
+		},
+		"spec": {
+			"args": ["new"],
+			"containers": [
+				{"name": "keep", "image": "keep:1"},
+				{"name": "add", "image": "add:1"}
+			]
+		}
+	}`)
+
+	_, stats, err := MergeWithStats(observed, lastApplied, desired, nil)
+	if err != nil {
+		t.Fatalf("MergeWithStats error: %v", err)
+	}
+	want := []Change{
+		{Path: "[metadata][labels][add]", Reason: ReasonFieldAdded},
+		{Path: "[metadata][labels][remove]", Reason: ReasonFieldRemoved},
+		{Path: "[metadata][labels][update]", Reason: ReasonFieldUpdated},
+		{Path: "[spec][args]", Reason: ReasonListReplaced},
+		{Path: "[spec][containers][add]", Reason: ReasonListElementAdded},
+		{Path: "[spec][containers][remove]", Reason: ReasonListElementRemoved},
+	}
+	if !reflect.DeepEqual(stats.Changes, want) {
+		t.Errorf("got changes %#v, want %#v", stats.Changes, want)
+	}
+}
+
+func TestMergeWithStatsOldValues(t *testing.T) {
+	observed := toJSONMap(t, `{
+		"spec": {
+			"replicas": 1,
+			"paused": true,
+			"containers": [
+				{"name": "app", "image": "app:1"},
+				{"name": "sidecar", "image": "sidecar:1"}
+			]
+		}
+	}`)
+	lastApplied := toJSONMap(t, `{
+		"spec": {
+			"replicas": 1,
+			"paused": true,
+			"containers": [
+				{"name": "app", "image": "app:1"},
+				{"name": "sidecar", "image": "sidecar:1"}
+			]
+		}
+	}`)
+	desired := toJSONMap(t, `{
+		"spec": {
+			"replicas": 3,
+			"timeout": "1m",
+			"containers": [
+				{"name": "app", "image": "app:2"}
+			]
+		}
+	}`)
+
+	_, stats, err := MergeWithStats(observed, lastApplied, desired, nil)
+	if err != nil {
+		t.Fatalf("MergeWithStats error: %v", err)
+	}
+	want := map[string]interface{}{
+		"[spec][replicas]":               int64(1),
+		"[spec][paused]":                 true,
+		"[spec][containers][app][image]": "app:1",
+		"[spec][containers][sidecar]":    map[string]interface{}{"name": "sidecar", "image": "sidecar:1"},
+	}
+	if !reflect.DeepEqual(stats.OldValues, want) {
+		t.Errorf("got old values %#v, want %#v", stats.OldValues, want)
+	}
+}
+
+func TestIsPathOrChild(t *testing.T) {
+	var tests = map[string]struct {
+		path   string
+		parent string
+		want   bool
+	}{
+		"same path":          {path: "[spec][selector]", parent: "[spec][selector]", want: true},
+		"nested path":        {path: "[spec][selector][matchLabels]", parent: "[spec][selector]", want: true},
+		"sibling path":       {path: "[spec][selectorTerms]", parent: "[spec][selector]"},
+		"sibling with ] key": {path: "[spec][selector]v2]", parent: "[spec][selector]"},
+		"parent path":        {path: "[spec]", parent: "[spec][selector]"},
+	}
+	for name, mock := range tests {
+		name := name
+		mock := mock
+		t.Run(name, func(t *testing.T) {
+			if got := isPathOrChild(mock.path, mock.parent); got != mock.want {
+				t.Fatalf("Expected %t: Got %t", mock.want, got)
+			}
+		})
+	}
+}
+
+func TestMergeWithStatsNoOps(t *testing.T) {
+	observed := toJSONMap(t, `{
+		"spec": {
+			"replicas": 1,
+			"paused": true,
+			"containers": [{"name": "app", "image": "app:1"}]
+		}
+	}`)
+	desired := toJSONMap(t, `{
+		"spec": {
+			"replicas": 3,
+			"paused": true,
+			"containers": [{"name": "app", "image": "app:1"}]
+		}
+	}`)
+
+	_, stats, err := MergeWithStats(observed, desired, desired, nil)
+	if err != nil {
+		t.Fatalf("MergeWithStats error: %v", err)
+	}
+	if stats.NoOps != nil {
+		t.Errorf("got no-ops %v, want none unless enabled", stats.NoOps)
+	}
+
+	_, stats, err = MergeWithStats(observed, desired, desired, &MergeOptions{RecordNoOps: true})
+	if err != nil {
+		t.Fatalf("MergeWithStats error: %v", err)
+	}
+	want := []string{
+		"[spec][containers][app][image]",
+		"[spec][containers][app][name]",
+		"[spec][paused]",
+	}
+	if !reflect.DeepEqual(stats.NoOps, want) {
+		t.Errorf("got no-ops %v, want %v", stats.NoOps, want)
+	}
+	if len(stats.Changes) != 1 || stats.Changes[0].Path != "[spec][replicas]" {
+		t.Errorf("got changes %v, want [spec][replicas] only", stats.Changes)
+	}
+}
+
+func TestMergeWithStatsTouched(t *testing.T) {
+	observed := `{
+		"metadata": {"labels": {"app": "web", "other": "x"}},
+		"spec": {
+			"replicas": 1,
+			"paused": true,
+			"containers": [{"name": "app", "image": "app:1"}]
+		}
+	}`
+	lastApplied := `{"spec": {"replicas": 1, "paused": true}}`
+	desired := `{
+		"metadata": {"labels": {"app": "web"}},
+		"spec": {
+			"replicas": 3,
+			"containers": [{"name": "app", "image": "app:2"}]
+		}
+	}`
+	want := []string{
+		"[metadata][labels][app]",
+		"[spec][containers][app][image]",
+		"[spec][containers][app][name]",
+		"[spec][paused]",
+		"[spec][replicas]",
+	}
+
+	for i := 0; i < 10; i++ {
+		_, stats, err := MergeWithStats(
+			toJSONMap(t, observed),
+			toJSONMap(t, lastApplied),
+			toJSONMap(t, desired),
+			&MergeOptions{RecordTouched: true},
+		)
+		if err != nil {
+			t.Fatalf("MergeWithStats error: %v", err)
+		}
+		if !reflect.DeepEqual(stats.Touched, want) {
+			t.Fatalf("got touched %v, want %v", stats.Touched, want)
+		}
+	}
+
+	_, stats, err := MergeWithStats(
+		toJSONMap(t, observed), toJSONMap(t, lastApplied), toJSONMap(t, desired), nil,
+	)
+	if err != nil {
+		t.Fatalf("MergeWithStats error: %v", err)
+	}
+	if stats.Touched != nil {
+		t.Errorf("got touched %v, want none unless enabled", stats.Touched)
+	}
+}
+
+func TestMergeWithStatsListStrategies(t *testing.T) {
+	observed := toJSONMap(t, `{
+		"spec": {
+			"containers": [{"name": "app", "image": "app:1"}],
+			"args": ["-v"],
+			"slots": ["a", "b"],
+			"hosts": ["a.example.com"],
+			"large": [{"name": "a"}, {"name": "b"}, {"name": "c"}]
+		}
+	}`)
+	desired := toJSONMap(t, `{
+		"spec": {
+			"containers": [{"name": "app", "image": "app:2"}],
+			"args": ["-q"],
+			"slots": ["x"],
+			"hosts": ["b.example.com"],
+			"large": [{"name": "a"}, {"name": "b"}, {"name": "c"}],
+			"ports": [80]
+		}
+	}`)
+	opts := &MergeOptions{
+		IndexMergeListPaths:   []string{"[spec][slots]"},
+		ContentMergeListPaths: []string{"[spec][hosts]"},
+		MaxListMapElements:    2,
+	}
+	_, stats, err := MergeWithStats(observed, nil, desired, opts)
+	if err != nil {
+		t.Fatalf("MergeWithStats error: %v", err)
+	}
+	want := map[string]ListStrategy{
+		"[spec][containers]": {Strategy: "ListMap", MergeKey: "name"},
+		"[spec][args]":       {Strategy: "List"},
+		"[spec][slots]":      {Strategy: "IndexList"},
+		"[spec][hosts]":      {Strategy: "ContentList"},
+		"[spec][large]":      {Strategy: "List"},
+		"[spec][ports]":      {Strategy: "Scalar"},
+	}
+	if !reflect.DeepEqual(stats.ListStrategies, want) {
+		t.Errorf("got list strategies %v, want %v", stats.ListStrategies, want)
+	}
+}
+
+func TestMergeWithStatsCost(t *testing.T) {
+	observed := toJSONMap(t, `{
+		"spec": {"replicas": 1, "containers": [{"name": "app", "image": "app:1"}]}
+	}`)
+	desired := toJSONMap(t, `{
+		"spec": {"replicas": 1, "containers": [{"name": "app", "image": "app:2"}]}
+	}`)
+
+	_, stats, err := MergeWithStats(observed, nil, desired, nil)
+	if err != nil {
+		t.Fatalf("MergeWithStats error: %v", err)
+	}
+	if stats.Cost != nil {
+		t.Errorf("got cost %+v, want none unless enabled", stats.Cost)
+	}
+
+	_, stats, err = MergeWithStats(observed, nil, desired, &MergeOptions{RecordCost: true})
+	if err != nil {
+		t.Fatalf("MergeWithStats error: %v", err)
+	}
+	// root, spec, replicas, containers, app element, its name & image
+	// 3 observed maps & 3 list map indexes
+	want := &MergeCost{Nodes: 7, MapAllocs: 6}
+	if !reflect.DeepEqual(stats.Cost, want) {
+		t.Errorf("got cost %+v, want %+v", stats.Cost, want)
+	}
+}
+
+func TestMergeWithStatsConflicts(t *testing.T) {
+	observed := toJSONMap(t, `{"spec": {"replicas": 5, "image": "app:1", "paused": false}}`)
+	lastApplied := toJSONMap(t, `{"spec": {"replicas": 2, "image": "app:1", "paused": true}}`)
+	desired := toJSONMap(t, `{"spec": {"replicas": 3, "image": "app:2", "paused": false}}`)
+
+	_, stats, err := MergeWithStats(observed, lastApplied, desired, nil)
+	if err != nil {
+		t.Fatalf("MergeWithStats error: %v", err)
+	}
+	if stats.Conflicts != nil {
+		t.Errorf("got conflicts %v, want none unless enabled", stats.Conflicts)
+	}
+
+	got, stats, err := MergeWithStats(observed, lastApplied, desired, &MergeOptions{RecordConflicts: true})
+	if err != nil {
+		t.Fatalf("MergeWithStats error: %v", err)
+	}
+	// only replicas was changed by both
+	want := []Conflict{
+		{Path: "[spec][replicas]", Base: int64(2), Observed: int64(5), Desired: int64(3)},
+	}
+	if !reflect.DeepEqual(stats.Conflicts, want) {
+		t.Errorf("got conflicts %+v, want %+v", stats.Conflicts, want)
+	}
+	if replicas, _, _ := unstructured.NestedInt64(got, "spec", "replicas"); replicas != 3 {
+		t.Errorf("got replicas %d, want 3", replicas)
+	}
+}
+
+func TestMergeWithStatsMaxConflicts(t *testing.T) {
+	observed := map[string]interface{}{}
+	lastApplied := map[string]interface{}{}
+	desired := map[string]interface{}{}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("field%d", i)
+		observed[key] = "observed"
+		lastApplied[key] = "base"
+		desired[key] = "desired"
+	}
+	opts := &MergeOptions{RecordConflicts: true, MaxConflicts: 3}
+
+	got, stats, err := MergeWithStats(observed, lastApplied, desired, opts)
+	if err != nil {
+		t.Fatalf("MergeWithStats error: %v", err)
+	}
+	var paths []string
+	for _, conflict := range stats.Conflicts {
+		paths = append(paths, conflict.Path)
+	}
+	want := []string{"[field0]", "[field1]", "[field2]"}
+	if !reflect.DeepEqual(paths, want) || !stats.ConflictsTruncated {
+		t.Errorf("got conflicts %v & truncated %t, want %v & truncated", paths, stats.ConflictsTruncated, want)
+	}
+	// merge result is not affected
+	for key, val := range got {
+		if val != "desired" {
+			t.Errorf("got %s %v, want desired", key, val)
+		}
+	}
+
+	opts.MaxConflicts = 10
+	_, stats, err = MergeWithStats(observed, lastApplied, desired, opts)
+	if err != nil {
+		t.Fatalf("MergeWithStats error: %v", err)
+	}
+	if len(stats.Conflicts) != 10 || stats.ConflictsTruncated {
+		t.Errorf("got %d conflicts & truncated %t, want 10 & not truncated", len(stats.Conflicts), stats.ConflictsTruncated)
+	}
+}
+
+func TestMergeDiagnosticsAreDeterministic(t *testing.T) {
+	observed := `{
+		"metadata": {"labels": {"a": "1", "b": "2", "c": "3", "d": "4"}},
+		"spec": {
+			"containers": [
+				{"name": "a", "image": "a:1", "args": ["-v"]},
+				{"name": "b", "image": "b:1"},
+				{"name": "c", "image": "c:1"},
+				{"name": "d", "image": "d:1"}
+			]
+		}
+	}`
+	lastApplied := `{
+		"metadata": {"labels": {"a": "1", "b": "2"}},
+		"spec": {"containers": [{"name": "b", "image": "b:1"}, {"name": "d", "image": "d:1"}]}
+	}`
+	desired := `{
+		"metadata": {"labels": {"a": "x", "e": "5"}},
+		"spec": {
+			"containers": [
+				{"name": "a", "image": "a:2"},
+				{"name": "c", "image": "c:2"},
+				{"name": "e", "image": "e:1"}
+			]
+		}
+	}`
+
+	var want []byte
+	for i := 0; i < 50; i++ {
+		opts := &MergeOptions{RecordNoOps: true}
+		_, stats, err := MergeWithStats(
+			toJSONMap(t, observed), toJSONMap(t, lastApplied), toJSONMap(t, desired), opts,
+		)
+		if err != nil {
+			t.Fatalf("MergeWithStats error: %v", err)
+		}
+		_, decision, err := MergeWithDecisions(
+			toJSONMap(t, observed), toJSONMap(t, lastApplied), toJSONMap(t, desired), opts,
+		)
+		if err != nil {
+			t.Fatalf("MergeWithDecisions error: %v", err)
+		}
+		got, err := json.Marshal([]interface{}{stats, decision})
+		if err != nil {
+			t.Fatalf("Marshal error: %v", err)
+		}
+		if want == nil {
+			want = got
+			continue
+		}
+		if string(got) != string(want) {
+			t.Fatalf("Run %d: got diagnostics\n%s\nwant\n%s", i, got, want)
+		}
+	}
+}
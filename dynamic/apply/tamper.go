@@ -0,0 +1,162 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// DetectTampering returns the sorted field paths that are claimed by the
+// given managed fields intent, but whose observed values differ from
+// their last applied values. In other words, some other actor has set
+// these fields. This includes the claimed fields that are set in
+// observed but were never applied.
+//
+// The intent is the one recorded when the fields were last applied e.g.
+// via ManagedFieldsIntent. Unlike a three-way conflict, this does not
+// depend on the desired values. It flags the unexpected presence of
+// managed fields before these get set. Paths use the same notation as
+// merge. List map elements use the element's merge key as the path
+// segment.
+func DetectTampering(
+	observed, lastApplied map[string]interface{}, intent metav1.FieldsV1,
+) ([]string, error) {
+	set := map[string]interface{}{}
+	if len(intent.Raw) > 0 {
+		if err := json.Unmarshal(intent.Raw, &set); err != nil {
+			return nil, errors.Wrapf(err, "Failed to unmarshal managed fields intent")
+		}
+	}
+	paths, err := detectTampering("", observed, lastApplied, set, nil, []string{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid managed fields intent")
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// detectTampering walks the fields claimed by the given FieldsV1 set
+// found at the given field path, appends the ones that were tampered &
+// returns the resulting list. Given key fields are skipped.
+func detectTampering(
+	fieldPath string,
+	observed, lastApplied interface{},
+	set map[string]interface{},
+	keyFields map[string]bool,
+	paths []string,
+) ([]string, error) {
+	for key, val := range set {
+		if key == "." || keyFields[key] {
+			continue
+		}
+		child, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("%s: Invalid fields entry %q: Got %T", fieldPath, key, val)
+		}
+		var segment string
+		var childKeyFields map[string]bool
+		var obsVal, lastVal interface{}
+		switch {
+		case strings.HasPrefix(key, "f:"):
+			segment = strings.TrimPrefix(key, "f:")
+			obsVal = fieldOf(observed, segment)
+			lastVal = fieldOf(lastApplied, segment)
+		case strings.HasPrefix(key, "k:"):
+			keyJSON := strings.TrimPrefix(key, "k:")
+			elemKey := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(keyJSON), &elemKey); err != nil {
+				return nil, errors.Wrapf(err, "%s: Invalid fields entry %q", fieldPath, key)
+			}
+			segment, childKeyFields = elementSegment(keyJSON)
+			obsVal = elementOf(observed, elemKey)
+			lastVal = elementOf(lastApplied, elemKey)
+		case strings.HasPrefix(key, "v:"):
+			valJSON := strings.TrimPrefix(key, "v:")
+			var elem interface{}
+			if err := json.Unmarshal([]byte(valJSON), &elem); err != nil {
+				return nil, errors.Wrapf(err, "%s: Invalid fields entry %q", fieldPath, key)
+			}
+			segment = valJSON
+			obsVal = valueOf(observed, elem)
+			lastVal = valueOf(lastApplied, elem)
+		default:
+			return nil, errors.Errorf("%s: Unsupported fields entry %q", fieldPath, key)
+		}
+		childPath := fmt.Sprintf("%s[%s]", fieldPath, segment)
+		if isLeafSet(child) {
+			if obsVal != nil && !reflect.DeepEqual(obsVal, lastVal) {
+				paths = append(paths, childPath)
+			}
+			continue
+		}
+		var err error
+		paths, err = detectTampering(childPath, obsVal, lastVal, child, childKeyFields, paths)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// fieldOf returns the field of the given object with the given name.
+// Nil is returned if the value is not an object.
+func fieldOf(obj interface{}, name string) interface{} {
+	objMap, _ := obj.(map[string]interface{})
+	return objMap[name]
+}
+
+// elementOf returns the element of the given list map whose fields
+// match the given key. Nil is returned if there is no such element.
+func elementOf(list interface{}, key map[string]interface{}) interface{} {
+	items, _ := list.([]interface{})
+	for _, item := range items {
+		elem, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		matches := true
+		for name, val := range key {
+			if !reflect.DeepEqual(elem[name], val) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return elem
+		}
+	}
+	return nil
+}
+
+// valueOf returns the element of the given list that is equal to the
+// given value. Nil is returned if there is no such element.
+func valueOf(list interface{}, val interface{}) interface{} {
+	items, _ := list.([]interface{})
+	for _, item := range items {
+		if reflect.DeepEqual(item, val) {
+			return item
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDetectTampering(t *testing.T) {
+	table := []struct {
+		name, observed, lastApplied, managed string
+		want                                 []string
+	}{
+		{
+			name:        "no tampering",
+			observed:    `{"spec": {"replicas": 1, "paused": true}}`,
+			lastApplied: `{"spec": {"replicas": 1}}`,
+			managed:     `{"spec": {"replicas": 1}}`,
+			want:        []string{},
+		},
+		{
+			name:        "managed field is changed by other actor",
+			observed:    `{"spec": {"replicas": 5}}`,
+			lastApplied: `{"spec": {"replicas": 1}}`,
+			managed:     `{"spec": {"replicas": 1}}`,
+			want:        []string{"[spec][replicas]"},
+		},
+		{
+			name:        "managed field was never applied",
+			observed:    `{"spec": {"serviceAccountName": "admin"}}`,
+			lastApplied: `{}`,
+			managed:     `{"spec": {"serviceAccountName": "restricted"}}`,
+			want:        []string{"[spec][serviceAccountName]"},
+		},
+		{
+			name:        "managed field removed by other actor is not tampering",
+			observed:    `{"spec": {}}`,
+			lastApplied: `{"spec": {"replicas": 1}}`,
+			managed:     `{"spec": {"replicas": 1}}`,
+			want:        []string{},
+		},
+		{
+			name: "list map element is tampered",
+			observed: `{"containers": [
+				{"name": "app", "image": "evil:1"},
+				{"name": "external", "image": "external:1"}
+			]}`,
+			lastApplied: `{"containers": [{"name": "app", "image": "app:1"}]}`,
+			managed:     `{"containers": [{"name": "app", "image": "app:1"}]}`,
+			want:        []string{"[containers][app][image]"},
+		},
+		{
+			name:        "field not claimed by the recorded intent is not managed",
+			observed:    `{"spec": {"replicas": 1, "paused": true}}`,
+			lastApplied: `{"spec": {"replicas": 1}}`,
+			managed:     `{"spec": {"replicas": 1}}`,
+			want:        []string{},
+		},
+	}
+	for _, tc := range table {
+		intent, err := ManagedFieldsIntent(toJSONMap(t, tc.managed), "test-controller")
+		if err != nil {
+			t.Fatalf("%s: ManagedFieldsIntent error: %v", tc.name, err)
+		}
+		got, err := DetectTampering(
+			toJSONMap(t, tc.observed),
+			toJSONMap(t, tc.lastApplied),
+			*intent.FieldsV1,
+		)
+		if err != nil {
+			t.Fatalf("%s: DetectTampering error: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: DetectTampering() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDetectTamperingInvalidIntent(t *testing.T) {
+	_, err := DetectTampering(
+		toJSONMap(t, `{"spec": {"replicas": 1}}`),
+		toJSONMap(t, `{}`),
+		metav1.FieldsV1{Raw: []byte(`{"x:spec": {}}`)},
+	)
+	if err == nil {
+		t.Errorf("DetectTampering() error = nil, want unsupported fields entry error")
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+// redactedValue replaces sensitive scalar values in traces & logs
+const redactedValue = "***"
+
+// TraceFunc is invoked once per scalar field that gets merged. Values
+// at sensitive field paths are redacted before invoking this.
+type TraceFunc func(fieldPath string, observed, desired, merged interface{})
+
+// Redact returns a copy of the given object with the scalar values
+// found at or below any of the given field paths replaced by `***`.
+// These paths are matched as glob patterns. The given object is not
+// modified.
+//
+// Use this to log objects that may have sensitive fields e.g. data of
+// a Secret.
+func Redact(obj map[string]interface{}, paths []string) map[string]interface{} {
+	isSensitive := func(fieldPath string) bool {
+		return matchesAnyPathOrParent(MatchGlobPath, paths, fieldPath)
+	}
+	redacted, _ := redact("", obj, isSensitive).(map[string]interface{})
+	return redacted
+}
+
+// redact returns a copy of the given value with its sensitive scalar
+// values replaced
+func redact(fieldPath string, val interface{}, isSensitive func(string) bool) interface{} {
+	switch tval := val.(type) {
+	case map[string]interface{}:
+		if tval == nil {
+			return tval
+		}
+		out := make(map[string]interface{}, len(tval))
+		for key, item := range tval {
+			out[key] = redact(fmt.Sprintf("%s[%s]", fieldPath, key), item, isSensitive)
+		}
+		return out
+	case []interface{}:
+		if tval == nil {
+			return tval
+		}
+		// elements of a list map are addressed by their merge key
+		mergeKey := detectListMapKey(tval)
+		out := make([]interface{}, len(tval))
+		for idx, item := range tval {
+			itemPath := fieldPath
+			if mergeKey != "" {
+				itemPath = fmt.Sprintf(
+					"%s[%s]",
+					fieldPath,
+					stringMergeKey(item.(map[string]interface{})[mergeKey]),
+				)
+			}
+			out[idx] = redact(itemPath, item, isSensitive)
+		}
+		return out
+	default:
+		if val != nil && isSensitive(fieldPath) {
+			return redactedValue
+		}
+		return val
+	}
+}
+
+// sensitiveKinds lists the field paths of the kinds whose values are
+// always redacted
+var sensitiveKinds = map[string][]string{
+	"Secret": {"[data]", "[stringData]"},
+}
+
+// isSensitive returns true if the given field path is at or below any
+// of the configured sensitive paths or the sensitive paths of the kind
+// being merged
+func (m *merger) isSensitive(fieldPath string) bool {
+	return matchesAnyPathOrParent(m.opts.MatchPath, m.opts.RedactPaths, fieldPath) ||
+		matchesAnyPathOrParent(m.opts.MatchPath, sensitiveKinds[m.kind], fieldPath)
+}
+
+// redacted returns the given value found at the given field path with
+// its sensitive scalar values replaced. Values are passed through this
+// before these are logged.
+func (m *merger) redacted(fieldPath string, val interface{}) interface{} {
+	if len(m.opts.RedactPaths) == 0 && len(sensitiveKinds[m.kind]) == 0 {
+		return val
+	}
+	return redact(fieldPath, val, m.isSensitive)
+}
+
+// traceScalar logs & traces the merge of a scalar field. Values at
+// sensitive field paths are redacted.
+func (m *merger) traceScalar(fieldPath string, observed, desired, merged interface{}) {
+	if m.opts.Trace == nil && !glog.V(7) {
+		return
+	}
+	if m.isSensitive(fieldPath) {
+		observed = redact(fieldPath, observed, m.isSensitive)
+		desired = redact(fieldPath, desired, m.isSensitive)
+		merged = redact(fieldPath, merged, m.isSensitive)
+	}
+	glog.V(7).Infof(
+		"%s merge operation: Observed %v: Desired %v: Merged %v",
+		fieldPath, observed, desired, merged,
+	)
+	if m.opts.Trace != nil {
+		m.opts.Trace(fieldPath, observed, desired, merged)
+	}
+}
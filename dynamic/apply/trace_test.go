@@ -0,0 +1,165 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeTraceRedactsSensitiveFields(t *testing.T) {
+	observed := toJSONMap(t, `{
+		"kind": "Secret",
+		"metadata": {"name": "creds"},
+		"data": {"password": "b2xk"}
+	}`)
+	desired := toJSONMap(t, `{
+		"kind": "Secret",
+		"metadata": {"name": "creds"},
+		"data": {"password": "bmV3"}
+	}`)
+
+	traced := map[string][]interface{}{}
+	opts := &MergeOptions{
+		RedactPaths: []string{"[data]"},
+		Trace: func(fieldPath string, observed, desired, merged interface{}) {
+			traced[fieldPath] = []interface{}{observed, desired, merged}
+		},
+	}
+	got, err := MergeWithOptions(observed, nil, desired, opts)
+	if err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+
+	want := []interface{}{redactedValue, redactedValue, redactedValue}
+	if !reflect.DeepEqual(traced["[data][password]"], want) {
+		t.Errorf("got trace %v, want %v", traced["[data][password]"], want)
+	}
+	wantName := []interface{}{"creds", "creds", "creds"}
+	if !reflect.DeepEqual(traced["[metadata][name]"], wantName) {
+		t.Errorf("got trace %v, want %v", traced["[metadata][name]"], wantName)
+	}
+	if got["data"].(map[string]interface{})["password"] != "bmV3" {
+		t.Errorf("got data %v, want password bmV3", got["data"])
+	}
+}
+
+func TestMergeTraceRedactsSecretDataByDefault(t *testing.T) {
+	observed := toJSONMap(t, `{
+		"kind": "Secret",
+		"data": {"password": "b2xk"},
+		"stringData": {"token": "old"}
+	}`)
+	desired := toJSONMap(t, `{
+		"kind": "Secret",
+		"data": {"password": "bmV3"},
+		"stringData": {"token": "new"},
+		"type": "Opaque"
+	}`)
+
+	traced := map[string][]interface{}{}
+	opts := &MergeOptions{
+		Trace: func(fieldPath string, observed, desired, merged interface{}) {
+			traced[fieldPath] = []interface{}{observed, desired, merged}
+		},
+	}
+	if _, err := MergeWithOptions(observed, nil, desired, opts); err != nil {
+		t.Fatalf("MergeWithOptions error: %v", err)
+	}
+
+	want := []interface{}{redactedValue, redactedValue, redactedValue}
+	for _, path := range []string{"[data][password]", "[stringData][token]"} {
+		if !reflect.DeepEqual(traced[path], want) {
+			t.Errorf("%s: got trace %v, want %v", path, traced[path], want)
+		}
+	}
+	wantType := []interface{}{nil, "Opaque", "Opaque"}
+	if !reflect.DeepEqual(traced["[type]"], wantType) {
+		t.Errorf("got trace %v, want %v", traced["[type]"], wantType)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	obj := toJSONMap(t, `{
+		"data": {"password": "secret"},
+		"spec": {
+			"containers": [
+				{"name": "app", "env": [{"name": "TOKEN", "value": "abc"}]},
+				{"name": "sidecar", "image": "sidecar:1"}
+			]
+		}
+	}`)
+	got := Redact(obj, []string{"[data]", "[spec][containers][app][env]"})
+	want := toJSONMap(t, `{
+		"data": {"password": "***"},
+		"spec": {
+			"containers": [
+				{"name": "app", "env": [{"name": "***", "value": "***"}]},
+				{"name": "sidecar", "image": "sidecar:1"}
+			]
+		}
+	}`)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Redact() = %#v, want %#v", got, want)
+	}
+	if obj["data"].(map[string]interface{})["password"] != "secret" {
+		t.Errorf("Redact() modified the given object: %#v", obj)
+	}
+}
+
+func TestMergerRedacted(t *testing.T) {
+	var tests = map[string]struct {
+		redactPaths []string
+		fieldPath   string
+		val         interface{}
+		want        interface{}
+	}{
+		"no redact paths": {
+			fieldPath: "[data][password]",
+			val:       "secret",
+			want:      "secret",
+		},
+		"sensitive scalar": {
+			redactPaths: []string{"[data]"},
+			fieldPath:   "[data][password]",
+			val:         "secret",
+			want:        redactedValue,
+		},
+		"sensitive map": {
+			redactPaths: []string{"[data]"},
+			fieldPath:   "[data]",
+			val:         map[string]interface{}{"password": "secret"},
+			want:        map[string]interface{}{"password": redactedValue},
+		},
+		"not sensitive": {
+			redactPaths: []string{"[data]"},
+			fieldPath:   "[spec][replicas]",
+			val:         int64(3),
+			want:        int64(3),
+		},
+	}
+	for name, mock := range tests {
+		name, mock := name, mock
+		t.Run(name, func(t *testing.T) {
+			m := newMerger(&MergeOptions{RedactPaths: mock.redactPaths})
+			got := m.redacted(mock.fieldPath, mock.val)
+			if !reflect.DeepEqual(got, mock.want) {
+				t.Errorf("got %#v, want %#v", got, mock.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// mergeSpanName is the name of the span that traces a merge
+const mergeSpanName = "metac.apply.Merge"
+
+// Attributes recorded in the span of a merge
+const (
+	SpanAttrAPIVersion = "k8s.apiVersion"
+	SpanAttrKind       = "k8s.kind"
+	SpanAttrNamespace  = "k8s.namespace"
+	SpanAttrName       = "k8s.name"
+	SpanAttrChanges    = "metac.merge.changes"
+	SpanAttrListMaps   = "metac.merge.listMaps"
+	SpanAttrDuration   = "metac.merge.durationMs"
+	SpanAttrCached     = "metac.merge.cached"
+	SpanAttrError      = "error"
+)
+
+// Tracer starts spans. This is meant to be implemented by an adapter
+// of a tracing library e.g. OpenTelemetry. This keeps the tracing
+// library an optional dependency.
+type Tracer interface {
+	// Start starts a span with the given name as a child of the span
+	// of the given context if any. It returns a context that has the
+	// started span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a traced operation
+type Span interface {
+	// SetAttribute records the given attribute of this span
+	SetAttribute(key string, value interface{})
+
+	// End completes this span
+	End()
+}
+
+// tracerKey is the context key of the tracer
+type tracerKey struct{}
+
+// WithTracer returns a copy of the given context that has the given
+// tracer. Merges done with the returned context are traced by this
+// tracer unless the Tracer option is set.
+func WithTracer(ctx context.Context, tracer Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, tracer)
+}
+
+// mergeSpan is the span of a merge in progress
+type mergeSpan struct {
+	span  Span
+	start time.Time
+}
+
+// startSpan starts the span of a merge if a tracer is set either via
+// options or the given context
+func (m *merger) startSpan(
+	ctx context.Context, observed, desired map[string]interface{},
+) (context.Context, *mergeSpan) {
+	tracer := m.opts.Tracer
+	if tracer == nil {
+		tracer, _ = ctx.Value(tracerKey{}).(Tracer)
+	}
+	if tracer == nil {
+		return ctx, nil
+	}
+	if m.stats == nil {
+		// changes are counted via stats
+		m.stats = &MergeStats{Changes: []Change{}, OldValues: map[string]interface{}{}}
+	}
+
+	ctx, span := tracer.Start(ctx, mergeSpanName)
+	obj := &unstructured.Unstructured{Object: desired}
+	if obj.GetKind() == "" {
+		obj = &unstructured.Unstructured{Object: observed}
+	}
+	span.SetAttribute(SpanAttrAPIVersion, obj.GetAPIVersion())
+	span.SetAttribute(SpanAttrKind, obj.GetKind())
+	span.SetAttribute(SpanAttrNamespace, obj.GetNamespace())
+	span.SetAttribute(SpanAttrName, obj.GetName())
+	return ctx, &mergeSpan{span: span, start: time.Now()}
+}
+
+// endSpan records the outcome of a merge & ends its span if any
+func (m *merger) endSpan(span *mergeSpan, cached bool, err error) {
+	if span == nil {
+		return
+	}
+	span.span.SetAttribute(SpanAttrCached, cached)
+	if err != nil {
+		span.span.SetAttribute(SpanAttrError, err.Error())
+	} else if !cached {
+		span.span.SetAttribute(SpanAttrChanges, len(m.stats.Changes))
+		span.span.SetAttribute(SpanAttrListMaps, m.listMaps)
+	}
+	span.span.SetAttribute(SpanAttrDuration, int64(time.Since(span.start)/time.Millisecond))
+	span.span.End()
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"context"
+	"testing"
+)
+
+type fakeSpan struct {
+	name  string
+	attrs map[string]interface{}
+	ended bool
+}
+
+func (s *fakeSpan) SetAttribute(key string, value interface{}) {
+	s.attrs[key] = value
+}
+
+func (s *fakeSpan) End() {
+	s.ended = true
+}
+
+type fakeTracer struct {
+	spans []*fakeSpan
+}
+
+func (t *fakeTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &fakeSpan{name: name, attrs: map[string]interface{}{}}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+func TestMergeTracing(t *testing.T) {
+	observed := `{
+		"apiVersion": "apps/v1",
+		"kind": "Deployment",
+		"metadata": {"name": "app", "namespace": "ns"},
+		"spec": {"replicas": 1, "ports": [{"port": 80, "protocol": "TCP"}]}
+	}`
+	desired := `{
+		"apiVersion": "apps/v1",
+		"kind": "Deployment",
+		"metadata": {"name": "app", "namespace": "ns"},
+		"spec": {"replicas": 2, "ports": [{"port": 80, "protocol": "UDP"}]}
+	}`
+	var tests = map[string]struct {
+		viaContext       bool
+		maxVisitedFields int
+		desired          string
+		wantAttrs        map[string]interface{}
+		wantErr          bool
+	}{
+		"traced via options": {
+			desired: desired,
+			wantAttrs: map[string]interface{}{
+				SpanAttrAPIVersion: "apps/v1",
+				SpanAttrKind:       "Deployment",
+				SpanAttrNamespace:  "ns",
+				SpanAttrName:       "app",
+				SpanAttrCached:     false,
+				SpanAttrChanges:    2,
+				SpanAttrListMaps:   1,
+			},
+		},
+		"traced via context": {
+			viaContext: true,
+			desired:    desired,
+			wantAttrs: map[string]interface{}{
+				SpanAttrKind:     "Deployment",
+				SpanAttrName:     "app",
+				SpanAttrChanges:  2,
+				SpanAttrListMaps: 1,
+			},
+		},
+		"traced failure": {
+			maxVisitedFields: 1,
+			desired:          desired,
+			wantAttrs: map[string]interface{}{
+				SpanAttrKind:   "Deployment",
+				SpanAttrCached: false,
+			},
+			wantErr: true,
+		},
+	}
+	for name, mock := range tests {
+		name := name
+		mock := mock
+		t.Run(name, func(t *testing.T) {
+			tracer := &fakeTracer{}
+			ctx := context.Background()
+			opts := &MergeOptions{MaxVisitedFields: mock.maxVisitedFields}
+			if mock.viaContext {
+				ctx = WithTracer(ctx, tracer)
+			} else {
+				opts.Tracer = tracer
+			}
+			_, err := MergeContext(
+				ctx,
+				toJSONMap(t, observed),
+				toJSONMap(t, `{}`),
+				toJSONMap(t, mock.desired),
+				opts,
+			)
+			if mock.wantErr != (err != nil) {
+				t.Fatalf("Expected error %t: Got %v", mock.wantErr, err)
+			}
+			if len(tracer.spans) != 1 {
+				t.Fatalf("Expected 1 span: Got %d", len(tracer.spans))
+			}
+			span := tracer.spans[0]
+			if span.name != mergeSpanName || !span.ended {
+				t.Fatalf("Expected ended span %q: Got %+v", mergeSpanName, span)
+			}
+			for key, want := range mock.wantAttrs {
+				if got := span.attrs[key]; got != want {
+					t.Fatalf("Expected %s %v: Got %v", key, want, got)
+				}
+			}
+			if _, found := span.attrs[SpanAttrDuration]; !found {
+				t.Fatalf("Expected %s attribute", SpanAttrDuration)
+			}
+			if _, found := span.attrs[SpanAttrError]; found != (err != nil) {
+				t.Fatalf("Expected error attribute %t: Got %t", err != nil, found)
+			}
+		})
+	}
+}
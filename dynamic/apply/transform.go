@@ -0,0 +1,68 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"fmt"
+)
+
+// TransformFunc returns the normalized form of the given desired value
+type TransformFunc func(value interface{}) interface{}
+
+// transformDesired returns a copy of the given desired state with the
+// configured transforms applied. The given desired state is returned
+// as is if there are no transforms.
+func (m *merger) transformDesired(desired map[string]interface{}) map[string]interface{} {
+	if len(m.opts.Transforms) == 0 {
+		return desired
+	}
+	transformed, _ := m.transform("", desired).(map[string]interface{})
+	return transformed
+}
+
+// transform returns the given value found at the given field path with
+// the configured transforms applied to it & its nested values. Objects
+// & lists are copied before these are modified.
+func (m *merger) transform(fieldPath string, val interface{}) interface{} {
+	if fieldPath != "" {
+		if pattern, found := m.firstMatchingPattern(m.patterns.transforms, fieldPath); found {
+			val = m.opts.Transforms[pattern](val)
+		}
+	}
+	switch tval := val.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(tval))
+		for key, item := range tval {
+			out[key] = m.transform(fmt.Sprintf("%s[%s]", fieldPath, key), item)
+		}
+		return out
+	case []interface{}:
+		// only list map elements are addressable by path
+		mergeKey := m.detectListMapKey(tval)
+		if mergeKey == "" {
+			return val
+		}
+		out := make([]interface{}, len(tval))
+		for idx, item := range tval {
+			itemPath := fmt.Sprintf("%s[%s]", fieldPath, stringMergeKey(item.(map[string]interface{})[mergeKey]))
+			out[idx] = m.transform(itemPath, item)
+		}
+		return out
+	default:
+		return val
+	}
+}
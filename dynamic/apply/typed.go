@@ -0,0 +1,117 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// MergeTyped merges the desired typed object into the observed typed
+// object similar to MergeObjects. Last applied state is read from
+// observed's annotations. The given scheme must know the type of
+// observed.
+//
+// It returns an updated copy of observed of the same concrete type
+// that has desired recorded as its new last applied state. Typed
+// desired objects have every field set, including the fields that the
+// controller never meant to set. Hence, status, creationTimestamp as
+// well as the null & empty object fields are removed from desired
+// before it is merged. This keeps these fields out of the last applied
+// state.
+func MergeTyped(scheme *runtime.Scheme, observed, desired runtime.Object) (runtime.Object, error) {
+	if scheme == nil {
+		return nil, errors.Errorf("Can't merge typed objects: Nil scheme")
+	}
+	if observed == nil || desired == nil {
+		return nil, errors.Errorf("Can't merge typed objects: Nil observed or desired")
+	}
+	gvks, _, err := scheme.ObjectKinds(observed)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can't merge typed objects: Unknown observed type %T", observed)
+	}
+	gvk := gvks[0]
+	observedObj, err := toUnstructured(gvk, observed)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can't merge typed objects: Invalid observed")
+	}
+	desiredObj, err := toUnstructured(gvk, desired)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can't merge typed objects: Invalid desired")
+	}
+	pruneTypedDesired(desiredObj.Object)
+	merged, err := MergeObjects(observedObj, desiredObj)
+	if err != nil {
+		return nil, err
+	}
+	typed, err := scheme.New(gvk)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can't merge typed objects: Can't create %s", gvk)
+	}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(merged.UnstructuredContent(), typed)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can't merge typed objects: Can't convert merged to %T", typed)
+	}
+	return typed, nil
+}
+
+// toUnstructured converts the given typed object to an unstructured
+// object of the given kind. Kind is set explicitly since typed objects
+// often have an empty TypeMeta.
+func toUnstructured(gvk schema.GroupVersionKind, obj runtime.Object) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	res := &unstructured.Unstructured{Object: content}
+	res.SetGroupVersionKind(gvk)
+	return res, nil
+}
+
+// pruneTypedDesired removes the fields of the given desired object that
+// are set only since the object was converted from its typed form
+func pruneTypedDesired(desired map[string]interface{}) {
+	delete(desired, "status")
+	unstructured.RemoveNestedField(desired, "metadata", "creationTimestamp")
+	pruneZeroValues(desired)
+}
+
+// pruneZeroValues removes the null fields & the fields that are empty
+// objects from the given object & its nested objects. Objects that are
+// empty once pruned are removed as well. List elements are pruned but
+// are never removed since these are positional.
+func pruneZeroValues(obj map[string]interface{}) {
+	for key, val := range obj {
+		switch tval := val.(type) {
+		case nil:
+			delete(obj, key)
+		case map[string]interface{}:
+			pruneZeroValues(tval)
+			if len(tval) == 0 {
+				delete(obj, key)
+			}
+		case []interface{}:
+			for _, item := range tval {
+				if itemMap, ok := item.(map[string]interface{}); ok {
+					pruneZeroValues(itemMap)
+				}
+			}
+		}
+	}
+}
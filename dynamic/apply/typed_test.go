@@ -0,0 +1,106 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func newDeployment(replicas int32, image string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: int32Ptr(replicas),
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: image}},
+				},
+			},
+		},
+	}
+}
+
+func TestMergeTyped(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := appsv1.AddToScheme(scheme); err != nil {
+		t.Fatalf("AddToScheme error: %v", err)
+	}
+
+	observed := newDeployment(2, "app:1")
+	observed.Labels = map[string]string{"team": "web"}
+	observed.Status.ReadyReplicas = 2
+
+	got, err := MergeTyped(scheme, observed, newDeployment(3, "app:2"))
+	if err != nil {
+		t.Fatalf("MergeTyped error: %v", err)
+	}
+	merged, ok := got.(*appsv1.Deployment)
+	if !ok {
+		t.Fatalf("MergeTyped(): want *appsv1.Deployment, got %T", got)
+	}
+	if *merged.Spec.Replicas != 3 || merged.Spec.Template.Spec.Containers[0].Image != "app:2" {
+		t.Errorf("MergeTyped(): want desired spec, got %+v", merged.Spec)
+	}
+	if merged.Labels["team"] != "web" || merged.Status.ReadyReplicas != 2 {
+		t.Errorf("MergeTyped(): want observed labels & status, got %+v", merged)
+	}
+	lastApplied, err := GetLastApplied(&unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]interface{}{
+					lastAppliedAnnotation: merged.Annotations[lastAppliedAnnotation],
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("GetLastApplied error: %v", err)
+	}
+	wantLastApplied := toJSONMap(t, `{
+		"apiVersion": "apps/v1",
+		"kind": "Deployment",
+		"metadata": {"name": "web", "namespace": "default"},
+		"spec": {
+			"replicas": 3,
+			"template": {
+				"spec": {
+					"containers": [{"name": "app", "image": "app:2"}]
+				}
+			}
+		}
+	}`)
+	if !reflect.DeepEqual(lastApplied, wantLastApplied) {
+		t.Errorf("MergeTyped(): got last applied %v, want %v", lastApplied, wantLastApplied)
+	}
+
+	// a type unknown to the scheme can't be merged
+	_, err = MergeTyped(scheme, &corev1.Pod{}, &corev1.Pod{})
+	if err == nil {
+		t.Errorf("MergeTyped(): want error for unknown type, got none")
+	}
+}